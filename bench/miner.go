@@ -0,0 +1,305 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// maxAttempts is how many nonces a simulated miner tries per submission
+// before giving up and submitting its best effort anyway
+const maxAttempts = 1 << 16
+
+type notifyJob struct {
+	id       string
+	prevHash []byte
+	coinb1   []byte
+	coinb2   []byte
+	branch   [][]byte
+	version  uint32
+	bits     uint32
+	ntime    uint32
+}
+
+// Stats counts the submissions of all simulated miners
+type Stats struct {
+	Submitted uint64
+	Accepted  uint64
+	Rejected  uint64
+}
+
+// SimulatedMiner connects to a stratum server like a real miner would and
+// submits solutions at a fixed rate, grinding a few nonces with the
+// network's PoW function to meet its difficulty where it can
+type SimulatedMiner struct {
+	Address  string
+	Username string
+	Rate     float64
+	Network  p2pnet.Network
+	Stats    *Stats
+
+	conn        net.Conn
+	extranonce1 []byte
+	extranonce2 uint32
+	difficulty  float64
+	job         *notifyJob
+	lock        sync.Mutex
+	nextID      uint64
+}
+
+// SimulateMiners starts count simulated miners against the stratum server at
+// address, each submitting rate solutions per second
+func SimulateMiners(address string, count int, rate float64, username string, n p2pnet.Network) *Stats {
+	stats := &Stats{}
+	for i := 0; i < count; i++ {
+		m := &SimulatedMiner{
+			Address:  address,
+			Username: fmt.Sprintf("%s.bench%d", username, i),
+			Rate:     rate,
+			Network:  n,
+			Stats:    stats,
+		}
+		go func() {
+			for {
+				err := m.Run()
+				logging.Warnf("Simulated miner %s stopped: %v", m.Username, err)
+				time.Sleep(time.Second * 5)
+			}
+		}()
+	}
+	return stats
+}
+
+// Run connects, subscribes and authorizes, then submits until the connection
+// fails
+func (m *SimulatedMiner) Run() error {
+	conn, err := net.Dial("tcp", m.Address)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	defer conn.Close()
+
+	err = m.send("mining.subscribe", []interface{}{"p2pool-go-bench"})
+	if err != nil {
+		return err
+	}
+	err = m.send("mining.authorize", []interface{}{m.Username, "x"})
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.readLoop()
+	}()
+
+	interval := time.Duration(float64(time.Second) / m.Rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			err = m.submit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *SimulatedMiner) send(method string, params []interface{}) error {
+	m.lock.Lock()
+	m.nextID++
+	id := m.nextID
+	m.lock.Unlock()
+	b, err := json.Marshal(map[string]interface{}{"id": id, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	_, err = m.conn.Write(append(b, '\n'))
+	return err
+}
+
+func (m *SimulatedMiner) readLoop() error {
+	scanner := bufio.NewScanner(m.conn)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			ID     interface{}       `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			Result json.RawMessage   `json:"result"`
+			Error  json.RawMessage   `json:"error"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			return err
+		}
+		switch msg.Method {
+		case "mining.set_difficulty":
+			var d float64
+			if len(msg.Params) > 0 && json.Unmarshal(msg.Params[0], &d) == nil {
+				m.lock.Lock()
+				m.difficulty = d
+				m.lock.Unlock()
+			}
+		case "mining.notify":
+			j, err := parseNotify(msg.Params)
+			if err != nil {
+				return err
+			}
+			m.lock.Lock()
+			m.job = j
+			m.lock.Unlock()
+		case "":
+			m.handleResult(msg.ID, msg.Result, msg.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+func (m *SimulatedMiner) handleResult(id interface{}, result json.RawMessage, errMsg json.RawMessage) {
+	// The first reply is the subscription
+	if f, ok := id.(float64); ok && f == 1 {
+		var res []json.RawMessage
+		if json.Unmarshal(result, &res) == nil && len(res) >= 2 {
+			var en1 string
+			json.Unmarshal(res[1], &en1)
+			m.lock.Lock()
+			m.extranonce1, _ = hex.DecodeString(en1)
+			m.lock.Unlock()
+		}
+		return
+	}
+	if f, ok := id.(float64); ok && f == 2 {
+		return
+	}
+	if string(result) == "true" {
+		atomic.AddUint64(&m.Stats.Accepted, 1)
+	} else {
+		atomic.AddUint64(&m.Stats.Rejected, 1)
+	}
+}
+
+func parseNotify(params []json.RawMessage) (*notifyJob, error) {
+	if len(params) < 8 {
+		return nil, fmt.Errorf("Invalid mining.notify")
+	}
+	var s [8]string
+	var branch []string
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			json.Unmarshal(params[i], &branch)
+			continue
+		}
+		json.Unmarshal(params[i], &s[i])
+	}
+
+	j := &notifyJob{id: s[0]}
+	j.prevHash, _ = hex.DecodeString(s[1])
+	// Undo the word swap
+	for i := 0; i+4 <= len(j.prevHash); i += 4 {
+		j.prevHash[i], j.prevHash[i+1], j.prevHash[i+2], j.prevHash[i+3] = j.prevHash[i+3], j.prevHash[i+2], j.prevHash[i+1], j.prevHash[i]
+	}
+	j.coinb1, _ = hex.DecodeString(s[2])
+	j.coinb2, _ = hex.DecodeString(s[3])
+	for _, b := range branch {
+		h, _ := hex.DecodeString(b)
+		j.branch = append(j.branch, h)
+	}
+	v, _ := strconv.ParseUint(s[5], 16, 32)
+	j.version = uint32(v)
+	v, _ = strconv.ParseUint(s[6], 16, 32)
+	j.bits = uint32(v)
+	v, _ = strconv.ParseUint(s[7], 16, 32)
+	j.ntime = uint32(v)
+	return j, nil
+}
+
+// header returns the block header of a solution to the job with the given
+// extranonces, the nonce left zero
+func (j *notifyJob) header(en1, en2 []byte) []byte {
+	var coinbase bytes.Buffer
+	coinbase.Write(j.coinb1)
+	coinbase.Write(en1)
+	coinbase.Write(en2)
+	coinbase.Write(j.coinb2)
+	root := util.Sha256d(coinbase.Bytes())
+	for _, b := range j.branch {
+		root = util.Sha256d(append(root, b...))
+	}
+
+	hdr := make([]byte, 80)
+	binary.LittleEndian.PutUint32(hdr[0:], j.version)
+	copy(hdr[4:], j.prevHash)
+	copy(hdr[36:], root)
+	binary.LittleEndian.PutUint32(hdr[68:], j.ntime)
+	binary.LittleEndian.PutUint32(hdr[72:], j.bits)
+	return hdr
+}
+
+func (m *SimulatedMiner) submit() error {
+	m.lock.Lock()
+	j := m.job
+	en1 := m.extranonce1
+	diff := m.difficulty
+	m.extranonce2++
+	en2 := make([]byte, 4)
+	binary.BigEndian.PutUint32(en2, m.extranonce2)
+	m.lock.Unlock()
+	if j == nil || en1 == nil || diff == 0 {
+		return nil
+	}
+
+	hdr := j.header(en1, en2)
+	target := work.DifficultyToTarget(diff / m.Network.DumbScryptDiff)
+	nonce := rand.Uint32()
+	for i := 0; i < maxAttempts; i++ {
+		binary.LittleEndian.PutUint32(hdr[76:], nonce)
+		h, _ := chainhash.NewHash(m.Network.POWHash(hdr))
+		if blockchain.HashToBig(h).Cmp(target) <= 0 {
+			break
+		}
+		nonce++
+	}
+
+	atomic.AddUint64(&m.Stats.Submitted, 1)
+	return m.send("mining.submit", []interface{}{
+		m.Username,
+		j.id,
+		hex.EncodeToString(en2),
+		fmt.Sprintf("%08x", j.ntime),
+		fmt.Sprintf("%08x", nonce),
+	})
+}
+
+// Report logs the submission counters every interval
+func (s *Stats) Report(interval time.Duration) {
+	var last uint64
+	for {
+		time.Sleep(interval)
+		submitted := atomic.LoadUint64(&s.Submitted)
+		rate := float64(submitted-last) / interval.Seconds()
+		logging.Infof("Benchmark: %d submitted (%.1f/s), %d accepted, %d rejected", submitted, rate, atomic.LoadUint64(&s.Accepted), atomic.LoadUint64(&s.Rejected))
+		last = submitted
+	}
+}
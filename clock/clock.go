@@ -0,0 +1,100 @@
+// Package clock is where the node reads the time from. Vardiff, share
+// timestamps, pings, polling and statistics windows go through it instead of
+// the time package, so a Manual clock can be swapped in to move time forward
+// at will and replay timing-sensitive behavior exactly. Deadlines on network
+// connections and timestamps in logs and file names keep using real time.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the time once d has passed
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a ticker that fires every d. Like time.Ticker, it
+	// drops ticks for slow receivers.
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker delivers ticks of a Clock on C
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker. No more ticks are sent on C afterwards.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// Real is the clock of the system
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+var (
+	current     Clock = Real{}
+	currentLock sync.RWMutex
+)
+
+// Set makes c the clock of the node
+func Set(c Clock) {
+	currentLock.Lock()
+	current = c
+	currentLock.Unlock()
+}
+
+// Get returns the clock of the node
+func Get() Clock {
+	currentLock.RLock()
+	defer currentLock.RUnlock()
+	return current
+}
+
+func Now() time.Time {
+	return Get().Now()
+}
+
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+func After(d time.Duration) <-chan time.Time {
+	return Get().After(d)
+}
+
+func NewTicker(d time.Duration) *Ticker {
+	return Get().NewTicker(d)
+}
+
+// Sleep waits for d to pass on the clock
+func Sleep(d time.Duration) {
+	<-After(d)
+}
+
+// SleepContext waits for d to pass on the clock, or returns the error of
+// ctx once it's done first
+func SleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manual is a clock that only moves when advanced. Timers and tickers due
+// by then fire in order of their deadlines, so what happens over an hour
+// takes as long as it takes to compute.
+type Manual struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending After or Ticker. Tickers have a period and are
+// rescheduled after firing.
+type waiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+func (m *Manual) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.now
+}
+
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w := &waiter{at: m.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- m.now
+		return w.c
+	}
+	m.waiters = append(m.waiters, w)
+	return w.c
+}
+
+func (m *Manual) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for clock.NewTicker")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w := &waiter{at: m.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	return &Ticker{C: w.c, stop: func() { m.remove(w) }}
+}
+
+// Waiters returns how many timers and tickers are pending, to tell whether
+// the goroutines being driven have reached their next wait
+func (m *Manual) Waiters() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.waiters)
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers that
+// come due on the way
+func (m *Manual) Advance(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	end := m.now.Add(d)
+	for {
+		sort.SliceStable(m.waiters, func(i, j int) bool { return m.waiters[i].at.Before(m.waiters[j].at) })
+		if len(m.waiters) == 0 || m.waiters[0].at.After(end) {
+			break
+		}
+		w := m.waiters[0]
+		m.now = w.at
+		select {
+		case w.c <- m.now:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			m.waiters = m.waiters[1:]
+		}
+	}
+	m.now = end
+}
+
+func (m *Manual) remove(w *waiter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, other := range m.waiters {
+		if other == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/config"
+	"github.com/gertjaap/p2pool-go/control"
+	"github.com/gertjaap/p2pool-go/datadir"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/gateway"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/mockdaemon"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// command is a subcommand of the binary
+type command struct {
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run":          {"Run the node (the default)", runNode},
+		"decodeshare":  {"Decode hex encoded shares, as in a shares message, to JSON", runDecodeShare},
+		"dumpchain":    {"Write the stored sharechain as JSON", runDumpChain},
+		"verifychain":  {"Check the proof of work and linking of the stored sharechain", runVerifyChain},
+		"checkvectors": {"Check the hashes of shares against those computed by another implementation", runCheckVectors},
+		"peers":        {"List the peer addresses saved by the node", runPeers},
+		"importshares": {"Add the shares in a sharechain file to the stored sharechain", runImportShares},
+		"config":       {"config check: validate the configuration without starting", runConfig},
+		"backups":      {"backups [list|create|verify <name>|restore <name>]: manage data directory backups", runBackups},
+		"benchmerkle":  {"Time serial against parallel merkle computation for a large template", runBenchMerkle},
+		"mockdaemon":   {"Serve synthetic block templates over JSON-RPC, to run a node without a coin daemon", runMockDaemon},
+		"difffuzz":     {"Decode fuzzed messages with both our decoders and another implementation's, and report where they disagree", runDiffFuzz},
+		"control":      {"control <method>: call a method of a node's control API, like Health or Events", runControl},
+		"gateway":      {"Serve stratum with the work of a node's -controlport, to spread miner connections over machines", runGateway},
+		"help":         {"Show this list", runHelp},
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+		runHelp(nil)
+		os.Exit(2)
+	}
+	err := cmd.Run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func runHelp(args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s%s\n", name, commands[name].Usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse %s <command> -h for the flags of a command\n", os.Args[0])
+	return nil
+}
+
+// networkLoader adds -network and -networkdir to fs, and returns a function
+// that loads the chosen network once fs is parsed
+func networkLoader(fs *flag.FlagSet) func() (p2pnet.Network, error) {
+	network := fs.String("network", "vertcoin", "Network to join, built in or defined in -networkdir")
+	networkDir := fs.String("networkdir", "networks", "Directory with JSON network definitions to load")
+	return func() (p2pnet.Network, error) {
+		return loadNetwork(*network, *networkDir)
+	}
+}
+
+// dataDirFlag adds -datadir to fs, and returns a function that opens the
+// directory once fs is parsed
+func dataDirFlag(fs *flag.FlagSet) func() (*datadir.DataDir, error) {
+	path := fs.String("datadir", ".", "Directory the node keeps its data in")
+	return func() (*datadir.DataDir, error) {
+		return datadir.Open(*path)
+	}
+}
+
+// controlClientFlags adds -tls and -cafile to fs, and returns a function
+// that creates a client of a node's control API once fs is parsed
+func controlClientFlags(fs *flag.FlagSet) func(address, token string) (*control.Client, error) {
+	useTLS := fs.Bool("tls", false, "Call the node over TLS, needed for nodes serving their web port with TLS")
+	caFile := fs.String("cafile", "", "CA certificate (PEM) to trust for the node's TLS certificate, in addition to the system's. Implies -tls.")
+	return func(address, token string) (*control.Client, error) {
+		c := control.NewClient(address, token)
+		if *caFile != "" {
+			config, err := rpc.LoadTLSConfig(*caFile)
+			if err != nil {
+				return nil, err
+			}
+			c.SetTLSConfig(config)
+		} else if *useTLS {
+			c.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+		}
+		return c, nil
+	}
+}
+
+// loadNetwork loads the network definitions in dir and returns the named
+// network
+func loadNetwork(name, dir string) (p2pnet.Network, error) {
+	defined, err := p2pnet.LoadDefinitions(dir)
+	if err != nil {
+		return p2pnet.Network{}, err
+	}
+	if len(defined) > 0 {
+		logging.Infof("Loaded network definitions %s", strings.Join(defined, ", "))
+	}
+	n, err := p2pnet.Get(name)
+	if err != nil {
+		return p2pnet.Network{}, fmt.Errorf("%s, available are %s", err.Error(), strings.Join(p2pnet.Names(), ", "))
+	}
+	return n, nil
+}
+
+// toolFlagSet creates the flag set of a command that works on the node's
+// files, which doesn't need the debug logging of the node
+func toolFlagSet(name string) *flag.FlagSet {
+	logging.SetLogLevel(int(logging.LogLevelWarning))
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// runDecodeShare decodes shares given as hex, on the command line or stdin
+func runDecodeShare(args []string) error {
+	fs := toolFlagSet("decodeshare")
+	loadNetwork := networkLoader(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: decodeshare [flags] <hex>, reads stdin without <hex>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+
+	in := fs.Arg(0)
+	if in == "" || in == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		in = string(b)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(in))
+	if err != nil {
+		return fmt.Errorf("Invalid hex: %s", err.Error())
+	}
+	shares, err := wire.ReadShares(bytes.NewReader(b), n)
+	if err != nil {
+		return fmt.Errorf("Could not decode shares: %s", err.Error())
+	}
+
+	type decodedShare struct {
+		work.ExportedShare
+		Type  uint64 `json:"type"`
+		Valid bool   `json:"valid"`
+	}
+	decoded := make([]decodedShare, 0, len(shares))
+	for i := range shares {
+		decoded = append(decoded, decodedShare{
+			ExportedShare: work.ExportShare(&shares[i], n),
+			Type:          shares[i].Type,
+			Valid:         shares[i].IsValid(),
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(decoded)
+}
+
+// runCheckVectors checks a JSON list of share vectors, as written from the
+// Python p2pool, against the hashes we calculate
+func runCheckVectors(args []string) error {
+	fs := toolFlagSet("checkvectors")
+	loadNetwork := networkLoader(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: checkvectors [flags] <file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected one vector file")
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var vectors []wire.ShareVector
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		return fmt.Errorf("Invalid vector file: %s", err.Error())
+	}
+
+	failed := 0
+	for i, v := range vectors {
+		name := v.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		err := v.Check(n)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err.Error())
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d vectors failed", failed, len(vectors))
+	}
+	fmt.Printf("All %d vectors match\n", len(vectors))
+	return nil
+}
+
+// runDumpChain writes (part of) the stored sharechain as JSON
+func runDumpChain(args []string) error {
+	fs := toolFlagSet("dumpchain")
+	loadNetwork := networkLoader(fs)
+	openDataDir := dataDirFlag(fs)
+	out := fs.String("o", "-", "File to write to, - for stdout")
+	from := fs.String("from", "", "Share height, RFC 3339 time or date to start at")
+	to := fs.String("to", "", "Share height, RFC 3339 time or date to end at")
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	dd, err := openDataDir()
+	if err != nil {
+		return err
+	}
+	return runExportShares(dd, n, *out, *from, *to)
+}
+
+// runVerifyChain checks the stored sharechain without loading it into a
+// node, which would refuse invalid shares
+func runVerifyChain(args []string) error {
+	fs := toolFlagSet("verifychain")
+	loadNetwork := networkLoader(fs)
+	openDataDir := dataDirFlag(fs)
+	file := fs.String("sharechain", datadir.ShareChainFile, "Sharechain file to check, relative to -datadir")
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	dd, err := openDataDir()
+	if err != nil {
+		return err
+	}
+
+	shares, err := readShareFile(dd.File(*file), n)
+	if err != nil {
+		return err
+	}
+	r := work.VerifyShares(shares)
+	fmt.Printf("Shares: %d\nInvalid: %d\nDuplicates: %d\nTails: %d\nTips: %d\n", r.Shares, len(r.Invalid), r.Duplicates, r.Tails, r.Tips)
+	for _, h := range r.Invalid {
+		fmt.Printf("Invalid share %s\n", h)
+	}
+	if !r.OK() {
+		return fmt.Errorf("Sharechain %s is not valid", *file)
+	}
+	return nil
+}
+
+// runPeers lists the peer addresses the node saved
+func runPeers(args []string) error {
+	fs := toolFlagSet("peers")
+	openDataDir := dataDirFlag(fs)
+	file := fs.String("peersfile", datadir.PeersFile, "Peer address file of the node, relative to -datadir")
+	fs.Parse(args)
+	dd, err := openDataDir()
+	if err != nil {
+		return err
+	}
+
+	addrs, err := p2p.ReadAddresses(dd.File(*file))
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		fmt.Println(net.JoinHostPort(a.Address.Address.String(), strconv.Itoa(int(a.Address.Port))))
+	}
+	return nil
+}
+
+// runImportShares adds the shares of another sharechain file, like one
+// copied from another node, to ours. The node must not be running.
+func runImportShares(args []string) error {
+	fs := toolFlagSet("importshares")
+	loadNetwork := networkLoader(fs)
+	openDataDir := dataDirFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: importshares [flags] <file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected one file to import")
+	}
+	dd, err := openDataDir()
+	if err != nil {
+		return err
+	}
+
+	shares, err := readShareFile(fs.Arg(0), n)
+	if err != nil {
+		return err
+	}
+	sc := work.NewShareChain(n)
+	sc.DataFile = dd.File(datadir.ShareChainFile)
+	err = sc.Load()
+	if err != nil {
+		return err
+	}
+	before := sc.AllShares.Len()
+	added := sc.AddShares(shares)
+	fmt.Printf("Imported %d of %d shares, sharechain has %d shares (was %d)\n", len(added), len(shares), sc.AllShares.Len(), before)
+	return nil
+}
+
+// runConfig handles the config subcommands
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("Usage: config check [-probe] [-config file] [flags]")
+	}
+	fs := toolFlagSet("config check")
+	probe := fs.Bool("probe", false, "Also check that the daemons are reachable and on the right chain")
+	f := newNodeFlags(fs)
+	fs.Parse(args[1:])
+	sources, problems, err := config.Check(fs, *f.configFile)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, checkNodeConfig(fs, f, sources, *probe)...)
+	_, instanceProblems, err := loadInstances(&instance{fs: fs, f: f, sources: sources}, *probe)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, instanceProblems...)
+	if len(problems) > 0 {
+		return problemsError(problems)
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+// runBackups lists, makes, checks and restores backups of the data
+// directory
+func runBackups(args []string) error {
+	fs := toolFlagSet("backups")
+	openDataDir := dataDirFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: backups [flags] [list|create|verify <name>|restore <name>]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	dd, err := openDataDir()
+	if err != nil {
+		return err
+	}
+
+	action, name := fs.Arg(0), fs.Arg(1)
+	if (action == "verify" || action == "restore") && name == "" {
+		fs.Usage()
+		return fmt.Errorf("Expected the name of a backup")
+	}
+	switch action {
+	case "", "list":
+		names, err := dd.Backups()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			status := "ok"
+			if err := dd.VerifyBackup(name); err != nil {
+				status = err.Error()
+			}
+			fmt.Printf("%s\t%s\n", name, status)
+		}
+		return nil
+	case "create":
+		backup, err := dd.Backup("manual")
+		if err != nil {
+			return err
+		}
+		fmt.Println(backup)
+		return nil
+	case "verify":
+		err = dd.VerifyBackup(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backup %s is intact\n", name)
+		return nil
+	case "restore":
+		err = dd.Restore(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored backup %s, the previous data is in a pre-restore backup\n", name)
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("Unknown action %s", action)
+}
+
+// runBenchMerkle times the merkle branch and witness root of a synthetic
+// template, hashed serially and in parallel
+func runBenchMerkle(args []string) error {
+	fs := toolFlagSet("benchmerkle")
+	txs := fs.Int("txs", 5000, "Number of transactions in the template")
+	rounds := fs.Int("rounds", 20, "Number of times to compute the merkle roots")
+	fs.Parse(args)
+	if *txs < 1 || *rounds < 1 {
+		return fmt.Errorf("Need at least one transaction and one round")
+	}
+	bt, err := work.TemplateFromRPC(work.SyntheticTemplate(1, *txs))
+	if err != nil {
+		return err
+	}
+
+	threshold := work.MerkleParallelThreshold
+	defer func() { work.MerkleParallelThreshold = threshold }()
+	timeRounds := func() time.Duration {
+		start := time.Now()
+		for i := 0; i < *rounds; i++ {
+			work.CalcMerkleBranch(bt.TxHashes)
+			work.CalcWitnessMerkleRoot(bt.Transactions)
+		}
+		return time.Since(start) / time.Duration(*rounds)
+	}
+	work.MerkleParallelThreshold = 0
+	serial := timeRounds()
+	work.MerkleParallelThreshold = threshold
+	parallel := timeRounds()
+	fmt.Printf("Transactions: %d, CPUs: %d, parallel from %d hashes\n", *txs, runtime.GOMAXPROCS(0), threshold)
+	fmt.Printf("Serial: %s\nParallel: %s\nSpeedup: %.2fx\n", serial, parallel, float64(serial)/float64(parallel))
+	return nil
+}
+
+// runMockDaemon serves a mock daemon for the network until interrupted,
+// finding a block of its own every block interval
+func runMockDaemon(args []string) error {
+	fs := toolFlagSet("mockdaemon")
+	loadNetwork := networkLoader(fs)
+	listen := fs.String("listen", "127.0.0.1:18332", "Address to serve JSON-RPC on")
+	user := fs.String("rpcuser", "mock", "User calls must authenticate with")
+	password := fs.String("rpcpass", "mock", "Password calls must authenticate with")
+	interval := fs.Duration("blockinterval", time.Minute*2, "How often the daemon moves on to a new block, 0 for only when one is submitted")
+	txCount := fs.Int("txs", 10, "Number of transactions in the templates")
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+
+	d := mockdaemon.New(n)
+	d.User, d.Password = *user, *password
+	d.SetTxCount(*txCount)
+	err = d.Listen(*listen)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	fmt.Printf("Mock %s daemon at %s\n", n.Name, d.URL())
+
+	var blocks <-chan time.Time
+	if *interval > 0 {
+		t := time.NewTicker(*interval)
+		defer t.Stop()
+		blocks = t.C
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-blocks:
+			d.Advance(1)
+			fmt.Printf("New block %s at height %d\n", d.Tip(), d.Height())
+		case <-sig:
+			return nil
+		}
+	}
+}
+
+// runDiffFuzz feeds fuzzed messages to the decoders and to an oracle, another
+// implementation like the Python p2pool, and reports every case where one
+// accepts what the other rejects or they decode it differently
+func runDiffFuzz(args []string) error {
+	fs := toolFlagSet("difffuzz")
+	loadNetwork := networkLoader(fs)
+	oracleCmd := fs.String("oracle", "", "Command running the oracle, like \"python2 contrib/p2pool-oracle.py --p2pool ../p2pool --net vertcoin\"")
+	count := fs.Int("n", 10000, "Number of cases to run")
+	seed := fs.Int64("seed", 1, "Seed of the fuzzer, to reproduce a run")
+	sharesFile := fs.String("shares", "", "Sharechain file with shares to build shares messages from")
+	maxShown := fs.Int("max", 20, "Number of divergences to print")
+	fs.Parse(args)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	if *oracleCmd == "" {
+		return fmt.Errorf("No -oracle given to compare against")
+	}
+
+	var shares []wire.Share
+	if *sharesFile != "" {
+		shares, err = readShareFile(*sharesFile, n)
+		if err != nil {
+			return err
+		}
+	}
+	fuzzer, err := wire.NewFuzzer(*seed, shares)
+	if err != nil {
+		return err
+	}
+	o, err := startOracle(*oracleCmd)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+
+	diverged := 0
+	for i := 0; i < *count; i++ {
+		fc := fuzzer.Next()
+		theirs, err := o.Decode(fc)
+		if err != nil {
+			return fmt.Errorf("Oracle failed on case %d (%s %s): %s", i, fc.Command, fc.Payload, err.Error())
+		}
+		d := fc.Decode(n).Diverges(theirs)
+		if d == "" {
+			continue
+		}
+		diverged++
+		if diverged <= *maxShown {
+			fmt.Printf("DIVERGED %s %s: %s\n", fc.Command, fc.Payload, d)
+		}
+	}
+	if diverged > 0 {
+		return fmt.Errorf("%d of %d cases diverged", diverged, *count)
+	}
+	fmt.Printf("All %d cases agreed\n", *count)
+	return nil
+}
+
+// oracle is a subprocess that decodes cases for runDiffFuzz, reading them
+// as JSON lines on stdin and writing a verdict line for each on stdout
+type oracle struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Scanner
+}
+
+func startOracle(command string) (*oracle, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Could not start oracle: %s", err.Error())
+	}
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(nil, 64*1024*1024)
+	return &oracle{cmd: cmd, in: in, out: scanner}, nil
+}
+
+func (o *oracle) Decode(fc wire.FuzzCase) (wire.Verdict, error) {
+	var v wire.Verdict
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return v, err
+	}
+	_, err = o.in.Write(append(b, '\n'))
+	if err != nil {
+		return v, err
+	}
+	if !o.out.Scan() {
+		if o.out.Err() != nil {
+			return v, o.out.Err()
+		}
+		return v, fmt.Errorf("Oracle exited")
+	}
+	err = json.Unmarshal(o.out.Bytes(), &v)
+	if err != nil {
+		return v, fmt.Errorf("Invalid oracle response %s: %s", o.out.Text(), err.Error())
+	}
+	return v, nil
+}
+
+func (o *oracle) Close() {
+	o.in.Close()
+	o.cmd.Wait()
+}
+
+// runControl calls a method of the control API of a node and prints the
+// JSON document it answers, or the events it streams
+func runControl(args []string) error {
+	fs := toolFlagSet("control")
+	addr := fs.String("addr", "127.0.0.1:9173", "Host and port of the node's -controlport")
+	token := fs.String("token", "", "Read or admin token of the node")
+	newClient := controlClientFlags(fs)
+	var req control.Request
+	fs.StringVar(&req.Address, "address", "", "Miner address, for Miner")
+	fs.StringVar(&req.IP, "ip", "", "Peer IP, for BanPeer and UnbanPeer")
+	fs.StringVar(&req.Target, "target", "", "Peer host:port, for AddPeer")
+	fs.StringVar(&req.Username, "username", "", "Miner username, for DisconnectMiner and SetDifficulty")
+	fs.Float64Var(&req.Difficulty, "difficulty", 0, "Difficulty, for SetDifficulty")
+	fs.StringVar(&req.Subsystem, "subsystem", "", "Subsystem, for SetLogLevel")
+	fs.StringVar(&req.Level, "level", "", "Log level, for SetLogLevel")
+	types := fs.String("types", "", "Comma separated event types to stream with Events, all if empty")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s control [flags] <method>\n\nMethods are those of control/control.proto\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected one method")
+	}
+	method := fs.Arg(0)
+	c, err := newClient(*addr, *token)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if method == "Events" {
+		var filter []events.Type
+		if *types != "" {
+			for _, t := range strings.Split(*types, ",") {
+				filter = append(filter, events.Type(t))
+			}
+		}
+		stream, done, err := c.Events(ctx, filter...)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for e := range stream {
+			enc.Encode(e)
+		}
+		err = <-done
+		if err == context.Canceled {
+			return nil
+		}
+		return err
+	}
+	doc, err := c.Call(ctx, method, req)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+// runGateway serves stratum to miners with work from a node, until
+// interrupted
+func runGateway(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	loadNetwork := networkLoader(fs)
+	node := fs.String("node", "127.0.0.1:9173", "Host and port of the node's -controlport")
+	token := fs.String("token", "", "The node's -gatewaytoken")
+	newClient := controlClientFlags(fs)
+	logLevel := fs.String("loglevel", "info", "Log level, like -loglevel of the node")
+	stratumPort := fs.Int("stratumport", 0, "Port for stratum, the network's if 0")
+	stratumTLSPort := fs.Int("stratumtlsport", 0, "Port for stratum over TLS, disabled if 0")
+	stratumTLSCert := fs.String("stratumtlscert", "", "Certificate (PEM) for stratum over TLS")
+	stratumTLSKey := fs.String("stratumtlskey", "", "Private key (PEM) for stratum over TLS")
+	varDiffTarget := fs.Duration("vardifftarget", 0, "Time between shares vardiff aims for, 0 for the default")
+	varDiffMin := fs.Float64("vardiffmin", 0, "Lowest difficulty vardiff goes to, 0 for the default")
+	varDiffMax := fs.Float64("vardiffmax", 0, "Highest difficulty vardiff goes to, 0 for the default")
+	defaultAddress := fs.String("defaultaddress", "", "Address to mine to for miners whose username isn't a valid address, rejected if empty")
+	niceHashMinDiff := fs.Float64("nicehashmindiff", 0, "Lowest difficulty for NiceHash miners, the default if 0")
+	staleGrace := fs.Duration("stalegrace", 0, "How long submissions for replaced jobs are still accepted, the default if 0")
+	fs.Parse(args)
+	level, subsystemLevels, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		return err
+	}
+	logging.SetLevels(level, subsystemLevels)
+	n, err := loadNetwork()
+	if err != nil {
+		return err
+	}
+	if *token == "" {
+		return fmt.Errorf("No -token given, the node only serves gateways with its -gatewaytoken")
+	}
+
+	c, err := newClient(*node, *token)
+	if err != nil {
+		return err
+	}
+	g := gateway.NewGateway(c, n)
+	port := *stratumPort
+	if port == 0 {
+		port = n.StratumPort
+	}
+	ss := stratum.NewServer(port, n, g)
+	ss.NiceHashMinDifficulty = *niceHashMinDiff
+	if *staleGrace != 0 {
+		ss.StaleGrace = *staleGrace
+	}
+	if *defaultAddress != "" {
+		ss.DefaultAddress = work.NormalizeAddress(*defaultAddress, n)
+		_, _, err = work.AddressToPubKeyHash(ss.DefaultAddress, n)
+		if err != nil {
+			return fmt.Errorf("Invalid default address: %s", err.Error())
+		}
+	}
+	ss.SetVarDiff(*varDiffTarget, *varDiffMin, *varDiffMax)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go g.Run(ctx)
+	err = ss.Listen()
+	if err != nil {
+		return err
+	}
+	defer ss.Close()
+	if *stratumTLSPort != 0 {
+		err = ss.ListenTLS(*stratumTLSPort, *stratumTLSCert, *stratumTLSKey)
+		if err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	logging.Infof("Shutting down")
+	return nil
+}
+
+// readShareFile reads a sharechain file, of either format, with all shares
+// decoded and hashed
+func readShareFile(path string, n p2pnet.Network) ([]wire.Share, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return wire.ParseShareFile(data, false, n)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gertjaap/p2pool-go/config"
+	"github.com/gertjaap/p2pool-go/datadir"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/notify"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/p2pool"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/webhook"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// configChecker collects the problems with the settings of the run command
+type configChecker struct {
+	fs       *flag.FlagSet
+	f        *nodeFlags
+	sources  map[string]string
+	problems []config.Problem
+}
+
+// add records err, if any, as a problem with a setting
+func (c *configChecker) add(setting string, err error) {
+	if err == nil {
+		return
+	}
+	c.problems = append(c.problems, config.Problem{Setting: setting, Source: c.sources[setting], Message: err.Error()})
+}
+
+func (c *configChecker) value(setting string) string {
+	return c.fs.Lookup(setting).Value.String()
+}
+
+// checkNodeConfig validates the settings of the run command without starting
+// anything. With probe, it also asks the daemons what chain they're on.
+func checkNodeConfig(fs *flag.FlagSet, f *nodeFlags, sources map[string]string, probe bool) []config.Problem {
+	c := &configChecker{fs: fs, f: f, sources: sources}
+
+	_, err := p2pnet.LoadDefinitions(c.value("networkdir"))
+	c.add("networkdir", err)
+	n, err := p2pnet.Get(c.value("network"))
+	if err != nil {
+		c.add("network", fmt.Errorf("%s, available are %s", err.Error(), strings.Join(p2pnet.Names(), ", ")))
+		// Everything else depends on the network
+		return c.problems
+	}
+
+	c.add("sha256", util.SetSha256(*f.sha256Backend))
+	_, _, err = logging.ParseLevels(*f.logLevel)
+	c.add("loglevel", err)
+	if *f.logFormat != "console" && *f.logFormat != "json" {
+		c.add("logformat", fmt.Errorf("Unknown log format %s, use console or json", *f.logFormat))
+	}
+	dd := &datadir.DataDir{Path: c.value("datadir")}
+	if v, err := dd.Version(); err != nil {
+		c.add("datadir", err)
+	} else if v > datadir.SchemaVersion {
+		c.add("datadir", fmt.Errorf("Schema version %d is newer than this version of p2pool-go knows (%d)", v, datadir.SchemaVersion))
+	}
+
+	c.checkDaemons(n, probe)
+	c.checkPayouts(n)
+	c.checkPorts(n)
+	c.checkFiles(n)
+
+	_, err = parseIPs(*f.allowPeers)
+	c.add("allowpeers", err)
+	_, err = parseIPs(*f.banPeers)
+	c.add("banpeers", err)
+	_, _, err = parseDrainTarget(*f.drainTo)
+	c.add("drainto", err)
+	if *f.chaos != "" {
+		_, err = p2p.ParseChaos(*f.chaos)
+		c.add("chaos", err)
+	}
+	for _, spec := range f.notifiers {
+		_, err = notify.New(spec)
+		c.add("notify", err)
+	}
+	if *f.varDiffMin > 0 && *f.varDiffMax > 0 && *f.varDiffMin > *f.varDiffMax {
+		c.add("vardiffmin", fmt.Errorf("%g is above -vardiffmax %g", *f.varDiffMin, *f.varDiffMax))
+	}
+	if len(f.execs) > 0 && *f.execTimeout <= 0 {
+		c.add("exectimeout", fmt.Errorf("Must be positive"))
+	}
+	if (*f.replicationPort != 0 || *f.standbyOf != "") && *f.replicationKey == "" {
+		c.add("replicationkey", fmt.Errorf("Required to replicate"))
+	}
+	if *f.standbyOf != "" {
+		if len(f.daemons) == 0 {
+			c.add("standbyof", fmt.Errorf("A standby needs a -daemon to take over the miners"))
+		}
+		if _, _, err := net.SplitHostPort(*f.standbyOf); err != nil {
+			c.add("standbyof", err)
+		}
+		if *f.standbyTimeout <= 0 {
+			c.add("standbytimeout", fmt.Errorf("Must be positive"))
+		}
+	}
+	if *f.gatewayToken != "" {
+		if *f.controlPort == 0 {
+			c.add("gatewaytoken", fmt.Errorf("Gateways get work from the -controlport, which is disabled"))
+		}
+		if len(f.daemons) == 0 {
+			c.add("gatewaytoken", fmt.Errorf("Gateways need a node with a -daemon"))
+		}
+	}
+	if *f.webTLSCert != "" && *f.webACMEDomains != "" {
+		c.add("webacmedomains", fmt.Errorf("Use either -webtlscert or -webacmedomains"))
+	}
+	if *f.webACMEEmail != "" && *f.webACMEDomains == "" {
+		c.add("webacmeemail", fmt.Errorf("Only used with -webacmedomains"))
+	}
+	if *f.webRateLimit < 0 {
+		c.add("webratelimit", fmt.Errorf("Can't be negative"))
+	}
+	for _, setting := range []string{"logmaxsize", "logmaxage", "logkeep", "logretention", "commitdelay", "clockskew"} {
+		if strings.HasPrefix(c.value(setting), "-") {
+			c.add(setting, fmt.Errorf("Can't be negative"))
+		}
+	}
+	if *f.backupInterval < 0 {
+		c.add("backupinterval", fmt.Errorf("Can't be negative"))
+	}
+	if *f.backupKeep < 1 {
+		c.add("backupkeep", fmt.Errorf("Must keep at least one backup"))
+	}
+	var rng work.ExportRange
+	c.add("exportfrom", rng.SetBound(*f.exportFrom, true))
+	c.add("exportto", rng.SetBound(*f.exportTo, false))
+	return c.problems
+}
+
+// checkDaemons checks the daemon URLs and RPC settings, and with probe that
+// the daemons are reachable and on the network's chain
+func (c *configChecker) checkDaemons(n p2pnet.Network, probe bool) {
+	_, err := rpc.GetAdapter(n.DaemonAdapter)
+	if err != nil {
+		c.add("network", err)
+		return
+	}
+	if *c.f.rpcCAFile != "" {
+		_, err = rpc.LoadTLSConfig(*c.f.rpcCAFile)
+		c.add("rpccafile", err)
+	}
+	if *c.f.rpcCookieFile != "" {
+		_, err = os.Stat(*c.f.rpcCookieFile)
+		c.add("rpccookiefile", err)
+	}
+	for _, d := range c.f.daemons {
+		_, err = rpc.NewClient(d)
+		c.add("daemon", err)
+	}
+	if !probe || len(c.problems) > 0 {
+		return
+	}
+	clients, err := p2pool.DaemonClients(p2pool.Config{
+		Network:       n,
+		Daemons:       c.f.daemons,
+		RPCCookieFile: *c.f.rpcCookieFile,
+		RPCCAFile:     *c.f.rpcCAFile,
+		RPCTimeout:    *c.f.rpcTimeout,
+	})
+	if err != nil {
+		c.add("daemon", err)
+		return
+	}
+	for _, d := range clients {
+		bi, err := d.GetBlockchainInfo()
+		if err != nil {
+			c.add("daemon", fmt.Errorf("Could not reach %s: %s", d.URL, err.Error()))
+			continue
+		}
+		err = work.CheckDaemonNetwork(d, bi, n)
+		if err != nil {
+			c.add("daemon", fmt.Errorf("%s: %s", d.URL, err.Error()))
+		}
+	}
+}
+
+// checkPayouts checks the addresses and percentages that end up in shares
+func (c *configChecker) checkPayouts(n p2pnet.Network) {
+	_, err := work.GetPayoutPolicy(n.PayoutPolicy)
+	c.add("network", err)
+	wm := work.NewWorkManager(n, nil, nil, nil)
+	c.add("donation", wm.SetDonation(*c.f.donation))
+	if *c.f.fee < 0 || *c.f.fee > 100 {
+		c.add("fee", fmt.Errorf("Must be between 0 and 100 percent"))
+	} else if *c.f.fee > 0 && *c.f.feeAddress == "" {
+		c.add("fee", fmt.Errorf("Needs a -feeaddress"))
+	} else {
+		c.add("feeaddress", wm.SetFee(*c.f.fee, work.NormalizeAddress(*c.f.feeAddress, n)))
+	}
+	for _, setting := range []string{"defaultaddress", "exportaddress"} {
+		if address := c.value(setting); address != "" {
+			_, _, err := work.AddressToPubKeyHash(work.NormalizeAddress(address, n), n)
+			c.add(setting, err)
+		}
+	}
+	c.add("coinbasetag", work.ValidateCoinbaseTag(*c.f.coinbaseTag, n))
+	c.add("maxblockweight", work.CheckMaxBlockWeight(*c.f.maxBlockWeight))
+}
+
+// checkPorts makes sure the ports we listen on are valid and distinct
+func (c *configChecker) checkPorts(n p2pnet.Network) {
+	used := map[int]string{}
+	for _, p := range listenPorts(c.f, n) {
+		if p.port == 0 {
+			continue
+		}
+		if p.port < 0 || p.port > 65535 {
+			c.add(p.setting, fmt.Errorf("Port %d out of range", p.port))
+			continue
+		}
+		if other, ok := used[p.port]; ok {
+			c.add(p.setting, fmt.Errorf("Port %d is also used by %s", p.port, other))
+			continue
+		}
+		used[p.port] = p.name
+	}
+}
+
+// listenPort is a port the node listens on and the setting it comes from
+type listenPort struct {
+	setting string
+	name    string
+	port    int
+}
+
+// listenPorts returns the ports a node on network n with the settings of f
+// listens on, 0 for the ones that are disabled
+func listenPorts(f *nodeFlags, n p2pnet.Network) []listenPort {
+	ports := []listenPort{
+		{"webport", "-webport", *f.webPort},
+		{"controlport", "-controlport", *f.controlPort},
+		{"stratumtlsport", "-stratumtlsport", *f.stratumTLSPort},
+		{"sv2port", "-sv2port", *f.sv2Port},
+		{"replicationport", "-replicationport", *f.replicationPort},
+	}
+	if len(f.daemons) > 0 {
+		if *f.stratumPort != 0 {
+			ports = append(ports, listenPort{"stratumport", "-stratumport", *f.stratumPort})
+		} else {
+			ports = append(ports, listenPort{"network", "the stratum port of the network", n.StratumPort})
+		}
+	}
+	return ports
+}
+
+// checkFiles makes sure the certificates, keys and templates load
+func (c *configChecker) checkFiles(n p2pnet.Network) {
+	if *c.f.stratumTLSPort != 0 {
+		_, err := tls.LoadX509KeyPair(*c.f.stratumTLSCert, *c.f.stratumTLSKey)
+		c.add("stratumtlscert", err)
+	}
+	if *c.f.webTLSCert != "" || *c.f.webTLSKey != "" {
+		_, err := tls.LoadX509KeyPair(*c.f.webTLSCert, *c.f.webTLSKey)
+		c.add("webtlscert", err)
+	}
+	if *c.f.sv2Port != 0 && *c.f.sv2AuthorityKey != "" {
+		_, err := stratum.LoadAuthorityKey(*c.f.sv2AuthorityKey)
+		c.add("sv2authoritykey", err)
+	}
+	if *c.f.webhookTemplate != "" {
+		c.add("webhooktemplate", webhook.NewHook("").LoadTemplate(*c.f.webhookTemplate))
+	}
+	if n.PowAlgorithm == "verthash" && len(c.f.daemons) > 0 {
+		_, err := os.Stat(*c.f.verthashFile)
+		c.add("verthashfile", err)
+	}
+}
+
+// problemsError lists problems in one error
+func problemsError(problems []config.Problem) error {
+	lines := make([]string, 0, len(problems)+1)
+	lines = append(lines, "Invalid configuration:")
+	for _, p := range problems {
+		lines = append(lines, "  "+p.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
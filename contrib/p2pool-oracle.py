@@ -0,0 +1,58 @@
+#!/usr/bin/env python2
+# Decoding oracle for the difffuzz command: decodes messages with the Python
+# p2pool's packers so they can be compared with ours. Reads JSON lines of
+# {"command", "payload"} on stdin and writes a {"ok", "payload", "error"}
+# line for each, where payload is the decoded message packed again.
+#
+#   p2pool-go difffuzz -oracle "python2 contrib/p2pool-oracle.py --p2pool ../p2pool --net vertcoin"
+import argparse
+import json
+import sys
+
+parser = argparse.ArgumentParser()
+parser.add_argument('--p2pool', default='.', help='path of a p2pool checkout')
+parser.add_argument('--net', default='vertcoin', help='p2pool network name')
+args = parser.parse_args()
+
+sys.path.insert(0, args.p2pool)
+from p2pool import data, networks, p2p
+
+net = networks.nets[args.net]
+
+
+def share_contents_type(share_type):
+    # The shares in shares and sharereply messages are type and contents
+    # only, decode the contents too so bad ones are rejected like ours
+    if share_type not in data.share_versions:
+        raise ValueError('unknown share type %d' % share_type)
+    cls = data.share_versions[share_type]
+    if hasattr(cls, 'get_dynamic_types'):
+        return cls.get_dynamic_types(net)['share_type']
+    return cls.share_type
+
+
+def decode(command, payload):
+    t = getattr(p2p.Protocol, 'message_' + command, None)
+    if t is None:
+        raise ValueError('unknown command %s' % command)
+    msg = t.unpack(payload)
+    for share in msg.get('shares', []):
+        ct = share_contents_type(share['type'])
+        share['contents'] = ct.pack(ct.unpack(share['contents']))
+    return t.pack(msg)
+
+
+def main():
+    for line in iter(sys.stdin.readline, ''):
+        req = json.loads(line)
+        try:
+            out = decode(str(req['command']), req['payload'].decode('hex'))
+            res = {'ok': True, 'payload': out.encode('hex')}
+        except Exception as e:
+            res = {'ok': False, 'error': '%s: %s' % (type(e).__name__, e)}
+        sys.stdout.write(json.dumps(res) + '\n')
+        sys.stdout.flush()
+
+
+if __name__ == '__main__':
+    main()
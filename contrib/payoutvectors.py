@@ -0,0 +1,107 @@
+#!/usr/bin/env python3
+# Writes the payout vectors in work/testdata: sharechains and the outputs
+# the Python p2pool's generate_transaction pays for a block found on top of
+# them, following its get_cumulative_weights and amounts arithmetic.
+#
+# The outputs come from this port of that arithmetic, not from running the
+# Python p2pool's own code, so a misreading of it made here and in Go
+# alike isn't caught.
+#
+#   python3 contrib/payoutvectors.py > work/testdata/payout_vectors.json
+#
+# Miners are numbered, miner m is paid to the pay to pubkey hash script of
+# the pubkey hash of 16 zero bytes and m as a big endian uint32, miner -1
+# is the donation.
+import json
+
+DONATION = -1
+
+
+def bits_to_target(bits):
+    return (bits & 0x007fffff) << (8 * ((bits >> 24) - 3))
+
+
+def attempts(target):
+    return 2**256 // (target + 1)
+
+
+def script(miner):
+    return b'\x76\xa9\x14' + b'\0' * 16 + miner.to_bytes(4, 'big') + b'\x88\xac'
+
+
+def cumulative_weights(shares, max_shares, desired_weight):
+    # shares are newest first, like walking back from the start share
+    weights = {}
+    total_weight = 0
+    donation_weight = 0
+    for count, (miner, bits, donation) in enumerate(shares):
+        if count >= max_shares or total_weight >= desired_weight:
+            break
+        att = attempts(bits_to_target(bits))
+        weight = att * (65535 - donation)
+        share_total = att * 65535
+        share_donation = att * donation
+        if total_weight + share_total > desired_weight:
+            assert (desired_weight - total_weight) % 65535 == 0
+            remaining = (desired_weight - total_weight) // 65535
+            weight = remaining * weight // (share_total // 65535)
+            share_donation = remaining * share_donation // (share_total // 65535)
+            share_total = desired_weight - total_weight
+        weights[miner] = weights.get(miner, 0) + weight
+        total_weight += share_total
+        donation_weight += share_donation
+    return weights, total_weight, donation_weight
+
+
+def payouts(v):
+    # The new share builds on the last one, the weights count from the one
+    # before it
+    shares = list(reversed(v['shares']))
+    height = min(len(shares), v['chain_length'])
+    desired_weight = 65535 * v['spread'] * attempts(bits_to_target(v['block_bits']))
+    weights, total_weight, _ = cumulative_weights(shares[1:], max(0, height - 1), desired_weight)
+
+    subsidy = v['subsidy']
+    amounts = {}
+    for miner, weight in weights.items():
+        amounts[miner] = subsidy * (199 * weight) // (200 * total_weight)
+    amounts[v['finder']] = amounts.get(v['finder'], 0) + subsidy // 200
+    amounts[DONATION] = amounts.get(DONATION, 0) + subsidy - sum(amounts.values())
+    assert sum(amounts.values()) == subsidy and all(a >= 0 for a in amounts.values())
+
+    def key(m):
+        return (m == DONATION, amounts[m], b'' if m == DONATION else script(m))
+    dests = sorted(amounts, key=key)[-4000:]
+    return [[m, amounts[m]] for m in dests if amounts[m] or m == DONATION]
+
+
+def main():
+    base = {'spread': 3, 'chain_length': 400, 'subsidy': 2500000000, 'block_bits': 0x1c00ffff}
+    vectors = [
+        dict(base, name='single miner', finder=1,
+             shares=[[1, 0x1d00ffff, 0]] * 5),
+        dict(base, name='donation and rounding', finder=3, subsidy=2500000001,
+             shares=[[1, 0x1d00ffff, 0], [2, 0x1d00ffff, 50], [3, 0x1c7fffff, 655],
+                     [1, 0x1d00ffff, 0], [2, 0x1c3fffff, 65535], [4, 0x1d00ffff, 10]]),
+        dict(base, name='finder without shares', finder=9, subsidy=1234567,
+             shares=[[1, 0x1d00ffff, 100], [2, 0x1d00ffff, 200], [3, 0x1d00ffff, 300]]),
+        dict(base, name='window cuts a share', finder=1, spread=1, block_bits=0x1d007fff,
+             shares=[[1, 0x1d00ffff, 0], [2, 0x1d00ffff, 0], [3, 0x1c7fffff, 1000],
+                     [4, 0x1d00ffff, 0], [5, 0x1d00ffff, 0]]),
+        dict(base, name='chain length', finder=2, chain_length=4,
+             shares=[[1, 0x1d00ffff, 0], [2, 0x1d00ffff, 0], [3, 0x1d00ffff, 0],
+                     [4, 0x1d00ffff, 0], [5, 0x1d00ffff, 0], [6, 0x1d00ffff, 0]]),
+        dict(base, name='payouts below the dust threshold are kept', finder=1,
+             shares=[[1, 0x1c00ffff, 0], [2, 0x1e0fffff, 0], [1, 0x1c00ffff, 0], [3, 0x1e00ffff, 0]]),
+        dict(base, name='only the donation', finder=1,
+             shares=[[1, 0x1d00ffff, 65535], [2, 0x1d00ffff, 65535]]),
+        dict(base, name='4000 outputs', finder=7, chain_length=5000, block_bits=0x1a00ffff,
+             shares=[[m, [0x1d00ffff, 0x1d00fffe, 0x1c7fffff][m % 3], m % 7] for m in range(4100)]),
+    ]
+    for v in vectors:
+        v['payouts'] = payouts(v)
+    print('[\n' + ',\n'.join(json.dumps(v, separators=(',', ':')) for v in vectors) + '\n]')
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,250 @@
+#!/usr/bin/env python3
+# Writes the share vectors in wire/testdata: shares of the vertcoin network
+# packed and hashed the way the Python p2pool's data.py does it, written
+# independently of our Go code so TestShareVectors catches us drifting from
+# it. The proof of work hash is left out, it needs lyra2rev3.
+#
+# The shares are made up and hashed by this rewrite of data.py, not by the
+# Python p2pool itself, so they catch us drifting from the rewrite rather
+# than from p2pool. None of the vectors are real shares yet.
+#
+#   python3 contrib/sharevectors.py > wire/testdata/share_vectors.json
+#
+# Vectors dumped from a running Python p2pool, for instance with
+# p2pool.data.load_share and share.hash, share.gentx_hash and
+# share.header_hash, can be added to the file or checked with the
+# checkvectors command.
+import hashlib
+import json
+import struct
+
+IDENTIFIER = bytes.fromhex('a06a81c827cab983')
+DONATION_SCRIPT = bytes.fromhex(
+    '410418a74130b2f4fad899d8ed2bff272bc43a03c8ca72897ae3da584d7a770b5a9e'
+    'a8dd1b37a620d27c6cf6d5a7a9bbd6872f5981e95816d701d94f201c5d093be6ac')
+
+
+# sha256 with access to the internal state, like p2pool.util.math.sha256
+K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+]
+INITIAL_STATE = struct.pack('>8I', 0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+                            0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19)
+
+
+def rotr(x, n):
+    return ((x >> n) | (x << (32 - n))) & 0xffffffff
+
+
+def process(state, chunk):
+    w = list(struct.unpack('>16I', chunk))
+    for i in range(16, 64):
+        s0 = rotr(w[i-15], 7) ^ rotr(w[i-15], 18) ^ (w[i-15] >> 3)
+        s1 = rotr(w[i-2], 17) ^ rotr(w[i-2], 19) ^ (w[i-2] >> 10)
+        w.append((w[i-16] + s0 + w[i-7] + s1) & 0xffffffff)
+    a, b, c, d, e, f, g, h = start = struct.unpack('>8I', state)
+    for i in range(64):
+        s0 = rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)
+        t2 = s0 + ((a & b) ^ (a & c) ^ (b & c))
+        s1 = rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)
+        t1 = h + s1 + ((e & f) ^ (~e & g)) + K[i] + w[i]
+        a, b, c, d, e, f, g, h = (t1 + t2) & 0xffffffff, a, b, c, (d + t1) & 0xffffffff, e, f, g
+    return struct.pack('>8I', *((x + y) & 0xffffffff for x, y in zip(start, (a, b, c, d, e, f, g, h))))
+
+
+def midstate(data):
+    # The state after the complete 64 byte blocks of data, and the rest
+    state = INITIAL_STATE
+    full = len(data) - len(data) % 64
+    for i in range(0, full, 64):
+        state = process(state, data[i:i+64])
+    return state, data[full:]
+
+
+def sha256d(data):
+    return hashlib.sha256(hashlib.sha256(data).digest()).digest()
+
+
+# Packers of p2pool.util.pack
+def varint(v):
+    if v < 0xfd:
+        return struct.pack('<B', v)
+    if v <= 0xffff:
+        return b'\xfd' + struct.pack('<H', v)
+    if v <= 0xffffffff:
+        return b'\xfe' + struct.pack('<I', v)
+    return b'\xff' + struct.pack('<Q', v)
+
+
+def varstr(b):
+    return varint(len(b)) + b
+
+
+def hashlist(hashes):
+    return varint(len(hashes)) + b''.join(hashes)
+
+
+def inttype(v, bits):
+    return v.to_bytes(bits // 8, 'little')
+
+
+def tx(ins, outs):
+    b = struct.pack('<I', 1) + varint(len(ins))
+    for script in ins:
+        b += b'\0' * 32 + struct.pack('<I', 0xffffffff) + varstr(script) + struct.pack('<I', 0xffffffff)
+    b += varint(len(outs))
+    for value, script in outs:
+        b += struct.pack('<Q', value) + varstr(script)
+    return b + struct.pack('<I', 0)
+
+
+def merkle_link(leaf, branch):
+    # The root of the link at index 0
+    for h in branch:
+        leaf = sha256d(leaf + h)
+    return leaf
+
+
+def h(name):
+    return hashlib.sha256(name.encode()).digest()
+
+
+def hexhash(b):
+    # Hashes are shown reversed, like block hashes
+    return b[::-1].hex()
+
+
+def share_info(v):
+    d = v['share_data']
+    b = d['previous_share_hash'] + varstr(d['coinbase']) + struct.pack('<I', d['nonce'])
+    b += d['pubkey_hash'] + struct.pack('<B', d['pubkey_hash_version'])
+    b += struct.pack('<QHB', d['subsidy'], d['donation'], d['stale_info']) + varint(d['desired_version'])
+    if v['type'] >= 17:
+        b += hashlist(v['segwit_data']['txid_merkle_link']) + v['segwit_data']['wtxid_merkle_root']
+    b += hashlist(v['new_transaction_hashes'])
+    b += varint(len(v['transaction_hash_refs']))
+    for share_count, tx_count in v['transaction_hash_refs']:
+        b += varint(share_count) + varint(tx_count)
+    b += v['far_share_hash']
+    b += struct.pack('<IIII', v['max_bits'], v['bits'], v['timestamp'], v['absheight'])
+    return b + inttype(v['abswork'], 128)
+
+
+def vector(name, v):
+    d = v['share_data']
+    info = share_info(v)
+    ref_hash = merkle_link(sha256d(IDENTIFIER + info), v['ref_merkle_link'])
+
+    outs = []
+    if v['type'] >= 17:
+        outs.append((0, b'\x6a\x24\xaa\x21\xa9\xed' + sha256d(v['segwit_data']['wtxid_merkle_root'] + b'\0' * 32)))
+    outs += v['payouts']
+    outs.append((v['donation_amount'], DONATION_SCRIPT))
+    outs.append((0, b'\x6a\x28' + ref_hash + struct.pack('<Q', v['last_txout_nonce'])))
+    gentx = tx([d['coinbase']], outs)
+    gentx_hash = sha256d(gentx)
+
+    # The hash link commits to the gentx up to the ref hash, which must end
+    # with gentx_before_refhash
+    before_refhash = varstr(DONATION_SCRIPT) + inttype(0, 64) + varstr(b'\x6a\x28' + b'\0' * 40)[:3]
+    prefix = gentx[:-(32 + 8 + 4)]
+    assert prefix.endswith(before_refhash)
+    state, extra = midstate(prefix)
+    assert len(extra) <= len(before_refhash)
+
+    link = v['segwit_data']['txid_merkle_link'] if v['type'] >= 17 else v['merkle_link']
+    merkle_root = merkle_link(gentx_hash, link)
+    header = struct.pack('<I', v['version']) + v['previous_block'] + merkle_root
+    header += struct.pack('<III', v['timestamp'], v['header_bits'], v['header_nonce'])
+
+    contents = varint(v['version']) + v['previous_block']
+    contents += struct.pack('<III', v['timestamp'], v['header_bits'], v['header_nonce'])
+    contents += info + hashlist(v['ref_merkle_link']) + struct.pack('<Q', v['last_txout_nonce'])
+    contents += state + varint(len(prefix)) + hashlist(v['merkle_link'])
+    return {
+        'name': name,
+        'share': (varint(v['type']) + varstr(contents)).hex(),
+        'hash': hexhash(sha256d(header)),
+        'ref_hash': hexhash(ref_hash),
+        'gentx_hash': hexhash(gentx_hash),
+        'pow_hash': '',
+    }
+
+
+def share(share_type, **kw):
+    v = {
+        'type': share_type,
+        'version': 0x20000000,
+        'previous_block': h('previous block'),
+        'timestamp': 1600000000,
+        'header_bits': 0x1b0404cb,
+        'header_nonce': 0x12345678,
+        'share_data': {
+            'previous_share_hash': h('previous share'),
+            'coinbase': bytes.fromhex('03a08601') + b'/P2Pool/',
+            'nonce': 0xdeadbeef,
+            'pubkey_hash': h('pubkey hash')[:20],
+            'pubkey_hash_version': 71,
+            'subsidy': 1250000000,
+            'donation': 50,
+            'stale_info': 0,
+            'desired_version': share_type,
+        },
+        'segwit_data': {
+            'txid_merkle_link': [h('txid 1'), h('txid 2')],
+            'wtxid_merkle_root': h('wtxid root'),
+        },
+        'new_transaction_hashes': [],
+        'transaction_hash_refs': [],
+        'far_share_hash': h('far share'),
+        'max_bits': 0x1e0fffff,
+        'bits': 0x1d4fffff,
+        'absheight': 1000000,
+        'abswork': 0x1234567890abcdef1122334455667788,
+        'ref_merkle_link': [],
+        'last_txout_nonce': 0x0102030405060708,
+        'merkle_link': [],
+        'payouts': [
+            (1243000000, b'\x76\xa9\x14' + h('pubkey hash')[:20] + b'\x88\xac'),
+        ],
+        'donation_amount': 7000000,
+    }
+    for k, val in kw.items():
+        if k in v['share_data']:
+            v['share_data'][k] = val
+        else:
+            v[k] = val
+    return v
+
+
+def main():
+    many_payouts = [(1000 + i, b'\x00\x14' + h('payout %d' % i)[:20]) for i in range(40)]
+    vectors = [
+        vector('segwit', share(17)),
+        vector('segwit, no transactions', share(17, segwit_data={
+            'txid_merkle_link': [],
+            'wtxid_merkle_root': h('wtxid root'),
+        })),
+        vector('segwit, many payouts', share(17, payouts=many_payouts, donation_amount=1249960000)),
+        vector('segwit, transactions and stale', share(
+            17, stale_info=253, desired_version=18, donation=0,
+            new_transaction_hashes=[h('tx 1'), h('tx 2'), h('tx 3')],
+            transaction_hash_refs=[(0, 0), (0, 2), (3, 7), (300, 1)],
+            previous_share_hash=b'\0' * 32, abswork=2**128 - 1)),
+        vector('non-segwit', share(16, merkle_link=[h('tx 1'), h('tx 2'), h('tx 3')])),
+        vector('non-segwit, ref merkle link', share(
+            16, merkle_link=[], ref_merkle_link=[h('ref 1')], pubkey_hash_version=74,
+            coinbase=bytes.fromhex('03a0860100') + b'\xff' * 80)),
+    ]
+    print(json.dumps(vectors, indent=2))
+
+
+if __name__ == '__main__':
+    main()
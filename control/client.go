@@ -0,0 +1,242 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// Client calls the control API of a node
+type Client struct {
+	// Address is the host and port of the node's -controlport
+	Address string
+	// Token is sent as bearer token, the read or admin token of the node
+	Token string
+
+	httpClient *http.Client
+	scheme     string
+}
+
+func NewClient(address, token string) *Client {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &Client{
+		Address:    address,
+		Token:      token,
+		httpClient: &http.Client{Transport: &http.Transport{Protocols: protocols}},
+		scheme:     "http",
+	}
+}
+
+// SetTLSConfig makes the client call a node that serves the control API
+// over TLS, checking its certificate with config
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.httpClient.Transport = &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}
+	c.scheme = "https"
+}
+
+// unary calls a method that answers with one message, and returns it
+func (c *Client) unary(ctx context.Context, method string, msg []byte) ([]byte, error) {
+	res, err := c.post(ctx, method, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := readMessage(res.Body, maxResponse)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// The status comes after the body
+	io.Copy(io.Discard, res.Body)
+	err = status(res)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// post starts a call of method with an encoded request
+func (c *Client) post(ctx context.Context, method string, msg []byte) (*http.Response, error) {
+	var body bytes.Buffer
+	writeMessage(&body, msg)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.scheme+"://"+c.Address+servicePath+method, &body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.httpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Node answered %s", res.Status)
+	}
+	return res, nil
+}
+
+// status returns the error of a finished call, nil if it succeeded. The
+// status is in the trailers, or in the headers of calls that failed
+// without a response.
+func status(res *http.Response) error {
+	code := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	if code == "" {
+		return fmt.Errorf("Call ended without a status")
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("Invalid status %q", code)
+	}
+	if n == codeOK {
+		return nil
+	}
+	return &StatusError{Code: n, Message: decodeStatusMessage(message)}
+}
+
+// Call calls a method of the read or admin API, returning its JSON document
+func (c *Client) Call(ctx context.Context, method string, req Request) (json.RawMessage, error) {
+	b, err := c.unary(ctx, method, req.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	err = doc.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(doc.JSON), nil
+}
+
+// Events streams the events of the given types, all if none are given,
+// until ctx is done or the stream fails. Their data is JSON.
+func (c *Client) Events(ctx context.Context, types ...events.Type) (<-chan events.Event, <-chan error, error) {
+	req := EventsRequest{}
+	for _, t := range types {
+		req.Types = append(req.Types, string(t))
+	}
+	res, err := c.post(ctx, "Events", req.Marshal())
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := make(chan events.Event)
+	done := make(chan error, 1)
+	go func() {
+		defer res.Body.Close()
+		defer close(stream)
+		for {
+			b, err := readMessage(res.Body, maxResponse)
+			if err == io.EOF {
+				done <- status(res)
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+			var ev Event
+			err = ev.Unmarshal(b)
+			if err != nil {
+				done <- err
+				return
+			}
+			e := events.Event{Type: events.Type(ev.Type), Time: ev.Time, Network: ev.Network, Data: json.RawMessage(ev.Data)}
+			select {
+			case stream <- e:
+			case <-ctx.Done():
+				done <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return stream, done, nil
+}
+
+// Job gets a job paying to a pubkey hash from the node, for a stratum
+// gateway. Its token must be the node's gateway token.
+func (c *Client) Job(ctx context.Context, pubKeyHash []byte, pubKeyHashVersion uint8) (*work.Job, error) {
+	req := &JobRequest{PubKeyHash: pubKeyHash, PubKeyHashVersion: uint32(pubKeyHashVersion)}
+	b, err := c.unary(ctx, "GatewayJob", req.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	var m Job
+	err = m.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return m.WorkJob()
+}
+
+// Submit hands a solution for a job from Job to the node
+func (c *Client) Submit(ctx context.Context, jobID string, extranonce uint64, timestamp uint32, nonce uint32) (*SubmitResult, error) {
+	sub := &Submission{JobID: jobID, Extranonce: extranonce, Timestamp: timestamp, Nonce: nonce}
+	b, err := c.unary(ctx, "GatewaySubmit", sub.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	var res SubmitResult
+	err = res.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// WorkUpdates streams the node's work updates, starting with the current
+// state, until ctx is done or the stream fails
+func (c *Client) WorkUpdates(ctx context.Context) (<-chan WorkUpdate, <-chan error, error) {
+	res, err := c.post(ctx, "GatewayWork", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := make(chan WorkUpdate)
+	done := make(chan error, 1)
+	go func() {
+		defer res.Body.Close()
+		defer close(stream)
+		for {
+			b, err := readMessage(res.Body, maxRequest)
+			if err == io.EOF {
+				err = status(res)
+				if err == nil {
+					err = fmt.Errorf("Node ended the work stream")
+				}
+				done <- err
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+			var u WorkUpdate
+			err = u.Unmarshal(b)
+			if err != nil {
+				done <- err
+				return
+			}
+			select {
+			case stream <- u:
+			case <-ctx.Done():
+				done <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return stream, done, nil
+}
@@ -0,0 +1,126 @@
+package control
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes, as far as they are used here
+const (
+	codeOK                = 0
+	codeInvalidArgument   = 3
+	codeNotFound          = 5
+	codePermissionDenied  = 7
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+	codeUnauthenticated   = 16
+)
+
+// Limits of the messages accepted. Requests are small, the largest
+// documents are exports of the sharechain.
+const (
+	maxRequest  = 64 * 1024
+	maxResponse = 64 * 1024 * 1024
+)
+
+// servicePath is the path of the methods of the service, followed by the
+// method name
+const servicePath = "/p2pool.Control/"
+
+// StatusError is a call that failed with a gRPC status
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// readMessage reads a length prefixed message. io.EOF means there are no
+// more.
+func readMessage(r io.Reader, limit int) ([]byte, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, &StatusError{codeUnimplemented, "Compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if int64(length) > int64(limit) {
+		return nil, &StatusError{codeResourceExhausted, fmt.Sprintf("Message of %d bytes is too large", length)}
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// writeMessage writes a message with its length prefix
+func writeMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// statusForHTTP maps the status of an HTTP API response to a gRPC code
+func statusForHTTP(status int) int {
+	switch {
+	case status < 300:
+		return codeOK
+	case status == http.StatusUnauthorized:
+		return codeUnauthenticated
+	case status == http.StatusForbidden:
+		return codePermissionDenied
+	case status == http.StatusNotFound:
+		return codeNotFound
+	case status == http.StatusTooManyRequests:
+		return codeResourceExhausted
+	case status == http.StatusServiceUnavailable:
+		return codeUnavailable
+	case status < 500:
+		return codeInvalidArgument
+	}
+	return codeInternal
+}
+
+// encodeStatusMessage percent-encodes a status message for the
+// grpc-message trailer
+func encodeStatusMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func decodeStatusMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
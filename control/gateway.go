@@ -0,0 +1,206 @@
+package control
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// jobLifetime is how long a job handed to a gateway can be submitted to.
+// Miners don't work on a job for that long, the stale ones are rejected
+// sooner by the gateway.
+const jobLifetime = time.Minute * 10
+
+// gatewayJobs are the jobs handed out to gateways, by ID
+type gatewayJobs struct {
+	jobs      map[string]*work.Job
+	next      uint64
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+func (g *gatewayJobs) add(j *work.Job) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.jobs == nil {
+		g.jobs = map[string]*work.Job{}
+	}
+	now := clock.Now()
+	if now.Sub(g.lastPrune) > time.Minute {
+		g.lastPrune = now
+		for id, old := range g.jobs {
+			if now.Sub(old.CreatedAt) > jobLifetime {
+				delete(g.jobs, id)
+			}
+		}
+	}
+	g.next++
+	j.ID = strconv.FormatUint(g.next, 16)
+	g.jobs[j.ID] = j
+}
+
+func (g *gatewayJobs) get(id string) *work.Job {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.jobs[id]
+}
+
+// serveGateway answers the methods stratum gateways use, returning false
+// for other methods
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request, method string, b []byte) bool {
+	switch method {
+	case "GatewayJob", "GatewaySubmit", "GatewayWork":
+	default:
+		return false
+	}
+	if s.Work == nil {
+		finish(w, codeUnimplemented, "This node does not serve stratum gateways")
+		return true
+	}
+	if !s.CanGateway(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		finish(w, codeUnauthenticated, "Invalid token")
+		return true
+	}
+	switch method {
+	case "GatewayJob":
+		var req JobRequest
+		err := req.Unmarshal(b)
+		if err != nil {
+			finish(w, codeInvalidArgument, err.Error())
+			return true
+		}
+		if paused, reason := s.Work.Paused(); paused {
+			finish(w, codeUnavailable, fmt.Sprintf("Not handing out work: %s", reason))
+			return true
+		}
+		j, err := s.Work.GetJob(req.PubKeyHash, uint8(req.PubKeyHashVersion))
+		if err != nil {
+			finish(w, codeUnavailable, err.Error())
+			return true
+		}
+		s.gatewayJobs.add(j)
+		writeMessage(w, JobMessage(j).Marshal())
+		finish(w, codeOK, "")
+	case "GatewaySubmit":
+		var sub Submission
+		err := sub.Unmarshal(b)
+		if err != nil {
+			finish(w, codeInvalidArgument, err.Error())
+			return true
+		}
+		j := s.gatewayJobs.get(sub.JobID)
+		if j == nil {
+			finish(w, codeNotFound, fmt.Sprintf("Unknown job %s", sub.JobID))
+			return true
+		}
+		res, err := s.Work.Submit(j, sub.Extranonce, sub.Timestamp, sub.Nonce)
+		if err != nil {
+			finish(w, codeInternal, err.Error())
+			return true
+		}
+		writeMessage(w, (&SubmitResult{POWHash: res.POWHash[:], IsShare: res.IsShare, IsBlock: res.IsBlock, DOA: res.DOA}).Marshal())
+		finish(w, codeOK, "")
+	case "GatewayWork":
+		s.streamWork(w, r)
+	}
+	return true
+}
+
+// streamWork tells a gateway about new work until it goes away, starting
+// with the current state
+func (s *Server) streamWork(w http.ResponseWriter, r *http.Request) {
+	signals, stop := s.Work.WatchWork()
+	defer stop()
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	var last WorkUpdate
+	clean := true
+	for {
+		u := WorkUpdate{Clean: clean}
+		_, u.Paused = s.Work.Paused()
+		if bt := s.Work.CurrentTemplate(); bt != nil {
+			u.PreviousBlock = bt.PreviousBlock[:]
+		}
+		// Gateways treat jobs on another block as stale, and need no
+		// jobs while there is no work
+		if u.Paused != last.Paused || string(u.PreviousBlock) != string(last.PreviousBlock) {
+			u.Clean = true
+		}
+		last = u
+		if writeMessage(w, u.Marshal()) != nil || rc.Flush() != nil {
+			return
+		}
+		select {
+		case clean = <-signals:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// JobMessage is the message handing a job to a gateway
+func JobMessage(j *work.Job) *Job {
+	m := &Job{
+		ID:             j.ID,
+		CoinbasePrefix: j.CoinbasePrefix,
+		CoinbaseSuffix: j.CoinbaseSuffix,
+		Version:        j.Share.MinHeader.Version,
+		PreviousBlock:  j.Share.MinHeader.PreviousBlock[:],
+		Bits:           j.Share.MinHeader.Bits,
+		Timestamp:      uint32(j.Share.ShareInfo.Timestamp),
+		ShareTarget:    j.ShareTarget.Bytes(),
+		BlockTarget:    j.BlockTarget.Bytes(),
+		Solo:           j.Solo,
+	}
+	for _, h := range j.Template.MerkleBranch {
+		m.MerkleBranch = append(m.MerkleBranch, h[:])
+	}
+	return m
+}
+
+// WorkJob is the job a gateway got, with what stratum needs of it to hand
+// it to miners and check their solutions. It can't be submitted to a
+// WorkManager.
+func (m *Job) WorkJob() (*work.Job, error) {
+	prev, err := chainhash.NewHash(m.PreviousBlock)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid previous block: %s", err.Error())
+	}
+	bt := &work.BlockTemplate{
+		Version:       m.Version,
+		PreviousBlock: prev,
+		Bits:          m.Bits,
+		Target:        new(big.Int).SetBytes(m.BlockTarget),
+	}
+	for _, b := range m.MerkleBranch {
+		h, err := chainhash.NewHash(b)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid merkle branch: %s", err.Error())
+		}
+		bt.MerkleBranch = append(bt.MerkleBranch, h)
+	}
+	j := &work.Job{
+		ID:             m.ID,
+		Template:       bt,
+		CoinbasePrefix: m.CoinbasePrefix,
+		CoinbaseSuffix: m.CoinbaseSuffix,
+		ShareTarget:    new(big.Int).SetBytes(m.ShareTarget),
+		BlockTarget:    bt.Target,
+		CreatedAt:      clock.Now(),
+		Solo:           m.Solo,
+	}
+	j.Share.MinHeader.Version = m.Version
+	j.Share.MinHeader.PreviousBlock = prev
+	j.Share.MinHeader.Bits = m.Bits
+	j.Share.ShareInfo.Timestamp = int32(m.Timestamp)
+	return j, nil
+}
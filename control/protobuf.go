@@ -0,0 +1,466 @@
+package control
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// The messages of control.proto, with just enough of the protobuf encoding
+// for their fields: varints, doubles, strings and bytes.
+
+// Request holds the parameters of all methods, each uses the fields it
+// needs
+type Request struct {
+	Address    string  `json:"address,omitempty"`
+	IP         string  `json:"ip,omitempty"`
+	Target     string  `json:"target,omitempty"`
+	Username   string  `json:"username,omitempty"`
+	Difficulty float64 `json:"difficulty,omitempty"`
+	Subsystem  string  `json:"subsystem,omitempty"`
+	Level      string  `json:"level,omitempty"`
+}
+
+// Document is a JSON document, as the HTTP API answers it
+type Document struct {
+	JSON string
+}
+
+// EventsRequest limits an event stream to Types, all if empty
+type EventsRequest struct {
+	Types []string
+}
+
+// Event is an event as it is streamed, its data encoded as JSON
+type Event struct {
+	Type    string
+	Time    int64
+	Network string
+	Data    string
+}
+
+// JobRequest asks for a job paying to a pubkey hash
+type JobRequest struct {
+	PubKeyHash        []byte
+	PubKeyHashVersion uint32
+}
+
+// Job is what a stratum gateway needs of a job to hand it to miners and
+// check their solutions
+type Job struct {
+	ID             string
+	CoinbasePrefix []byte
+	CoinbaseSuffix []byte
+	MerkleBranch   [][]byte
+	Version        int32
+	PreviousBlock  []byte
+	Bits           uint32
+	Timestamp      uint32
+	ShareTarget    []byte
+	BlockTarget    []byte
+	Solo           bool
+}
+
+// Submission is a solution for a job that a gateway found good enough for
+// a share or a block
+type Submission struct {
+	JobID      string
+	Extranonce uint64
+	Timestamp  uint32
+	Nonce      uint32
+}
+
+type SubmitResult struct {
+	POWHash []byte
+	IsShare bool
+	IsBlock bool
+	DOA     bool
+}
+
+// WorkUpdate tells gateways there is new work
+type WorkUpdate struct {
+	// Clean is set when all previous jobs are invalid
+	Clean bool
+	// Paused is why there is no work, empty if there is
+	Paused        string
+	PreviousBlock []byte
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field<<3|wireType))
+}
+
+func (e *encoder) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) int64(field int, v int64) {
+	e.uint64(field, uint64(v))
+}
+
+func (e *encoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.uint64(field, 1)
+	}
+}
+
+func (e *encoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireFixed64)
+	e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+}
+
+// field is a decoded field. Varints and fixed size values are in n, strings
+// in b.
+type field struct {
+	number int
+	n      uint64
+	b      []byte
+}
+
+// decodeFields splits an encoded message into its fields
+func decodeFields(b []byte) ([]field, error) {
+	fields := make([]field, 0)
+	for len(b) > 0 {
+		tag, l := binary.Uvarint(b)
+		if l <= 0 {
+			return nil, fmt.Errorf("Invalid field tag")
+		}
+		b = b[l:]
+		f := field{number: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			f.n, l = binary.Uvarint(b)
+			if l <= 0 {
+				return nil, fmt.Errorf("Invalid varint in field %d", f.number)
+			}
+			b = b[l:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("Field %d is truncated", f.number)
+			}
+			f.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("Field %d is truncated", f.number)
+			}
+			f.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			n, l := binary.Uvarint(b)
+			if l <= 0 || n > uint64(len(b)-l) {
+				return nil, fmt.Errorf("Field %d is truncated", f.number)
+			}
+			f.b, b = b[l:l+int(n)], b[l+int(n):]
+		default:
+			return nil, fmt.Errorf("Unsupported wire type %d in field %d", tag&7, f.number)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (r *Request) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, r.Address)
+	e.string(2, r.IP)
+	e.string(3, r.Target)
+	e.string(4, r.Username)
+	e.double(5, r.Difficulty)
+	e.string(6, r.Subsystem)
+	e.string(7, r.Level)
+	return e.b
+}
+
+func (r *Request) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			r.Address = string(f.b)
+		case 2:
+			r.IP = string(f.b)
+		case 3:
+			r.Target = string(f.b)
+		case 4:
+			r.Username = string(f.b)
+		case 5:
+			r.Difficulty = math.Float64frombits(f.n)
+		case 6:
+			r.Subsystem = string(f.b)
+		case 7:
+			r.Level = string(f.b)
+		}
+	}
+	return nil
+}
+
+func (d *Document) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, d.JSON)
+	return e.b
+}
+
+func (d *Document) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.number == 1 {
+			d.JSON = string(f.b)
+		}
+	}
+	return nil
+}
+
+func (r *EventsRequest) Marshal() []byte {
+	e := &encoder{}
+	for _, t := range r.Types {
+		e.tag(1, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(t)))
+		e.b = append(e.b, t...)
+	}
+	return e.b
+}
+
+func (r *EventsRequest) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.number == 1 {
+			r.Types = append(r.Types, string(f.b))
+		}
+	}
+	return nil
+}
+
+func (ev *Event) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, ev.Type)
+	e.int64(2, ev.Time)
+	e.string(3, ev.Network)
+	e.string(4, ev.Data)
+	return e.b
+}
+
+func (ev *Event) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			ev.Type = string(f.b)
+		case 2:
+			ev.Time = int64(f.n)
+		case 3:
+			ev.Network = string(f.b)
+		case 4:
+			ev.Data = string(f.b)
+		}
+	}
+	return nil
+}
+
+func (r *JobRequest) Marshal() []byte {
+	e := &encoder{}
+	e.bytes(1, r.PubKeyHash)
+	e.uint64(2, uint64(r.PubKeyHashVersion))
+	return e.b
+}
+
+func (r *JobRequest) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			r.PubKeyHash = f.b
+		case 2:
+			r.PubKeyHashVersion = uint32(f.n)
+		}
+	}
+	return nil
+}
+
+func (j *Job) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, j.ID)
+	e.bytes(2, j.CoinbasePrefix)
+	e.bytes(3, j.CoinbaseSuffix)
+	for _, h := range j.MerkleBranch {
+		// Repeated fields keep their empty entries
+		e.tag(4, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(h)))
+		e.b = append(e.b, h...)
+	}
+	e.int64(5, int64(j.Version))
+	e.bytes(6, j.PreviousBlock)
+	e.uint64(7, uint64(j.Bits))
+	e.uint64(8, uint64(j.Timestamp))
+	e.bytes(9, j.ShareTarget)
+	e.bytes(10, j.BlockTarget)
+	e.bool(11, j.Solo)
+	return e.b
+}
+
+func (j *Job) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			j.ID = string(f.b)
+		case 2:
+			j.CoinbasePrefix = f.b
+		case 3:
+			j.CoinbaseSuffix = f.b
+		case 4:
+			j.MerkleBranch = append(j.MerkleBranch, f.b)
+		case 5:
+			j.Version = int32(f.n)
+		case 6:
+			j.PreviousBlock = f.b
+		case 7:
+			j.Bits = uint32(f.n)
+		case 8:
+			j.Timestamp = uint32(f.n)
+		case 9:
+			j.ShareTarget = f.b
+		case 10:
+			j.BlockTarget = f.b
+		case 11:
+			j.Solo = f.n != 0
+		}
+	}
+	return nil
+}
+
+func (s *Submission) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, s.JobID)
+	e.uint64(2, s.Extranonce)
+	e.uint64(3, uint64(s.Timestamp))
+	e.uint64(4, uint64(s.Nonce))
+	return e.b
+}
+
+func (s *Submission) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			s.JobID = string(f.b)
+		case 2:
+			s.Extranonce = f.n
+		case 3:
+			s.Timestamp = uint32(f.n)
+		case 4:
+			s.Nonce = uint32(f.n)
+		}
+	}
+	return nil
+}
+
+func (r *SubmitResult) Marshal() []byte {
+	e := &encoder{}
+	e.bytes(1, r.POWHash)
+	e.bool(2, r.IsShare)
+	e.bool(3, r.IsBlock)
+	e.bool(4, r.DOA)
+	return e.b
+}
+
+func (r *SubmitResult) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			r.POWHash = f.b
+		case 2:
+			r.IsShare = f.n != 0
+		case 3:
+			r.IsBlock = f.n != 0
+		case 4:
+			r.DOA = f.n != 0
+		}
+	}
+	return nil
+}
+
+func (u *WorkUpdate) Marshal() []byte {
+	e := &encoder{}
+	e.bool(1, u.Clean)
+	e.string(2, u.Paused)
+	e.bytes(3, u.PreviousBlock)
+	return e.b
+}
+
+func (u *WorkUpdate) Unmarshal(b []byte) error {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			u.Clean = f.n != 0
+		case 2:
+			u.Paused = string(f.b)
+		case 3:
+			u.PreviousBlock = f.b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Package control serves the control API of a node, for operators
+// automating fleets of nodes. It is the HTTP API carried in gRPC's wire
+// format, not a typed gRPC service: every read and admin endpoint is a
+// method answering with the endpoint's JSON document wrapped in a Document
+// message, checked with the same tokens, and Events streams what the
+// /events WebSocket does. The messages are encoded by hand rather than
+// generated. control.proto describes them, so gRPC clients for other
+// languages can be generated from it, Client is the one for Go. The calls
+// run over HTTP/2, with TLS if the server has a TLS configuration, which the
+// node gives it when its web port uses TLS. Without it the tokens are sent
+// in the clear, so the port must only be reachable over a trusted network.
+//
+// The Gateway methods serve stratum gateways: processes that take the miner
+// connections of a node, handing its jobs to miners and forwarding the
+// solutions good enough for shares or blocks, so connection handling scales
+// over many machines while one node owns the sharechain and the daemon.
+package control
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var log = logging.For("control")
+
+// eventsBuffer is how many events a stream may fall behind before it misses
+// some
+const eventsBuffer = 256
+
+// route is the HTTP API endpoint a method is answered by
+type route struct {
+	path  string
+	admin bool
+}
+
+var routes = map[string]route{
+	"LocalStats":       {path: "/local_stats"},
+	"GlobalStats":      {path: "/global_stats"},
+	"Peers":            {path: "/peers"},
+	"RecentShares":     {path: "/recent_shares"},
+	"RecentBlocks":     {path: "/recent_blocks"},
+	"CurrentPayouts":   {path: "/current_payouts"},
+	"PayoutProjection": {path: "/payout_projection"},
+	"Users":            {path: "/users"},
+	"Rate":             {path: "/rate"},
+	"FeeStats":         {path: "/fee_stats"},
+	"Health":           {path: "/health"},
+	"MinerSoftware":    {path: "/web/miner_software"},
+	"GraphSources":     {path: "/web/graph_sources"},
+	"Miner":            {path: "/miner/"},
+	"BanPeer":          {path: "/admin/peers/ban", admin: true},
+	"UnbanPeer":        {path: "/admin/peers/unban", admin: true},
+	"BannedPeers":      {path: "/admin/peers/banned", admin: true},
+	"AddPeer":          {path: "/admin/peers/add", admin: true},
+	"DisconnectMiner":  {path: "/admin/stratum/disconnect", admin: true},
+	"SetDifficulty":    {path: "/admin/stratum/difficulty", admin: true},
+	"RefreshTemplate":  {path: "/admin/template/refresh", admin: true},
+	"FlushCaches":      {path: "/admin/caches/flush", admin: true},
+	"SetLogLevel":      {path: "/admin/loglevel", admin: true},
+	"Reload":           {path: "/admin/reload", admin: true},
+	"Shutdown":         {path: "/admin/shutdown", admin: true},
+	"Dump":             {path: "/admin/dump", admin: true},
+}
+
+// Server answers the calls of the control API with the HTTP API
+type Server struct {
+	Port int
+	// TLSConfig, if set, serves the calls over TLS, else they are served
+	// over HTTP/2 without it
+	TLSConfig *tls.Config
+	// API is the HTTP API the methods are answered by
+	API http.Handler
+	// Network is the network whose events are streamed
+	Network string
+	// CanRead tells whether a token may read, which streaming events needs
+	CanRead func(token string) bool
+	// Work, if set, is handed out to stratum gateways
+	Work *work.WorkManager
+	// CanGateway tells whether a token may act as stratum gateway
+	CanGateway func(token string) bool
+	// Log gets the records of the control API, the package's logger if nil
+	Log *logging.SubsystemLogger
+
+	httpServer  *http.Server
+	gatewayJobs gatewayJobs
+}
+
+func NewServer(port int, api http.Handler, network string) *Server {
+	return &Server{
+		Port:    port,
+		API:     api,
+		Network: network,
+		CanRead: func(string) bool { return true },
+		// Gateways get work that pays to any address, they need a token
+		CanGateway: func(string) bool { return false },
+	}
+}
+
+func (s *Server) logger() *logging.SubsystemLogger {
+	return s.Log.Or(log)
+}
+
+// Listen binds the port and serves calls in the background
+func (s *Server) Listen() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return err
+	}
+	serve := func() error { return s.httpServer.Serve(l) }
+	if s.TLSConfig != nil {
+		s.logger().Infof("Control API listening for TLS on port %d", s.Port)
+		// ServeTLS offers HTTP/2 to clients, which gRPC needs
+		s.httpServer = &http.Server{Handler: s, TLSConfig: s.TLSConfig.Clone()}
+		serve = func() error { return s.httpServer.ServeTLS(l, "", "") }
+	} else {
+		s.logger().Infof("Control API listening on port %d", s.Port)
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		s.httpServer = &http.Server{Handler: s, Protocols: protocols}
+	}
+	go func() {
+		err := serve()
+		if err != nil && err != http.ErrServerClosed {
+			s.logger().Errorf("Control API stopped: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Close stops the server, ending open event streams
+func (s *Server) Close() error {
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Only calls in gRPC framing are served", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	method, ok := strings.CutPrefix(r.URL.Path, servicePath)
+	if !ok {
+		finish(w, codeUnimplemented, fmt.Sprintf("Unknown service of %s", r.URL.Path))
+		return
+	}
+	b, err := readMessage(r.Body, maxRequest)
+	if err != nil {
+		finishError(w, err)
+		return
+	}
+
+	if method == "Events" {
+		var req EventsRequest
+		err = req.Unmarshal(b)
+		if err != nil {
+			finish(w, codeInvalidArgument, err.Error())
+			return
+		}
+		s.streamEvents(w, r, req)
+		return
+	}
+	if s.serveGateway(w, r, method, b) {
+		return
+	}
+	rt, ok := routes[method]
+	if !ok {
+		finish(w, codeUnimplemented, fmt.Sprintf("Unknown method %s", method))
+		return
+	}
+	var req Request
+	err = req.Unmarshal(b)
+	if err != nil {
+		finish(w, codeInvalidArgument, err.Error())
+		return
+	}
+	status, body := s.call(r, rt, req)
+	code := statusForHTTP(status)
+	if code != codeOK {
+		var res struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &res) != nil || res.Error == "" {
+			res.Error = http.StatusText(status)
+		}
+		finish(w, code, res.Error)
+		return
+	}
+	writeMessage(w, (&Document{JSON: string(body)}).Marshal())
+	finish(w, codeOK, "")
+}
+
+// call answers a request with the HTTP API, returning the status and body
+// of its response
+func (s *Server) call(r *http.Request, rt route, req Request) (int, []byte) {
+	path := rt.path
+	method := http.MethodGet
+	var body []byte
+	if rt.admin {
+		method = http.MethodPost
+		body, _ = json.Marshal(req)
+	} else if rt.path == "/miner/" {
+		path += url.PathEscape(req.Address)
+	}
+	hr, err := http.NewRequestWithContext(r.Context(), method, path, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	hr.RemoteAddr = r.RemoteAddr
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		hr.Header.Set("Authorization", auth)
+	}
+	rec := &recorder{header: http.Header{}, status: http.StatusOK}
+	s.API.ServeHTTP(rec, hr)
+	return rec.status, rec.body.Bytes()
+}
+
+// streamEvents sends the node's events until the client goes away
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, req EventsRequest) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !s.CanRead(token) {
+		finish(w, codeUnauthenticated, "Invalid token")
+		return
+	}
+	types := make([]events.Type, 0, len(req.Types))
+	for _, t := range req.Types {
+		types = append(types, events.Type(t))
+	}
+	sub := events.SubscribeNetwork(s.Network, eventsBuffer, types...)
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		select {
+		case e := <-sub.Events:
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				s.logger().Warnf("Could not encode %s event: %s", e.Type, err.Error())
+				continue
+			}
+			ev := &Event{Type: string(e.Type), Time: e.Time, Network: e.Network, Data: string(data)}
+			if writeMessage(w, ev.Marshal()) != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// finish ends a call with its status, in the trailers
+func finish(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeStatusMessage(message))
+	}
+}
+
+func finishError(w http.ResponseWriter, err error) {
+	if se, ok := err.(*StatusError); ok {
+		finish(w, se.Code, se.Message)
+		return
+	}
+	finish(w, codeInvalidArgument, err.Error())
+}
+
+// recorder collects the response of the HTTP API to a call
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
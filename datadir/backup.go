@@ -0,0 +1,167 @@
+package datadir
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// checksumFile lists the SHA-256 of every file in a backup, in the format
+// of sha256sum
+const checksumFile = "SHA256SUMS"
+
+// ScheduledBackup is the name of backups made by RunBackups, only those are
+// rotated
+const ScheduledBackup = "scheduled"
+
+// Backups returns the names of the backups, oldest first
+func (d *DataDir) Backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.Path, BackupDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	// Names start with the time they were made
+	sort.Strings(names)
+	return names, nil
+}
+
+// Rotate deletes the oldest scheduled backups, keeping keep of them
+func (d *DataDir) Rotate(keep int) error {
+	names, err := d.Backups()
+	if err != nil {
+		return err
+	}
+	scheduled := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, "-"+ScheduledBackup) {
+			scheduled = append(scheduled, name)
+		}
+	}
+	for i := 0; i < len(scheduled)-keep; i++ {
+		err = os.RemoveAll(filepath.Join(d.Path, BackupDir, scheduled[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyBackup checks the files of a backup against its checksums
+func (d *DataDir) VerifyBackup(name string) error {
+	dir := filepath.Join(d.Path, BackupDir, name)
+	f, err := os.Open(filepath.Join(dir, checksumFile))
+	if err != nil {
+		return fmt.Errorf("Backup %s has no checksums: %s", name, err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return fmt.Errorf("Backup %s: Invalid checksum line %q", name, scanner.Text())
+		}
+		actual, err := fileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return fmt.Errorf("Backup %s: %s", name, err.Error())
+		}
+		if actual != sum {
+			return fmt.Errorf("Backup %s: %s is corrupt", name, file)
+		}
+	}
+	return scanner.Err()
+}
+
+// Restore replaces the data files with those of a backup, after checking
+// them and backing up the current files. The node must not be running.
+func (d *DataDir) Restore(name string) error {
+	err := d.VerifyBackup(name)
+	if err != nil {
+		return err
+	}
+	current, err := d.Backup("pre-restore")
+	if err != nil {
+		return fmt.Errorf("Could not back up the current data: %s", err.Error())
+	}
+	logging.Infof("Backed up the current data to %s", current)
+
+	dir := filepath.Join(d.Path, BackupDir, name)
+	for _, f := range dataFiles {
+		from := filepath.Join(dir, f)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			// Wasn't there when the backup was made
+			err = os.Remove(filepath.Join(d.Path, f))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		err = copyFile(from, filepath.Join(d.Path, f))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunBackups makes a scheduled backup every interval, keeping the newest
+// keep of them. flush is called first, to get the node's state on disk.
+func (d *DataDir) RunBackups(interval time.Duration, keep int, flush func()) {
+	for {
+		time.Sleep(interval)
+		flush()
+		backup, err := d.Backup(ScheduledBackup)
+		if err != nil {
+			logging.Errorf("Scheduled backup failed: %s", err.Error())
+			continue
+		}
+		logging.Infof("Backed up data directory to %s", backup)
+		err = d.Rotate(keep)
+		if err != nil {
+			logging.Warnf("Could not delete old backups: %s", err.Error())
+		}
+	}
+}
+
+func writeChecksums(dir string, files []string) error {
+	var b strings.Builder
+	for _, f := range files {
+		sum, err := fileChecksum(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, f)
+	}
+	return writeFileAtomic(filepath.Join(dir, checksumFile), []byte(b.String()))
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,222 @@
+// Package datadir lays out the files the node keeps between restarts in one
+// directory, and upgrades directories written by older versions.
+package datadir
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// SchemaVersion is the layout version this build reads and writes
+const SchemaVersion = 1
+
+// Files in the data directory, relative to it
+const (
+	ShareChainFile = "shares/sharechain.dat"
+	// ShareChainJournal holds the shares added since ShareChainFile was
+	// written
+	ShareChainJournal = "shares/sharechain.dat.journal"
+	FoundBlocksFile   = "blocks/foundblocks.dat"
+	PoolBlocksFile    = "blocks/poolblocks.dat"
+	PeersFile         = "peers.json"
+	BansFile          = "bans.json"
+	GraphsFile        = "stats/graphs.json"
+	BackupDir         = "backups"
+	ACMEDir           = "acme"
+	versionFile       = "VERSION"
+)
+
+// dataFiles are the files that are backed up, including those of older
+// layouts. The directory may be shared with other files, those are left
+// alone.
+var dataFiles = []string{
+	versionFile,
+	ShareChainFile,
+	ShareChainJournal,
+	FoundBlocksFile,
+	PoolBlocksFile,
+	PeersFile,
+	BansFile,
+	GraphsFile,
+	"sharechain.dat",
+	"foundblocks.dat",
+	"poolblocks.dat",
+	"graphs.json",
+}
+
+// migrations[i] upgrades a directory from schema version i to i+1
+var migrations = []func(dir string) error{
+	migrateFlatLayout,
+}
+
+// DataDir is an opened data directory
+type DataDir struct {
+	Path string
+}
+
+// Open creates the data directory if needed and migrates it to the current
+// schema version, backing it up first
+func Open(path string) (*DataDir, error) {
+	d := &DataDir{Path: path}
+	for _, sub := range []string{"shares", "blocks", "stats", BackupDir} {
+		err := os.MkdirAll(filepath.Join(path, sub), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	version, err := d.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("Data directory %s has schema version %d, this version of p2pool-go only knows up to %d", path, version, SchemaVersion)
+	}
+	if version < SchemaVersion {
+		backup := "a backup"
+		if d.hasData() {
+			backup, err = d.Backup(fmt.Sprintf("pre-migration-v%d", version))
+			if err != nil {
+				return nil, fmt.Errorf("Could not back up data directory before migrating: %s", err.Error())
+			}
+			logging.Infof("Backed up data directory to %s", backup)
+		}
+		for v := version; v < SchemaVersion; v++ {
+			logging.Infof("Migrating data directory from schema version %d to %d", v, v+1)
+			err = migrations[v](path)
+			if err != nil {
+				return nil, fmt.Errorf("Migrating data directory to schema version %d failed, restore from %s: %s", v+1, backup, err.Error())
+			}
+			err = d.setVersion(v + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// Version returns the schema version of the directory, 0 for directories
+// from before versioning
+func (d *DataDir) Version() (int, error) {
+	b, err := os.ReadFile(filepath.Join(d.Path, versionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid data directory version %q", strings.TrimSpace(string(b)))
+	}
+	return v, nil
+}
+
+func (d *DataDir) setVersion(v int) error {
+	return writeFileAtomic(filepath.Join(d.Path, versionFile), []byte(strconv.Itoa(v)+"\n"))
+}
+
+// File resolves a path relative to the data directory. Absolute paths and
+// empty ones, which disable a file, are returned as is.
+func (d *DataDir) File(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(d.Path, name)
+}
+
+// Backup copies the data files in the directory to a new directory under
+// backups, along with their checksums, and returns its path
+func (d *DataDir) Backup(name string) (string, error) {
+	target := filepath.Join(d.Path, BackupDir, fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), name))
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return "", err
+	}
+	copied := make([]string, 0, len(dataFiles))
+	for _, f := range dataFiles {
+		from := filepath.Join(d.Path, f)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+		err = copyFile(from, filepath.Join(target, f))
+		if err != nil {
+			return "", err
+		}
+		copied = append(copied, f)
+	}
+	err = writeChecksums(target, copied)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func (d *DataDir) hasData() bool {
+	for _, f := range dataFiles {
+		if _, err := os.Stat(filepath.Join(d.Path, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateFlatLayout moves the files older versions kept next to each other,
+// in the directory the node was started in, to their place in the layout
+func migrateFlatLayout(dir string) error {
+	moves := map[string]string{
+		"sharechain.dat":  ShareChainFile,
+		"foundblocks.dat": FoundBlocksFile,
+		"poolblocks.dat":  PoolBlocksFile,
+		"graphs.json":     GraphsFile,
+	}
+	for from, to := range moves {
+		from = filepath.Join(dir, from)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+		err := os.Rename(from, filepath.Join(dir, to))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	err := os.WriteFile(path+".new", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
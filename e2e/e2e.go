@@ -0,0 +1,328 @@
+// Package e2e runs a node end to end: a daemon on a regtest chain, the node
+// binary in its own process and simulated CPU miners connected over
+// stratum. The test passes once the miners' shares got a block accepted by
+// the daemon whose coinbase pays every miner and nobody else, which takes
+// templates, the sharechain, payouts, stratum and block submission all
+// working together. TestE2E runs it, behind the e2e build tag.
+package e2e
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/bench"
+	"github.com/gertjaap/p2pool-go/mockdaemon"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// minerRate is how many solutions per second each miner submits
+const minerRate = 10
+
+// sharesBeforeBlock is how many accepted solutions every miner needs before
+// a mock daemon makes blocks easy to find
+const sharesBeforeBlock = 3
+
+// Test is an end to end run on a regtest network
+type Test struct {
+	// Binary is the p2pool binary to run the node with
+	Binary  string
+	Network p2pnet.Network
+	// NetworkDir is passed on to the node as -networkdir
+	NetworkDir string
+	// Daemon is the RPC URL of a regtest daemon. If empty, a mock daemon is
+	// started, which only makes blocks easy once every miner has shares.
+	Daemon string
+	// Dir is the node's data directory, with its log in node.log
+	Dir     string
+	Miners  int
+	Timeout time.Duration
+	// NodeArgs are extra flags for the node
+	NodeArgs []string
+	// Out receives the progress of the test
+	Out io.Writer
+
+	mock   *mockdaemon.Daemon
+	client *rpc.Client
+	node   *exec.Cmd
+	// exited is closed once the node has exited
+	exited chan struct{}
+	miners []*bench.SimulatedMiner
+	// addresses are those the miners mine to
+	addresses map[string]bool
+	stop      int32
+}
+
+// Run runs the test, returning why it failed
+func (t *Test) Run() error {
+	if !t.Network.Regtest {
+		return fmt.Errorf("Network %s is not a regtest network", t.Network.Name)
+	}
+	if t.Miners < 1 {
+		return fmt.Errorf("At least one miner is needed")
+	}
+	deadline := time.Now().Add(t.Timeout)
+
+	err := t.startDaemon()
+	if err != nil {
+		return err
+	}
+	defer t.stopDaemon()
+	info, err := t.client.GetBlockchainInfo()
+	if err != nil {
+		return fmt.Errorf("Could not reach the daemon: %s", err.Error())
+	}
+	startHeight := info.Blocks
+	t.logf("Daemon at height %d", startHeight)
+
+	err = t.startNode()
+	if err != nil {
+		return err
+	}
+	defer t.stopNode()
+
+	err = t.startMiners()
+	if err != nil {
+		return err
+	}
+	defer atomic.StoreInt32(&t.stop, 1)
+
+	if t.mock != nil {
+		err = t.waitForShares(deadline)
+		if err != nil {
+			return err
+		}
+		bits := blockchain.BigToCompact(t.Network.MaxTarget)
+		t.mock.SetTarget(fmt.Sprintf("%064x", blockchain.CompactToBig(bits)), fmt.Sprintf("%08x", bits))
+		t.logf("Every miner has shares, made blocks easy to find")
+	}
+	return t.waitForBlock(startHeight, deadline)
+}
+
+func (t *Test) logf(format string, args ...interface{}) {
+	fmt.Fprintf(t.Out, format+"\n", args...)
+}
+
+func (t *Test) startDaemon() error {
+	var err error
+	if t.Daemon != "" {
+		t.client, err = rpc.NewClient(t.Daemon)
+		return err
+	}
+	t.mock = mockdaemon.New(t.Network)
+	err = t.mock.Listen("127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	t.Daemon = t.mock.URL()
+	t.client, err = t.mock.Client()
+	return err
+}
+
+func (t *Test) stopDaemon() {
+	if t.mock != nil {
+		t.mock.Close()
+	}
+}
+
+// minerDifficulty is the stratum difficulty of the miners, that of the
+// easiest share, so their solutions are mostly shares while the sharechain
+// is young
+func (t *Test) minerDifficulty() float64 {
+	return work.TargetToDifficulty(t.Network.MaxTarget) * t.Network.DumbScryptDiff
+}
+
+func (t *Test) startNode() error {
+	logFile, err := os.Create(filepath.Join(t.Dir, "node.log"))
+	if err != nil {
+		return err
+	}
+	diff := strconv.FormatFloat(t.minerDifficulty(), 'g', -1, 64)
+	args := []string{"run",
+		"-network", t.Network.Name,
+		"-networkdir", t.NetworkDir,
+		"-datadir", t.Dir,
+		"-daemon", t.Daemon,
+		"-loglevel", "info",
+		"-webport", "0",
+		"-peersfile", "",
+		"-graphfile", "",
+		"-backupinterval", "0",
+		"-vardiffmin", diff,
+	}
+	t.node = exec.Command(t.Binary, append(args, t.NodeArgs...)...)
+	t.node.Stdout = logFile
+	t.node.Stderr = logFile
+	err = t.node.Start()
+	logFile.Close()
+	if err != nil {
+		return fmt.Errorf("Could not start the node: %s", err.Error())
+	}
+	t.exited = make(chan struct{})
+	go func() {
+		t.node.Wait()
+		close(t.exited)
+	}()
+	t.logf("Started node, logging to %s", logFile.Name())
+	return nil
+}
+
+// nodeExited returns an error if the node isn't running anymore
+func (t *Test) nodeExited() error {
+	select {
+	case <-t.exited:
+		return fmt.Errorf("Node exited, see %s", filepath.Join(t.Dir, "node.log"))
+	default:
+		return nil
+	}
+}
+
+// stopNode interrupts the node and waits for it to shut down, killing it
+// if that takes too long
+func (t *Test) stopNode() {
+	t.node.Process.Signal(os.Interrupt)
+	select {
+	case <-t.exited:
+	case <-time.After(time.Second * 30):
+		t.logf("Node didn't shut down, killing it")
+		t.node.Process.Kill()
+		<-t.exited
+	}
+}
+
+// startMiners connects the miners, each mining to its own address
+func (t *Test) startMiners() error {
+	t.addresses = map[string]bool{}
+	diff := strconv.FormatFloat(t.minerDifficulty(), 'g', -1, 64)
+	for i := 0; i < t.Miners; i++ {
+		pkh := make([]byte, 20)
+		pkh[0], pkh[19] = 0xe2, byte(i+1)
+		addr, err := btcutil.NewAddressPubKeyHash(pkh, t.Network.ChainParams)
+		if err != nil {
+			return err
+		}
+		t.addresses[addr.EncodeAddress()] = true
+		m := &bench.SimulatedMiner{
+			Address:  fmt.Sprintf("127.0.0.1:%d", t.Network.StratumPort),
+			Username: addr.EncodeAddress() + "+" + diff,
+			Rate:     minerRate,
+			Network:  t.Network,
+			Stats:    &bench.Stats{},
+		}
+		t.miners = append(t.miners, m)
+		go func() {
+			// The node takes a moment to start listening
+			for atomic.LoadInt32(&t.stop) == 0 {
+				m.Run()
+				time.Sleep(time.Second)
+			}
+		}()
+	}
+	t.logf("Started %d miners", t.Miners)
+	return nil
+}
+
+// waitForShares waits until every miner has had solutions accepted
+func (t *Test) waitForShares(deadline time.Time) error {
+	for {
+		ready := 0
+		for _, m := range t.miners {
+			if atomic.LoadUint64(&m.Stats.Accepted) >= sharesBeforeBlock {
+				ready++
+			}
+		}
+		if ready == len(t.miners) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Only %d of %d miners got %d solutions accepted in time", ready, len(t.miners), sharesBeforeBlock)
+		}
+		if err := t.nodeExited(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
+// waitForBlock checks the blocks after startHeight as they come in, until
+// one pays all miners. Blocks paying anyone else fail the test.
+func (t *Test) waitForBlock(startHeight int64, deadline time.Time) error {
+	checked := startHeight
+	for {
+		info, err := t.client.GetBlockchainInfo()
+		if err != nil {
+			return err
+		}
+		for ; checked < info.Blocks; checked++ {
+			paid, err := t.checkBlock(checked + 1)
+			if err != nil {
+				return err
+			}
+			if paid == len(t.addresses) {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("No block paying all %d miners was found in time", len(t.addresses))
+		}
+		if err := t.nodeExited(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
+// checkBlock fetches the block at height and checks its coinbase outputs,
+// returning how many miners it pays
+func (t *Test) checkBlock(height int64) (int, error) {
+	hashStr, err := t.client.GetBlockHash(height)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := chainhash.NewHashFromStr(hashStr)
+	if err != nil {
+		return 0, err
+	}
+	block, err := t.client.GetRawBlock(hash)
+	if err != nil {
+		return 0, fmt.Errorf("Could not get block %s: %s", hashStr, err.Error())
+	}
+	coinbase := block.Transactions[0]
+	total := big.NewInt(0)
+	paid := map[string]int64{}
+	for _, out := range coinbase.TxOut {
+		total.Add(total, big.NewInt(out.Value))
+		if out.Value == 0 || string(out.PkScript) == string(wire.DonationScript(t.Network)) {
+			continue
+		}
+		addr, err := work.ScriptToAddress(out.PkScript, t.Network)
+		if err != nil {
+			return 0, fmt.Errorf("Block %s pays %d to unexpected script %x", hashStr, out.Value, out.PkScript)
+		}
+		paid[addr] += out.Value
+	}
+	count := 0
+	for addr, value := range paid {
+		if !t.addresses[addr] {
+			return 0, fmt.Errorf("Block %s pays %d to %s, which isn't one of the miners", hashStr, value, addr)
+		}
+		count++
+	}
+	t.logf("Block %s at height %d pays %d of %d miners, %s in total", hashStr, height, count, len(t.addresses), total)
+	for addr, value := range paid {
+		t.logf("  %s %d", addr, value)
+	}
+	return count, nil
+}
@@ -0,0 +1,195 @@
+// Package events lets parts of the node announce what happens, so external
+// integrations can follow along without polling. Publishing never blocks:
+// subscribers that don't keep up miss events.
+package events
+
+import (
+	"sync"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+type Type string
+
+const (
+	// LocalShare is a share found by one of our miners
+	LocalShare = Type("local_share")
+	// RemoteShare is a valid new share we got from a peer
+	RemoteShare = Type("remote_share")
+	// BlockFound is a block we submitted, with the daemons' verdict
+	BlockFound = Type("block_found")
+	// Fork is a share building on something other than the tip of our
+	// sharechain, starting a competing branch
+	Fork = Type("fork")
+	// PeerConnected and PeerDisconnected track the p2pool peers we are
+	// connected to
+	PeerConnected    = Type("peer_connected")
+	PeerDisconnected = Type("peer_disconnected")
+	// DifficultyChanged is a vardiff adjustment for a miner
+	DifficultyChanged = Type("difficulty_changed")
+	// DaemonUnavailable is sent when we stop handing out work because no
+	// daemon is usable, DaemonAvailable when we resume
+	DaemonUnavailable = Type("daemon_unavailable")
+	DaemonAvailable   = Type("daemon_available")
+	// ShareChainSynced is sent when we have a recent sharechain to mine on
+	// and leave solo mining
+	ShareChainSynced = Type("sharechain_synced")
+	// ShareRejected is a share from a peer we refused
+	ShareRejected = Type("share_rejected")
+	// Reorg is the tip of our sharechain moving to a heavier branch, leaving
+	// shares that were on it behind
+	Reorg = Type("reorg")
+)
+
+type Event struct {
+	Type Type  `json:"type"`
+	Time int64 `json:"time"`
+	// Network is the name of the p2pool network the event happened on,
+	// empty for events that aren't about one
+	Network string      `json:"network,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+// Subscription receives published events on Events until it is closed
+type Subscription struct {
+	Events chan Event
+	// Dropped counts the events that were missed because Events was full
+	Dropped uint64
+
+	types   map[Type]bool
+	network string
+}
+
+var (
+	subscriptions     = map[*Subscription]struct{}{}
+	subscriptionsLock sync.Mutex
+)
+
+// Subscribe returns a subscription to the given event types, or to all of
+// them if none are given. Events are buffered up to buffer.
+func Subscribe(buffer int, types ...Type) *Subscription {
+	return SubscribeNetwork("", buffer, types...)
+}
+
+// SubscribeNetwork is Subscribe for the events of one network, for the
+// parts of a node that only care about their own. Events that aren't about
+// a network are received too, and all networks' events if network is empty.
+func SubscribeNetwork(network string, buffer int, types ...Type) *Subscription {
+	s := &Subscription{Events: make(chan Event, buffer), network: network}
+	if len(types) > 0 {
+		s.types = map[Type]bool{}
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	subscriptionsLock.Lock()
+	subscriptions[s] = struct{}{}
+	subscriptionsLock.Unlock()
+	return s
+}
+
+// Close stops the subscription and closes its channel
+func (s *Subscription) Close() {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	if _, ok := subscriptions[s]; ok {
+		delete(subscriptions, s)
+		close(s.Events)
+	}
+}
+
+// Publish hands an event to all subscribers interested in its type
+func Publish(t Type, data interface{}) {
+	PublishOn("", t, data)
+}
+
+// PublishOn publishes an event that happened on the named network, so
+// subscribers can tell the nodes apart when several networks run in one
+// process
+func PublishOn(network string, t Type, data interface{}) {
+	e := Event{Type: t, Time: clock.Now().Unix(), Network: network, Data: data}
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	for s := range subscriptions {
+		if s.types != nil && !s.types[t] {
+			continue
+		}
+		if s.network != "" && network != "" && s.network != network {
+			continue
+		}
+		select {
+		case s.Events <- e:
+		default:
+			s.Dropped++
+		}
+	}
+}
+
+// Share is the data of LocalShare and RemoteShare events
+type Share struct {
+	Hash     string `json:"hash"`
+	Previous string `json:"previous"`
+	Address  string `json:"address,omitempty"`
+	// DOA is set for local shares that were dead on arrival
+	DOA   bool `json:"doa,omitempty"`
+	Block bool `json:"block,omitempty"`
+	// Trace is the trace ID of the share in the node's logs
+	Trace string `json:"trace,omitempty"`
+}
+
+// ForkInfo is the data of Fork events. Depth is how many shares our tip is
+// ahead of the share the new branch builds on.
+type ForkInfo struct {
+	Share
+	Tip   string `json:"tip"`
+	Depth int    `json:"depth"`
+}
+
+// Block is the data of BlockFound events
+type Block struct {
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+	Hex       string `json:"hex,omitempty"`
+	// Status is accepted or rejected
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Accepted tells whether a daemon accepted the block
+func (b Block) Accepted() bool {
+	return b.Status == "accepted"
+}
+
+// Rejection is the data of ShareRejected events
+type Rejection struct {
+	Hash string `json:"hash"`
+	// Reason is the reason the rejection is counted under, see package
+	// rejects
+	Reason string `json:"reason"`
+	Trace  string `json:"trace,omitempty"`
+}
+
+// ReorgInfo is the data of Reorg events. Depth is how many shares of the old
+// branch are no longer below the tip.
+type ReorgInfo struct {
+	OldTip string `json:"old_tip"`
+	NewTip string `json:"new_tip"`
+	Depth  int    `json:"depth"`
+}
+
+// Daemon is the data of DaemonUnavailable and DaemonAvailable events
+type Daemon struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Peer is the data of PeerConnected and PeerDisconnected events
+type Peer struct {
+	Address string `json:"address"`
+	Version string `json:"version"`
+}
+
+// Difficulty is the data of DifficultyChanged events
+type Difficulty struct {
+	User       string  `json:"user"`
+	Difficulty float64 `json:"difficulty"`
+}
@@ -0,0 +1,72 @@
+package events
+
+// hookBuffer is how many events a hook may fall behind
+const hookBuffer = 256
+
+// hook calls f with the data of every event of the given types that has
+// data of type T. Hooks are typed callbacks for programs embedding the node
+// and for its own subsystems. Each is a subscription with a goroutine
+// calling it for one event after the other, so a slow hook holds up nobody
+// but itself, and like any subscriber misses events once it's hookBuffer
+// behind. Closing the returned subscription removes the hook.
+func hook[T any](f func(T), types ...Type) *Subscription {
+	sub := Subscribe(hookBuffer, types...)
+	go func() {
+		for e := range sub.Events {
+			if d, ok := e.Data.(T); ok {
+				f(d)
+			}
+		}
+	}()
+	return sub
+}
+
+// OnShareAccepted calls f for every new share added to the sharechain,
+// local and remote
+func OnShareAccepted(f func(Share)) *Subscription {
+	return hook(f, LocalShare, RemoteShare)
+}
+
+// OnShareRejected calls f for every share from a peer we refused
+func OnShareRejected(f func(Rejection)) *Subscription {
+	return hook(f, ShareRejected)
+}
+
+// OnBlockFound calls f for every block we submitted, accepted or not
+func OnBlockFound(f func(Block)) *Subscription {
+	return hook(f, BlockFound)
+}
+
+// OnReorg calls f every time the sharechain tip moves to another branch
+func OnReorg(f func(ReorgInfo)) *Subscription {
+	return hook(f, Reorg)
+}
+
+// OnFork calls f for every share starting or extending a competing branch
+func OnFork(f func(ForkInfo)) *Subscription {
+	return hook(f, Fork)
+}
+
+// OnPeerConnected calls f for every peer we connect to
+func OnPeerConnected(f func(Peer)) *Subscription {
+	return hook(f, PeerConnected)
+}
+
+// OnPeerDisconnected calls f for every peer we lose
+func OnPeerDisconnected(f func(Peer)) *Subscription {
+	return hook(f, PeerDisconnected)
+}
+
+// OnDaemon calls f with true when we stop handing out work because no
+// daemon is usable, and with false when we resume
+func OnDaemon(f func(unavailable bool, d Daemon)) *Subscription {
+	sub := Subscribe(hookBuffer, DaemonUnavailable, DaemonAvailable)
+	go func() {
+		for e := range sub.Events {
+			if d, ok := e.Data.(Daemon); ok {
+				f(e.Type == DaemonUnavailable, d)
+			}
+		}
+	}()
+	return sub
+}
@@ -0,0 +1,169 @@
+// Package exechook runs shell commands on events, for operators who have
+// scripts to hook up rather than an HTTP endpoint. A command gets the event
+// as JSON on stdin, and its type, time, network and data fields in P2POOL_*
+// environment variables, like P2POOL_EVENT=block_found and P2POOL_HASH.
+package exechook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// DefaultEvents are the events commands run on when none are configured
+var DefaultEvents = []events.Type{
+	events.BlockFound,
+	events.Reorg,
+	events.DaemonUnavailable,
+}
+
+// maxEnvValue is the longest value passed in a variable. Longer ones, like
+// the hex of a block, are only on stdin, they could exceed the limits of
+// the system.
+const maxEnvValue = 1024
+
+// maxOutput is how much of a failed command's output is logged
+const maxOutput = 1024
+
+// Command is a shell command run for events
+type Command struct {
+	Command string
+	Events  []events.Type
+	// MinReorgDepth leaves out reorgs shallower than this
+	MinReorgDepth int
+	// Timeout is how long the command may run before it's killed
+	Timeout time.Duration
+}
+
+func NewCommand(command string) *Command {
+	return &Command{
+		Command: command,
+		Events:  DefaultEvents,
+		Timeout: time.Minute,
+	}
+}
+
+func (c *Command) wants(e events.Event) bool {
+	if e.Type == events.Reorg {
+		if r, ok := e.Data.(events.ReorgInfo); ok && r.Depth < c.MinReorgDepth {
+			return false
+		}
+	}
+	for _, t := range c.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Env returns the variables a command gets for an event: P2POOL_EVENT,
+// P2POOL_TIME, P2POOL_NETWORK if the event is about one and one for every
+// field of the event's data that isn't an object, list or too long, named
+// after its JSON key
+func Env(e events.Event) ([]string, error) {
+	env := []string{
+		"P2POOL_EVENT=" + string(e.Type),
+		"P2POOL_TIME=" + strconv.FormatInt(e.Time, 10),
+	}
+	if e.Network != "" {
+		env = append(env, "P2POOL_NETWORK="+e.Network)
+	}
+	if e.Data == nil {
+		return env, nil
+	}
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	// Numbers as they were written, not as floats
+	d.UseNumber()
+	if d.Decode(&fields) != nil {
+		return env, nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var v string
+		switch t := fields[k].(type) {
+		case string:
+			v = t
+		case json.Number:
+			v = t.String()
+		case bool:
+			v = strconv.FormatBool(t)
+		default:
+			continue
+		}
+		if len(v) > maxEnvValue {
+			continue
+		}
+		env = append(env, "P2POOL_"+strings.ToUpper(k)+"="+v)
+	}
+	return env, nil
+}
+
+// Exec runs the command for an event, returning its output if it fails
+func (c *Command) Exec(e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	env, err := Env(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Killed after %s", c.Timeout)
+	}
+	if err != nil {
+		if len(out) > maxOutput {
+			out = out[:maxOutput]
+		}
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Run runs the commands for events as they are published. Every command
+// runs for one event after the other, so scripts don't have to expect to
+// run next to themselves.
+func Run(commands []*Command) {
+	for _, c := range commands {
+		go c.run()
+	}
+}
+
+func (c *Command) run() {
+	sub := events.Subscribe(64, c.Events...)
+	for e := range sub.Events {
+		if !c.wants(e) {
+			continue
+		}
+		err := c.Exec(e)
+		if err != nil {
+			logging.Warnf("Command %q for %s failed: %s", c.Command, e.Type, err.Error())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package gateway runs a stratum gateway: a process that takes miner
+// connections for a node, with vardiff and the miner statistics, and gets
+// its work from the node over the control API. Solutions are
+// checked here, only those good enough for a share or a block go to the
+// node, so a farm's connections can be spread over many gateways in front
+// of one node that owns the sharechain and the daemon.
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/control"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var log = logging.For("gateway")
+
+const (
+	// requestTimeout limits how long getting a job or submitting takes
+	requestTimeout = time.Second * 10
+	// retryInterval is how long the gateway waits before reconnecting to
+	// the node
+	retryInterval = time.Second
+)
+
+// unreachable is why there is no work while the node can't be reached
+const unreachable = "the node is unreachable"
+
+// Gateway is the work source of a stratum server that forwards to a node
+type Gateway struct {
+	Node    *control.Client
+	Network p2pnet.Network
+
+	newWork      chan bool
+	lock         sync.Mutex
+	pendingClean bool
+	paused       string
+	prevBlock    *chainhash.Hash
+}
+
+func NewGateway(node *control.Client, n p2pnet.Network) *Gateway {
+	return &Gateway{
+		Node:    node,
+		Network: n,
+		newWork: make(chan bool, 1),
+		paused:  unreachable,
+	}
+}
+
+// Run follows the node's work, reconnecting when the stream fails, until
+// ctx is done
+func (g *Gateway) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := g.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		g.update(control.WorkUpdate{Clean: true, Paused: unreachable})
+		log.Warnf("Lost the node %s: %s", g.Node.Address, err.Error())
+		clock.SleepContext(ctx, retryInterval)
+	}
+}
+
+func (g *Gateway) follow(ctx context.Context) error {
+	updates, done, err := g.Node.WorkUpdates(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Getting work from node %s", g.Node.Address)
+	for u := range updates {
+		g.update(u)
+	}
+	return <-done
+}
+
+// update applies a work update of the node and signals the stratum server
+func (g *Gateway) update(u control.WorkUpdate) {
+	g.lock.Lock()
+	if u.Paused != g.paused {
+		if u.Paused != "" {
+			log.Warnf("Not handing out work: %s", u.Paused)
+		} else {
+			log.Infof("Node has work again")
+		}
+	}
+	g.paused = u.Paused
+	g.prevBlock, _ = chainhash.NewHash(u.PreviousBlock)
+	g.pendingClean = g.pendingClean || u.Clean
+	g.lock.Unlock()
+	select {
+	case g.newWork <- true:
+	default:
+	}
+}
+
+func (g *Gateway) GetJob(pubKeyHash []byte, pubKeyHashVersion uint8) (*work.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return g.Node.Job(ctx, pubKeyHash, pubKeyHashVersion)
+}
+
+// Submit checks a solution, and hands it to the node if it is a share or a
+// block
+func (g *Gateway) Submit(j *work.Job, extranonce uint64, timestamp uint32, nonce uint32) (*work.SubmitResult, error) {
+	powHash, err := j.POWHash(g.Network, extranonce, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	bnHash := blockchain.HashToBig(powHash)
+	if bnHash.Cmp(j.BlockTarget) > 0 && (j.Solo || bnHash.Cmp(j.ShareTarget) > 0) {
+		return &work.SubmitResult{POWHash: powHash}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	res, err := g.Node.Submit(ctx, j.ID, extranonce, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if res.IsBlock {
+		log.Infof("Forwarded block solution %s", powHash.String())
+	}
+	return &work.SubmitResult{POWHash: powHash, IsShare: res.IsShare, IsBlock: res.IsBlock, DOA: res.DOA}, nil
+}
+
+// IsStale tells whether a job is on a block the node moved away from
+func (g *Gateway) IsStale(j *work.Job) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.prevBlock != nil && !g.prevBlock.IsEqual(j.Template.PreviousBlock)
+}
+
+func (g *Gateway) Paused() (bool, string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused != "", g.paused
+}
+
+func (g *Gateway) NewWork() <-chan bool {
+	return g.newWork
+}
+
+func (g *Gateway) TakeClean() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	clean := g.pendingClean
+	g.pendingClean = false
+	return clean
+}
@@ -0,0 +1,302 @@
+// Package graph keeps time series of node statistics at several
+// resolutions, in the style of the Python p2pool's graph data. Every series
+// is a set of fixed size ring buffers, one per view, so memory and disk use
+// don't grow over time.
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// View is a window of history, split into Bins bins of equal width
+type View struct {
+	Name string
+	Bins int
+	Span time.Duration
+}
+
+func (v View) binWidth() int64 {
+	return int64(v.Span/time.Second) / int64(v.Bins)
+}
+
+// Views are the resolutions every series is kept at. The names match what
+// the classic p2pool frontend asks for.
+var Views = []View{
+	{Name: "last_10min", Bins: 60, Span: time.Minute * 10},
+	{Name: "last_hour", Bins: 150, Span: time.Hour},
+	{Name: "last_day", Bins: 300, Span: time.Hour * 24},
+	{Name: "last_week", Bins: 300, Span: time.Hour * 24 * 7},
+	{Name: "last_month", Bins: 300, Span: time.Hour * 24 * 30},
+	{Name: "last_year", Bins: 300, Span: time.Hour * 24 * 365},
+}
+
+func getView(name string) (View, bool) {
+	for _, v := range Views {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return View{}, false
+}
+
+// ring holds the average of the values added within each bin of a view
+type ring struct {
+	// Index is the bin number (unix time / bin width) each slot holds
+	Index  []int64   `json:"index"`
+	Sums   []float64 `json:"sums"`
+	Counts []uint32  `json:"counts"`
+}
+
+func newRing(bins int) *ring {
+	return &ring{Index: make([]int64, bins), Sums: make([]float64, bins), Counts: make([]uint32, bins)}
+}
+
+func (r *ring) add(idx int64, v float64) {
+	slot := int(idx % int64(len(r.Index)))
+	if r.Index[slot] != idx {
+		r.Index[slot] = idx
+		r.Sums[slot] = 0
+		r.Counts[slot] = 0
+	}
+	r.Sums[slot] += v
+	r.Counts[slot]++
+}
+
+func (r *ring) get(idx int64) (float64, bool) {
+	slot := int(idx % int64(len(r.Index)))
+	if r.Index[slot] != idx || r.Counts[slot] == 0 {
+		return 0, false
+	}
+	return r.Sums[slot] / float64(r.Counts[slot]), true
+}
+
+// latest returns the newest bin number with data
+func (r *ring) latest() int64 {
+	l := int64(0)
+	for i, idx := range r.Index {
+		if r.Counts[i] > 0 && idx > l {
+			l = idx
+		}
+	}
+	return l
+}
+
+type series struct {
+	Rings map[string]*ring `json:"rings"`
+}
+
+func newSeries(views []View) *series {
+	s := &series{Rings: map[string]*ring{}}
+	for _, v := range views {
+		s.Rings[v.Name] = newRing(v.Bins)
+	}
+	return s
+}
+
+// valid checks that a loaded series matches the views, which may have
+// changed since it was saved. Rings of views no longer kept are dropped.
+func (s *series) valid(views []View) bool {
+	kept := map[string]bool{}
+	for _, v := range views {
+		kept[v.Name] = true
+		r, ok := s.Rings[v.Name]
+		if !ok || len(r.Index) != v.Bins || len(r.Sums) != v.Bins || len(r.Counts) != v.Bins {
+			return false
+		}
+	}
+	for name := range s.Rings {
+		if !kept[name] {
+			delete(s.Rings, name)
+		}
+	}
+	return true
+}
+
+// multiSep separates a multi valued source from its key in series names
+const multiSep = "\x00"
+
+// DB holds all series and saves them to a file, so history survives
+// restarts
+type DB struct {
+	Path string
+	// Retention drops the views spanning more than it, to save memory and
+	// disk. All views are kept if 0.
+	Retention time.Duration
+
+	series map[string]*series
+	lock   sync.Mutex
+}
+
+func NewDB(path string) *DB {
+	return &DB{Path: path, series: map[string]*series{}}
+}
+
+// Load reads the series saved before. A missing file is not an error.
+func (db *DB) Load() error {
+	b, err := os.ReadFile(db.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded := map[string]*series{}
+	err = json.Unmarshal(b, &loaded)
+	if err != nil {
+		return fmt.Errorf("Could not read graph data from %s: %s", db.Path, err.Error())
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for name, s := range loaded {
+		if s.valid(db.views()) {
+			db.series[name] = s
+		}
+	}
+	return nil
+}
+
+// Save writes all series to the file, replacing it only once the new data
+// is completely written
+func (db *DB) Save() error {
+	db.lock.Lock()
+	b, err := json.Marshal(db.series)
+	db.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := db.Path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.Path)
+}
+
+// views returns the views kept under Retention. The shortest is always kept.
+func (db *DB) views() []View {
+	views := make([]View, 0, len(Views))
+	for i, v := range Views {
+		if i == 0 || db.Retention == 0 || v.Span <= db.Retention {
+			views = append(views, v)
+		}
+	}
+	return views
+}
+
+func (db *DB) add(name string, t time.Time, v float64) {
+	views := db.views()
+	s, ok := db.series[name]
+	if !ok {
+		s = newSeries(views)
+		db.series[name] = s
+	}
+	for _, view := range views {
+		s.Rings[view.Name].add(t.Unix()/view.binWidth(), v)
+	}
+}
+
+// Add records a sample of a single valued source
+func (db *DB) Add(source string, t time.Time, v float64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.add(source, t, v)
+}
+
+// AddMulti records a sample of a source with a value per key, like the
+// hashrate of every miner
+func (db *DB) AddMulti(source string, t time.Time, values map[string]float64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for k, v := range values {
+		db.add(source+multiSep+k, t, v)
+	}
+}
+
+// Prune drops the keys of multi valued sources that have had no data in
+// the longest view, like miners that left long ago
+func (db *DB) Prune(now time.Time) {
+	views := db.views()
+	longest := views[len(views)-1]
+	oldest := (now.Unix() - int64(longest.Span/time.Second)) / longest.binWidth()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for name, s := range db.series {
+		if strings.Contains(name, multiSep) && s.Rings[longest.Name].latest() < oldest {
+			delete(db.series, name)
+		}
+	}
+}
+
+// Sources returns the names of all sources with data
+func (db *DB) Sources() []string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	seen := map[string]bool{}
+	sources := make([]string, 0)
+	for name := range db.series {
+		source := strings.SplitN(name, multiSep, 2)[0]
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Data returns the bins of a source in a view, oldest first, as pairs of
+// the bin's start time and its value. The value is nil for bins without
+// data, and a map of key to value for multi valued sources.
+func (db *DB) Data(source string, viewName string, now time.Time) ([][2]interface{}, error) {
+	view, ok := getView(viewName)
+	if !ok {
+		return nil, fmt.Errorf("Unknown view %s", viewName)
+	}
+	if db.Retention != 0 && view.Span > db.Retention && view.Name != Views[0].Name {
+		return nil, fmt.Errorf("View %s is not kept on this node", viewName)
+	}
+	width := view.binWidth()
+	last := now.Unix() / width
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	single, isSingle := db.series[source]
+	multi := map[string]*series{}
+	prefix := source + multiSep
+	for name, s := range db.series {
+		if strings.HasPrefix(name, prefix) {
+			multi[strings.TrimPrefix(name, prefix)] = s
+		}
+	}
+	if !isSingle && len(multi) == 0 {
+		return nil, fmt.Errorf("Unknown source %s", source)
+	}
+
+	data := make([][2]interface{}, 0, view.Bins)
+	for idx := last - int64(view.Bins) + 1; idx <= last; idx++ {
+		var value interface{}
+		if isSingle {
+			if v, ok := single.Rings[view.Name].get(idx); ok {
+				value = v
+			}
+		} else {
+			values := map[string]float64{}
+			for k, s := range multi {
+				if v, ok := s.Rings[view.Name].get(idx); ok {
+					values[k] = v
+				}
+			}
+			if len(values) > 0 {
+				value = values
+			}
+		}
+		data = append(data, [2]interface{}{idx * width, value})
+	}
+	return data, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/gertjaap/p2pool-go/config"
+	"github.com/gertjaap/p2pool-go/datadir"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/p2pool"
+)
+
+// processSettings are the settings of the run command that are about the
+// process rather than one of its networks. Only the main configuration sets
+// them.
+var processSettings = []string{
+	"loglevel", "logformat", "logfile", "logmaxsize", "logmaxage", "logkeep", "logretention", "logcompress",
+	"sha256", "verthashfile", "verthashverify", "shutdowntimeout",
+	"influxurl", "influxtoken", "statsd", "statsdprefix", "metricsinterval",
+	"webhook", "webhooksecret", "webhookevents", "webhookforkdepth", "webhooktemplate",
+	"exec", "execevents", "execreorgdepth", "exectimeout",
+	"benchmark", "benchminers", "benchrate",
+	"exportshares", "exportfrom", "exportto", "exportblocks", "exportpayouts", "exportaddress",
+	"instance",
+}
+
+// instance is one of the p2pool networks the run command runs, with its
+// own settings, data directory and node
+type instance struct {
+	// path is the configuration file given by -instance, empty for the
+	// main configuration
+	path    string
+	fs      *flag.FlagSet
+	f       *nodeFlags
+	sources map[string]string
+
+	network p2pnet.Network
+	dd      *datadir.DataDir
+	node    *p2pool.Node
+}
+
+func (in *instance) String() string {
+	if in.path == "" {
+		return "the main configuration"
+	}
+	return in.path
+}
+
+// loadInstances reads and checks the configuration files given by -instance
+// of the main configuration. Their settings only come from the file, the
+// environment is for the main configuration.
+func loadInstances(primary *instance, probe bool) ([]*instance, []config.Problem, error) {
+	instances := make([]*instance, 0, len(primary.f.instances))
+	problems := make([]config.Problem, 0)
+	for _, path := range primary.f.instances {
+		fs := flag.NewFlagSet("instance", flag.ContinueOnError)
+		in := &instance{path: path, fs: fs, f: newNodeFlags(fs)}
+		fs.Parse(nil)
+		sources, p, err := config.CheckFile(fs, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		in.sources = sources
+		problems = append(problems, p...)
+		for _, name := range processSettings {
+			if sources[name] != config.SourceDefault {
+				problems = append(problems, config.Problem{Setting: name, Source: sources[name], Message: "Only the main configuration can set this"})
+			}
+		}
+		// The verthash data is loaded once, from the main configuration's
+		// file
+		fs.Set("verthashfile", *primary.f.verthashFile)
+		problems = append(problems, checkNodeConfig(fs, in.f, sources, probe)...)
+		instances = append(instances, in)
+	}
+	problems = append(problems, checkInstances(append([]*instance{primary}, instances...))...)
+	return instances, problems, nil
+}
+
+// checkInstances makes sure no two instances share a data directory or a
+// port
+func checkInstances(instances []*instance) []config.Problem {
+	problems := make([]config.Problem, 0)
+	dirs := map[string]*instance{}
+	ports := map[int]*instance{}
+	for _, in := range instances {
+		dir, err := filepath.Abs(in.fs.Lookup("datadir").Value.String())
+		if err == nil {
+			if other, ok := dirs[dir]; ok {
+				problems = append(problems, config.Problem{Setting: "datadir", Source: in.sources["datadir"], Message: fmt.Sprintf("Data directory is also used by %s", other)})
+			}
+			dirs[dir] = in
+		}
+		n, err := p2pnet.Get(in.fs.Lookup("network").Value.String())
+		if err != nil {
+			// Reported by checkNodeConfig
+			continue
+		}
+		for _, p := range listenPorts(in.f, n) {
+			if p.port <= 0 {
+				continue
+			}
+			if other, ok := ports[p.port]; ok && other != in {
+				problems = append(problems, config.Problem{Setting: p.setting, Source: in.sources[p.setting], Message: fmt.Sprintf("Port %d is also used by %s", p.port, other)})
+				continue
+			}
+			ports[p.port] = in
+		}
+	}
+	return problems
+}
+
+// open loads the network of the instance and opens its data directory
+func (in *instance) open() error {
+	var err error
+	in.network, err = in.f.network()
+	if err != nil {
+		return err
+	}
+	if *in.f.lowResource {
+		applyPreset(in.fs, in.sources, lowResourceSettings(in.network))
+	}
+	in.dd, err = in.f.openDataDir()
+	return err
+}
+
+// build creates the node of the instance, tagging its logs with name
+func (in *instance) build(name string) error {
+	cfg, err := nodeConfig(in.f, in.dd, in.network)
+	if err != nil {
+		return err
+	}
+	cfg.Name = name
+	in.node, err = p2pool.New(cfg)
+	return err
+}
+
+// reload reads the configuration of the instance again and applies the
+// settings that can change while running
+func (in *instance) reload() error {
+	var err error
+	if in.path == "" {
+		err = config.Reload(in.fs, *in.f.configFile)
+	} else {
+		err = config.ReloadFile(in.fs, in.path)
+	}
+	if err != nil {
+		return err
+	}
+	settings, err := nodeSettings(in.f)
+	if err != nil {
+		return err
+	}
+	return in.node.Apply(settings)
+}
+
+// instanceNames names the nodes after their networks when there is more than
+// one, numbering the ones on the same network
+func instanceNames(instances []*instance) []string {
+	names := make([]string, len(instances))
+	if len(instances) < 2 {
+		return names
+	}
+	count := map[string]int{}
+	for i, in := range instances {
+		count[in.network.Name]++
+		names[i] = in.network.Name
+		if c := count[in.network.Name]; c > 1 {
+			names[i] = fmt.Sprintf("%s-%d", in.network.Name, c)
+		}
+	}
+	return names
+}
@@ -12,12 +12,18 @@ package logging
 // Warn  -> You should probably take a look at this
 // Error -> Something failed but I'm not quitting
 // Fatal -> Bye
+//
+// The package level functions log without a subsystem, packages that belong
+// to one log through the SubsystemLogger returned by For, so its level can
+// be set on its own. Applications embedding the node can take over the
+// output of any of them with SetLogger and SetSubsystemLogger.
 
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 )
 
 type LogLevel int
@@ -29,110 +35,116 @@ const (
 	LogLevelDebug   LogLevel = 3
 )
 
-var logLevel = LogLevelError // the default
+var defaultLogger = &SubsystemLogger{}
 
 func SetLogLevel(newLevel int) {
-	logLevel = LogLevel(newLevel)
+	setLevel(LogLevel(newLevel))
+}
+
+// ParseLogLevel returns the level for a name: error, warn, info or debug
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "error":
+		return LogLevelError, nil
+	case "warn", "warning":
+		return LogLevelWarning, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	}
+	return 0, fmt.Errorf("Unknown log level %s", name)
+}
+
+// String returns the name of the level, as accepted by ParseLogLevel
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelError:
+		return "error"
+	case LogLevelWarning:
+		return "warn"
+	case LogLevelInfo:
+		return "info"
+	}
+	return "debug"
 }
 
-func SetLogFile(logFile io.Writer) {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	logOutput := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(logOutput)
+func (l LogLevel) slogLevel() slog.Level {
+	switch l {
+	case LogLevelError:
+		return slog.LevelError
+	case LogLevelWarning:
+		return slog.LevelWarn
+	case LogLevelInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
 }
 
-func getPrefix(level string) string {
-	return fmt.Sprintf("[%s]", level)
+func SetLogFile(logFile io.Writer) {
+	setOutput(io.MultiWriter(os.Stdout, logFile))
 }
 
 func Fatalln(args ...interface{}) {
-	log.Fatalln(args...)
+	defaultLogger.fatal(sprintln(args...))
 }
 
 func Fatalf(format string, args ...interface{}) {
-	log.Fatalf(format, args...)
+	defaultLogger.fatal(fmt.Sprintf(format, args...))
 }
 
 func Fatal(args ...interface{}) {
-	log.Fatal(args...)
+	defaultLogger.fatal(fmt.Sprint(args...))
 }
 
 func Debugf(format string, args ...interface{}) {
-	if logLevel >= LogLevelDebug {
-		log.Printf(fmt.Sprintf("%s %s", getPrefix("DEBUG"), format), args...)
-	}
+	defaultLogger.Debugf(format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	if logLevel >= LogLevelInfo {
-		log.Printf(fmt.Sprintf("%s %s", getPrefix("INFO"), format), args...)
-	}
+	defaultLogger.Infof(format, args...)
 }
 
 func Warnf(format string, args ...interface{}) {
-	if logLevel >= LogLevelWarning {
-		log.Printf(fmt.Sprintf("%s %s", getPrefix("WARN"), format), args...)
-	}
+	defaultLogger.Warnf(format, args...)
 }
 
 func Errorf(format string, args ...interface{}) {
-	if logLevel >= LogLevelError {
-		log.Printf(fmt.Sprintf("%s %s", getPrefix("ERROR"), format), args...)
-	}
+	defaultLogger.Errorf(format, args...)
 }
 
 func Debugln(args ...interface{}) {
-	if logLevel >= LogLevelDebug {
-		args = append([]interface{}{getPrefix("DEBUG")}, args...)
-		log.Println(args...)
-	}
+	defaultLogger.log(LogLevelDebug, sprintln(args...))
 }
 
 func Infoln(args ...interface{}) {
-	if logLevel >= LogLevelInfo {
-		args = append([]interface{}{getPrefix("INFO")}, args...)
-		log.Println(args...)
-	}
+	defaultLogger.log(LogLevelInfo, sprintln(args...))
 }
 
 func Warnln(args ...interface{}) {
-	if logLevel >= LogLevelWarning {
-		args = append([]interface{}{getPrefix("WARN")}, args...)
-		log.Println(args...)
-	}
+	defaultLogger.log(LogLevelWarning, sprintln(args...))
 }
 
 func Errorln(args ...interface{}) {
-	if logLevel >= LogLevelError {
-		args = append([]interface{}{getPrefix("ERROR")}, args...)
-		log.Println(args...)
-	}
+	defaultLogger.log(LogLevelError, sprintln(args...))
 }
 
 func Debug(args ...interface{}) {
-	if logLevel >= LogLevelDebug {
-		args = append([]interface{}{getPrefix("DEBUG")}, args...)
-		log.Print(args...)
-	}
+	defaultLogger.log(LogLevelDebug, fmt.Sprint(args...))
 }
 
 func Info(args ...interface{}) {
-	if logLevel >= LogLevelInfo {
-		args = append([]interface{}{getPrefix("INFO")}, args...)
-		log.Print(args...)
-	}
+	defaultLogger.log(LogLevelInfo, fmt.Sprint(args...))
 }
 
 func Warn(args ...interface{}) {
-	if logLevel >= LogLevelWarning {
-		args = append([]interface{}{getPrefix("WARN")}, args...)
-		log.Print(args...)
-	}
+	defaultLogger.log(LogLevelWarning, fmt.Sprint(args...))
 }
 
 func Error(args ...interface{}) {
-	if logLevel >= LogLevelError {
-		args = append([]interface{}{getPrefix("ERROR")}, args...)
-		log.Print(args...)
-	}
+	defaultLogger.log(LogLevelError, fmt.Sprint(args...))
+}
+
+func sprintln(args ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
 }
@@ -0,0 +1,190 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file that moves itself aside when it gets too big or
+// too old, for systems without logrotate. Old files are named after the time
+// they were rotated, like p2pool-20060102T150405Z.log, optionally gzipped.
+type RotatingFile struct {
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated, 0 for no
+	// limit
+	MaxSize int64
+	// MaxAge is how long a file is written before it's rotated, 0 for no
+	// limit
+	MaxAge time.Duration
+	// Keep is the number of old files to keep, 0 keeps all
+	Keep int
+	// Retention is how long old files are kept, 0 keeps them forever
+	Retention time.Duration
+	// Compress gzips old files
+	Compress bool
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open opens the file for appending, rotating it first if it's already too
+// old or too big
+func (f *RotatingFile) Open() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	if f.due() {
+		return f.rotate()
+	}
+	return nil
+}
+
+func (f *RotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(f.Path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, fi.Size(), time.Now()
+	if fi.Size() > 0 {
+		// Continuing a file, it's as old as its last write at least
+		f.opened = fi.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) due() bool {
+	return (f.MaxSize > 0 && f.size >= f.MaxSize) || (f.MaxAge > 0 && f.size > 0 && time.Since(f.opened) >= f.MaxAge)
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if f.due() {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// rotate moves the current file aside and starts a new one. The file is
+// closed first, Windows can't rename open files.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	f.file = nil
+	ext := filepath.Ext(f.Path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.Path, ext), time.Now().UTC().Format("20060102T150405Z"), ext)
+	err = os.Rename(f.Path, rotated)
+	if err != nil {
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if f.Compress {
+			err := compressFile(rotated)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not compress log file %s: %s\n", rotated, err.Error())
+			}
+		}
+		f.removeOld()
+	}()
+	return nil
+}
+
+// removeOld deletes the old files beyond Keep or Retention
+func (f *RotatingFile) removeOld() {
+	ext := filepath.Ext(f.Path)
+	matches, err := filepath.Glob(strings.TrimSuffix(f.Path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// Names sort by rotation time, newest last
+	sort.Strings(matches)
+	for i, path := range matches {
+		old := f.Keep > 0 && i < len(matches)-f.Keep
+		if !old && f.Retention > 0 {
+			if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > f.Retention {
+				old = true
+			}
+		}
+		if old {
+			os.Remove(path)
+		}
+	}
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,404 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subsystems are the parts of the node whose level can be set on their own
+var Subsystems = []string{"wire", "p2p", "chain", "stratum", "rpc", "web"}
+
+var (
+	lock            sync.RWMutex
+	level                        = LogLevelError // the default
+	subsystemLevels              = map[string]LogLevel{}
+	output          io.Writer    = os.Stderr
+	format                       = "console"
+	handler         slog.Handler = newConsoleHandler(os.Stderr)
+	// Loggers records are routed to instead of the handler
+	allLogger        Logger
+	subsystemLoggers = map[string]Logger{}
+)
+
+// SetLogger routes the records of all subsystems to l, after filtering
+// them by level. nil returns to the built in output.
+func SetLogger(l Logger) {
+	lock.Lock()
+	allLogger = l
+	lock.Unlock()
+}
+
+// SetSubsystemLogger routes the records of one subsystem, or those without
+// one for "default", to l, taking precedence over SetLogger. nil removes
+// the route.
+func SetSubsystemLogger(subsystem string, l Logger) error {
+	if subsystem == "default" {
+		subsystem = ""
+	} else if !isSubsystem(subsystem) {
+		return fmt.Errorf("Unknown subsystem %s, known are %s", subsystem, strings.Join(Subsystems, ", "))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if l == nil {
+		delete(subsystemLoggers, subsystem)
+	} else {
+		subsystemLoggers[subsystem] = l
+	}
+	return nil
+}
+
+// Logger is the minimal interface of a logger. Applications embedding the
+// node can route its logs into their own logging with SetLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Discard is a Logger that drops everything, to silence a subsystem
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debugf(format string, args ...interface{}) {}
+func (discard) Infof(format string, args ...interface{})  {}
+func (discard) Warnf(format string, args ...interface{})  {}
+func (discard) Errorf(format string, args ...interface{}) {}
+
+// SubsystemLogger logs for a subsystem, with attributes added to every
+// record. It implements Logger.
+type SubsystemLogger struct {
+	subsystem string
+	attrs     []interface{}
+	// handler, if set, gets the records in stead of the output of this
+	// package, and filters them by its own level
+	handler slog.Handler
+}
+
+// For returns the logger of a subsystem
+func For(subsystem string) *SubsystemLogger {
+	return &SubsystemLogger{subsystem: subsystem}
+}
+
+// With returns a logger that adds the given key value pairs to its records
+func (l *SubsystemLogger) With(args ...interface{}) *SubsystemLogger {
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	return &SubsystemLogger{subsystem: l.subsystem, attrs: append(append(attrs, l.attrs...), args...), handler: l.handler}
+}
+
+// WithHandler returns a logger whose records go to h, like those of one node
+// among several in a process, rather than to the output and loggers set in
+// this package. h decides which levels it takes. A nil h returns l.
+func (l *SubsystemLogger) WithHandler(h slog.Handler) *SubsystemLogger {
+	if h == nil {
+		return l
+	}
+	return &SubsystemLogger{subsystem: l.subsystem, attrs: l.attrs, handler: h}
+}
+
+// For returns the logger of another subsystem, with the attributes and
+// handler of l
+func (l *SubsystemLogger) For(subsystem string) *SubsystemLogger {
+	return &SubsystemLogger{subsystem: subsystem, attrs: l.attrs, handler: l.handler}
+}
+
+// Or returns l, or fallback if l is nil. Types that can log to a logger of
+// their own use it with their package's logger.
+func (l *SubsystemLogger) Or(fallback *SubsystemLogger) *SubsystemLogger {
+	if l == nil {
+		return fallback
+	}
+	return l
+}
+
+// Enabled returns whether messages of the level are logged
+func (l *SubsystemLogger) Enabled(messageLevel LogLevel) bool {
+	if l.handler != nil {
+		return l.handler.Enabled(context.Background(), messageLevel.slogLevel())
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	max, ok := subsystemLevels[l.subsystem]
+	if !ok {
+		max = level
+	}
+	return messageLevel <= max
+}
+
+// NewTraceID returns a random ID to tag the log records about one message or
+// share with, so they can be found across goroutines
+func NewTraceID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Trace returns a logger that tags its records with a trace ID, or l itself
+// for an empty ID
+func (l *SubsystemLogger) Trace(id string) *SubsystemLogger {
+	if id == "" {
+		return l
+	}
+	return l.With("trace", id)
+}
+
+func (l *SubsystemLogger) Debugf(format string, args ...interface{}) {
+	if l.Enabled(LogLevelDebug) {
+		l.log(LogLevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *SubsystemLogger) Infof(format string, args ...interface{}) {
+	if l.Enabled(LogLevelInfo) {
+		l.log(LogLevelInfo, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *SubsystemLogger) Warnf(format string, args ...interface{}) {
+	if l.Enabled(LogLevelWarning) {
+		l.log(LogLevelWarning, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *SubsystemLogger) Errorf(format string, args ...interface{}) {
+	l.log(LogLevelError, fmt.Sprintf(format, args...))
+}
+
+func (l *SubsystemLogger) log(messageLevel LogLevel, msg string) {
+	if !l.Enabled(messageLevel) {
+		return
+	}
+	h := l.handler
+	if h == nil {
+		lock.RLock()
+		h = handler
+		routed, ok := subsystemLoggers[l.subsystem]
+		if !ok {
+			routed = allLogger
+		}
+		lock.RUnlock()
+		if routed != nil {
+			l.route(routed, messageLevel, msg)
+			return
+		}
+	}
+	r := slog.NewRecord(time.Now(), messageLevel.slogLevel(), msg, 0)
+	if l.subsystem != "" {
+		r.AddAttrs(slog.String("subsystem", l.subsystem))
+	}
+	r.Add(l.attrs...)
+	h.Handle(context.Background(), r)
+}
+
+// route passes a record to a Logger of the application, with the attributes
+// after the message
+func (l *SubsystemLogger) route(to Logger, messageLevel LogLevel, msg string) {
+	var b strings.Builder
+	b.WriteString(msg)
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(l.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	switch messageLevel {
+	case LogLevelDebug:
+		to.Debugf("%s", b.String())
+	case LogLevelInfo:
+		to.Infof("%s", b.String())
+	case LogLevelWarning:
+		to.Warnf("%s", b.String())
+	default:
+		to.Errorf("%s", b.String())
+	}
+}
+
+func (l *SubsystemLogger) fatal(msg string) {
+	l.log(LogLevelError, msg)
+	os.Exit(1)
+}
+
+func setLevel(newLevel LogLevel) {
+	lock.Lock()
+	level = newLevel
+	lock.Unlock()
+}
+
+// SetLevels sets the default level and replaces the levels of subsystems
+func SetLevels(newLevel LogLevel, subsystems map[string]LogLevel) {
+	lock.Lock()
+	defer lock.Unlock()
+	level = newLevel
+	subsystemLevels = make(map[string]LogLevel, len(subsystems))
+	for s, l := range subsystems {
+		subsystemLevels[s] = l
+	}
+}
+
+// SetSubsystemLevel sets the level of one subsystem, or of the default
+// for "default"
+func SetSubsystemLevel(subsystem string, newLevel LogLevel) error {
+	if subsystem == "default" {
+		setLevel(newLevel)
+		return nil
+	}
+	if !isSubsystem(subsystem) {
+		return fmt.Errorf("Unknown subsystem %s, known are %s", subsystem, strings.Join(Subsystems, ", "))
+	}
+	lock.Lock()
+	subsystemLevels[subsystem] = newLevel
+	lock.Unlock()
+	return nil
+}
+
+// Levels returns the level of every subsystem, and the default
+func Levels() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+	levels := map[string]string{"default": level.String()}
+	for _, s := range Subsystems {
+		l, ok := subsystemLevels[s]
+		if !ok {
+			l = level
+		}
+		levels[s] = l.String()
+	}
+	return levels
+}
+
+// ParseLevels parses a level specification like "info,p2p=debug,rpc=warn"
+// into the default level and those of subsystems
+func ParseLevels(spec string) (LogLevel, map[string]LogLevel, error) {
+	defaultLevel := LogLevelDebug
+	subsystems := map[string]LogLevel{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, ok := strings.Cut(part, "=")
+		if !ok {
+			l, err := ParseLogLevel(part)
+			if err != nil {
+				return 0, nil, err
+			}
+			defaultLevel = l
+			continue
+		}
+		if !isSubsystem(subsystem) {
+			return 0, nil, fmt.Errorf("Unknown subsystem %s, known are %s", subsystem, strings.Join(Subsystems, ", "))
+		}
+		l, err := ParseLogLevel(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		subsystems[subsystem] = l
+	}
+	return defaultLevel, subsystems, nil
+}
+
+func isSubsystem(name string) bool {
+	for _, s := range Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFormat selects the output format: console, for people, or json, one
+// object per line for log collectors
+func SetFormat(name string) error {
+	if name != "console" && name != "json" {
+		return fmt.Errorf("Unknown log format %s, use console or json", name)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	format = name
+	handler = newHandler(format, output)
+	return nil
+}
+
+func setOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	output = w
+	handler = newHandler(format, output)
+}
+
+func newHandler(format string, w io.Writer) slog.Handler {
+	if format == "json" {
+		// Levels are filtered before records get here
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+	}
+	return newConsoleHandler(w)
+}
+
+// consoleHandler writes records as a line with the time, the level and the
+// subsystem in front of the message, followed by the other attributes
+type consoleHandler struct {
+	lock  *sync.Mutex
+	w     io.Writer
+	attrs []slog.Attr
+}
+
+func newConsoleHandler(w io.Writer) *consoleHandler {
+	return &consoleHandler{lock: &sync.Mutex{}, w: w}
+}
+
+func (h *consoleHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05.000000"))
+	fmt.Fprintf(&b, " [%s]", r.Level.String())
+
+	subsystem := ""
+	rest := make([]slog.Attr, 0, len(h.attrs)+r.NumAttrs())
+	collect := func(a slog.Attr) bool {
+		if a.Key == "subsystem" {
+			subsystem = a.Value.String()
+		} else {
+			rest = append(rest, a)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+
+	if subsystem != "" {
+		fmt.Fprintf(&b, " [%s]", subsystem)
+	}
+	b.WriteString(" ")
+	b.WriteString(r.Message)
+	for _, a := range rest {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	b.WriteString("\n")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &consoleHandler{lock: h.lock, w: h.w, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	return h
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxExporter writes metrics to InfluxDB's HTTP API in line protocol, as
+// fields of a single measurement
+type InfluxExporter struct {
+	// URL is the full write URL, like http://host:8086/write?db=p2pool for
+	// InfluxDB 1.x or http://host:8086/api/v2/write?org=o&bucket=b for 2.x
+	URL string
+	// Token is sent for InfluxDB 2.x authentication, if set
+	Token       string
+	Measurement string
+	// Tags are added to every point, like the node's name
+	Tags map[string]string
+
+	client *http.Client
+}
+
+func NewInfluxExporter(url, token string) *InfluxExporter {
+	return &InfluxExporter{
+		URL:         url,
+		Token:       token,
+		Measurement: "p2pool",
+		Tags:        map[string]string{},
+		client:      &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// line formats the metrics as a line protocol point
+func (e *InfluxExporter) line(ms []Metric, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxEscaper.Replace(e.Measurement))
+	keys := make([]string, 0, len(e.Tags))
+	for k := range e.Tags {
+		keys = append(keys, k)
+	}
+	// InfluxDB handles tags in sorted order best
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + influxEscaper.Replace(k) + "=" + influxEscaper.Replace(e.Tags[k]))
+	}
+	for i, m := range ms {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(influxEscaper.Replace(m.Name) + "=" + strconv.FormatFloat(m.Value, 'g', -1, 64))
+	}
+	b.WriteString(" " + strconv.FormatInt(t.UnixNano(), 10) + "\n")
+	return b.String()
+}
+
+func (e *InfluxExporter) Export(ms []Metric, t time.Time) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewBufferString(e.line(ms, t)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.Token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Package metrics collects the node's operational metrics and pushes them to
+// monitoring systems that expect to be sent data, like InfluxDB and StatsD.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/rejects"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// lookbehind is how many shares pool wide rates are taken over
+const lookbehind = 720
+
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Collector gathers the metrics of the node's components. Components that
+// aren't running are left nil.
+type Collector struct {
+	WorkManager *work.WorkManager
+	Stratum     *stratum.Server
+	Peers       *p2p.PeerManager
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Collect returns the current value of every metric, sorted by name
+func (c *Collector) Collect() []Metric {
+	wm := c.WorkManager
+	ms := make([]Metric, 0, 20)
+	add := func(name string, v float64) {
+		ms = append(ms, Metric{Name: name, Value: v})
+	}
+
+	nonstale, total, staleProp := wm.ShareChain.PoolRates(lookbehind)
+	add("pool_hashrate", total)
+	add("pool_nonstale_hashrate", nonstale)
+	add("pool_stale_prop", staleProp)
+
+	counts := wm.StaleCounts()
+	add("shares_total", float64(counts.Shares))
+	add("shares_orphan", float64(counts.Orphans))
+	add("shares_dead", float64(counts.DOA))
+
+	paused, _ := wm.Paused()
+	add("paused", boolValue(paused))
+	add("solo", boolValue(wm.IsSolo()))
+	add("tx_cache_size", float64(wm.TxCache.Len()))
+	if bt := wm.CurrentTemplate(); bt != nil {
+		add("block_height", float64(bt.Height))
+		add("block_value", float64(bt.CoinbaseValue)/1e8)
+		add("block_transactions", float64(len(bt.Transactions)))
+	}
+
+	if c.Stratum != nil {
+		rates, dead := c.Stratum.MinerHashRates()
+		local, localDead := 0.0, 0.0
+		for _, r := range rates {
+			local += r
+		}
+		for _, r := range dead {
+			localDead += r
+		}
+		add("local_hashrate", local)
+		add("local_dead_hashrate", localDead)
+		add("miners", float64(len(rates)))
+		add("stratum_clients", float64(len(c.Stratum.Clients())))
+	}
+	if c.Peers != nil {
+		add("peers", float64(c.Peers.GetPeerCount()))
+	}
+	for _, r := range rejects.Counts() {
+		add("rejects_"+string(r.Layer)+"_"+strings.ReplaceAll(r.Reason, "-", "_"), float64(r.Count))
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	return ms
+}
+
+// Exporter sends a set of metrics somewhere
+type Exporter interface {
+	Export(ms []Metric, t time.Time) error
+}
+
+// Push collects and exports the metrics every interval, forever
+func Push(c *Collector, e Exporter, interval time.Duration) {
+	for {
+		clock.Sleep(interval)
+		now := clock.Now()
+		err := e.Export(c.Collect(), now)
+		if err != nil {
+			logging.Warnf("Could not export metrics: %s", err.Error())
+		}
+	}
+}
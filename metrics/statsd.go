@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// statsdMaxPacket keeps packets below common network MTUs
+const statsdMaxPacket = 1400
+
+// StatsDExporter sends metrics as StatsD gauges over UDP
+type StatsDExporter struct {
+	Address string
+	// Prefix is put before every metric name, separated by a dot
+	Prefix string
+}
+
+func NewStatsDExporter(address, prefix string) *StatsDExporter {
+	return &StatsDExporter{Address: address, Prefix: prefix}
+}
+
+func (e *StatsDExporter) Export(ms []Metric, t time.Time) error {
+	conn, err := net.Dial("udp", e.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet := make([]byte, 0, statsdMaxPacket)
+	for _, m := range ms {
+		name := m.Name
+		if e.Prefix != "" {
+			name = e.Prefix + "." + name
+		}
+		line := name + ":" + strconv.FormatFloat(m.Value, 'f', -1, 64) + "|g"
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			_, err = conn.Write(packet)
+			if err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		_, err = conn.Write(packet)
+	}
+	return err
+}
@@ -0,0 +1,543 @@
+// Package mockdaemon is a coin daemon that only speaks the JSON-RPC calls
+// p2pool makes. It hands out synthetic block templates on top of its own
+// chain, checks and accepts submitted blocks and only moves on when told to,
+// so the code talking to daemons can be exercised quickly and without a
+// real one.
+package mockdaemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var log = logging.For("mockdaemon")
+
+const (
+	errCodeMethodNotFound = -32601
+	errCodeInvalidParams  = -8
+	errCodeNotFound       = -5
+	errCodeDeserialize    = -22
+	errCodeMisc           = -1
+)
+
+// Submission is a block submitted to the daemon
+type Submission struct {
+	Hash   string
+	Height int64
+	// Reason is why the block was rejected, empty if it was accepted
+	Reason string
+}
+
+// Daemon is a mock coin daemon for a network
+type Daemon struct {
+	Network p2pnet.Network
+	// User and Password are the credentials calls must carry, if set
+	User     string
+	Password string
+
+	lock    sync.Mutex
+	txCount int
+	target  string
+	bits    string
+	chain   []*chainhash.Hash
+	heights map[chainhash.Hash]int64
+	txs     map[chainhash.Hash]string
+	// blocks are the hex of the submitted blocks that were accepted, the
+	// others have no body
+	blocks    map[chainhash.Hash]string
+	submitted []Submission
+	failures  map[string]*rpc.Error
+	syncing   bool
+	// tipChanged is closed when the tip changes, releasing the long polls
+	tipChanged chan struct{}
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// New creates a daemon for the network with only the genesis block. Its
+// templates have 10 transactions and the difficulty of work.SyntheticTemplate.
+func New(n p2pnet.Network) *Daemon {
+	genesis := n.ChainParams.GenesisHash
+	if genesis == nil {
+		genesis = &chainhash.Hash{}
+	}
+	d := &Daemon{
+		Network:    n,
+		User:       "mock",
+		Password:   "mock",
+		txCount:    10,
+		chain:      []*chainhash.Hash{genesis},
+		heights:    map[chainhash.Hash]int64{*genesis: 0},
+		txs:        map[chainhash.Hash]string{},
+		blocks:     map[chainhash.Hash]string{},
+		failures:   map[string]*rpc.Error{},
+		tipChanged: make(chan struct{}),
+	}
+	t := work.SyntheticTemplate(1, 0)
+	d.target, d.bits = t.Target, t.Bits
+	return d
+}
+
+// Listen serves calls on addr, like 127.0.0.1:0 for a free port of
+// localhost
+func (d *Daemon) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	d.listener = l
+	d.server = &http.Server{Handler: http.HandlerFunc(d.serveHTTP)}
+	go func() {
+		err := d.server.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Mock daemon stopped: %s", err.Error())
+		}
+	}()
+	log.Debugf("Mock daemon for %s listening on %s", d.Network.Name, l.Addr().String())
+	return nil
+}
+
+// Close stops the daemon, failing the calls in progress
+func (d *Daemon) Close() {
+	if d.server != nil {
+		d.server.Close()
+	}
+}
+
+// URL returns the address of the daemon with its credentials, as taken by
+// rpc.NewClient
+func (d *Daemon) URL() string {
+	if d.User == "" && d.Password == "" {
+		return "http://" + d.listener.Addr().String()
+	}
+	return fmt.Sprintf("http://%s:%s@%s", d.User, d.Password, d.listener.Addr().String())
+}
+
+// Client returns a new client for the daemon
+func (d *Daemon) Client() (*rpc.Client, error) {
+	return rpc.NewClient(d.URL())
+}
+
+// SetTarget sets the target of the templates, in the format of
+// getblocktemplate, and the bits of the blocks that meet it
+func (d *Daemon) SetTarget(target, bits string) {
+	d.lock.Lock()
+	d.target, d.bits = target, bits
+	d.lock.Unlock()
+	d.releaseLongPolls()
+}
+
+// SetTxCount sets the number of transactions in the templates
+func (d *Daemon) SetTxCount(count int) {
+	d.lock.Lock()
+	d.txCount = count
+	d.lock.Unlock()
+}
+
+// SetSyncing makes the daemon report it is still in initial block download
+func (d *Daemon) SetSyncing(syncing bool) {
+	d.lock.Lock()
+	d.syncing = syncing
+	d.lock.Unlock()
+}
+
+// Fail makes all calls of method fail with err, until called again with a
+// nil err
+func (d *Daemon) Fail(method string, err *rpc.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err == nil {
+		delete(d.failures, method)
+		return
+	}
+	d.failures[method] = err
+}
+
+// Advance adds count blocks found by others to the chain
+func (d *Daemon) Advance(count int) {
+	d.lock.Lock()
+	for i := 0; i < count; i++ {
+		tip := d.chain[len(d.chain)-1]
+		seed := make([]byte, chainhash.HashSize+8)
+		copy(seed, tip[:])
+		binary.LittleEndian.PutUint64(seed[chainhash.HashSize:], uint64(len(d.chain)))
+		hash, _ := chainhash.NewHash(util.Sha256d(seed))
+		d.extend(hash)
+	}
+	d.lock.Unlock()
+	d.releaseLongPolls()
+}
+
+// Height returns the height of the daemon's tip
+func (d *Daemon) Height() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return int64(len(d.chain) - 1)
+}
+
+// Tip returns the hash of the daemon's tip
+func (d *Daemon) Tip() *chainhash.Hash {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.chain[len(d.chain)-1]
+}
+
+// Submitted returns the blocks submitted so far, in order
+func (d *Daemon) Submitted() []Submission {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := make([]Submission, len(d.submitted))
+	copy(s, d.submitted)
+	return s
+}
+
+// extend adds a block to the chain, the lock must be held
+func (d *Daemon) extend(hash *chainhash.Hash) {
+	d.heights[*hash] = int64(len(d.chain))
+	d.chain = append(d.chain, hash)
+}
+
+func (d *Daemon) releaseLongPolls() {
+	d.lock.Lock()
+	close(d.tipChanged)
+	d.tipChanged = make(chan struct{})
+	d.lock.Unlock()
+}
+
+// template returns the template on the current tip, the lock must be held
+func (d *Daemon) template() *rpc.BlockTemplate {
+	height := int64(len(d.chain))
+	t := work.SyntheticTemplate(height, d.txCount)
+	t.PreviousBlockHash = d.chain[height-1].String()
+	t.Target, t.Bits = d.target, d.bits
+	t.LongPollID = fmt.Sprintf("%s%d", t.PreviousBlockHash, height)
+	for _, tx := range t.Transactions {
+		txid, err := chainhash.NewHashFromStr(tx.TxID)
+		if err == nil {
+			d.txs[*txid] = tx.Data
+		}
+	}
+	return t
+}
+
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  *rpc.Error      `json:"error"`
+}
+
+func (d *Daemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.User != "" || d.Password != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != d.User || password != d.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	var req request
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Invalid JSON-RPC request", http.StatusBadRequest)
+		return
+	}
+	result, rpcErr := d.call(r, req.Method, req.Params)
+	status := http.StatusOK
+	if rpcErr != nil {
+		result = nil
+		status = http.StatusInternalServerError
+		if rpcErr.Code == errCodeMethodNotFound {
+			status = http.StatusNotFound
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response{ID: req.ID, Result: result, Error: rpcErr})
+}
+
+func (d *Daemon) call(r *http.Request, method string, params []json.RawMessage) (interface{}, *rpc.Error) {
+	d.lock.Lock()
+	failure := d.failures[method]
+	d.lock.Unlock()
+	if failure != nil {
+		return nil, failure
+	}
+
+	switch method {
+	case "getblocktemplate":
+		var opts struct {
+			Mode       string `json:"mode"`
+			Data       string `json:"data"`
+			LongPollID string `json:"longpollid"`
+		}
+		if len(params) > 0 && json.Unmarshal(params[0], &opts) != nil {
+			return nil, invalidParams()
+		}
+		if opts.Mode == "proposal" {
+			return d.propose(opts.Data)
+		}
+		return d.getBlockTemplate(r, opts.LongPollID), nil
+	case "submitblock":
+		var blockHex string
+		if len(params) < 1 || json.Unmarshal(params[0], &blockHex) != nil {
+			return nil, invalidParams()
+		}
+		return d.submitBlock(blockHex)
+	case "getblock":
+		var hash string
+		if len(params) < 1 || json.Unmarshal(params[0], &hash) != nil {
+			return nil, invalidParams()
+		}
+		verbosity := 1
+		if len(params) > 1 && json.Unmarshal(params[1], &verbosity) != nil {
+			return nil, invalidParams()
+		}
+		return d.getBlock(hash, verbosity)
+	case "getblockhash":
+		var height int64
+		if len(params) < 1 || json.Unmarshal(params[0], &height) != nil {
+			return nil, invalidParams()
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if height < 0 || height >= int64(len(d.chain)) {
+			return nil, &rpc.Error{Code: errCodeInvalidParams, Message: "Block height out of range"}
+		}
+		return d.chain[height].String(), nil
+	case "getblockchaininfo":
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		height := int64(len(d.chain) - 1)
+		return rpc.BlockchainInfo{
+			Chain:                d.Network.DaemonChain,
+			Blocks:               height,
+			Headers:              height,
+			BestBlockHash:        d.chain[height].String(),
+			Difficulty:           1,
+			VerificationProgress: 1,
+			InitialBlockDownload: d.syncing,
+		}, nil
+	case "getmininginfo":
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return rpc.MiningInfo{Blocks: int64(len(d.chain) - 1), Difficulty: 1, PooledTx: int64(d.txCount), Chain: d.Network.DaemonChain}, nil
+	case "getmempoolinfo":
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return rpc.MempoolInfo{Size: int64(d.txCount), Bytes: int64(d.txCount) * 200, MempoolMinFee: 0.00001, MinRelayTxFee: 0.00001}, nil
+	case "estimatesmartfee":
+		var blocks int64
+		if len(params) < 1 || json.Unmarshal(params[0], &blocks) != nil {
+			return nil, invalidParams()
+		}
+		return rpc.SmartFeeEstimate{FeeRate: 0.0001, Blocks: blocks}, nil
+	case "getrawtransaction":
+		var txid string
+		if len(params) < 1 || json.Unmarshal(params[0], &txid) != nil {
+			return nil, invalidParams()
+		}
+		hash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, invalidParams()
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		data, ok := d.txs[*hash]
+		if !ok {
+			return nil, &rpc.Error{Code: errCodeNotFound, Message: "No such mempool or blockchain transaction"}
+		}
+		return data, nil
+	case "sendrawtransaction":
+		var txHex string
+		if len(params) < 1 || json.Unmarshal(params[0], &txHex) != nil {
+			return nil, invalidParams()
+		}
+		tx, err := decodeTx(txHex)
+		if err != nil {
+			return nil, &rpc.Error{Code: errCodeDeserialize, Message: "TX decode failed"}
+		}
+		return tx.TxHash().String(), nil
+	}
+	return nil, &rpc.Error{Code: errCodeMethodNotFound, Message: "Method not found"}
+}
+
+// getBlockTemplate returns the template on the tip. With the long poll ID
+// of that template, it waits for the tip to change first.
+func (d *Daemon) getBlockTemplate(r *http.Request, longPollID string) *rpc.BlockTemplate {
+	d.lock.Lock()
+	t := d.template()
+	changed := d.tipChanged
+	d.lock.Unlock()
+	if longPollID == "" || longPollID != t.LongPollID {
+		return t
+	}
+	select {
+	case <-changed:
+	case <-r.Context().Done():
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.template()
+}
+
+// submitBlock checks a block and makes it the new tip if it's valid
+func (d *Daemon) submitBlock(blockHex string) (interface{}, *rpc.Error) {
+	b, err := decodeBlock(blockHex)
+	if err != nil {
+		return nil, &rpc.Error{Code: errCodeDeserialize, Message: "Block decode failed"}
+	}
+	hash := b.BlockHash()
+
+	d.lock.Lock()
+	reason := d.check(b, true)
+	height := int64(len(d.chain))
+	if reason == "" {
+		d.extend(&hash)
+		d.blocks[hash] = blockHex
+	}
+	d.submitted = append(d.submitted, Submission{Hash: hash.String(), Height: height, Reason: reason})
+	d.lock.Unlock()
+
+	if reason != "" {
+		log.Debugf("Mock daemon rejected block %s: %s", hash.String(), reason)
+		return reason, nil
+	}
+	log.Debugf("Mock daemon accepted block %s at height %d", hash.String(), height)
+	d.releaseLongPolls()
+	return nil, nil
+}
+
+// propose checks a block like submitblock without accepting it or looking
+// at its proof of work
+func (d *Daemon) propose(blockHex string) (interface{}, *rpc.Error) {
+	b, err := decodeBlock(blockHex)
+	if err != nil {
+		return nil, &rpc.Error{Code: errCodeDeserialize, Message: "Block decode failed"}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	reason := d.check(b, false)
+	if reason == "duplicate" || reason == "inconclusive" {
+		reason = "inconclusive-not-best-prevblk"
+	}
+	if reason == "" {
+		return nil, nil
+	}
+	return reason, nil
+}
+
+// check returns why the block can't extend the chain, with the reasons
+// Bitcoin Core gives, or an empty string for a valid block. The lock must be
+// held.
+func (d *Daemon) check(b *btcwire.MsgBlock, checkPOW bool) string {
+	hash := b.BlockHash()
+	if _, ok := d.heights[hash]; ok {
+		return "duplicate"
+	}
+	tip := d.chain[len(d.chain)-1]
+	if !b.Header.PrevBlock.IsEqual(tip) {
+		if _, ok := d.heights[b.Header.PrevBlock]; ok {
+			return "inconclusive"
+		}
+		return "prev-blk-not-found"
+	}
+	if fmt.Sprintf("%08x", b.Header.Bits) != d.bits {
+		return "bad-diffbits"
+	}
+	if checkPOW {
+		var buf bytes.Buffer
+		b.Header.Serialize(&buf)
+		powHash, _ := chainhash.NewHash(d.Network.POWHash(buf.Bytes()))
+		if blockchain.HashToBig(powHash).Cmp(blockchain.CompactToBig(b.Header.Bits)) > 0 {
+			return "high-hash"
+		}
+	}
+	if len(b.Transactions) == 0 || !blockchain.IsCoinBaseTx(b.Transactions[0]) {
+		return "bad-cb-missing"
+	}
+	txs := make([]*btcutil.Tx, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		txs[i] = btcutil.NewTx(tx)
+	}
+	merkleRoot := blockchain.CalcMerkleRoot(txs, false)
+	if !b.Header.MerkleRoot.IsEqual(&merkleRoot) {
+		return "bad-txnmrklroot"
+	}
+	return ""
+}
+
+// getBlock returns the hex of a block for verbosity 0, which only submitted
+// blocks have, and its info otherwise
+func (d *Daemon) getBlock(hashStr string, verbosity int) (interface{}, *rpc.Error) {
+	hash, err := chainhash.NewHashFromStr(hashStr)
+	if err != nil {
+		return nil, invalidParams()
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	height, ok := d.heights[*hash]
+	if !ok {
+		return nil, &rpc.Error{Code: errCodeNotFound, Message: "Block not found"}
+	}
+	if verbosity == 0 {
+		blockHex, ok := d.blocks[*hash]
+		if !ok {
+			return nil, &rpc.Error{Code: errCodeMisc, Message: "Block not available"}
+		}
+		return blockHex, nil
+	}
+	bi := rpc.BlockInfo{Hash: hash.String(), Height: height, Confirmations: int64(len(d.chain)) - height}
+	if height > 0 {
+		bi.PreviousHash = d.chain[height-1].String()
+	}
+	return bi, nil
+}
+
+func invalidParams() *rpc.Error {
+	return &rpc.Error{Code: errCodeInvalidParams, Message: "Invalid parameters"}
+}
+
+func decodeBlock(blockHex string) (*btcwire.MsgBlock, error) {
+	raw, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, err
+	}
+	b := &btcwire.MsgBlock{}
+	return b, b.Deserialize(bytes.NewReader(raw))
+}
+
+func decodeTx(txHex string) (*btcwire.MsgTx, error) {
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	tx := &btcwire.MsgTx{}
+	return tx, tx.Deserialize(bytes.NewReader(raw))
+}
@@ -0,0 +1,211 @@
+package net
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/pow"
+)
+
+// Definition describes a network in a JSON file, so coins can be added
+// without recompiling. Byte strings and the max target are hex.
+type Definition struct {
+	Name             string   `json:"name"`
+	MessagePrefix    string   `json:"message_prefix"`
+	Identifier       string   `json:"identifier"`
+	P2PPort          int      `json:"p2p_port"`
+	StratumPort      int      `json:"stratum_port"`
+	SeedHosts        []string `json:"seed_hosts"`
+	ChainLength      int      `json:"chain_length"`
+	SharePeriod      int      `json:"share_period"`
+	Spread           int      `json:"spread"`
+	TargetLookbehind int      `json:"target_lookbehind"`
+	ShareVersion     uint64   `json:"share_version"`
+	MaxTarget        string   `json:"max_target"`
+	DumbScryptDiff   float64  `json:"dumb_scrypt_diff"`
+	DustThreshold    uint64   `json:"dust_threshold"`
+	PowAlgorithm     string   `json:"pow_algorithm"`
+	DaemonChain      string   `json:"daemon_chain"`
+	Regtest          bool     `json:"regtest"`
+	DaemonAdapter    string   `json:"daemon_adapter"`
+	PayoutPolicy     string   `json:"payout_policy"`
+	DonationScript   string   `json:"donation_script"`
+	BlockExplorerURL string   `json:"block_explorer_url"`
+
+	// The rules below are optional, those of the p2pool network if not
+	// given. TxRefLimit defaults to 10 above TxRefLookbehind, like 110 and
+	// 100 on the p2pool network.
+	MaxTargetChange    int  `json:"max_target_change"`
+	ShareTargetRange   int  `json:"share_target_range"`
+	MinCoinbaseSize    *int `json:"min_coinbase_size"`
+	MaxCoinbaseSize    int  `json:"max_coinbase_size"`
+	TxRefLookbehind    *int `json:"tx_ref_lookbehind"`
+	TxRefLimit         *int `json:"tx_ref_limit"`
+	MaxNewTransactions int  `json:"max_new_transactions"`
+
+	Chain ChainDefinition `json:"chain"`
+}
+
+// ChainDefinition holds the coin's chain parameters that matter to us
+type ChainDefinition struct {
+	Name        string `json:"name"`
+	GenesisHash string `json:"genesis_hash"`
+	// Magic are the coin's p2p message start bytes as a number
+	Magic              uint32 `json:"magic"`
+	PubKeyHashAddrID   byte   `json:"pubkey_hash_addr_id"`
+	ScriptHashAddrID   byte   `json:"script_hash_addr_id"`
+	Bech32HRPSegwit    string `json:"bech32_hrp"`
+	TargetTimePerBlock int    `json:"target_time_per_block"`
+}
+
+func decodeHex(field, s string, size int) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (size > 0 && len(b) != size) {
+		if size > 0 {
+			return nil, fmt.Errorf("%s must be %d hex encoded bytes", field, size)
+		}
+		return nil, fmt.Errorf("%s must be hex encoded", field)
+	}
+	return b, nil
+}
+
+// Network validates the definition and builds the network from it
+func (d Definition) Network() (Network, error) {
+	var err error
+	n := Network{
+		Name:             d.Name,
+		P2PPort:          d.P2PPort,
+		StratumPort:      d.StratumPort,
+		SeedHosts:        d.SeedHosts,
+		Rules:            DefaultRules(),
+		ShareVersion:     d.ShareVersion,
+		DumbScryptDiff:   d.DumbScryptDiff,
+		DustThreshold:    d.DustThreshold,
+		PowAlgorithm:     d.PowAlgorithm,
+		DaemonChain:      d.DaemonChain,
+		Regtest:          d.Regtest,
+		DaemonAdapter:    d.DaemonAdapter,
+		PayoutPolicy:     d.PayoutPolicy,
+		BlockExplorerURL: d.BlockExplorerURL,
+	}
+	switch {
+	case d.Name == "":
+		return n, fmt.Errorf("Network has no name")
+	case d.P2PPort <= 0 || d.P2PPort > 65535 || d.StratumPort <= 0 || d.StratumPort > 65535:
+		return n, fmt.Errorf("Network %s needs valid p2p and stratum ports", d.Name)
+	case d.DumbScryptDiff <= 0:
+		return n, fmt.Errorf("Network %s needs a positive dumb scrypt difficulty", d.Name)
+	}
+	if n.MessagePrefix, err = decodeHex("message_prefix", d.MessagePrefix, 8); err != nil {
+		return n, err
+	}
+	if n.Identifier, err = decodeHex("identifier", d.Identifier, 8); err != nil {
+		return n, err
+	}
+	if d.DonationScript != "" {
+		if n.DonationScript, err = decodeHex("donation_script", d.DonationScript, 0); err != nil {
+			return n, err
+		}
+	}
+	var ok bool
+	n.MaxTarget, ok = big.NewInt(0).SetString(d.MaxTarget, 16)
+	if !ok || n.MaxTarget.Sign() <= 0 {
+		return n, fmt.Errorf("max_target must be a positive hex number")
+	}
+	n.ChainLength = d.ChainLength
+	n.SharePeriod = d.SharePeriod
+	n.Spread = d.Spread
+	n.TargetLookbehind = d.TargetLookbehind
+	if d.MaxTargetChange != 0 {
+		n.MaxTargetChange = d.MaxTargetChange
+	}
+	if d.ShareTargetRange != 0 {
+		n.ShareTargetRange = d.ShareTargetRange
+	}
+	if d.MinCoinbaseSize != nil {
+		n.MinCoinbaseSize = *d.MinCoinbaseSize
+	}
+	if d.MaxCoinbaseSize != 0 {
+		n.MaxCoinbaseSize = d.MaxCoinbaseSize
+	}
+	if d.TxRefLookbehind != nil {
+		n.TxRefLookbehind = *d.TxRefLookbehind
+		n.TxRefLimit = n.TxRefLookbehind + 10
+	}
+	if d.TxRefLimit != nil {
+		n.TxRefLimit = *d.TxRefLimit
+	}
+	n.MaxNewTransactions = d.MaxNewTransactions
+	if err = n.Rules.Check(); err != nil {
+		return n, fmt.Errorf("Network %s: %s", d.Name, err.Error())
+	}
+	if n.POWHash, err = pow.Get(d.PowAlgorithm); err != nil {
+		return n, err
+	}
+	if d.DaemonAdapter == "" {
+		n.DaemonAdapter = "bitcoind"
+	}
+
+	genesis, err := chainhash.NewHashFromStr(d.Chain.GenesisHash)
+	if err != nil {
+		return n, fmt.Errorf("Invalid genesis_hash: %s", err.Error())
+	}
+	name := d.Chain.Name
+	if name == "" {
+		name = d.Name
+	}
+	n.ChainParams = &chaincfg.Params{
+		Name:               name,
+		GenesisHash:        genesis,
+		Net:                wire.BitcoinNet(d.Chain.Magic),
+		PubKeyHashAddrID:   d.Chain.PubKeyHashAddrID,
+		ScriptHashAddrID:   d.Chain.ScriptHashAddrID,
+		Bech32HRPSegwit:    d.Chain.Bech32HRPSegwit,
+		TargetTimePerBlock: time.Duration(d.Chain.TargetTimePerBlock) * time.Second,
+	}
+	return n, nil
+}
+
+// LoadDefinitions registers the networks defined in the *.json files in dir
+// and returns their names. A missing directory defines nothing.
+func LoadDefinitions(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var d Definition
+		err = json.Unmarshal(b, &d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		n, err := d.Network()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		err = RegisterChainParams(n.ChainParams)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		Register(n.Name, func() Network {
+			c := n
+			c.SeedHosts = append([]string{}, n.SeedHosts...)
+			return c
+		})
+		names = append(names, n.Name)
+	}
+	return names, nil
+}
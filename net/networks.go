@@ -2,30 +2,205 @@ package net
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
 
-	"github.com/adamcollier1/lyra2rev3"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/pow"
 )
 
-var ActiveNetwork Network
-
 type Network struct {
+	// Name is what the network is registered as
+	Name          string
 	MessagePrefix []byte
 	Identifier    []byte
 	P2PPort       int
+	StratumPort   int
 	SeedHosts     []string
-	ChainLength   int
-	POWHash       func([]byte) []byte
+	// Rules are the consensus rules shares are checked against
+	Rules
+	ShareVersion   uint64
+	DumbScryptDiff float64
+	DustThreshold  uint64
+	ChainParams    *chaincfg.Params
+	PowAlgorithm   string
+	POWHash        pow.PowHash
+	// DaemonChain is the chain the daemon reports in getblockchaininfo for
+	// this network
+	DaemonChain string
+	// DaemonAdapter names the rpc adapter for the coin's daemon
+	DaemonAdapter string
+	// PayoutPolicy names the work payout policy that splits the block
+	// reward, p2pool's PPLNS if empty
+	PayoutPolicy string
+	// Regtest networks have trivial block and share targets and no public
+	// peers, so the whole stack can be exercised on a CPU. The node starts
+	// its own sharechain instead of waiting for peers.
+	Regtest bool
+	// DonationScript receives the donation output of the gentx, the
+	// default p2pool one if empty
+	DonationScript []byte
+	// BlockExplorerURL links to a block on an explorer, %s is replaced by
+	// the block hash. Empty if there is no explorer.
+	BlockExplorerURL string
+	// ShareHashSlots limits how many shares have their proof of work hashed
+	// at the same time, unlimited if nil. It's not part of the network's
+	// definition: a node sets its own, which the copies of the network its
+	// parts get share.
+	ShareHashSlots chan struct{}
+}
+
+var vertcoinGenesisHash, _ = chainhash.NewHashFromStr("4d96a915f49d40b1e5c2844d1ee2dccb90013a990ccea12c492d22110489f0c4")
+
+var vertcoinParams = chaincfg.Params{
+	Name:             "vertcoin",
+	GenesisHash:      vertcoinGenesisHash,
+	Net:              wire.BitcoinNet(0xdab5bffa),
+	PubKeyHashAddrID: 71,
+	ScriptHashAddrID: 5,
+	Bech32HRPSegwit:  "vtc",
+	// Used to estimate the network hashrate
+	TargetTimePerBlock: time.Second * 150,
 }
 
 func Vertcoin() Network {
-	n := Network{P2PPort: 9346}
+	n := Network{Name: "vertcoin", P2PPort: 9346, StratumPort: 9171, Rules: DefaultRules()}
 	n.MessagePrefix, _ = hex.DecodeString("7c3614a6bcdcf784")
 	n.Identifier, _ = hex.DecodeString("a06a81c827cab983")
 	n.ChainLength = 5100
+	n.SharePeriod = 15
+	n.Spread = 3
+	n.TargetLookbehind = 200
+	n.ShareVersion = 17
+	n.MaxTarget, _ = big.NewInt(0).SetString("00000fffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	n.DumbScryptDiff = 256
+	n.DustThreshold = 3000000
+	n.DaemonChain = "main"
+	n.DaemonAdapter = "vertcoind"
+	n.BlockExplorerURL = "https://chainz.cryptoid.info/vtc/block.dws?%s.htm"
+	n.ChainParams = &vertcoinParams
 	n.SeedHosts = []string{"localhost", "p2proxy.vertcoin.org", "vtc.alwayshashing.com", "crypto.office-on-the.net", "pool.vtconline.org"}
-	n.POWHash = func(b []byte) []byte {
-		res, _ := lyra2rev3.SumV3(b)
-		return res
-	}
+	n.PowAlgorithm = "lyra2rev3"
+	n.POWHash, _ = pow.Get(n.PowAlgorithm)
+	return n
+}
+
+// The alternate Vertcoin networks only run between nodes of this
+// implementation, their prefixes and identifiers are our own. Daemons are
+// checked by chain name only, the genesis blocks aren't known here.
+
+var vertcoinTestnetParams = chaincfg.Params{
+	Name:               "vertcoin-testnet",
+	Net:                wire.BitcoinNet(0x74726576),
+	PubKeyHashAddrID:   74,
+	ScriptHashAddrID:   196,
+	Bech32HRPSegwit:    "tvtc",
+	TargetTimePerBlock: time.Second * 150,
+}
+
+// Vertcoin Core's regtest keeps the address versions and bech32 prefix of
+// Bitcoin's regtest
+var vertcoinRegtestParams = chaincfg.Params{
+	Name:               "vertcoin-regtest",
+	Net:                wire.BitcoinNet(0xdab5bffb),
+	PubKeyHashAddrID:   111,
+	ScriptHashAddrID:   196,
+	Bech32HRPSegwit:    "bcrt",
+	TargetTimePerBlock: time.Second * 150,
+}
+
+// VertcoinTestnet is the Vertcoin p2pool network on the coin's testnet
+func VertcoinTestnet() Network {
+	n := Vertcoin()
+	n.Name = "vertcoin-testnet"
+	n.P2PPort = 19346
+	n.StratumPort = 19171
+	n.MessagePrefix, _ = hex.DecodeString("7c3614a6bcdcf785")
+	n.Identifier, _ = hex.DecodeString("a06a81c827cab984")
+	n.SeedHosts = []string{"localhost"}
+	// Testnet difficulty drops to the minimum after long gaps, a short
+	// chain keeps payouts meaningful with few miners
+	n.ChainLength = 400
+	n.MaxTarget, _ = big.NewInt(0).SetString("000fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	n.DustThreshold = 100000
+	n.DaemonChain = "test"
+	n.BlockExplorerURL = ""
+	n.ChainParams = &vertcoinTestnetParams
 	return n
 }
+
+// VertcoinRegtest is a private Vertcoin p2pool network on regtest, for
+// development and integration tests
+func VertcoinRegtest() Network {
+	n := Vertcoin()
+	n.Name = "vertcoin-regtest"
+	n.Regtest = true
+	n.P2PPort = 29346
+	n.StratumPort = 29171
+	n.MessagePrefix, _ = hex.DecodeString("7c3614a6bcdcf786")
+	n.Identifier, _ = hex.DecodeString("a06a81c827cab985")
+	n.SeedHosts = []string{}
+	n.ChainLength = 100
+	n.SharePeriod = 5
+	n.TargetLookbehind = 20
+	// Regtest blocks take a handful of hashes, shares shouldn't take more
+	n.MaxTarget, _ = big.NewInt(0).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	n.DumbScryptDiff = 1
+	n.DustThreshold = 0
+	n.DaemonChain = "regtest"
+	n.BlockExplorerURL = ""
+	n.ChainParams = &vertcoinRegtestParams
+	return n
+}
+
+// Benchmark is a network for load testing without a daemon or peers. It uses
+// sha256d with a very easy share target, so simulated miners can find shares
+// on a CPU.
+func Benchmark() Network {
+	n := Vertcoin()
+	n.Name = "benchmark"
+	n.MessagePrefix, _ = hex.DecodeString("62656e63686d726b")
+	n.Identifier, _ = hex.DecodeString("62656e63686d726b")
+	n.SeedHosts = []string{}
+	n.BlockExplorerURL = ""
+	n.MaxTarget, _ = big.NewInt(0).SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	// Difficulty 1 takes 65536 hashes on average
+	n.DumbScryptDiff = 65536
+	n.PowAlgorithm = "sha256d"
+	n.POWHash, _ = pow.Get(n.PowAlgorithm)
+	return n
+}
+
+// RegisterChainParams makes the bech32 prefix of a coin's params known to
+// the address decoder. chaincfg keeps params by their network magic, and
+// coins reuse those of Bitcoin's networks: Vertcoin's is that of Bitcoin's
+// regtest. Those are registered under a free magic instead, nothing here
+// speaks the coin's own protocol.
+func RegisterChainParams(params *chaincfg.Params) error {
+	p := *params
+	for i := 0; i < 256; i++ {
+		err := chaincfg.Register(&p)
+		if !errors.Is(err, chaincfg.ErrDuplicateNet) {
+			return err
+		}
+		p.Net++
+	}
+	return fmt.Errorf("Could not register the params of %s", params.Name)
+}
+
+func init() {
+	for _, params := range []*chaincfg.Params{&vertcoinParams, &vertcoinTestnetParams, &vertcoinRegtestParams} {
+		err := RegisterChainParams(params)
+		if err != nil {
+			panic(err)
+		}
+	}
+	Register("vertcoin", Vertcoin)
+	Register("vertcoin-testnet", VertcoinTestnet)
+	Register("vertcoin-regtest", VertcoinRegtest)
+	Register("benchmark", Benchmark)
+}
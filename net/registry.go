@@ -0,0 +1,44 @@
+package net
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	networks     = map[string]func() Network{}
+	networksLock sync.RWMutex
+)
+
+// Register makes a network available by name. The constructor is called for
+// every Get, so callers can change their copy freely. Registering an
+// existing name replaces it.
+func Register(name string, f func() Network) {
+	networksLock.Lock()
+	defer networksLock.Unlock()
+	networks[name] = f
+}
+
+// Get returns the network with the given name
+func Get(name string) (Network, error) {
+	networksLock.RLock()
+	defer networksLock.RUnlock()
+	f, ok := networks[name]
+	if !ok {
+		return Network{}, fmt.Errorf("Unknown network %s", name)
+	}
+	return f(), nil
+}
+
+// Names returns the names of all registered networks
+func Names() []string {
+	networksLock.RLock()
+	defer networksLock.RUnlock()
+	names := make([]string, 0, len(networks))
+	for n := range networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
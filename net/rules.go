@@ -0,0 +1,79 @@
+package net
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Rules are the consensus rules of a network's sharechain: how share
+// targets adjust and what shares may contain. Every node of a network must
+// use the same, shares breaking them are rejected.
+type Rules struct {
+	// ChainLength is the number of shares payouts are computed over and
+	// forks are resolved within
+	ChainLength int
+	// SharePeriod is the time between shares the share target aims for, in
+	// seconds
+	SharePeriod int
+	// Spread is the number of blocks' worth of work payouts are spread over
+	Spread int
+	// TargetLookbehind is the number of shares the pool hashrate, and with
+	// it the share target, is estimated from
+	TargetLookbehind int
+	// MaxTarget is the easiest a share may be
+	MaxTarget *big.Int
+	// MaxTargetChange is how many percent the maximum share target may move
+	// from one share to the next
+	MaxTargetChange int
+	// ShareTargetRange is how many times harder than the maximum share
+	// target miners may choose their share target
+	ShareTargetRange int
+	// MinCoinbaseSize and MaxCoinbaseSize bound the coinbase script of
+	// shares, in bytes
+	MinCoinbaseSize int
+	MaxCoinbaseSize int
+	// TxRefLookbehind is how many previous shares the shares we make refer
+	// to the transactions of instead of repeating their hashes
+	TxRefLookbehind int
+	// TxRefLimit is how many shares back the shares of peers may refer to,
+	// exclusive. It is above TxRefLookbehind so shares made on a chain that
+	// differs a little from ours still pass.
+	TxRefLimit int
+	// MaxNewTransactions limits the transaction hashes a share introduces,
+	// unlimited if 0
+	MaxNewTransactions int
+}
+
+// DefaultRules are the rules of the p2pool network, apart from the ones
+// every network sets
+func DefaultRules() Rules {
+	return Rules{
+		MaxTargetChange:  10,
+		ShareTargetRange: 30,
+		MinCoinbaseSize:  2,
+		MaxCoinbaseSize:  100,
+		TxRefLookbehind:  100,
+		TxRefLimit:       110,
+	}
+}
+
+// Check tells whether the rules make sense
+func (r Rules) Check() error {
+	switch {
+	case r.ChainLength <= 0 || r.SharePeriod <= 0 || r.Spread <= 0 || r.TargetLookbehind <= 0:
+		return fmt.Errorf("Needs a positive chain length, share period, spread and target lookbehind")
+	case r.MaxTarget == nil || r.MaxTarget.Sign() <= 0:
+		return fmt.Errorf("Needs a positive max target")
+	case r.MaxTargetChange <= 0 || r.MaxTargetChange >= 100:
+		return fmt.Errorf("Max target change must be between 0 and 100 percent")
+	case r.ShareTargetRange < 1:
+		return fmt.Errorf("Share target range must be at least 1")
+	case r.MinCoinbaseSize < 0 || r.MaxCoinbaseSize < r.MinCoinbaseSize:
+		return fmt.Errorf("Invalid coinbase size bounds %d to %d", r.MinCoinbaseSize, r.MaxCoinbaseSize)
+	case r.TxRefLookbehind < 0 || r.MaxNewTransactions < 0:
+		return fmt.Errorf("Transaction limits can't be negative")
+	case r.TxRefLimit <= r.TxRefLookbehind:
+		return fmt.Errorf("Transaction reference limit %d must be above the lookbehind %d", r.TxRefLimit, r.TxRefLookbehind)
+	}
+	return nil
+}
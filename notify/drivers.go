@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: time.Second * 15}
+
+func postJSON(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Telegram sends messages through a bot to a chat. Parameters: token, chat.
+type Telegram struct {
+	Token string
+	Chat  string
+}
+
+func NewTelegram(params map[string]string) (Notifier, error) {
+	err := requireParams("telegram", params, "token", "chat")
+	if err != nil {
+		return nil, err
+	}
+	return &Telegram{Token: params["token"], Chat: params["chat"]}, nil
+}
+
+func (t *Telegram) Notify(subject, message string) error {
+	return postJSON("https://api.telegram.org/bot"+t.Token+"/sendMessage", map[string]string{
+		"chat_id": t.Chat,
+		"text":    subject + "\n" + message,
+	})
+}
+
+// Discord posts messages to a channel webhook. Parameters: url, and
+// optionally username.
+type Discord struct {
+	URL      string
+	Username string
+}
+
+func NewDiscord(params map[string]string) (Notifier, error) {
+	err := requireParams("discord", params, "url")
+	if err != nil {
+		return nil, err
+	}
+	return &Discord{URL: params["url"], Username: params["username"]}, nil
+}
+
+func (d *Discord) Notify(subject, message string) error {
+	msg := map[string]string{"content": "**" + subject + "**\n" + message}
+	if d.Username != "" {
+		msg["username"] = d.Username
+	}
+	return postJSON(d.URL, msg)
+}
+
+// SMTP sends mail. Parameters: host (host:port), from, to, and optionally
+// user and password for authentication.
+type SMTP struct {
+	Host     string
+	From     string
+	To       []string
+	User     string
+	Password string
+}
+
+func NewSMTP(params map[string]string) (Notifier, error) {
+	err := requireParams("smtp", params, "host", "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	return &SMTP{
+		Host:     params["host"],
+		From:     params["from"],
+		To:       strings.Split(params["to"], ";"),
+		User:     params["user"],
+		Password: params["password"],
+	}, nil
+}
+
+func (s *SMTP) Notify(subject, message string) error {
+	var auth smtp.Auth
+	if s.User != "" {
+		host, _, err := net.SplitHostPort(s.Host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.User, s.Password, host)
+	}
+	body := "From: " + s.From + "\r\n" +
+		"To: " + strings.Join(s.To, ", ") + "\r\n" +
+		"Subject: [p2pool] " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		message + "\r\n"
+	return smtp.SendMail(s.Host, auth, s.From, s.To, []byte(body))
+}
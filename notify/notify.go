@@ -0,0 +1,149 @@
+// Package notify sends short human readable messages about important node
+// events, like found blocks and daemon outages, through chat and mail
+// services.
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// Notifier delivers a message somewhere
+type Notifier interface {
+	Notify(subject, message string) error
+}
+
+// Driver creates a notifier from its parameters
+type Driver func(params map[string]string) (Notifier, error)
+
+var (
+	drivers     = map[string]Driver{}
+	driversLock sync.RWMutex
+)
+
+func init() {
+	RegisterDriver("telegram", NewTelegram)
+	RegisterDriver("discord", NewDiscord)
+	RegisterDriver("smtp", NewSMTP)
+}
+
+// RegisterDriver makes a notifier driver available. Registering an existing
+// name replaces it.
+func RegisterDriver(name string, d Driver) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	drivers[name] = d
+}
+
+// Drivers returns the names of all registered drivers
+func Drivers() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for n := range drivers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a notifier from a spec like
+// "telegram:token=123:abc,chat=456": the driver name, a colon and comma
+// separated parameters
+func New(spec string) (Notifier, error) {
+	name, rest, _ := strings.Cut(spec, ":")
+	driversLock.RLock()
+	d, ok := drivers[name]
+	driversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown notifier %s, available are %s", name, strings.Join(Drivers(), ", "))
+	}
+	params := map[string]string{}
+	for _, kv := range strings.Split(rest, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid notifier parameter %s", kv)
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return d(params)
+}
+
+func requireParams(driver string, params map[string]string, names ...string) error {
+	for _, n := range names {
+		if params[n] == "" {
+			return fmt.Errorf("Notifier %s needs parameter %s", driver, n)
+		}
+	}
+	return nil
+}
+
+// DefaultEvents are the events notifiers get when none are configured
+var DefaultEvents = []events.Type{
+	events.BlockFound,
+	events.DaemonUnavailable,
+	events.DaemonAvailable,
+}
+
+// Message turns an event into a subject and message, and returns false for
+// events that have no message
+func Message(e events.Event) (string, string, bool) {
+	switch d := e.Data.(type) {
+	case events.Block:
+		if d.Accepted() {
+			return "Block found", fmt.Sprintf("Block %s was found and accepted", d.Hash), true
+		}
+		return "Block rejected", fmt.Sprintf("Block %s was found but rejected: %s", d.Hash, d.Reason), true
+	case events.Daemon:
+		if e.Type == events.DaemonUnavailable {
+			return "Node paused", fmt.Sprintf("Not handing out work: %s", d.Reason), true
+		}
+		return "Node resumed", "The coin daemon is available again, handing out work", true
+	case events.ForkInfo:
+		return "Sharechain fork", fmt.Sprintf("Share %s forks the sharechain %d shares deep", d.Hash, d.Depth), true
+	case events.ReorgInfo:
+		return "Sharechain reorganized", fmt.Sprintf("Tip moved from %s to %s, %d shares deep", d.OldTip, d.NewTip, d.Depth), true
+	case events.Peer:
+		if e.Type == events.PeerConnected {
+			return "Peer connected", fmt.Sprintf("Connected to peer %s (%s)", d.Address, d.Version), true
+		}
+		return "Peer disconnected", fmt.Sprintf("Disconnected from peer %s", d.Address), true
+	}
+	switch e.Type {
+	case events.ShareChainSynced:
+		return "Sharechain synced", "The sharechain is synced, mining on the pool", true
+	}
+	return "", "", false
+}
+
+// Start sends a message to all notifiers for every event of the given types
+// on the named network, or on all networks if it's empty, until the returned
+// subscription is closed
+func Start(network string, notifiers []Notifier, types []events.Type) *events.Subscription {
+	sub := events.SubscribeNetwork(network, 64, types...)
+	go func() {
+		for e := range sub.Events {
+			subject, message, ok := Message(e)
+			if !ok {
+				continue
+			}
+			for _, n := range notifiers {
+				go func(n Notifier) {
+					err := n.Notify(subject, message)
+					if err != nil {
+						logging.Warnf("Could not send notification %q: %s", subject, err.Error())
+					}
+				}(n)
+			}
+		}
+	}()
+	return sub
+}
@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// LoadAddresses adds the peer addresses saved by SaveAddresses to the
+// possible peers. A missing file is not an error.
+func (p *PeerManager) LoadAddresses(path string) error {
+	addrs, err := ReadAddresses(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.possiblePeersLock.Lock()
+	defer p.possiblePeersLock.Unlock()
+	known := map[string]bool{}
+	for _, a := range p.possiblePeers {
+		known[a.Address.Address.String()] = true
+	}
+	for _, a := range addrs {
+		if a.Address.Address == nil || known[a.Address.Address.String()] {
+			continue
+		}
+		known[a.Address.Address.String()] = true
+		p.possiblePeers = append(p.possiblePeers, a)
+	}
+	return nil
+}
+
+// ReadAddresses reads the peer addresses saved by SaveAddresses
+func ReadAddresses(path string) ([]wire.Addr, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []wire.Addr
+	err = json.Unmarshal(b, &addrs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid peer address file %s: %s", path, err.Error())
+	}
+	return addrs, nil
+}
+
+// SaveAddresses writes the possible peers and the peers we're connected to,
+// so a restarted node doesn't depend on the seed hosts alone
+func (p *PeerManager) SaveAddresses(path string) error {
+	addrs := make([]wire.Addr, 0)
+	known := map[string]bool{}
+	for _, peer := range p.GetPeers() {
+		known[peer.RemoteIP.String()] = true
+		addrs = append(addrs, wire.Addr{
+			Timestamp: clock.Now().Unix(),
+			Address:   wire.P2PoolAddress{Address: peer.RemoteIP, Port: int16(peer.RemotePort)},
+		})
+	}
+	p.possiblePeersLock.Lock()
+	for _, a := range p.possiblePeers {
+		if !known[a.Address.Address.String()] {
+			known[a.Address.Address.String()] = true
+			addrs = append(addrs, a)
+		}
+	}
+	p.possiblePeersLock.Unlock()
+
+	b, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".new", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
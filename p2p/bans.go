@@ -0,0 +1,47 @@
+package p2p
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// LoadBans bans the peers saved in BansFile. A missing file is not an error.
+func (p *PeerManager) LoadBans() error {
+	if p.BansFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(p.BansFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var banned []string
+	err = json.Unmarshal(b, &banned)
+	if err != nil {
+		return err
+	}
+	p.bannedLock.Lock()
+	defer p.bannedLock.Unlock()
+	for _, ip := range banned {
+		p.banned[ip] = true
+	}
+	return nil
+}
+
+// saveBans writes the banned peers to BansFile, if set
+func (p *PeerManager) saveBans() error {
+	if p.BansFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(p.Banned())
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(p.BansFile+".new", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p.BansFile+".new", p.BansFile)
+}
@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+// Chaos makes peer connections behave like ones over a bad internet link,
+// to see how the peer layer copes. Every write is held back by Latency plus
+// up to Jitter, and with the given probabilities it is dropped, sent in two
+// parts with a pause in between, or cut short by a disconnect. Writes carry
+// whole messages, so a dropped one is a lost message rather than a garbled
+// stream.
+type Chaos struct {
+	Latency        time.Duration
+	Jitter         time.Duration
+	DropRate       float64
+	PartialRate    float64
+	DisconnectRate float64
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewChaos creates a Chaos that doesn't disturb anything yet. The seed makes
+// its choices the same every run.
+func NewChaos(seed int64) *Chaos {
+	return &Chaos{rand: rand.New(rand.NewSource(seed))}
+}
+
+// ParseChaos creates a Chaos from a spec like
+// "latency=200ms,jitter=100ms,drop=0.01,partial=0.1,disconnect=0.001,seed=1"
+func ParseChaos(spec string) (*Chaos, error) {
+	c := NewChaos(time.Now().UnixNano())
+	for _, kv := range strings.Split(spec, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid chaos setting %s", kv)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		var err error
+		switch k {
+		case "latency":
+			c.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(v)
+		case "drop":
+			c.DropRate, err = parseRate(v)
+		case "partial":
+			c.PartialRate, err = parseRate(v)
+		case "disconnect":
+			c.DisconnectRate, err = parseRate(v)
+		case "seed":
+			var seed int64
+			seed, err = strconv.ParseInt(v, 10, 64)
+			c.rand = rand.New(rand.NewSource(seed))
+		default:
+			return nil, fmt.Errorf("Unknown chaos setting %s, known are latency, jitter, drop, partial, disconnect and seed", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid chaos setting %s: %s", kv, err.Error())
+		}
+	}
+	if c.Latency < 0 || c.Jitter < 0 {
+		return nil, fmt.Errorf("Chaos latency and jitter can't be negative")
+	}
+	return c, nil
+}
+
+func parseRate(v string) (float64, error) {
+	r, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 || r > 1 {
+		return 0, fmt.Errorf("Rate must be between 0 and 1")
+	}
+	return r, nil
+}
+
+func (c *Chaos) String() string {
+	return fmt.Sprintf("latency=%s,jitter=%s,drop=%g,partial=%g,disconnect=%g", c.Latency, c.Jitter, c.DropRate, c.PartialRate, c.DisconnectRate)
+}
+
+// Wrap returns conn with the chaos applied to what is written to it
+func (c *Chaos) Wrap(conn net.Conn) net.Conn {
+	return &chaosConn{Conn: conn, chaos: c}
+}
+
+// delay returns how long to hold back a write
+func (c *Chaos) delay() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d := c.Latency
+	if c.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(c.Jitter)))
+	}
+	return d
+}
+
+// happens tells whether something with probability rate happens this time
+func (c *Chaos) happens(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rand.Float64() < rate
+}
+
+// split picks where to cut a write of n bytes, somewhere inside it
+func (c *Chaos) split(n int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return 1 + c.rand.Intn(n-1)
+}
+
+type chaosConn struct {
+	net.Conn
+	chaos *Chaos
+	// writeLock keeps concurrent writes from passing each other while
+	// they're held back
+	writeLock sync.Mutex
+}
+
+func (cc *chaosConn) Write(b []byte) (int, error) {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+
+	if d := cc.chaos.delay(); d > 0 {
+		clock.Sleep(d)
+	}
+	if cc.chaos.happens(cc.chaos.DropRate) {
+		log.Debugf("Chaos: dropping write of %d bytes to %s", len(b), cc.RemoteAddr())
+		return len(b), nil
+	}
+	if len(b) > 1 && cc.chaos.happens(cc.chaos.DisconnectRate) {
+		log.Debugf("Chaos: disconnecting %s in the middle of a write", cc.RemoteAddr())
+		cc.Conn.Write(b[:cc.chaos.split(len(b))])
+		cc.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	if len(b) > 1 && cc.chaos.happens(cc.chaos.PartialRate) {
+		at := cc.chaos.split(len(b))
+		n, err := cc.Conn.Write(b[:at])
+		if err != nil {
+			return n, err
+		}
+		if d := cc.chaos.delay(); d > 0 {
+			clock.Sleep(d)
+		}
+		m, err := cc.Conn.Write(b[at:])
+		return n + m, err
+	}
+	return cc.Conn.Write(b)
+}
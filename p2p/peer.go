@@ -7,9 +7,18 @@ import (
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
 	p2poolnet "github.com/gertjaap/p2pool-go/net"
 	"github.com/gertjaap/p2pool-go/util"
 	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+const (
+	ProtocolVersion = 1800
+	// SubVersion identifies our software to peers
+	SubVersion = "p2pool-go/0.0.1"
 )
 
 type Peer struct {
@@ -18,21 +27,26 @@ type Peer struct {
 	RemotePort int
 	Network    p2poolnet.Network
 
-	newPeers    chan []wire.Addr
-	sharesChan  chan []wire.Share
-	versionInfo *wire.MsgVersion
+	newPeers      chan []wire.Addr
+	shareChain    *work.ShareChain
+	bestBlockChan chan *chainhash.Hash
+	txCache       *work.TxCache
+	versionInfo   *wire.MsgVersion
+	log           *logging.SubsystemLogger
 }
 
-func NewPeer(ip net.IP, port int, n p2poolnet.Network, newPeers chan []wire.Addr, closed chan bool, sharesChan chan []wire.Share) (*Peer, error) {
-	p := Peer{Network: n, newPeers: newPeers, sharesChan: sharesChan}
+// NewPeer does the handshake with the peer at ip and port on conn, telling
+// it we're at localIP, or the public IP looked up if that's nil. The peer
+// logs to l, or the package's logger if l is nil.
+func NewPeer(conn *wire.P2PoolConnection, ip net.IP, port int, localIP net.IP, n p2poolnet.Network, newPeers chan []wire.Addr, closed chan bool, sc *work.ShareChain, bestBlockChan chan *chainhash.Hash, txCache *work.TxCache, l *logging.SubsystemLogger) (*Peer, error) {
+	p := Peer{Connection: conn, Network: n, newPeers: newPeers, shareChain: sc, bestBlockChan: bestBlockChan, txCache: txCache, log: l.Or(log)}
 	p.RemoteIP = ip
-	var err error
-	p.Connection, err = wire.NewP2PoolClient(ip, port, n)
-	if err != nil {
-		return nil, err
+	p.RemotePort = port
+	if port == 0 {
+		p.RemotePort = n.P2PPort
 	}
 
-	err = p.Handshake()
+	err := p.Handshake(localIP)
 	if err != nil {
 		p.Connection.Close()
 		return nil, err
@@ -53,10 +67,20 @@ func (p *Peer) BestShare() *chainhash.Hash {
 	return p.versionInfo.BestShareHash
 }
 
+// RemoteVersion returns the software version the peer announced
+func (p *Peer) RemoteVersion() string {
+	return p.versionInfo.SubVersion
+}
+
+// PingLoop pings the peer until the connection is closed
 func (p *Peer) PingLoop() {
 	for {
-		time.Sleep(time.Second * 15)
-		p.Connection.Outgoing <- &wire.MsgPing{}
+		select {
+		case <-clock.After(time.Second * 15):
+		case <-p.Connection.Done():
+			return
+		}
+		p.Connection.Send(&wire.MsgPing{})
 	}
 }
 
@@ -66,26 +90,50 @@ func (p *Peer) IncomingLoop() {
 		case *wire.MsgAddrs:
 			p.newPeers <- t.Addresses
 		case *wire.MsgShares:
-			p.sharesChan <- t.Shares
+			p.shareChain.SharesChannel <- work.ReceivedShares{Peer: p.RemoteIP.String(), Shares: t.Shares, New: true}
 		case *wire.MsgShareReply:
-			p.sharesChan <- t.Shares
+			p.shareChain.SharesChannel <- work.ReceivedShares{Peer: p.RemoteIP.String(), Shares: t.Shares}
+		case *wire.MsgShareReq:
+			shares, err := p.shareChain.GetShares(t.Hashes, t.Parents, t.Stops)
+			if err != nil {
+				p.log.Warnf("Could not get the shares %s asked for: %s", p.RemoteIP.String(), err.Error())
+				shares = nil
+			}
+			if len(shares) > 0 {
+				p.log.Debugf("Sending %d shares to %s", len(shares), p.RemoteIP.String())
+			}
+			p.Connection.Send(&wire.MsgShareReply{ID: t.ID, Result: wire.MsgShareReplyResultGood, Shares: shares})
+		case *wire.MsgRememberTx:
+			// Transactions of shares the peer is about to send us
+			if p.txCache != nil {
+				p.txCache.Add(t.TXs...)
+			}
+		case *wire.MsgBestBlock:
+			h := t.BestBlock.BlockHash()
+			select {
+			case p.bestBlockChan <- &h:
+			default:
+			}
 		}
 	}
 }
 
 func (p *Peer) AskNewAddresses(count int32) {
-	p.Connection.Outgoing <- &wire.MsgGetAddrs{
+	p.Connection.Send(&wire.MsgGetAddrs{
 		Count: count,
-	}
+	})
 }
 
-func (p *Peer) Handshake() error {
-	myIP, err := util.GetMyPublicIP()
-	if err != nil {
-		panic(err)
+func (p *Peer) Handshake(myIP net.IP) error {
+	if myIP == nil {
+		var err error
+		myIP, err = util.GetMyPublicIP()
+		if err != nil {
+			panic(err)
+		}
 	}
-	p.Connection.Outgoing <- &wire.MsgVersion{
-		Version:  1800,
+	p.Connection.Send(&wire.MsgVersion{
+		Version:  ProtocolVersion,
 		Services: 0,
 		AddrTo: wire.P2PoolAddress{
 			Services: 0,
@@ -97,10 +145,11 @@ func (p *Peer) Handshake() error {
 			Address:  myIP,
 			Port:     int16(p.Network.P2PPort),
 		},
-		Nonce:      int64(rand.Uint64()),
-		SubVersion: "p2pool-go/0.0.1",
-		Mode:       1,
-	}
+		Nonce:         int64(rand.Uint64()),
+		SubVersion:    SubVersion,
+		Mode:          1,
+		BestShareHash: p.shareChain.GetTipHash(),
+	})
 	select {
 	case msg := <-p.Connection.Incoming:
 		var ok bool
@@ -108,8 +157,10 @@ func (p *Peer) Handshake() error {
 		if !ok {
 			return fmt.Errorf("First message received from peer was not version message")
 		}
-	case <-time.After(5 * time.Second):
+	case <-clock.After(5 * time.Second):
 		return fmt.Errorf("Timeout waiting for version message from peer")
+	case <-p.Connection.Done():
+		return fmt.Errorf("Connection closed before the peer sent its version")
 	}
 	return nil
 }
@@ -1,30 +1,65 @@
 package p2p
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/gertjaap/p2pool-go/clock"
 	"github.com/gertjaap/p2pool-go/util"
 	"github.com/gertjaap/p2pool-go/work"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/events"
 	"github.com/gertjaap/p2pool-go/logging"
 	p2poolnet "github.com/gertjaap/p2pool-go/net"
 	"github.com/gertjaap/p2pool-go/wire"
 )
 
+var log = logging.For("p2p")
+
 type PeerManager struct {
-	Network           p2poolnet.Network
+	Network          p2poolnet.Network
+	BestBlockChannel chan *chainhash.Hash
+	// TxCache gets the transactions peers send us
+	TxCache *work.TxCache
+	// BansFile keeps the banned peers between restarts, if set
+	BansFile string
+	// MaxPeers caps the number of peers we're connected to, and
+	// MaxAddresses the number of peer addresses we remember, if set
+	MaxPeers     int
+	MaxAddresses int
+	// LocalIP is the address we tell peers we're at. If nil it's looked
+	// up from a public service.
+	LocalIP net.IP
+	// Transport wraps the connections to peers, like Chaos.Wrap does, if
+	// set
+	Transport func(net.Conn) net.Conn
+	// Log gets the records about peers, the package's logger if nil. The
+	// connections log to it as the wire subsystem.
+	Log *logging.SubsystemLogger
+
 	peers             []*Peer
 	possiblePeers     []wire.Addr
 	shareChain        *work.ShareChain
 	askSharesChan     chan *chainhash.Hash
 	peersLock         sync.Mutex
 	possiblePeersLock sync.Mutex
+	banned            map[string]bool
+	allowed           map[string]bool
+	closed            bool
+	bannedLock        sync.Mutex
+	// ctx is done once the manager is closed, which closes the connections
+	// and ends the loops and dials
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewPeerManager(n p2poolnet.Network, sc *work.ShareChain) *PeerManager {
+func NewPeerManager(n p2poolnet.Network, sc *work.ShareChain, txCache *work.TxCache) *PeerManager {
 	p := &PeerManager{
 		Network:           n,
 		peers:             make([]*Peer, 0),
@@ -32,11 +67,15 @@ func NewPeerManager(n p2poolnet.Network, sc *work.ShareChain) *PeerManager {
 		peersLock:         sync.Mutex{},
 		possiblePeersLock: sync.Mutex{},
 		shareChain:        sc,
+		TxCache:           txCache,
 		askSharesChan:     make(chan *chainhash.Hash, 100),
+		BestBlockChannel:  make(chan *chainhash.Hash, 10),
+		banned:            map[string]bool{},
 	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
 	for _, h := range n.SeedHosts {
-		addrs, err := net.LookupIP(h)
+		addrs, err := net.DefaultResolver.LookupIP(p.ctx, "ip", h)
 		if err == nil {
 			a := wire.Addr{
 				Address: wire.P2PoolAddress{
@@ -52,27 +91,32 @@ func NewPeerManager(n p2poolnet.Network, sc *work.ShareChain) *PeerManager {
 	return p
 }
 
+func (p *PeerManager) logger() *logging.SubsystemLogger {
+	return p.Log.Or(log)
+}
+
 func (p *PeerManager) MonitorPeerCount() {
-	for {
-		if len(p.peers) > 0 {
-			time.Sleep(time.Second * 10)
+	for p.ctx.Err() == nil {
+		if p.GetPeerCount() > 0 {
+			clock.SleepContext(p.ctx, time.Second*10)
 		}
-		for len(p.peers) < 1 {
+		for p.GetPeerCount() < 1 && p.ctx.Err() == nil {
 			tryPeer := p.GetPossiblePeer()
 			if tryPeer.Timestamp == -1 {
-				logging.Debugf("Not enough peers, and no possible peers to try. Asking existing peers for new peers")
+				p.logger().Debugf("Not enough peers, and no possible peers to try. Asking existing peers for new peers")
 				// No peers left to try. Ask for more.
-				for _, peer := range p.peers {
+				for _, peer := range p.GetPeers() {
 					peer.AskNewAddresses(10)
 				}
+				clock.SleepContext(p.ctx, time.Second)
 				break
 			}
 			peerAddress := tryPeer.Address.Address
-			logging.Debugf("Trying peer %s", peerAddress.String())
+			p.logger().Debugf("Trying peer %s", peerAddress.String())
 
 			err := p.AddPeerWithPort(peerAddress, int(tryPeer.Address.Port))
 			if err != nil {
-				logging.Warnf("Peer %s failed: %s", peerAddress.String(), err.Error())
+				p.logger().Warnf("Peer %s failed: %s", peerAddress.String(), err.Error())
 				p.RemovePossiblePeer(tryPeer)
 			}
 		}
@@ -80,24 +124,41 @@ func (p *PeerManager) MonitorPeerCount() {
 }
 
 func (p *PeerManager) ShareAskLoop() {
-	for {
-		if len(p.peers) > 0 {
-			h := <-p.askSharesChan
-			for _, pr := range p.peers {
+	for p.ctx.Err() == nil {
+		if p.GetPeerCount() > 0 {
+			var h *chainhash.Hash
+			select {
+			case h = <-p.askSharesChan:
+			case <-p.ctx.Done():
+				return
+			}
+			for _, pr := range p.GetPeers() {
 				stops := make([]*chainhash.Hash, 0)
 				tip := p.shareChain.GetTipHash()
 				if tip != nil {
 					stops = append(stops, tip)
 				}
-				pr.Connection.Outgoing <- &wire.MsgShareReq{
+				pr.Connection.Send(&wire.MsgShareReq{
 					ID:      util.GetRandomId(),
 					Parents: 1000,
 					Stops:   stops,
 					Hashes:  []*chainhash.Hash{h},
-				}
+				})
 			}
 		}
-		time.Sleep(time.Second * 1)
+		clock.SleepContext(p.ctx, time.Second*1)
+	}
+}
+
+// BroadcastShares sends shares to all connected peers
+func (p *PeerManager) BroadcastShares(shares []wire.Share) {
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
+	for _, s := range shares {
+		p.logger().Trace(s.TraceID).Debugf("Relaying share %s to %d peers", s.Hash.String(), len(p.peers))
+	}
+	for _, pr := range p.peers {
+		pr.Connection.Send(&wire.MsgShares{Shares: shares})
 	}
 }
 
@@ -106,9 +167,15 @@ func (p *PeerManager) AskForShare(h *chainhash.Hash) {
 }
 
 func (p *PeerManager) GetPossiblePeer() wire.Addr {
+	peers := p.GetPeers()
+	p.possiblePeersLock.Lock()
+	defer p.possiblePeersLock.Unlock()
 	for _, pos := range p.possiblePeers {
+		if !p.mayConnect(pos.Address.Address) {
+			continue
+		}
 		alreadyAPeer := false
-		for _, pr := range p.peers {
+		for _, pr := range peers {
 			if pr.RemoteIP.String() == pos.Address.Address.String() {
 				alreadyAPeer = true
 				break
@@ -138,15 +205,52 @@ func (p *PeerManager) AddPeer(ip net.IP) error {
 }
 
 func (p *PeerManager) AddPeerWithPort(ip net.IP, port int) error {
+	err := p.mayAdd(ip)
+	if err != nil {
+		return err
+	}
+	conn, err := wire.DialP2PoolContext(p.ctx, ip, port, p.Network)
+	if err != nil {
+		return err
+	}
+	return p.AddPeerConn(conn, ip, port)
+}
+
+// AddPeerConn adds the peer at ip and port on an established connection,
+// like one end of a net.Pipe
+func (p *PeerManager) AddPeerConn(conn net.Conn, ip net.IP, port int) error {
+	err := p.mayAdd(ip)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if p.Transport != nil {
+		conn = p.Transport(conn)
+	}
+	return p.addPeer(wire.NewP2PoolConnectionContext(p.ctx, conn, p.Network, p.logger().For("wire")), ip, port)
+}
+
+func (p *PeerManager) mayAdd(ip net.IP) error {
+	if !p.mayConnect(ip) {
+		return fmt.Errorf("Peer %s is banned or not allowed", ip.String())
+	}
+	if p.MaxPeers > 0 && p.GetPeerCount() >= p.MaxPeers {
+		return fmt.Errorf("Already connected to %d peers", p.MaxPeers)
+	}
+	return nil
+}
+
+func (p *PeerManager) addPeer(conn *wire.P2PoolConnection, ip net.IP, port int) error {
 	newPeers := make(chan []wire.Addr, 10)
 	closed := make(chan bool, 1)
-	peer, err := NewPeer(ip, port, p.Network, newPeers, closed, p.shareChain.SharesChannel)
+	peer, err := NewPeer(conn, ip, port, p.LocalIP, p.Network, newPeers, closed, p.shareChain, p.BestBlockChannel, p.TxCache, p.logger())
 	if err != nil {
 		return err
 	}
 	p.peersLock.Lock()
 	p.peers = append(p.peers, peer)
 	p.peersLock.Unlock()
+	events.PublishOn(p.Network.Name, events.PeerConnected, peerEvent(peer))
 
 	stops := make([]*chainhash.Hash, 0)
 	tip := p.shareChain.GetTipHash()
@@ -157,14 +261,18 @@ func (p *PeerManager) AddPeerWithPort(ip net.IP, port int) error {
 			skipAsk = true
 		}
 	}
+	if peer.versionInfo.BestShareHash.IsEqual(&chainhash.Hash{}) {
+		// The peer has no shares yet
+		skipAsk = true
+	}
 
 	if !skipAsk {
-		peer.Connection.Outgoing <- &wire.MsgShareReq{
+		peer.Connection.Send(&wire.MsgShareReq{
 			ID:      util.GetRandomId(),
 			Parents: 1000,
 			Stops:   stops,
 			Hashes:  []*chainhash.Hash{peer.versionInfo.BestShareHash},
-		}
+		})
 	}
 
 	go p.NewPeersHandler(newPeers)
@@ -176,6 +284,10 @@ func (p *PeerManager) NewPeersHandler(c chan []wire.Addr) {
 	for a := range c {
 		p.possiblePeersLock.Lock()
 		p.possiblePeers = append(p.possiblePeers, a...)
+		if p.MaxAddresses > 0 && len(p.possiblePeers) > p.MaxAddresses {
+			// Keep the newest
+			p.possiblePeers = append([]wire.Addr{}, p.possiblePeers[len(p.possiblePeers)-p.MaxAddresses:]...)
+		}
 		p.possiblePeersLock.Unlock()
 	}
 
@@ -192,8 +304,107 @@ func (p *PeerManager) ClosedHandler(peer *Peer, c chan bool) {
 	}
 	p.peers = newPeers
 	p.peersLock.Unlock()
+	events.PublishOn(p.Network.Name, events.PeerDisconnected, peerEvent(peer))
+}
+
+func peerEvent(peer *Peer) events.Peer {
+	return events.Peer{
+		Address: net.JoinHostPort(peer.RemoteIP.String(), strconv.Itoa(peer.RemotePort)),
+		Version: peer.RemoteVersion(),
+	}
 }
 
 func (p *PeerManager) GetPeerCount() int {
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
 	return len(p.peers)
 }
+
+// GetPeers returns the peers we are currently connected to
+func (p *PeerManager) GetPeers() []*Peer {
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
+	return append([]*Peer{}, p.peers...)
+}
+
+// Ban disconnects from a peer and keeps us from connecting to it again
+func (p *PeerManager) Ban(ip net.IP) {
+	p.bannedLock.Lock()
+	p.banned[ip.String()] = true
+	p.bannedLock.Unlock()
+	err := p.saveBans()
+	if err != nil {
+		p.logger().Warnf("Could not save banned peers: %s", err.Error())
+	}
+	for _, peer := range p.GetPeers() {
+		if peer.RemoteIP.Equal(ip) {
+			p.logger().Infof("Disconnecting banned peer %s", ip.String())
+			peer.Connection.Close()
+		}
+	}
+}
+
+func (p *PeerManager) Unban(ip net.IP) {
+	p.bannedLock.Lock()
+	delete(p.banned, ip.String())
+	p.bannedLock.Unlock()
+	err := p.saveBans()
+	if err != nil {
+		p.logger().Warnf("Could not save banned peers: %s", err.Error())
+	}
+}
+
+func (p *PeerManager) IsBanned(ip net.IP) bool {
+	p.bannedLock.Lock()
+	defer p.bannedLock.Unlock()
+	return p.banned[ip.String()]
+}
+
+// SetAllowed restricts us to connecting to the given peers only, an empty
+// list lifts the restriction. Connected peers not in the list are dropped.
+func (p *PeerManager) SetAllowed(ips []net.IP) {
+	p.bannedLock.Lock()
+	p.allowed = map[string]bool{}
+	for _, ip := range ips {
+		p.allowed[ip.String()] = true
+	}
+	p.bannedLock.Unlock()
+	for _, peer := range p.GetPeers() {
+		if !p.mayConnect(peer.RemoteIP) {
+			p.logger().Infof("Disconnecting peer %s, it is not allowed anymore", peer.RemoteIP.String())
+			peer.Connection.Close()
+		}
+	}
+}
+
+// mayConnect tells whether a peer is neither banned nor left out of the
+// allowed peers
+func (p *PeerManager) mayConnect(ip net.IP) bool {
+	p.bannedLock.Lock()
+	defer p.bannedLock.Unlock()
+	if p.closed || p.banned[ip.String()] {
+		return false
+	}
+	return len(p.allowed) == 0 || p.allowed[ip.String()]
+}
+
+// Close disconnects from all peers, stops dials in progress and keeps us
+// from connecting to new ones
+func (p *PeerManager) Close() {
+	p.bannedLock.Lock()
+	p.closed = true
+	p.bannedLock.Unlock()
+	p.cancel()
+}
+
+// Banned returns the addresses of the banned peers
+func (p *PeerManager) Banned() []string {
+	p.bannedLock.Lock()
+	defer p.bannedLock.Unlock()
+	banned := make([]string, 0, len(p.banned))
+	for ip := range p.banned {
+		banned = append(banned, ip)
+	}
+	sort.Strings(banned)
+	return banned
+}
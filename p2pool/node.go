@@ -0,0 +1,610 @@
+// Package p2pool runs a p2pool node inside another Go program. A Node is
+// built from a Config and started and stopped by the program, which keeps
+// control of the process: the node doesn't read flags, catch signals or
+// exit, and logs to the handler of its Config rather than setting up the
+// process-wide logging. Several nodes can run in one process, on the same
+// network or on different ones, each with its own data directory, ports and
+// log handler.
+// What happens in the nodes can be followed with the hooks of package
+// events, like events.OnBlockFound, whose events name the network they
+// happened on.
+package p2pool
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/datadir"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/graph"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/notify"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/pow"
+	"github.com/gertjaap/p2pool-go/replica"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/web"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// Config is what a node is built from. The zero value of most fields is a
+// sensible default, Network and DataDir are required.
+type Config struct {
+	Network p2pnet.Network
+	DataDir *datadir.DataDir
+	// Name tags the node's log records, to tell nodes in one process
+	// apart
+	Name string
+	// LogHandler gets all the node's records and decides which levels it
+	// takes. If nil they go to the output set in package logging.
+	LogHandler slog.Handler
+
+	// Daemons are the RPC URLs of the coin daemons. Without any, the node
+	// follows the sharechain but doesn't serve miners.
+	Daemons []string
+	// RPCCookieFile is used for daemons given without user and password
+	RPCCookieFile string
+	// RPCCAFile is a CA certificate (PEM) to trust for daemons on https
+	RPCCAFile  string
+	RPCTimeout time.Duration
+
+	MaxBlockWeight   int64
+	MinFeeRate       float64
+	Signal           []string
+	NoSignal         []string
+	ProposeTemplates bool
+	CoinbaseTag      string
+
+	// PeersFile keeps known peer addresses between runs, relative to the
+	// data directory. Disabled if empty.
+	PeersFile    string
+	MaxPeers     int
+	MaxAddresses int
+	// Chaos, if set, degrades the peer connections for testing
+	Chaos *p2p.Chaos
+
+	MaxShares   int
+	CommitDelay time.Duration
+	ClockSkew   time.Duration
+	// ValidationWorkers limits how many shares are hashed at the same time,
+	// 0 for no limit. Proof of work hashes are expensive, on small machines
+	// peers sending shares at once can starve everything else.
+	ValidationWorkers int
+
+	// StratumPort is the port miners connect to, the network's if 0
+	StratumPort     int
+	StratumTLSPort  int
+	StratumTLSCert  string
+	StratumTLSKey   string
+	SV2Port         int
+	SV2AuthorityKey string
+	// DefaultAddress is mined to for miners without a valid address
+	DefaultAddress  string
+	NiceHashMinDiff float64
+	StaleGrace      time.Duration
+	// DrainHost and DrainPort are where miners are sent when the node
+	// stops, DrainDelay after. No miners are sent anywhere without a host.
+	DrainHost  string
+	DrainPort  int
+	DrainDelay time.Duration
+
+	// WebPort is the port of the HTTP API, disabled if 0
+	WebPort int
+	// WebTLSCert and WebTLSKey serve the HTTP API over TLS
+	WebTLSCert string
+	WebTLSKey  string
+	// WebACMEDomains serve the HTTP API over TLS with certificates from
+	// Let's Encrypt, kept in the data directory
+	WebACMEDomains []string
+	WebACMEEmail   string
+	// ControlPort is the port of the control API, disabled if 0
+	ControlPort int
+	AdminToken  string
+	// GatewayToken lets stratum gateways get work over the control API,
+	// disabled if empty
+	GatewayToken string
+	ReadTokens   []string
+	CORSOrigins  []string
+	WebCacheTTL  time.Duration
+	WebRateLimit float64
+	WebRateBurst int
+	Diagnostics  bool
+	// GraphFile keeps the statistics history for graphs, relative to the
+	// data directory. Disabled if empty.
+	GraphFile      string
+	StatsRetention time.Duration
+
+	// ReplicationPort serves the sharechain and miner registry to standby
+	// nodes, disabled if 0
+	ReplicationPort int
+	// ReplicationKey is the key primary and standby authenticate each
+	// other with
+	ReplicationKey string
+	// StandbyOf, if set, makes the node a hot standby of the primary with
+	// its replication port at this host:port. It serves miners only once
+	// the primary is gone for StandbyTimeout.
+	StandbyOf      string
+	StandbyTimeout time.Duration
+
+	// Settings are those that can be changed with Apply while running
+	Settings Settings
+}
+
+// Settings are the settings of a node that can change while it runs
+type Settings struct {
+	AllowPeers []net.IP
+	BanPeers   []net.IP
+	// Donation is the percentage of our shares' payouts donated to the p2pool
+	// developers
+	Donation   float64
+	Fee        float64
+	FeeAddress string
+	Notifiers  []notify.Notifier
+	// NotifyEvents are sent to the notifiers, notify.DefaultEvents if empty
+	NotifyEvents  []events.Type
+	VarDiffTarget time.Duration
+	VarDiffMin    float64
+	VarDiffMax    float64
+}
+
+// Node is a p2pool node and its parts, which are there for the embedding
+// program to use once New returns
+type Node struct {
+	Config      Config
+	ShareChain  *work.ShareChain
+	WorkManager *work.WorkManager
+	Peers       *p2p.PeerManager
+	Submitter   *work.BlockSubmitter
+	Blocks      *work.PoolBlockLog
+	// Stratum serves miners, nil without daemons
+	Stratum *stratum.Server
+	// Web serves the HTTP API, nil without a web port. Its Reload and
+	// Shutdown can be set before Start.
+	Web *web.Server
+	// Replication serves standbys, nil without a replication port
+	Replication *replica.Primary
+	// Standby follows the primary, nil unless the node is a standby
+	Standby *replica.Standby
+	// Errors receives what stops the node from running on after Start, like
+	// a sharechain that could not be loaded. The node should be stopped
+	// without saving then, or a new chain replaces the file.
+	Errors chan error
+
+	log          *logging.SubsystemLogger
+	daemons      *work.DaemonPool
+	settingsLock sync.Mutex
+	banned       []net.IP
+	notifySub    *events.Subscription
+	// cancel stops what Start started
+	cancel context.CancelFunc
+}
+
+// New builds a node from cfg, without starting anything
+func New(cfg Config) (*Node, error) {
+	if cfg.DataDir == nil {
+		return nil, fmt.Errorf("No data directory given")
+	}
+	if cfg.Network.Name == "" {
+		return nil, fmt.Errorf("No network given")
+	}
+	if cfg.ValidationWorkers > 0 {
+		cfg.Network.ShareHashSlots = make(chan struct{}, cfg.ValidationWorkers)
+	}
+	nw := cfg.Network
+	n := &Node{Config: cfg, Errors: make(chan error, 1), log: logging.For("").WithHandler(cfg.LogHandler)}
+	if cfg.Name != "" {
+		n.log = n.log.With("node", cfg.Name)
+	}
+	err := work.ValidateCoinbaseTag(cfg.CoinbaseTag, nw)
+	if err != nil {
+		return nil, err
+	}
+	// A node paying out otherwise than its peers would have all its shares
+	// rejected
+	_, err = work.GetPayoutPolicy(nw.PayoutPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := DaemonClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	n.Submitter = work.NewBlockSubmitter(clients, work.NewFoundBlockJournal(cfg.DataDir.File(datadir.FoundBlocksFile)))
+	n.Submitter.Network = nw.Name
+	n.Submitter.Log = n.log.For("chain")
+	n.ShareChain = work.NewShareChain(nw)
+	n.ShareChain.Log = n.log.For("chain")
+	n.ShareChain.Clock.Log = n.log.For("chain")
+	n.ShareChain.DataFile = cfg.DataDir.File(datadir.ShareChainFile)
+	n.ShareChain.MaxShares = cfg.MaxShares
+	n.ShareChain.CommitDelay = cfg.CommitDelay
+	if cfg.ClockSkew != 0 {
+		n.ShareChain.Clock.Tolerance = cfg.ClockSkew
+	}
+	n.Blocks = work.NewPoolBlockLog(cfg.DataDir.File(datadir.PoolBlocksFile))
+	n.Blocks.Log = n.log.For("chain")
+	if len(clients) > 0 {
+		n.daemons = work.NewDaemonPool(clients, nw)
+		n.daemons.Log = n.log.For("rpc")
+	}
+
+	wm := work.NewWorkManager(nw, n.ShareChain, n.daemons, n.Submitter)
+	wm.Log = n.log.For("chain")
+	if cfg.MaxBlockWeight != 0 {
+		err = work.CheckMaxBlockWeight(cfg.MaxBlockWeight)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maximum block weight: %s", err.Error())
+		}
+		wm.MaxBlockWeight = cfg.MaxBlockWeight
+	}
+	wm.MinFeeRate = cfg.MinFeeRate
+	wm.ProposeTemplates = cfg.ProposeTemplates
+	if nw.Regtest {
+		// Nobody to get a sharechain from, we start our own
+		wm.SoloTimeout = 0
+	}
+	wm.VersionBits = work.VersionBits{Signal: cfg.Signal, NoSignal: cfg.NoSignal}
+	wm.CoinbaseTag = cfg.CoinbaseTag
+	n.WorkManager = wm
+
+	n.Peers = p2p.NewPeerManager(nw, n.ShareChain, wm.TxCache)
+	n.Peers.MaxPeers = cfg.MaxPeers
+	n.Peers.MaxAddresses = cfg.MaxAddresses
+	n.Peers.BansFile = cfg.DataDir.File(datadir.BansFile)
+	n.Peers.Log = n.log.For("p2p")
+	if cfg.Chaos != nil {
+		n.Peers.Transport = cfg.Chaos.Wrap
+	}
+
+	if n.daemons != nil {
+		port := cfg.StratumPort
+		if port == 0 {
+			port = nw.StratumPort
+		}
+		ss := stratum.NewServer(port, nw, wm)
+		ss.Log = n.log.For("stratum")
+		ss.NiceHashMinDifficulty = cfg.NiceHashMinDiff
+		if cfg.StaleGrace != 0 {
+			ss.StaleGrace = cfg.StaleGrace
+		}
+		if cfg.DefaultAddress != "" {
+			ss.DefaultAddress = work.NormalizeAddress(cfg.DefaultAddress, nw)
+			_, _, err = work.AddressToPubKeyHash(ss.DefaultAddress, nw)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid default address: %s", err.Error())
+			}
+		}
+		n.Stratum = ss
+		wm.AddressRate = ss.PayoutHashRate
+	}
+
+	if cfg.WebPort != 0 || cfg.ControlPort != 0 {
+		ws := web.NewServer(cfg.WebPort, wm, n.Stratum, n.Peers)
+		ws.ControlPort = cfg.ControlPort
+		ws.Log = n.log.For("web")
+		ws.TLSCert = cfg.WebTLSCert
+		ws.TLSKey = cfg.WebTLSKey
+		if len(cfg.WebACMEDomains) > 0 {
+			ws.ACMEDomains = cfg.WebACMEDomains
+			ws.ACMEEmail = cfg.WebACMEEmail
+			ws.ACMECache = cfg.DataDir.File(datadir.ACMEDir)
+		}
+		ws.AdminToken = cfg.AdminToken
+		ws.GatewayToken = cfg.GatewayToken
+		ws.ReadTokens = cfg.ReadTokens
+		ws.CORSOrigins = cfg.CORSOrigins
+		ws.Blocks = n.Blocks
+		ws.Diagnostics = cfg.Diagnostics
+		ws.CacheTTL = cfg.WebCacheTTL
+		ws.RateLimit = cfg.WebRateLimit
+		ws.RateBurst = cfg.WebRateBurst
+		if cfg.GraphFile != "" {
+			ws.Graphs = graph.NewDB(cfg.DataDir.File(cfg.GraphFile))
+			ws.Graphs.Retention = cfg.StatsRetention
+		}
+		n.Web = ws
+	}
+
+	if (cfg.ReplicationPort != 0 || cfg.StandbyOf != "") && cfg.ReplicationKey == "" {
+		return nil, fmt.Errorf("No replication key given")
+	}
+	if cfg.ReplicationPort != 0 {
+		n.Replication = replica.NewPrimary(cfg.ReplicationPort, cfg.ReplicationKey, n.ShareChain, n.Stratum)
+		n.Replication.Log = n.log.For("replica")
+	}
+	if cfg.StandbyOf != "" {
+		if n.Stratum == nil {
+			return nil, fmt.Errorf("A standby needs a daemon to take over the miners")
+		}
+		n.Standby = replica.NewStandby(cfg.StandbyOf, cfg.ReplicationKey, n.ShareChain, n.Stratum)
+		n.Standby.Log = n.log.For("replica")
+		if cfg.StandbyTimeout != 0 {
+			n.Standby.Timeout = cfg.StandbyTimeout
+		}
+	}
+	return n, nil
+}
+
+// DaemonClients creates the RPC clients for the daemons of cfg
+func DaemonClients(cfg Config) ([]*rpc.Client, error) {
+	adapter, err := rpc.GetAdapter(cfg.Network.DaemonAdapter)
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]*rpc.Client, 0, len(cfg.Daemons))
+	for _, d := range cfg.Daemons {
+		c, err := rpc.NewClient(d)
+		if err != nil {
+			return nil, err
+		}
+		c.Adapter = adapter
+		if c.User == "" && c.Password == "" {
+			c.CookieFile = cfg.RPCCookieFile
+		}
+		if cfg.RPCCAFile != "" {
+			tlsConfig, err := rpc.LoadTLSConfig(cfg.RPCCAFile)
+			if err != nil {
+				return nil, err
+			}
+			c.SetTLSConfig(tlsConfig)
+		}
+		if cfg.RPCTimeout != 0 {
+			c.SetTimeout(cfg.RPCTimeout)
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// Start loads the node's files, checks the daemons are on the right chain
+// and starts serving peers, miners and the web API. The sharechain loads in
+// the background, a failure to do so is sent to Errors. The node runs until
+// Stop is called, or stops working on templates and loading once ctx is
+// done.
+func (n *Node) Start(ctx context.Context) error {
+	ctx, n.cancel = context.WithCancel(ctx)
+	cfg := n.Config
+	if cfg.Network.PowAlgorithm == "verthash" && !pow.VerthashLoaded() {
+		return fmt.Errorf("Verthash data file not loaded")
+	}
+	for _, c := range n.Submitter.Daemons {
+		if c.DetectREST() {
+			n.log.Infof("Using REST interface of daemon %s", c.URL)
+		}
+	}
+	go func() {
+		err := n.Submitter.ResubmitPending()
+		if err != nil {
+			n.log.Errorf("Could not resubmit pending blocks: %s", err.Error())
+		}
+	}()
+
+	// Miners get solo work and peers are served while this runs
+	loaded := n.ShareChain.LoadAsync(ctx)
+	go func() {
+		err := <-loaded
+		if err != nil && ctx.Err() == nil {
+			n.Errors <- fmt.Errorf("Could not load the sharechain: %s", err.Error())
+		}
+	}()
+	err := n.Blocks.Load()
+	if err != nil {
+		return err
+	}
+	go n.Blocks.Run(n.ShareChain)
+
+	if n.daemons != nil {
+		err = n.daemons.VerifyNetwork()
+		if err != nil {
+			return err
+		}
+	}
+	if peersFile := cfg.DataDir.File(cfg.PeersFile); peersFile != "" {
+		err = n.Peers.LoadAddresses(peersFile)
+		if err != nil {
+			n.log.Warnf("Could not load peer addresses: %s", err.Error())
+		}
+	}
+	err = n.Peers.LoadBans()
+	if err != nil {
+		n.log.Warnf("Could not load banned peers: %s", err.Error())
+	}
+	err = n.Apply(cfg.Settings)
+	if err != nil {
+		return err
+	}
+
+	if n.Standby != nil {
+		// Templates are kept ready, so taking over only opens the ports
+		n.startWork(ctx)
+		n.Standby.TakeOver = func() {
+			err := n.listenStratum()
+			if err != nil {
+				n.log.Errorf("Could not take over the miners: %s", err.Error())
+			}
+		}
+		go n.Standby.Run(ctx)
+		n.log.Infof("Standby of %s, serving miners once it is gone", cfg.StandbyOf)
+	} else if n.Stratum != nil {
+		n.startWork(ctx)
+		err = n.listenStratum()
+		if err != nil {
+			return err
+		}
+	} else {
+		n.log.Warnf("No daemon configured, not serving miners")
+	}
+	if n.Replication != nil {
+		err = n.Replication.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	if n.Web != nil {
+		if n.Web.Graphs != nil {
+			err = n.Web.Graphs.Load()
+			if err != nil {
+				n.log.Warnf("%s, starting with empty graphs", err.Error())
+			}
+		}
+		err = n.Web.Listen()
+		if err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for s := range n.ShareChain.NeedShareChannel {
+			n.Peers.AskForShare(s)
+		}
+	}()
+	go func() {
+		for s := range n.WorkManager.LocalSharesChannel {
+			n.Peers.BroadcastShares([]wire.Share{s})
+		}
+	}()
+	return nil
+}
+
+// startWork keeps the templates for miners up to date
+func (n *Node) startWork(ctx context.Context) {
+	go n.WorkManager.Run(ctx)
+	go func() {
+		for h := range n.Peers.BestBlockChannel {
+			n.WorkManager.NotifyBlock(h)
+		}
+	}()
+}
+
+// listenStratum opens the stratum ports
+func (n *Node) listenStratum() error {
+	cfg := n.Config
+	err := n.Stratum.Listen()
+	if err != nil {
+		return err
+	}
+	if cfg.StratumTLSPort != 0 {
+		err = n.Stratum.ListenTLS(cfg.StratumTLSPort, cfg.StratumTLSCert, cfg.StratumTLSKey)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.SV2Port != 0 {
+		authority, err := stratum.LoadAuthorityKey(cfg.SV2AuthorityKey)
+		if err != nil {
+			return err
+		}
+		if cfg.SV2AuthorityKey == "" {
+			n.log.Warnf("No Stratum V2 authority key given, miners have to be reconfigured after every restart")
+		}
+		n.log.Infof("Stratum V2 authority public key: %s", stratum.AuthorityPubKeyString(authority))
+		err = n.Stratum.ListenV2(cfg.SV2Port, authority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply changes the settings of a running node. Nothing changes if one of
+// them is invalid.
+func (n *Node) Apply(s Settings) error {
+	n.settingsLock.Lock()
+	defer n.settingsLock.Unlock()
+	nw := n.Config.Network
+	err := n.WorkManager.SetDonation(s.Donation)
+	if err != nil {
+		return err
+	}
+	err = n.WorkManager.SetFee(s.Fee, work.NormalizeAddress(s.FeeAddress, nw))
+	if err != nil {
+		return err
+	}
+
+	n.Peers.SetAllowed(s.AllowPeers)
+	for _, ip := range n.banned {
+		n.Peers.Unban(ip)
+	}
+	for _, ip := range s.BanPeers {
+		n.Peers.Ban(ip)
+	}
+	n.banned = s.BanPeers
+	if n.Stratum != nil {
+		n.Stratum.SetVarDiff(s.VarDiffTarget, s.VarDiffMin, s.VarDiffMax)
+	}
+	if n.notifySub != nil {
+		n.notifySub.Close()
+		n.notifySub = nil
+	}
+	if len(s.Notifiers) > 0 {
+		types := s.NotifyEvents
+		if len(types) == 0 {
+			types = notify.DefaultEvents
+		}
+		n.notifySub = notify.Start(n.Config.Network.Name, s.Notifiers, types)
+	}
+	n.Config.Settings = s
+	return nil
+}
+
+// Save writes what the node only keeps in memory otherwise
+func (n *Node) Save() {
+	err := n.ShareChain.Commit()
+	if err != nil {
+		n.log.Errorf("Could not save sharechain: %s", err.Error())
+	}
+	if peersFile := n.Config.DataDir.File(n.Config.PeersFile); peersFile != "" {
+		err = n.Peers.SaveAddresses(peersFile)
+		if err != nil {
+			n.log.Warnf("Could not save peer addresses: %s", err.Error())
+		}
+	}
+	if n.Web != nil && n.Web.Graphs != nil {
+		err := n.Web.Graphs.Save()
+		if err != nil {
+			n.log.Warnf("Could not save graph data: %s", err.Error())
+		}
+	}
+}
+
+// Stop stops serving miners, sending them to the drain target if there is
+// one, closes the web API, saves the node's state and disconnects the
+// peers
+func (n *Node) Stop() {
+	cfg := n.Config
+	if n.cancel != nil {
+		n.cancel()
+	}
+	if n.Stratum != nil {
+		n.Stratum.Close()
+		if cfg.DrainHost != "" {
+			n.Stratum.Reconnect(cfg.DrainHost, cfg.DrainPort, cfg.DrainDelay)
+		}
+	}
+	if n.Replication != nil {
+		n.Replication.Close()
+	}
+	if n.Web != nil {
+		err := n.Web.Close()
+		if err != nil {
+			n.log.Warnf("Could not close web server: %s", err.Error())
+		}
+	}
+	n.Save()
+	n.Peers.Close()
+	if n.Stratum != nil && cfg.DrainHost != "" {
+		// Give the reconnect messages a moment to get out
+		time.Sleep(time.Second * 2)
+	}
+	if n.notifySub != nil {
+		n.notifySub.Close()
+	}
+}
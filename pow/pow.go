@@ -0,0 +1,79 @@
+package pow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/adamcollier1/lyra2rev3"
+	"github.com/gertjaap/p2pool-go/util"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PowHash computes the proof of work hash of a serialized block header. It
+// returns nil if the header can't be hashed, which is no valid hash.
+type PowHash func(header []byte) []byte
+
+var (
+	algorithms     = map[string]PowHash{}
+	algorithmsLock sync.RWMutex
+)
+
+func init() {
+	Register("sha256d", util.Sha256d)
+	Register("scrypt", Scrypt)
+	Register("lyra2rev3", Lyra2REv3)
+	Register("verthash", Verthash)
+}
+
+// Register makes an algorithm available to network definitions. Registering
+// an existing name replaces it.
+func Register(name string, f PowHash) {
+	algorithmsLock.Lock()
+	defer algorithmsLock.Unlock()
+	algorithms[name] = f
+}
+
+// Get returns the algorithm with the given name
+func Get(name string) (PowHash, error) {
+	algorithmsLock.RLock()
+	defer algorithmsLock.RUnlock()
+	f, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown proof of work algorithm %s", name)
+	}
+	return f, nil
+}
+
+// Algorithms returns the names of all registered algorithms
+func Algorithms() []string {
+	algorithmsLock.RLock()
+	defer algorithmsLock.RUnlock()
+	names := make([]string, 0, len(algorithms))
+	for n := range algorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Scrypt is scrypt with the parameters used by Litecoin and its forks
+// (N=1024, r=1, p=1), salted with the header itself. It returns nil if the
+// header can't be hashed.
+func Scrypt(header []byte) []byte {
+	res, err := scrypt.Key(header, header, 1024, 1, 1, 32)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// Lyra2REv3 is the algorithm Vertcoin used before verthash. It returns nil
+// if the header can't be hashed.
+func Lyra2REv3(header []byte) []byte {
+	res, err := lyra2rev3.SumV3(header)
+	if err != nil {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,107 @@
+package pow
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	verthashHeaderSize    = 80
+	verthashHashSize      = 32
+	verthashP0Size        = 64
+	verthashIterations    = 8
+	verthashSubsetSize    = verthashP0Size * verthashIterations
+	verthashRotations     = 32
+	verthashIndexes       = 4096
+	verthashByteAlignment = 16
+)
+
+var (
+	verthashData     []byte
+	verthashDataLock sync.RWMutex
+)
+
+// SetVerthashData sets the contents of the verthash data file used by the
+// Verthash algorithm
+func SetVerthashData(data []byte) {
+	verthashDataLock.Lock()
+	defer verthashDataLock.Unlock()
+	verthashData = data
+}
+
+// VerthashLoaded returns whether verthash data has been set
+func VerthashLoaded() bool {
+	verthashDataLock.RLock()
+	defer verthashDataLock.RUnlock()
+	return len(verthashData) >= verthashHashSize
+}
+
+// Verthash hashes an 80 byte header using the verthash data file set with
+// SetVerthashData. Without a data file no header can be valid, so it returns
+// the highest possible hash.
+func Verthash(header []byte) []byte {
+	verthashDataLock.RLock()
+	defer verthashDataLock.RUnlock()
+	if len(verthashData) < verthashHashSize || len(header) != verthashHeaderSize {
+		res := make([]byte, verthashHashSize)
+		for i := range res {
+			res[i] = 0xff
+		}
+		return res
+	}
+	return verthashSum(verthashData, header)
+}
+
+func fnv1a(a, b uint32) uint32 {
+	return (a ^ b) * 0x1000193
+}
+
+func verthashSum(data []byte, header []byte) []byte {
+	p1 := sha3.Sum256(header)
+
+	p0 := make([]byte, verthashSubsetSize)
+	in := make([]byte, verthashHeaderSize)
+	copy(in, header)
+	for i := 0; i < verthashIterations; i++ {
+		in[0]++
+		h := sha3.Sum512(in)
+		copy(p0[i*verthashP0Size:], h[:])
+	}
+
+	p0Words := make([]uint32, verthashSubsetSize/4)
+	for i := range p0Words {
+		p0Words[i] = binary.LittleEndian.Uint32(p0[i*4:])
+	}
+
+	seekIndexes := make([]uint32, 0, verthashIndexes)
+	for x := 0; x < verthashRotations; x++ {
+		seekIndexes = append(seekIndexes, p0Words...)
+		for y := range p0Words {
+			p0Words[y] = p0Words[y]<<1 | p0Words[y]>>31
+		}
+	}
+
+	var p1Words [verthashHashSize / 4]uint32
+	for i := range p1Words {
+		p1Words[i] = binary.LittleEndian.Uint32(p1[i*4:])
+	}
+
+	acc := uint32(0x811c9dc5)
+	mdiv := uint32((len(data)-verthashHashSize)/verthashByteAlignment) + 1
+	for _, idx := range seekIndexes {
+		offset := int(fnv1a(idx, acc)%mdiv) * verthashByteAlignment
+		for i := range p1Words {
+			value := binary.LittleEndian.Uint32(data[offset+i*4:])
+			p1Words[i] = fnv1a(p1Words[i], value)
+			acc = fnv1a(acc, value)
+		}
+	}
+
+	res := make([]byte, verthashHashSize)
+	for i, w := range p1Words {
+		binary.LittleEndian.PutUint32(res[i*4:], w)
+	}
+	return res
+}
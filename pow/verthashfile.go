@@ -0,0 +1,61 @@
+package pow
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gertjaap/p2pool-go/util"
+)
+
+// VerthashFileHash is the sha256 of the verthash data file every Verthash
+// coin uses. The file is deterministic, so any copy (for instance the one
+// generated by the coin daemon) can be used.
+const VerthashFileHash = "a55531e843cd56b010114aaf6325b0d529ecf88f8ad47639b6ededafd721aa48"
+
+// DefaultVerthashFile returns where the coin daemon keeps its copy of the
+// verthash data file by default
+func DefaultVerthashFile() string {
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "Vertcoin", "verthash.dat")
+	case "darwin":
+		return filepath.Join(home, "Library", "Application Support", "Vertcoin", "verthash.dat")
+	}
+	return filepath.Join(home, ".vertcoin", "verthash.dat")
+}
+
+// LoadVerthashFile maps the verthash data file into memory and makes it
+// available to the Verthash algorithm. If verify is set, the file's hash is
+// checked first, which reads the whole file once.
+func LoadVerthashFile(path string, verify bool) error {
+	data, err := util.MapFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not open verthash data file %s: %s. It is created by the coin daemon on first start, point -verthashfile at the daemon's copy", path, err.Error())
+	}
+
+	if verify {
+		err = VerifyVerthashData(data)
+		if err != nil {
+			util.UnmapFile(data)
+			return err
+		}
+	}
+
+	SetVerthashData(data)
+	return nil
+}
+
+// VerifyVerthashData checks the contents of a verthash data file against the
+// known hash
+func VerifyVerthashData(data []byte) error {
+	h := sha256.Sum256(data)
+	if hex.EncodeToString(h[:]) != VerthashFileHash {
+		return fmt.Errorf("Verthash data file is corrupt: hash %x, expected %s", h, VerthashFileHash)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Package rejects counts refused shares and messages by layer and reason, so
+// a spike in one kind of rejection can be told apart from the others.
+package rejects
+
+import (
+	"sort"
+	"sync"
+)
+
+type Layer string
+
+const (
+	// Stratum rejections are submissions from our miners we refused
+	Stratum = Layer("stratum")
+	// P2P rejections are shares and messages from peers we refused
+	P2P = Layer("p2p")
+)
+
+// Reasons used by more than one layer. Layers count other reasons under
+// their own names.
+const (
+	Stale         = "stale"
+	Duplicate     = "duplicate"
+	LowDifficulty = "low-difficulty"
+	BadPoW        = "bad-pow"
+	BadGenTx      = "bad-gentx"
+	Oversized     = "oversized"
+	NonCanonical  = "non-canonical"
+	BadTimestamp  = "bad-timestamp"
+)
+
+// Count is one counter, as returned by Counts
+type Count struct {
+	Layer  Layer  `json:"layer"`
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+type key struct {
+	layer  Layer
+	reason string
+}
+
+var (
+	counts     = map[key]uint64{}
+	countsLock sync.Mutex
+)
+
+// Add counts a rejection
+func Add(layer Layer, reason string) {
+	countsLock.Lock()
+	counts[key{layer, reason}]++
+	countsLock.Unlock()
+}
+
+// Counts returns the rejections counted since the node started, sorted by
+// layer and reason
+func Counts() []Count {
+	countsLock.Lock()
+	res := make([]Count, 0, len(counts))
+	for k, n := range counts {
+		res = append(res, Count{Layer: k.layer, Reason: k.reason, Count: n})
+	}
+	countsLock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Layer != res[j].Layer {
+			return res[i].Layer < res[j].Layer
+		}
+		return res[i].Reason < res[j].Reason
+	})
+	return res
+}
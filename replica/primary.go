@@ -0,0 +1,240 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// standbyQueue is how many batches of new shares a standby may fall behind
+// before it is dropped, to catch up with a new snapshot when it reconnects
+const standbyQueue = 1024
+
+// writeTimeout limits how long sending a frame to a standby may take
+const writeTimeout = time.Second * 30
+
+// Primary serves the replication stream to standbys
+type Primary struct {
+	Port int
+	// Key is the key standbys must have
+	Key        string
+	ShareChain *work.ShareChain
+	// Stratum, if set, has its miner registry replicated
+	Stratum *stratum.Server
+	// Log gets the records of replication, the package's logger if nil
+	Log *logging.SubsystemLogger
+
+	listener net.Listener
+	standbys map[*standbyConn]struct{}
+	lock     sync.Mutex
+	closed   bool
+}
+
+// standbyConn is a connected standby and the shares waiting to be sent to
+// it
+type standbyConn struct {
+	ch        *channel
+	shares    chan []wire.Share
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *standbyConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.ch.conn.Close()
+	})
+}
+
+func NewPrimary(port int, key string, sc *work.ShareChain, ss *stratum.Server) *Primary {
+	return &Primary{
+		Port:       port,
+		Key:        key,
+		ShareChain: sc,
+		Stratum:    ss,
+		standbys:   map[*standbyConn]struct{}{},
+	}
+}
+
+func (p *Primary) logger() *logging.SubsystemLogger {
+	return p.Log.Or(log)
+}
+
+// Listen opens the replication port. From then on the shares the sharechain
+// adds are sent to the connected standbys.
+func (p *Primary) Listen() error {
+	if p.Key == "" {
+		return fmt.Errorf("No replication key given")
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.Port))
+	if err != nil {
+		return err
+	}
+	p.logger().Infof("Replication listening on port %d", p.Port)
+	p.listener = l
+	p.ShareChain.Added = p.added
+	go p.acceptLoop()
+	return nil
+}
+
+// Close stops replicating and disconnects the standbys
+func (p *Primary) Close() {
+	p.lock.Lock()
+	p.closed = true
+	standbys := p.standbys
+	p.standbys = map[*standbyConn]struct{}{}
+	p.lock.Unlock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	for c := range standbys {
+		c.close()
+	}
+}
+
+func (p *Primary) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			p.lock.Unlock()
+			if !closed {
+				p.logger().Errorf("Replication stopped accepting standbys: %s", err.Error())
+			}
+			return
+		}
+		go p.serve(conn)
+	}
+}
+
+// added queues new shares for the standbys
+func (p *Primary) added(shares []*wire.Share) {
+	batch := make([]wire.Share, len(shares))
+	for i, s := range shares {
+		batch[i] = *s
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for c := range p.standbys {
+		select {
+		case c.shares <- batch:
+		default:
+			p.logger().Warnf("Standby %s fell behind, dropping it", c.ch.conn.RemoteAddr())
+			delete(p.standbys, c)
+			c.close()
+		}
+	}
+}
+
+// serve authenticates a standby, sends it the sharechain and then the new
+// shares, the miner registry and heartbeats until it goes away
+func (p *Primary) serve(conn net.Conn) {
+	ch, err := acceptHandshake(conn, p.Key, p.ShareChain.Network.Name)
+	if err != nil {
+		p.logger().Warnf("Refused standby %s: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	c := &standbyConn{ch: ch, shares: make(chan []wire.Share, standbyQueue), done: make(chan struct{})}
+	defer c.close()
+	// Registered before the snapshot is taken, so no share falls in
+	// between. The standby ignores the ones it gets twice.
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.standbys[c] = struct{}{}
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.standbys, c)
+		p.lock.Unlock()
+	}()
+
+	p.logger().Infof("Standby %s connected, sending the sharechain", conn.RemoteAddr())
+	err = p.sendSnapshot(c)
+	if err == nil {
+		err = p.sendMiners(c)
+	}
+	heartbeat := clock.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	miners := clock.NewTicker(minersInterval)
+	defer miners.Stop()
+	for err == nil {
+		select {
+		case shares := <-c.shares:
+			err = sendShares(c, shares)
+		case <-heartbeat.C:
+			err = c.write(frameHeartbeat, nil)
+		case <-miners.C:
+			err = p.sendMiners(c)
+		case <-c.done:
+			return
+		}
+	}
+	p.logger().Warnf("Standby %s disconnected: %s", conn.RemoteAddr(), err.Error())
+}
+
+func (c *standbyConn) write(t byte, payload []byte) error {
+	c.ch.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.ch.writeFrame(t, payload)
+}
+
+// sendSnapshot sends all shares of the sharechain, forks included, the
+// oldest first so each builds on ones the standby has
+func (p *Primary) sendSnapshot(c *standbyConn) error {
+	shares := make([]wire.Share, 0, p.ShareChain.AllShares.Len())
+	p.ShareChain.AllShares.Range(func(cs *work.ChainShare) bool {
+		shares = append(shares, *cs.Share)
+		return true
+	})
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ShareInfo.AbsHeight < shares[j].ShareInfo.AbsHeight
+	})
+	for i := 0; i < len(shares); i += snapshotBatch {
+		end := i + snapshotBatch
+		if end > len(shares) {
+			end = len(shares)
+		}
+		err := sendShares(c, shares[i:end])
+		if err != nil {
+			return err
+		}
+	}
+	p.logger().Infof("Sent %d shares to standby %s", len(shares), c.ch.conn.RemoteAddr())
+	return nil
+}
+
+// sendShares sends shares in the sharechain file format, which carries
+// their hashes, so the standby doesn't hash them again
+func sendShares(c *standbyConn, shares []wire.Share) error {
+	var buf bytes.Buffer
+	err := wire.WriteShareFile(&buf, shares)
+	if err != nil {
+		return err
+	}
+	return c.write(frameShares, buf.Bytes())
+}
+
+func (p *Primary) sendMiners(c *standbyConn) error {
+	if p.Stratum == nil {
+		return nil
+	}
+	b, err := json.Marshal(p.Stratum.Miners())
+	if err != nil {
+		return err
+	}
+	return c.write(frameMiners, b)
+}
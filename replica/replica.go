@@ -0,0 +1,217 @@
+// Package replica keeps a hot standby of a node. The standby connects to
+// the replication port of the primary and gets the primary's sharechain,
+// every share it adds after and its registry of miners streamed, so the
+// standby's share store and registry stay identical to the primary's. When
+// the primary stops answering, the standby starts serving stratum itself,
+// with miners reconnecting at the difficulty they had. Pointing miners at
+// both, as failover pool, or moving an address over is up to the operator.
+//
+// Both ends share a key. The handshake proves both know it, and the frames
+// after are encrypted and authenticated with a key derived from it and the
+// nonces of both ends, so the stream can't be read, changed or replayed.
+package replica
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/logging"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var log = logging.For("replica")
+
+const (
+	// HeartbeatInterval is how often the primary sends a frame when it has
+	// nothing else to send
+	HeartbeatInterval = time.Second
+	// DefaultTimeout is how long a standby waits for the primary before
+	// taking over
+	DefaultTimeout = time.Second * 5
+
+	// minersInterval is how often the primary sends its miner registry
+	minersInterval = time.Second * 5
+	// snapshotBatch is the number of shares per frame of the initial
+	// sharechain
+	snapshotBatch = 500
+	maxFrame      = 64 * 1024 * 1024
+	nonceSize     = 32
+	// handshakeTimeout limits how long the handshake may take
+	handshakeTimeout = time.Second * 10
+)
+
+var magic = []byte("p2prepl1")
+
+// errWrongKey is a primary that answered, but with another key
+var errWrongKey = fmt.Errorf("Primary does not have the replication key")
+
+// Frame types
+const (
+	frameHeartbeat = byte(1)
+	frameShares    = byte(2)
+	frameMiners    = byte(3)
+)
+
+// channel is the authenticated connection after the handshake, encrypting
+// frames from the primary to the standby
+type channel struct {
+	conn net.Conn
+	key  [32]byte
+	n    uint64
+}
+
+// sessionKey derives the key of a connection from the shared key, the
+// network and the nonces of both ends
+func sessionKey(key, network string, standbyNonce, primaryNonce []byte) [32]byte {
+	return mac(key, "session", network, standbyNonce, primaryNonce)
+}
+
+func mac(key, label, network string, standbyNonce, primaryNonce []byte) [32]byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(label))
+	m.Write([]byte(network))
+	m.Write(standbyNonce)
+	m.Write(primaryNonce)
+	var sum [32]byte
+	copy(sum[:], m.Sum(nil))
+	return sum
+}
+
+func (c *channel) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce
+}
+
+// writeFrame sends a frame of type t. The header is authenticated along
+// with the payload.
+func (c *channel) writeFrame(t byte, payload []byte) error {
+	aead, _ := chacha20poly1305.New(c.key[:])
+	header := make([]byte, 5)
+	header[0] = t
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)+aead.Overhead()))
+	_, err := c.conn.Write(aead.Seal(header, c.nonce(), payload, header))
+	return err
+}
+
+func (c *channel) readFrame() (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(c.conn, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrame {
+		return 0, nil, fmt.Errorf("Frame of %d bytes is too large", length)
+	}
+	sealed := make([]byte, length)
+	_, err = io.ReadFull(c.conn, sealed)
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, _ := chacha20poly1305.New(c.key[:])
+	payload, err := aead.Open(nil, c.nonce(), sealed, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Frame failed authentication")
+	}
+	return header[0], payload, nil
+}
+
+func randomNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// acceptHandshake authenticates a standby on the primary's end. The standby
+// sends the magic, its network and a nonce, the primary answers with its
+// nonce and proof of the key, and the standby with its proof.
+func acceptHandshake(conn net.Conn, key, network string) (*channel, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, len(magic)+1)
+	_, err := io.ReadFull(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+	if string(hello[:len(magic)]) != string(magic) {
+		return nil, fmt.Errorf("Not a replication client")
+	}
+	name := make([]byte, hello[len(magic)])
+	_, err = io.ReadFull(conn, name)
+	if err != nil {
+		return nil, err
+	}
+	if string(name) != network {
+		return nil, fmt.Errorf("Standby is on network %s, not %s", name, network)
+	}
+	standbyNonce := make([]byte, nonceSize)
+	_, err = io.ReadFull(conn, standbyNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryNonce, err := randomNonce()
+	if err != nil {
+		return nil, err
+	}
+	proof := mac(key, "primary", network, standbyNonce, primaryNonce)
+	_, err = conn.Write(append(primaryNonce, proof[:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	theirs := make([]byte, 32)
+	_, err = io.ReadFull(conn, theirs)
+	if err != nil {
+		return nil, err
+	}
+	expected := mac(key, "standby", network, standbyNonce, primaryNonce)
+	if !hmac.Equal(theirs, expected[:]) {
+		return nil, fmt.Errorf("Standby does not have the replication key")
+	}
+	return &channel{conn: conn, key: sessionKey(key, network, standbyNonce, primaryNonce)}, nil
+}
+
+// dialHandshake authenticates the primary on the standby's end
+func dialHandshake(conn net.Conn, key, network string) (*channel, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	standbyNonce, err := randomNonce()
+	if err != nil {
+		return nil, err
+	}
+	hello := append([]byte{}, magic...)
+	hello = append(hello, byte(len(network)))
+	hello = append(hello, network...)
+	_, err = conn.Write(append(hello, standbyNonce...))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := make([]byte, nonceSize+32)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return nil, err
+	}
+	primaryNonce := answer[:nonceSize]
+	expected := mac(key, "primary", network, standbyNonce, primaryNonce)
+	if !hmac.Equal(answer[nonceSize:], expected[:]) {
+		return nil, errWrongKey
+	}
+	proof := mac(key, "standby", network, standbyNonce, primaryNonce)
+	_, err = conn.Write(proof[:])
+	if err != nil {
+		return nil, err
+	}
+	return &channel{conn: conn, key: sessionKey(key, network, standbyNonce, primaryNonce)}, nil
+}
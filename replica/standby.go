@@ -0,0 +1,127 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// retryInterval is how long a standby waits before reconnecting to the
+// primary
+const retryInterval = time.Second
+
+// Standby follows a primary until it is gone
+type Standby struct {
+	// Primary is the host and port of the primary's replication port
+	Primary    string
+	Key        string
+	ShareChain *work.ShareChain
+	// Stratum, if set, gets the primary's miner registry
+	Stratum *stratum.Server
+	// Timeout is how long the primary may not be heard from before the
+	// standby takes over
+	Timeout time.Duration
+	// TakeOver is called once the primary is gone, to start serving miners
+	TakeOver func()
+	// Log gets the records of replication, the package's logger if nil
+	Log *logging.SubsystemLogger
+}
+
+func NewStandby(primary, key string, sc *work.ShareChain, ss *stratum.Server) *Standby {
+	return &Standby{
+		Primary:    primary,
+		Key:        key,
+		ShareChain: sc,
+		Stratum:    ss,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+func (s *Standby) logger() *logging.SubsystemLogger {
+	return s.Log.Or(log)
+}
+
+// Run replicates from the primary, reconnecting when the connection drops,
+// until the primary hasn't been heard from for Timeout. It then calls
+// TakeOver and returns. A standby that took over stays the active node,
+// also when the primary comes back.
+func (s *Standby) Run(ctx context.Context) {
+	lastSeen := clock.Now()
+	for ctx.Err() == nil {
+		err := s.follow(ctx, &lastSeen)
+		if ctx.Err() != nil {
+			return
+		}
+		if gone := clock.Since(lastSeen); gone >= s.Timeout {
+			s.logger().Warnf("Primary %s not heard from for %s (%s), taking over", s.Primary, gone.Round(time.Second), err.Error())
+			if s.TakeOver != nil {
+				s.TakeOver()
+			}
+			return
+		}
+		s.logger().Warnf("Lost the primary %s: %s", s.Primary, err.Error())
+		clock.SleepContext(ctx, retryInterval)
+	}
+}
+
+// follow connects to the primary and applies what it sends until the
+// connection fails, which it returns
+func (s *Standby) follow(ctx context.Context, lastSeen *time.Time) error {
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	ch, err := dialHandshake(conn, s.Key, s.ShareChain.Network.Name)
+	if err == errWrongKey {
+		// The primary is there, taking over would leave two nodes serving
+		// miners
+		*lastSeen = clock.Now()
+		s.logger().Errorf("Primary %s has another replication key, not replicating", s.Primary)
+	}
+	if err != nil {
+		return err
+	}
+	s.logger().Infof("Replicating from primary %s", s.Primary)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.Timeout))
+		t, payload, err := ch.readFrame()
+		if err != nil {
+			return err
+		}
+		*lastSeen = clock.Now()
+		switch t {
+		case frameHeartbeat:
+		case frameShares:
+			shares, err := wire.ParseShareFile(payload, true, s.ShareChain.Network)
+			if err != nil {
+				return fmt.Errorf("Invalid shares: %s", err.Error())
+			}
+			added := s.ShareChain.AddShares(shares)
+			s.logger().Debugf("Replicated %d of %d shares", len(added), len(shares))
+		case frameMiners:
+			var miners []stratum.MinerRecord
+			err = json.Unmarshal(payload, &miners)
+			if err != nil {
+				return fmt.Errorf("Invalid miner registry: %s", err.Error())
+			}
+			if s.Stratum != nil {
+				s.Stratum.RestoreMiners(miners)
+			}
+		default:
+			return fmt.Errorf("Unknown frame type %d", t)
+		}
+	}
+}
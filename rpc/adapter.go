@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Adapter covers the differences between coin daemons, so the rest of the
+// code doesn't need to know which one it talks to
+type Adapter interface {
+	// TemplateRules are the rules we tell getblocktemplate we support
+	TemplateRules() []string
+	// LongPoll tells whether getblocktemplate long polling works
+	LongPoll() bool
+	// Proposals tells whether getblocktemplate takes block proposals
+	Proposals() bool
+	// SubmitAccepted tells whether a submitblock result means the daemon
+	// has the block
+	SubmitAccepted(reason string) bool
+}
+
+var (
+	adapters     = map[string]Adapter{}
+	adaptersLock sync.RWMutex
+)
+
+func init() {
+	RegisterAdapter("bitcoind", CoreAdapter{Rules: []string{"segwit"}})
+	RegisterAdapter("vertcoind", CoreAdapter{Rules: []string{"segwit"}})
+	// Litecoin Core refuses templates to clients that don't know MWEB
+	RegisterAdapter("litecoind", CoreAdapter{Rules: []string{"mweb", "segwit"}})
+	RegisterAdapter("legacy", LegacyAdapter{})
+}
+
+// RegisterAdapter makes an adapter available to network definitions.
+// Registering an existing name replaces it.
+func RegisterAdapter(name string, a Adapter) {
+	adaptersLock.Lock()
+	defer adaptersLock.Unlock()
+	adapters[name] = a
+}
+
+// GetAdapter returns the adapter with the given name
+func GetAdapter(name string) (Adapter, error) {
+	adaptersLock.RLock()
+	defer adaptersLock.RUnlock()
+	a, ok := adapters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown daemon adapter %s", name)
+	}
+	return a, nil
+}
+
+// Adapters returns the names of all registered adapters
+func Adapters() []string {
+	adaptersLock.RLock()
+	defer adaptersLock.RUnlock()
+	names := make([]string, 0, len(adapters))
+	for n := range adapters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CoreAdapter is for daemons based on a recent Bitcoin Core
+type CoreAdapter struct {
+	Rules []string
+}
+
+func (a CoreAdapter) TemplateRules() []string {
+	return a.Rules
+}
+
+func (a CoreAdapter) LongPoll() bool {
+	return true
+}
+
+func (a CoreAdapter) Proposals() bool {
+	return true
+}
+
+func (a CoreAdapter) SubmitAccepted(reason string) bool {
+	switch reason {
+	case "", "duplicate", "inconclusive":
+		return true
+	}
+	return false
+}
+
+// LegacyAdapter is for old forks without segwit, which don't understand
+// rules, proposals or long polling and report a known block differently
+type LegacyAdapter struct{}
+
+func (a LegacyAdapter) TemplateRules() []string {
+	return []string{}
+}
+
+func (a LegacyAdapter) LongPoll() bool {
+	return false
+}
+
+func (a LegacyAdapter) Proposals() bool {
+	return false
+}
+
+func (a LegacyAdapter) SubmitAccepted(reason string) bool {
+	switch reason {
+	case "", "duplicate", "duplicate-inconclusive", "inconclusive":
+		return true
+	}
+	return false
+}
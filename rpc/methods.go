@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+type BlockTemplateTransaction struct {
+	Data    string `json:"data"`
+	TxID    string `json:"txid"`
+	Hash    string `json:"hash"`
+	Fee     int64  `json:"fee"`
+	SigOps  int64  `json:"sigops"`
+	Weight  int64  `json:"weight"`
+	Depends []int  `json:"depends"`
+}
+
+type BlockTemplate struct {
+	Version                  int32                      `json:"version"`
+	Rules                    []string                   `json:"rules"`
+	PreviousBlockHash        string                     `json:"previousblockhash"`
+	Transactions             []BlockTemplateTransaction `json:"transactions"`
+	CoinbaseValue            int64                      `json:"coinbasevalue"`
+	Target                   string                     `json:"target"`
+	MinTime                  int64                      `json:"mintime"`
+	CurTime                  int64                      `json:"curtime"`
+	Bits                     string                     `json:"bits"`
+	Height                   int64                      `json:"height"`
+	DefaultWitnessCommitment string                     `json:"default_witness_commitment"`
+	LongPollID               string                     `json:"longpollid"`
+	VBAvailable              map[string]int             `json:"vbavailable"`
+	VBRequired               uint32                     `json:"vbrequired"`
+}
+
+type BlockInfo struct {
+	Hash          string `json:"hash"`
+	Confirmations int64  `json:"confirmations"`
+	Height        int64  `json:"height"`
+	PreviousHash  string `json:"previousblockhash"`
+}
+
+func (c *Client) GetBlockTemplate() (*BlockTemplate, error) {
+	var bt BlockTemplate
+	err := c.Call("getblocktemplate", []interface{}{map[string]interface{}{"rules": c.Adapter.TemplateRules()}}, &bt)
+	if err != nil {
+		return nil, err
+	}
+	return &bt, nil
+}
+
+// GetBlockTemplateLongPoll blocks until the daemon has a template that differs
+// from the one identified by longPollID, or ctx is done
+func (c *Client) GetBlockTemplateLongPoll(ctx context.Context, longPollID string) (*BlockTemplate, error) {
+	var bt BlockTemplate
+	err := c.call(ctx, c.longPollClient, "getblocktemplate", []interface{}{map[string]interface{}{"rules": c.Adapter.TemplateRules(), "longpollid": longPollID}}, &bt)
+	if err != nil {
+		return nil, err
+	}
+	return &bt, nil
+}
+
+// SubmitBlock submits a hex encoded block. An empty reject reason means the
+// daemon accepted the block
+func (c *Client) SubmitBlock(blockHex string) (string, error) {
+	var result json.RawMessage
+	err := c.Call("submitblock", []interface{}{blockHex}, &result)
+	if err != nil {
+		return "", err
+	}
+	var reason string
+	if len(result) > 0 && string(result) != "null" {
+		err = json.Unmarshal(result, &reason)
+		if err != nil {
+			return "", err
+		}
+	}
+	return reason, nil
+}
+
+// ProposeBlock asks the daemon to check a hex encoded block without
+// accepting it. Proof of work is not checked, so any candidate block can be
+// validated. An empty reject reason means the daemon considers it valid.
+func (c *Client) ProposeBlock(blockHex string) (string, error) {
+	if !c.Adapter.Proposals() {
+		return "", fmt.Errorf("Daemon does not support block proposals")
+	}
+	var result json.RawMessage
+	err := c.Call("getblocktemplate", []interface{}{map[string]interface{}{"mode": "proposal", "data": blockHex, "rules": c.Adapter.TemplateRules()}}, &result)
+	if err != nil {
+		return "", err
+	}
+	var reason string
+	if len(result) > 0 && string(result) != "null" {
+		err = json.Unmarshal(result, &reason)
+		if err != nil {
+			return "", err
+		}
+	}
+	return reason, nil
+}
+
+func (c *Client) GetBlockHash(height int64) (string, error) {
+	var hash string
+	err := c.Call("getblockhash", []interface{}{height}, &hash)
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (c *Client) GetBlock(hash string) (*BlockInfo, error) {
+	var bi BlockInfo
+	err := c.Call("getblock", []interface{}{hash, 1}, &bi)
+	if err != nil {
+		return nil, err
+	}
+	return &bi, nil
+}
+
+type BlockchainInfo struct {
+	Chain                string  `json:"chain"`
+	Blocks               int64   `json:"blocks"`
+	Headers              int64   `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	Difficulty           float64 `json:"difficulty"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+}
+
+func (c *Client) GetBlockchainInfo() (*BlockchainInfo, error) {
+	var bi BlockchainInfo
+	err := c.Call("getblockchaininfo", nil, &bi)
+	if err != nil {
+		return nil, err
+	}
+	return &bi, nil
+}
+
+type MiningInfo struct {
+	Blocks        int64   `json:"blocks"`
+	Difficulty    float64 `json:"difficulty"`
+	NetworkHashPS float64 `json:"networkhashps"`
+	PooledTx      int64   `json:"pooledtx"`
+	Chain         string  `json:"chain"`
+}
+
+func (c *Client) GetMiningInfo() (*MiningInfo, error) {
+	var mi MiningInfo
+	err := c.Call("getmininginfo", nil, &mi)
+	if err != nil {
+		return nil, err
+	}
+	return &mi, nil
+}
+
+// SendRawTransaction broadcasts a hex encoded transaction and returns its
+// txid
+func (c *Client) SendRawTransaction(txHex string) (string, error) {
+	var txid string
+	err := c.Call("sendrawtransaction", []interface{}{txHex}, &txid)
+	if err != nil {
+		return "", err
+	}
+	return txid, nil
+}
+
+type SmartFeeEstimate struct {
+	FeeRate float64  `json:"feerate"`
+	Blocks  int64    `json:"blocks"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// EstimateSmartFee asks the daemon for the fee rate, in coins per kvB,
+// needed to confirm within the given number of blocks
+func (c *Client) EstimateSmartFee(blocks int) (*SmartFeeEstimate, error) {
+	var est SmartFeeEstimate
+	err := c.Call("estimatesmartfee", []interface{}{blocks}, &est)
+	if err != nil {
+		return nil, err
+	}
+	return &est, nil
+}
+
+type MempoolInfo struct {
+	Size          int64   `json:"size"`
+	Bytes         int64   `json:"bytes"`
+	Usage         int64   `json:"usage"`
+	MempoolMinFee float64 `json:"mempoolminfee"`
+	MinRelayTxFee float64 `json:"minrelaytxfee"`
+}
+
+func (c *Client) GetMempoolInfo() (*MempoolInfo, error) {
+	var mi MempoolInfo
+	err := c.Call("getmempoolinfo", nil, &mi)
+	if err != nil {
+		return nil, err
+	}
+	return &mi, nil
+}
@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+)
+
+// DetectREST checks whether the daemon runs with -rest, so raw blocks and
+// transactions can be fetched in binary instead of hex through JSON-RPC
+func (c *Client) DetectREST() bool {
+	_, err := c.rest("chaininfo.json")
+	c.REST = err == nil
+	return c.REST
+}
+
+func (c *Client) restURL(path string) (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/rest/" + path
+	return u.String(), nil
+}
+
+// rest does a GET on the daemon's REST interface. It needs no credentials.
+func (c *Client) rest(path string) ([]byte, error) {
+	u, err := c.restURL(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("REST request for %s failed with HTTP status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// GetRawBlock fetches a full block, over REST if the daemon supports it
+func (c *Client) GetRawBlock(hash *chainhash.Hash) (*btcwire.MsgBlock, error) {
+	var raw []byte
+	if c.REST {
+		var err error
+		raw, err = c.rest("block/" + hash.String() + ".bin")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var blockHex string
+		err := c.Call("getblock", []interface{}{hash.String(), 0}, &blockHex)
+		if err != nil {
+			return nil, err
+		}
+		raw, err = hex.DecodeString(blockHex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := &btcwire.MsgBlock{}
+	err := b.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetRawTransaction fetches a transaction, over REST if the daemon supports
+// it. Without -txindex the daemon only knows mempool transactions.
+func (c *Client) GetRawTransaction(txid *chainhash.Hash) (*btcwire.MsgTx, error) {
+	var raw []byte
+	if c.REST {
+		var err error
+		raw, err = c.rest("tx/" + txid.String() + ".bin")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var txHex string
+		err := c.Call("getrawtransaction", []interface{}{txid.String(), false}, &txHex)
+		if err != nil {
+			return nil, err
+		}
+		raw, err = hex.DecodeString(txHex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tx := &btcwire.MsgTx{}
+	err := tx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,307 @@
+package simnet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+func TestMain(m *testing.M) {
+	// The nodes log a lot of connection churn, only errors are of interest
+	logging.SetLevels(logging.LogLevelError, nil)
+	os.Exit(m.Run())
+}
+
+// Scenario is a script for a simnet of Nodes nodes
+type Scenario struct {
+	Name  string
+	Nodes int
+	// Daemon has the nodes share a mock daemon
+	Daemon bool
+	Steps  []Step
+}
+
+// Step is one action or check of a scenario
+type Step struct {
+	Name string
+	Run  func(s *Simnet) error
+}
+
+// TestScenarios runs every scenario on a simnet of its own
+func TestScenarios(t *testing.T) {
+	for _, sc := range scenarios {
+		t.Run(sc.Name, func(t *testing.T) {
+			err := sc.Run(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+var scenarios = []Scenario{
+	{Name: "sync", Nodes: 2, Steps: []Step{
+		Mine(0, 10),
+		Connect(0, 1),
+		ExpectSameTip(0, 1),
+		ExpectHeight(1, 10),
+	}},
+	{Name: "relay", Nodes: 3, Steps: []Step{
+		ConnectAll(),
+		Mine(0, 3),
+		ExpectSameTip(0, 1, 2),
+		Mine(1, 3),
+		ExpectSameTip(0, 1, 2),
+		Mine(2, 3),
+		ExpectSameTip(0, 1, 2),
+		ExpectHeight(0, 9),
+	}},
+	{Name: "partition", Nodes: 3, Steps: []Step{
+		ConnectAll(),
+		Mine(0, 2),
+		ExpectSameTip(0, 1, 2),
+		Partition([]int{0}, []int{1, 2}),
+		Mine(0, 2),
+		Mine(1, 3),
+		ExpectSameTip(1, 2),
+		ExpectTipMinedBy(1, 1, 2),
+		ExpectTipMinedBy(0, 0),
+	}},
+	{Name: "reorg", Nodes: 2, Steps: []Step{
+		ConnectAll(),
+		Mine(0, 3),
+		ExpectSameTip(0, 1),
+		Partition([]int{0}, []int{1}),
+		Mine(0, 2),
+		Mine(1, 4),
+		ConnectAll(),
+		ExpectTipMinedBy(1, 0, 1),
+		ExpectHeight(0, 7),
+	}},
+	{Name: "block", Nodes: 3, Steps: []Step{
+		ConnectAll(),
+		Mine(0, 2),
+		ExpectSameTip(0, 1, 2),
+		NewBlock(true),
+		Mine(1, 1),
+		ExpectBlockOf(1, 0, 1, 2),
+	}},
+	{Name: "chaos", Nodes: 3, Steps: []Step{
+		Chaos("latency=2ms,jitter=5ms,partial=0.5,seed=1"),
+		ConnectAll(),
+		Mine(0, 3),
+		ExpectSameTip(0, 1, 2),
+		Mine(1, 3),
+		ExpectSameTip(0, 1, 2),
+		Mine(2, 3),
+		Mine(0, 1),
+		ExpectSameTip(0, 1, 2),
+	}},
+	{Name: "daemon", Nodes: 2, Daemon: true, Steps: []Step{
+		ConnectAll(),
+		Mine(0, 2),
+		ExpectSameTip(0, 1),
+		NewBlock(true),
+		Mine(1, 1),
+		ExpectDaemonAccepted(1, 0, 1),
+		ExpectOnDaemonTip(),
+	}},
+}
+
+// Run sets up a simnet for the scenario in dir and runs its steps in order,
+// up to the first that fails
+func (sc Scenario) Run(dir string) error {
+	dir = filepath.Join(dir, sc.Name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	s, err := New(dir, sc.Nodes, sc.Daemon)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for i, step := range sc.Steps {
+		err := step.Run(s)
+		if err != nil {
+			return fmt.Errorf("Step %d (%s): %s", i+1, step.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func Mine(node, count int) Step {
+	return Step{fmt.Sprintf("node%d mines %d", node, count), func(s *Simnet) error {
+		return s.Mine(node, count)
+	}}
+}
+
+func Connect(a, b int) Step {
+	return Step{fmt.Sprintf("connect node%d and node%d", a, b), func(s *Simnet) error {
+		return s.Connect(a, b)
+	}}
+}
+
+func ConnectAll() Step {
+	return Step{"connect all", func(s *Simnet) error {
+		return s.ConnectAll()
+	}}
+}
+
+func Partition(groups ...[]int) Step {
+	return Step{fmt.Sprintf("partition %v", groups), func(s *Simnet) error {
+		s.Partition(groups...)
+		return nil
+	}}
+}
+
+// Chaos degrades the connections made from now on, see p2p.ParseChaos
+func Chaos(spec string) Step {
+	return Step{"chaos " + spec, func(s *Simnet) error {
+		chaos, err := p2p.ParseChaos(spec)
+		if err != nil {
+			return err
+		}
+		for _, node := range s.Nodes {
+			node.PeerManager.Transport = chaos.Wrap
+		}
+		return nil
+	}}
+}
+
+func NewBlock(easy bool) Step {
+	return Step{"new block", func(s *Simnet) error {
+		return s.NewBlock(easy)
+	}}
+}
+
+// ExpectSameTip waits for the nodes to agree on the tip
+func ExpectSameTip(nodes ...int) Step {
+	return Step{fmt.Sprintf("same tip on %v", nodes), func(s *Simnet) error {
+		return s.Wait(func() error {
+			tip := s.Nodes[nodes[0]].Tip()
+			for _, i := range nodes[1:] {
+				other := s.Nodes[i].Tip()
+				if tip == nil || other == nil || !tip.IsEqual(other) {
+					return fmt.Errorf("%s is at %s, %s at %s", s.Nodes[nodes[0]].Name, tip, s.Nodes[i].Name, other)
+				}
+			}
+			return nil
+		})
+	}}
+}
+
+// ExpectTipMinedBy waits for the nodes to have the last share miner mined
+// as their tip
+func ExpectTipMinedBy(miner int, nodes ...int) Step {
+	return Step{fmt.Sprintf("tip of %v mined by node%d", nodes, miner), func(s *Simnet) error {
+		return s.Wait(func() error {
+			last := s.Nodes[miner].LastShare
+			if last == nil {
+				return fmt.Errorf("node%d mined nothing", miner)
+			}
+			for _, i := range nodes {
+				tip := s.Nodes[i].Tip()
+				if tip == nil || !tip.IsEqual(last.Hash) {
+					return fmt.Errorf("%s is at %s, not %s", s.Nodes[i].Name, tip, last.Hash)
+				}
+			}
+			return nil
+		})
+	}}
+}
+
+// ExpectHeight waits for the node's chain to have height shares
+func ExpectHeight(node, height int) Step {
+	return Step{fmt.Sprintf("node%d at height %d", node, height), func(s *Simnet) error {
+		return s.Wait(func() error {
+			if h := s.Nodes[node].Height(); h != height {
+				return fmt.Errorf("%s is at height %d", s.Nodes[node].Name, h)
+			}
+			return nil
+		})
+	}}
+}
+
+// ExpectBlockOf waits for the nodes to have submitted the block solved by
+// the last share miner mined. Nodes other than the miner rebuild the block
+// from their own sharechain, so this checks they agree on the payouts.
+func ExpectBlockOf(miner int, nodes ...int) Step {
+	return Step{fmt.Sprintf("%v submitted the block of node%d", nodes, miner), func(s *Simnet) error {
+		return s.Wait(func() error {
+			last := s.Nodes[miner].LastShare
+			if last == nil {
+				return fmt.Errorf("node%d mined nothing", miner)
+			}
+			missing := make([]string, 0)
+			for _, i := range nodes {
+				blocks, err := s.Nodes[i].Blocks()
+				if err != nil {
+					return err
+				}
+				found := false
+				for _, b := range blocks {
+					found = found || b.Hash == last.Hash.String()
+				}
+				if !found {
+					missing = append(missing, s.Nodes[i].Name)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("Block %s not submitted by %s", last.Hash, strings.Join(missing, ", "))
+			}
+			return nil
+		})
+	}}
+}
+
+// ExpectDaemonAccepted waits for the daemon to have the block solved by the
+// last share miner mined as its tip, and for the nodes to have recorded it
+// as accepted
+func ExpectDaemonAccepted(miner int, nodes ...int) Step {
+	return Step{fmt.Sprintf("daemon accepted the block of node%d from %v", miner, nodes), func(s *Simnet) error {
+		return s.Wait(func() error {
+			last := s.Nodes[miner].LastShare
+			if last == nil {
+				return fmt.Errorf("node%d mined nothing", miner)
+			}
+			if tip := s.Daemon.Tip(); !tip.IsEqual(last.Hash) {
+				for _, sub := range s.Daemon.Submitted() {
+					if sub.Hash == last.Hash.String() && sub.Reason != "" {
+						return fmt.Errorf("Daemon rejected block %s: %s", sub.Hash, sub.Reason)
+					}
+				}
+				return fmt.Errorf("Daemon is at block %s, not %s", tip, last.Hash)
+			}
+			for _, i := range nodes {
+				blocks, err := s.Nodes[i].Blocks()
+				if err != nil {
+					return err
+				}
+				status := work.FoundBlockStatus("")
+				for _, b := range blocks {
+					if b.Hash == last.Hash.String() {
+						status = b.Status
+					}
+				}
+				if status != work.FoundBlockAccepted {
+					return fmt.Errorf("%s has block %s as %q", s.Nodes[i].Name, last.Hash, status)
+				}
+			}
+			return nil
+		})
+	}}
+}
+
+// ExpectOnDaemonTip waits for all nodes to work on the daemon's tip
+func ExpectOnDaemonTip() Step {
+	return Step{"all nodes on the daemon's tip", func(s *Simnet) error {
+		return s.Wait(s.onDaemonTip)
+	}}
+}
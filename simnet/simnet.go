@@ -0,0 +1,315 @@
+// Package simnet runs several p2pool nodes in one process, connected over
+// in-memory pipes and mining synthetic work of the benchmark network on a
+// simulated clock. The scenarios of its tests script what the nodes do and
+// check where they end up, so syncing, forks, partitions and found blocks
+// are tested without daemons or a network. The nodes can also share a mock daemon, to
+// go through getting templates and submitting blocks over JSON-RPC.
+package simnet
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/mockdaemon"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// templateTxs is the number of transactions in the synthetic templates
+const templateTxs = 10
+
+// easyTarget makes every share solve a block as well. It's just below the
+// easiest share target, so no block is found that isn't a share.
+const (
+	easyTarget = "0fffff0000000000000000000000000000000000000000000000000000000000"
+	easyBits   = "200fffff"
+)
+
+// Node is one p2pool node of a simnet
+type Node struct {
+	Name        string
+	IP          net.IP
+	PubKeyHash  []byte
+	ShareChain  *work.ShareChain
+	WorkManager *work.WorkManager
+	PeerManager *p2p.PeerManager
+	// LastShare is the last share the node mined
+	LastShare *wire.Share
+
+	journal *work.FoundBlockJournal
+}
+
+// Tip returns the hash of the node's sharechain tip
+func (n *Node) Tip() *chainhash.Hash {
+	return n.ShareChain.GetTipHash()
+}
+
+// Height returns the number of shares up to the node's tip
+func (n *Node) Height() int {
+	return n.ShareChain.GetHeight(n.Tip(), math.MaxInt)
+}
+
+// Blocks returns the blocks the node submitted
+func (n *Node) Blocks() ([]work.FoundBlock, error) {
+	return n.journal.Blocks()
+}
+
+// Simnet is a set of nodes and the pipes between them
+type Simnet struct {
+	Nodes []*Node
+	// Network is the network the nodes are on
+	Network p2pnet.Network
+	// Clock is the simulated time of the nodes' sharechains. It only moves
+	// when advanced, so share timestamps are the same every run.
+	Clock *clock.Manual
+	// Daemon is the daemon the nodes get their templates from, nil if they
+	// are given synthetic ones
+	Daemon *mockdaemon.Daemon
+	// Timeout is how long Wait waits for a condition to hold
+	Timeout time.Duration
+
+	height int64
+	links  map[[2]int][2]net.Conn
+	// cancel stops the nodes' work loops
+	cancel context.CancelFunc
+}
+
+// New sets up count nodes keeping their files in dir, not connected to each
+// other yet, on the benchmark network. With daemon set, the nodes work on
+// templates of a mock daemon they share.
+func New(dir string, count int, daemon bool) (*Simnet, error) {
+	n := p2pnet.Benchmark()
+	s := &Simnet{
+		Network: n,
+		Clock:   clock.NewManual(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+		Timeout: time.Second * 10,
+		links:   map[[2]int][2]net.Conn{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if daemon {
+		s.Daemon = mockdaemon.New(n)
+		s.Daemon.SetTxCount(templateTxs)
+		err := s.Daemon.Listen("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("node%d", i)
+		sc := work.NewShareChain(n)
+		sc.DataFile = filepath.Join(dir, name+"-sharechain.dat")
+		sc.Clock.Base = s.Clock.Now
+		journal := work.NewFoundBlockJournal(filepath.Join(dir, name+"-foundblocks.dat"))
+		var pool *work.DaemonPool
+		var clients []*rpc.Client
+		if s.Daemon != nil {
+			client, err := s.Daemon.Client()
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			clients = []*rpc.Client{client}
+			pool = work.NewDaemonPool(clients, n)
+		}
+		wm := work.NewWorkManager(n, sc, pool, work.NewBlockSubmitter(clients, journal))
+		// The nodes start the sharechain themselves
+		wm.SoloTimeout = 0
+		pm := p2p.NewPeerManager(n, sc, wm.TxCache)
+		pm.LocalIP = net.IPv4(10, 0, 0, byte(i+1))
+
+		node := &Node{
+			Name:        name,
+			IP:          pm.LocalIP,
+			PubKeyHash:  make([]byte, 20),
+			ShareChain:  sc,
+			WorkManager: wm,
+			PeerManager: pm,
+			journal:     journal,
+		}
+		node.PubKeyHash[19] = byte(i + 1)
+		go func() {
+			for h := range sc.NeedShareChannel {
+				pm.AskForShare(h)
+			}
+		}()
+		go func() {
+			for share := range wm.LocalSharesChannel {
+				pm.BroadcastShares([]wire.Share{share})
+			}
+		}()
+		s.Nodes = append(s.Nodes, node)
+		if s.Daemon != nil {
+			go wm.Run(ctx)
+			continue
+		}
+		go wm.WatchBlockSolutions()
+	}
+	if s.Daemon != nil {
+		err := s.Wait(s.onDaemonTip)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	return s, s.NewBlock(false)
+}
+
+// NewBlock gives all nodes the template of the next block. With easy set,
+// every share mined on it solves a block. With a daemon, the daemon moves
+// on to the next block and this waits for all nodes to have its template.
+func (s *Simnet) NewBlock(easy bool) error {
+	if s.Daemon != nil {
+		t := work.SyntheticTemplate(0, 0)
+		if easy {
+			t.Target, t.Bits = easyTarget, easyBits
+		}
+		s.Daemon.SetTarget(t.Target, t.Bits)
+		s.Daemon.Advance(1)
+		return s.Wait(s.onDaemonTip)
+	}
+	s.height++
+	for _, node := range s.Nodes {
+		t := work.SyntheticTemplate(s.height, templateTxs)
+		if easy {
+			t.Target, t.Bits = easyTarget, easyBits
+		}
+		err := node.WorkManager.SetTemplate(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect connects two nodes over a pipe
+func (s *Simnet) Connect(a, b int) error {
+	if _, ok := s.links[link(a, b)]; ok {
+		return nil
+	}
+	ca, cb := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Nodes[b].PeerManager.AddPeerConn(cb, s.Nodes[a].IP, 0)
+	}()
+	err := s.Nodes[a].PeerManager.AddPeerConn(ca, s.Nodes[b].IP, 0)
+	if errB := <-done; err == nil {
+		err = errB
+	}
+	if err != nil {
+		ca.Close()
+		cb.Close()
+		return fmt.Errorf("Could not connect %s and %s: %s", s.Nodes[a].Name, s.Nodes[b].Name, err.Error())
+	}
+	s.links[link(a, b)] = [2]net.Conn{ca, cb}
+	return nil
+}
+
+// ConnectAll connects every node to every other node
+func (s *Simnet) ConnectAll() error {
+	for a := range s.Nodes {
+		for b := a + 1; b < len(s.Nodes); b++ {
+			err := s.Connect(a, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// onDaemonTip checks that all nodes have the template on the daemon's tip
+func (s *Simnet) onDaemonTip() error {
+	tip := s.Daemon.Tip()
+	for _, node := range s.Nodes {
+		t := node.WorkManager.CurrentTemplate()
+		if t == nil || !t.PreviousBlock.IsEqual(tip) {
+			return fmt.Errorf("%s has no template on block %s", node.Name, tip)
+		}
+	}
+	return nil
+}
+
+// Disconnect closes the pipe between two nodes
+func (s *Simnet) Disconnect(a, b int) {
+	conns, ok := s.links[link(a, b)]
+	if !ok {
+		return
+	}
+	conns[0].Close()
+	conns[1].Close()
+	delete(s.links, link(a, b))
+}
+
+// Partition disconnects the nodes in different groups from each other
+func (s *Simnet) Partition(groups ...[]int) {
+	group := map[int]int{}
+	for g, nodes := range groups {
+		for _, i := range nodes {
+			group[i] = g
+		}
+	}
+	for l := range s.links {
+		if group[l[0]] != group[l[1]] {
+			s.Disconnect(l[0], l[1])
+		}
+	}
+}
+
+// Mine has a node mine count shares on its tip, one share period apart
+func (s *Simnet) Mine(node, count int) error {
+	n := s.Nodes[node]
+	for i := 0; i < count; i++ {
+		s.Clock.Advance(time.Second * time.Duration(s.Network.SharePeriod))
+		share, err := n.WorkManager.MineShare(n.PubKeyHash)
+		if err != nil {
+			return fmt.Errorf("%s could not mine a share: %s", n.Name, err.Error())
+		}
+		n.LastShare = share
+	}
+	return nil
+}
+
+// Wait waits until cond returns nil, or returns its last error after the
+// timeout
+func (s *Simnet) Wait(cond func() error) error {
+	deadline := time.Now().Add(s.Timeout)
+	for {
+		err := cond()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// Close disconnects all nodes and stops the daemon
+func (s *Simnet) Close() {
+	s.cancel()
+	for l := range s.links {
+		s.Disconnect(l[0], l[1])
+	}
+	for _, node := range s.Nodes {
+		node.PeerManager.Close()
+	}
+	if s.Daemon != nil {
+		s.Daemon.Close()
+	}
+}
+
+func link(a, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int{a, b}
+}
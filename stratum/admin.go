@@ -0,0 +1,72 @@
+package stratum
+
+import (
+	"math"
+)
+
+func (s *Server) v2Connections() []*v2Conn {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	return append([]*v2Conn{}, s.v2Conns...)
+}
+
+// Disconnect closes the connections of the miners whose remote address or
+// username is target, and returns how many were closed
+func (s *Server) Disconnect(target string) int {
+	n := 0
+	for _, c := range s.Clients() {
+		if c.RemoteAddr() == target || c.Username == target {
+			s.logger().Infof("Disconnecting stratum client %s (%s)", c.RemoteAddr(), c.Username)
+			c.close()
+			n++
+		}
+	}
+	for _, c := range s.v2Connections() {
+		match := c.RemoteAddr() == target
+		c.lock.Lock()
+		for _, ch := range c.channels {
+			match = match || ch.Username == target
+		}
+		c.lock.Unlock()
+		if match {
+			s.logger().Infof("Disconnecting stratum V2 client %s", c.RemoteAddr())
+			c.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// SetDifficulty pins the difficulty of the miners authorized as username,
+// which turns off vardiff for them, and returns how many were changed
+func (s *Server) SetDifficulty(username string, diff float64) int {
+	n := 0
+	for _, c := range s.Clients() {
+		if c.Username != username {
+			continue
+		}
+		c.Difficulty = math.Min(math.Max(diff, c.vardiff.MinDifficulty), c.vardiff.MaxDifficulty)
+		c.FixedDifficulty = true
+		if c.Authorized {
+			c.SendDifficulty()
+		}
+		n++
+	}
+	for _, c := range s.v2Connections() {
+		c.lock.Lock()
+		channels := make([]*v2Channel, 0)
+		for _, ch := range c.channels {
+			if ch.Username == username {
+				channels = append(channels, ch)
+			}
+		}
+		c.lock.Unlock()
+		for _, ch := range channels {
+			ch.Difficulty = math.Min(math.Max(diff, ch.vardiff.MinDifficulty), ch.vardiff.MaxDifficulty)
+			ch.FixedDifficulty = true
+			c.sendTarget(ch)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,258 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// benchServer returns a stratum server on the benchmark network, handing
+// out work on a template of 2000 transactions. Every submission is
+// accepted, leaving the difficulty to the share target.
+func benchServer(b testing.TB) *Server {
+	n := p2pnet.Benchmark()
+	wm, err := work.NewSyntheticWorkManager(n, b.TempDir(), 2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		_, err = wm.MineShare(benchPubKeyHash(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := NewServer(0, n, wm)
+	s.InitialDifficulty = 1e-9
+	s.VarDiffMin = 1e-9
+	s.VarDiffMax = 1e-9
+	return s
+}
+
+func benchPubKeyHash(i int) []byte {
+	pkh := make([]byte, 20)
+	binary.BigEndian.PutUint32(pkh, uint32(i+1))
+	return pkh
+}
+
+func benchAddress(b testing.TB, n p2pnet.Network, i int) string {
+	address, err := work.PubKeyHashToAddress(benchPubKeyHash(i), n.ChainParams.PubKeyHashAddrID, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return address.EncodeAddress()
+}
+
+// pipeMiner is a stratum miner on one end of a net.Pipe, the server on the
+// other
+type pipeMiner struct {
+	conn   net.Conn
+	lines  *bufio.Scanner
+	nextID int
+}
+
+type pipeMessage struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  json.RawMessage   `json:"error"`
+}
+
+func newPipeMiner(s *Server) *pipeMiner {
+	server, client := net.Pipe()
+	s.ServeConn(server)
+	lines := bufio.NewScanner(client)
+	lines.Buffer(make([]byte, 4096), 1024*1024)
+	return &pipeMiner{conn: client, lines: lines}
+}
+
+func (m *pipeMiner) send(method string, params ...interface{}) error {
+	m.nextID++
+	b, err := json.Marshal(map[string]interface{}{"id": m.nextID, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	_, err = m.conn.Write(append(b, '\n'))
+	return err
+}
+
+func (m *pipeMiner) read() (*pipeMessage, error) {
+	if !m.lines.Scan() {
+		if m.lines.Err() != nil {
+			return nil, m.lines.Err()
+		}
+		return nil, fmt.Errorf("Stratum server closed the connection")
+	}
+	var msg pipeMessage
+	err := json.Unmarshal(m.lines.Bytes(), &msg)
+	return &msg, err
+}
+
+// result reads up to the reply to a request
+func (m *pipeMiner) result() (*pipeMessage, error) {
+	for {
+		msg, err := m.read()
+		if err != nil || msg.ID != nil {
+			return msg, err
+		}
+	}
+}
+
+// login subscribes and authorizes, and returns the extranonce1 and the
+// parameters of the first job
+func (m *pipeMiner) login(username string) ([]byte, []json.RawMessage, error) {
+	err := m.send("mining.subscribe", "p2pool-go-bench")
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := m.result()
+	if err != nil {
+		return nil, nil, err
+	}
+	var sub []json.RawMessage
+	var en1Hex string
+	if json.Unmarshal(msg.Result, &sub) != nil || len(sub) < 2 || json.Unmarshal(sub[1], &en1Hex) != nil {
+		return nil, nil, fmt.Errorf("Invalid subscription reply %s", string(msg.Result))
+	}
+	en1, err := hex.DecodeString(en1Hex)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = m.send("mining.authorize", username, "x")
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		msg, err := m.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg.ID != nil && string(msg.Result) != "true" {
+			return nil, nil, fmt.Errorf("Authorization failed: %s", string(msg.Error))
+		}
+		if msg.Method == "mining.notify" && len(msg.Params) >= 8 {
+			return en1, msg.Params, nil
+		}
+	}
+}
+
+// benchJob returns the job the server sent to the miner with the given
+// extranonce1
+func benchJob(b testing.TB, s *Server, en1 []byte, jobID string) *work.Job {
+	for _, c := range s.Clients() {
+		if !bytes.Equal(c.Extranonce1, en1) {
+			continue
+		}
+		c.jobsLock.Lock()
+		defer c.jobsLock.Unlock()
+		if cj, ok := c.jobs[jobID]; ok {
+			return cj.job
+		}
+	}
+	b.Fatalf("Job %s not found", jobID)
+	return nil
+}
+
+// BenchmarkSubmit has one miner submit solutions that meet its difficulty
+// but not the share target, like nearly all submissions do
+func BenchmarkSubmit(b *testing.B) {
+	s := benchServer(b)
+	m := newPipeMiner(s)
+	defer m.conn.Close()
+	address := benchAddress(b, s.Network, 0)
+	en1, params, err := m.login(address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var jobID, ntimeHex string
+	json.Unmarshal(params[0], &jobID)
+	json.Unmarshal(params[7], &ntimeHex)
+	var ntime uint32
+	fmt.Sscanf(ntimeHex, "%x", &ntime)
+	j := benchJob(b, s, en1, jobID)
+
+	en2 := []byte{0, 0, 0, 1}
+	extranonce := binary.LittleEndian.Uint64(append(append([]byte{}, en1...), en2...))
+	nonces := make([]uint32, 0, b.N)
+	for nonce := uint32(0); len(nonces) < b.N; nonce++ {
+		h, err := j.POWHash(s.Network, extranonce, ntime, nonce)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if blockchain.HashToBig(h).Cmp(j.ShareTarget) > 0 {
+			nonces = append(nonces, nonce)
+		}
+	}
+	en2Hex := hex.EncodeToString(en2)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, nonce := range nonces {
+		err = m.send("mining.submit", address, jobID, en2Hex, ntimeHex, fmt.Sprintf("%08x", nonce))
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg, err := m.result()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if string(msg.Result) != "true" {
+			b.Fatalf("Submission rejected: %s", string(msg.Error))
+		}
+	}
+}
+
+// BenchmarkBroadcastJobs sends new jobs to 100 miners mining to 10
+// addresses, and waits for all of them to receive it
+func BenchmarkBroadcastJobs(b *testing.B) {
+	s := benchServer(b)
+	received := make(chan struct{}, 100)
+	done := make(chan struct{})
+	defer close(done)
+	miners := make([]*pipeMiner, 100)
+	for i := range miners {
+		m := newPipeMiner(s)
+		defer m.conn.Close()
+		_, _, err := m.login(fmt.Sprintf("%s.%d", benchAddress(b, s.Network, i%10), i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		miners[i] = m
+	}
+	for _, m := range miners {
+		go func(m *pipeMiner) {
+			for {
+				msg, err := m.read()
+				if err != nil {
+					return
+				}
+				if msg.Method != "mining.notify" {
+					continue
+				}
+				select {
+				case received <- struct{}{}:
+				case <-done:
+					return
+				}
+			}
+		}(m)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.BroadcastJobs(false)
+		for range miners {
+			<-received
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var errClientClosed = errors.New("Stratum client disconnected")
+
+const (
+	maxJobsPerClient = 16
+	// Messages queued for a client that isn't reading them. A client whose
+	// queue is full is too slow and gets disconnected.
+	sendQueueSize = 256
+	writeTimeout  = time.Second * 30
+	// Miners that keep sending the same solution are broken or trying to
+	// pad their stats, and get disconnected
+	maxDuplicateSubmissions = 10
+)
+
+type clientJob struct {
+	job *work.Job
+	// Expires is set once a newer job invalidated this one. Submissions are
+	// still taken until then, but counted as stale.
+	expires   time.Time
+	submitted map[submission]struct{}
+}
+
+// clientPayout is who a miner mines for
+type clientPayout struct {
+	username          string
+	pubKeyHash        []byte
+	pubKeyHashVersion uint8
+}
+
+// submission identifies a solution to a job, to catch duplicates
+type submission struct {
+	extranonce uint64
+	ntime      uint32
+	nonce      uint32
+	version    uint32
+}
+
+type Client struct {
+	Extranonce1 []byte
+	Subscribed  bool
+	UserAgent   string
+	// Extensions are the stratum extensions the miner asked for with
+	// mining.configure, which tell firmwares apart when the user agent
+	// doesn't
+	Extensions []string
+	// ExtranonceSubscribed is set when the miner can handle its extranonce
+	// changing mid connection
+	ExtranonceSubscribed bool
+	Authorized           bool
+	Username             string
+	WorkerName           string
+	PubKeyHash           []byte
+	PubKeyHashVersion    uint8
+	Difficulty           float64
+	// FixedDifficulty is set when the miner pinned its difficulty, which
+	// turns off vardiff
+	FixedDifficulty bool
+	AcceptedShares  uint64
+	StaleShares     uint64
+	Duplicates      uint64
+
+	// payout is set once the miner subscribed and authorized. The fields
+	// above belong to the goroutine handling the miner's requests, jobs are
+	// sent to it from others with this.
+	payout atomic.Pointer[clientPayout]
+
+	conn      net.Conn
+	server    *Server
+	sendQueue chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	jobs      map[string]*clientJob
+	jobOrder  []string
+	jobsLock  sync.Mutex
+	vardiff   *VarDiff
+}
+
+func newClient(conn net.Conn, s *Server) *Client {
+	return &Client{
+		Extranonce1: s.nextExtranonce1(),
+		Difficulty:  s.InitialDifficulty,
+		conn:        conn,
+		server:      s,
+		sendQueue:   make(chan []byte, sendQueueSize),
+		done:        make(chan struct{}),
+		jobs:        map[string]*clientJob{},
+		jobOrder:    make([]string, 0),
+		vardiff:     s.newVarDiff(""),
+	}
+}
+
+func (c *Client) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Client) handle() {
+	defer func() {
+		c.close()
+		c.server.removeClient(c)
+		c.server.logger().Debugf("Stratum client %s disconnected", c.RemoteAddr())
+	}()
+
+	c.server.logger().Debugf("Stratum client %s connected", c.RemoteAddr())
+	go c.writeLoop()
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var req Request
+		err := json.Unmarshal(line, &req)
+		if err != nil {
+			c.server.logger().Warnf("Invalid stratum message from %s: %s", c.RemoteAddr(), err.Error())
+			return
+		}
+		err = c.handleRequest(req)
+		if err != nil {
+			c.server.logger().Warnf("Error handling stratum message from %s: %s", c.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+func (c *Client) handleRequest(req Request) error {
+	var params []interface{}
+	if len(req.Params) > 0 {
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return c.reply(req.ID, nil, stratumError(ErrOther, "Invalid parameters"))
+		}
+	}
+
+	switch req.Method {
+	case "mining.subscribe":
+		return c.handleSubscribe(req.ID, params)
+	case "mining.authorize":
+		return c.handleAuthorize(req.ID, params)
+	case "mining.submit":
+		return c.handleSubmit(req.ID, params)
+	case "mining.suggest_difficulty":
+		return c.handleSuggestDifficulty(req.ID, params)
+	case "mining.configure":
+		return c.handleConfigure(req.ID, params)
+	case "mining.extranonce.subscribe":
+		c.ExtranonceSubscribed = true
+		return c.reply(req.ID, true, nil)
+	default:
+		return c.reply(req.ID, nil, stratumError(ErrOther, "Method not supported"))
+	}
+}
+
+func (c *Client) handleSubscribe(id interface{}, params []interface{}) error {
+	c.Subscribed = true
+	c.setPayout()
+	if len(params) > 0 {
+		c.UserAgent, _ = params[0].(string)
+	}
+	c.server.configureVarDiff(c.vardiff, c.UserAgent)
+	if c.Difficulty < c.vardiff.MinDifficulty {
+		c.Difficulty = c.vardiff.MinDifficulty
+	}
+	subID := hex.EncodeToString(c.Extranonce1)
+	return c.reply(id, []interface{}{
+		[]interface{}{
+			[]interface{}{"mining.set_difficulty", subID},
+			[]interface{}{"mining.notify", subID},
+		},
+		hex.EncodeToString(c.Extranonce1),
+		extranonce2Size,
+	}, nil)
+}
+
+// handleConfigure answers mining.configure (BIP 310). We support none of the
+// extensions: version rolling in particular would change the version our
+// shares commit to.
+func (c *Client) handleConfigure(id interface{}, params []interface{}) error {
+	res := map[string]interface{}{}
+	if len(params) > 0 {
+		names, _ := params[0].([]interface{})
+		for _, n := range names {
+			if name, ok := n.(string); ok {
+				c.Extensions = append(c.Extensions, name)
+				res[name] = false
+			}
+		}
+	}
+	return c.reply(id, res, nil)
+}
+
+func (c *Client) handleAuthorize(id interface{}, params []interface{}) error {
+	if len(params) < 1 {
+		return c.reply(id, false, stratumError(ErrOther, "Missing username"))
+	}
+	username, _ := params[0].(string)
+	password := ""
+	if len(params) > 1 {
+		password, _ = params[1].(string)
+	}
+	username, fixedDiff := parseFixedDifficulty(username, password)
+
+	worker, pkh, version, err := c.server.resolvePayout(username, c.RemoteAddr())
+	if err != nil {
+		return c.reply(id, false, stratumError(ErrUnauthorized, err.Error()))
+	}
+
+	c.Username = username
+	c.WorkerName = worker
+	c.PubKeyHash = pkh
+	c.PubKeyHashVersion = version
+	c.Authorized = true
+	c.setPayout()
+	if fixedDiff > 0 {
+		c.Difficulty = math.Max(fixedDiff, c.vardiff.MinDifficulty)
+		c.FixedDifficulty = true
+	} else if last := c.server.stats.lastDifficulty(username); last > 0 {
+		// Miners coming back, also to a standby that took over from the
+		// node they were on, go on at the difficulty they had
+		c.Difficulty = math.Min(math.Max(last, c.vardiff.MinDifficulty), c.vardiff.MaxDifficulty)
+	}
+
+	err = c.reply(id, true, nil)
+	if err != nil {
+		return err
+	}
+	c.SendDifficulty()
+	c.SendJob(true)
+	return nil
+}
+
+// handleSuggestDifficulty lets a miner pick its starting difficulty, so large
+// rigs don't need to wait for vardiff to catch up with them
+func (c *Client) handleSuggestDifficulty(id interface{}, params []interface{}) error {
+	if len(params) < 1 {
+		return c.reply(id, false, stratumError(ErrOther, "Invalid parameters"))
+	}
+	diff, ok := params[0].(float64)
+	if !ok || diff <= 0 || math.IsInf(diff, 0) {
+		return c.reply(id, false, stratumError(ErrOther, "Invalid difficulty"))
+	}
+	err := c.reply(id, true, nil)
+	if err != nil || c.FixedDifficulty {
+		return err
+	}
+
+	c.Difficulty = math.Min(math.Max(diff, c.vardiff.MinDifficulty), c.vardiff.MaxDifficulty)
+	if c.Authorized {
+		return c.SendDifficulty()
+	}
+	return nil
+}
+
+func (c *Client) handleSubmit(id interface{}, params []interface{}) error {
+	if !c.Authorized {
+		return c.reply(id, false, RejectUnauthorized.stratumError())
+	}
+	if len(params) < 5 {
+		return c.reply(id, false, stratumError(ErrOther, "Invalid parameters"))
+	}
+	strParams := make([]string, 5)
+	for i := range strParams {
+		strParams[i], _ = params[i].(string)
+	}
+
+	j, stale, ok := c.getJob(strParams[1])
+	if !ok {
+		if stale {
+			c.StaleShares++
+			c.server.logger().Debugf("Stale submission from %s for expired job %s", c.Username, strParams[1])
+			return c.reply(id, false, RejectStale.stratumError())
+		}
+		return c.reply(id, false, RejectJobNotFound.stratumError())
+	}
+
+	extranonce2, err := hex.DecodeString(strParams[2])
+	if err != nil || len(extranonce2) != extranonce2Size {
+		return c.reply(id, false, RejectInvalidExtranonce.stratumError())
+	}
+	ntime, err := strconv.ParseUint(strParams[3], 16, 32)
+	if err != nil || !checkNTime(j, uint32(ntime)) {
+		return c.reply(id, false, RejectInvalidNTime.stratumError())
+	}
+	nonce, err := strconv.ParseUint(strParams[4], 16, 32)
+	if err != nil {
+		return c.reply(id, false, RejectInvalidNonce.stratumError())
+	}
+
+	// Without version rolling, which handleConfigure turns down, the
+	// version can only be the job's. Anything else isn't what we hash.
+	version := uint32(j.Share.MinHeader.Version)
+	if len(params) > 5 {
+		if v, ok := params[5].(string); ok {
+			n, err := strconv.ParseUint(v, 16, 32)
+			if err != nil || uint32(n) != version {
+				return c.reply(id, false, RejectInvalidVersion.stratumError())
+			}
+		}
+	}
+
+	extranonce := binary.LittleEndian.Uint64(append(append([]byte{}, c.Extranonce1...), extranonce2...))
+	if !c.markSubmitted(strParams[1], submission{extranonce, uint32(ntime), uint32(nonce), version}) {
+		c.Duplicates++
+		c.server.logger().Debugf("Duplicate submission from %s for job %s", c.Username, strParams[1])
+		err = c.reply(id, false, RejectDuplicate.stratumError())
+		if err == nil && c.Duplicates >= maxDuplicateSubmissions {
+			err = fmt.Errorf("Too many duplicate submissions")
+		}
+		return err
+	}
+	res, err := c.server.Work.Submit(j, extranonce, uint32(ntime), uint32(nonce))
+	if err != nil {
+		c.server.logger().Errorf("Could not process submission from %s: %s", c.Username, err.Error())
+		return c.reply(id, false, RejectInternal.stratumError())
+	}
+
+	pseudoTarget := work.DifficultyToTarget(c.Difficulty / c.server.Network.DumbScryptDiff)
+	if blockchain.HashToBig(res.POWHash).Cmp(pseudoTarget) > 0 && !res.IsShare {
+		return c.reply(id, false, RejectLowDifficulty.stratumError())
+	}
+
+	dead := stale || c.server.Work.IsStale(j)
+	if dead {
+		c.StaleShares++
+	} else {
+		c.AcceptedShares++
+	}
+	c.server.stats.record(c.Username, c.server.payoutAddress(c.PubKeyHash, c.PubKeyHashVersion), c.WorkerName, c.UserAgent, c.Difficulty, c.server.Network.DumbScryptDiff, dead)
+
+	err = c.reply(id, true, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.FixedDifficulty {
+		return nil
+	}
+	newDiff, changed := c.vardiff.Submitted(c.Difficulty)
+	if changed {
+		c.Difficulty = newDiff
+		events.PublishOn(c.server.Network.Name, events.DifficultyChanged, events.Difficulty{User: c.Username, Difficulty: newDiff})
+		c.SendDifficulty()
+	}
+	return nil
+}
+
+// SetExtranonce1 moves the miner to a new extranonce. Miners that didn't
+// subscribe to extranonce changes are disconnected instead, so they
+// reconnect and pick up a new one.
+func (c *Client) SetExtranonce1(extranonce1 []byte) error {
+	if !c.ExtranonceSubscribed {
+		c.close()
+		return errClientClosed
+	}
+	// Jobs sent before are no good with the new extranonce
+	c.jobsLock.Lock()
+	c.Extranonce1 = extranonce1
+	c.jobs = map[string]*clientJob{}
+	c.jobOrder = c.jobOrder[:0]
+	c.jobsLock.Unlock()
+	err := c.notify("mining.set_extranonce", []interface{}{hex.EncodeToString(extranonce1), extranonce2Size})
+	if err != nil {
+		return err
+	}
+	c.SendJob(true)
+	return nil
+}
+
+// setPayout makes the miner's payout known to the senders of jobs once it
+// subscribed and authorized
+func (c *Client) setPayout() {
+	if c.Subscribed && c.Authorized {
+		c.payout.Store(&clientPayout{c.Username, c.PubKeyHash, c.PubKeyHashVersion})
+	}
+}
+
+// DOAPercent is the percentage of this miner's submissions that were for
+// work that was already stale
+func (c *Client) DOAPercent() float64 {
+	return doaPercent(c.AcceptedShares, c.StaleShares)
+}
+
+func (c *Client) SendDifficulty() error {
+	return c.notify("mining.set_difficulty", []interface{}{c.Difficulty})
+}
+
+// SendJob creates a new job for this miner and notifies it
+func (c *Client) SendJob(clean bool) {
+	c.server.sendJobs([]*Client{c}, clean)
+}
+
+// addJob registers a job sent to this client, so its submissions can be
+// matched to it
+func (c *Client) addJob(jobID string, j *work.Job, clean bool) {
+	c.jobsLock.Lock()
+	defer c.jobsLock.Unlock()
+	if clean {
+		// Give miners a moment to switch over before old jobs are gone
+		expires := clock.Now().Add(c.server.StaleGrace)
+		for _, cj := range c.jobs {
+			if cj.expires.IsZero() {
+				cj.expires = expires
+			}
+		}
+	}
+	c.jobs[jobID] = &clientJob{job: j, submitted: map[submission]struct{}{}}
+	c.jobOrder = append(c.jobOrder, jobID)
+	if len(c.jobOrder) > maxJobsPerClient {
+		delete(c.jobs, c.jobOrder[0])
+		c.jobOrder = c.jobOrder[1:]
+	}
+}
+
+// getJob looks up a job by its ID. Jobs past their grace period are removed
+// and reported as stale, as are IDs we handed out before but no longer know.
+func (c *Client) getJob(jobID string) (j *work.Job, stale bool, ok bool) {
+	c.jobsLock.Lock()
+	defer c.jobsLock.Unlock()
+
+	cj, ok := c.jobs[jobID]
+	if !ok {
+		n, err := strconv.ParseUint(jobID, 16, 64)
+		return nil, err == nil && n <= atomic.LoadUint64(&c.server.jobID), false
+	}
+	if !cj.expires.IsZero() {
+		if clock.Now().After(cj.expires) {
+			delete(c.jobs, jobID)
+			return nil, true, false
+		}
+		return cj.job, true, true
+	}
+	return cj.job, false, true
+}
+
+// markSubmitted records a solution to a job, and returns false if it was
+// submitted before
+func (c *Client) markSubmitted(jobID string, sub submission) bool {
+	c.jobsLock.Lock()
+	defer c.jobsLock.Unlock()
+	cj, ok := c.jobs[jobID]
+	if !ok {
+		return true
+	}
+	if _, dup := cj.submitted[sub]; dup {
+		return false
+	}
+	cj.submitted[sub] = struct{}{}
+	return true
+}
+
+func jobNotifyParams(jobID string, j *work.Job, clean bool) []interface{} {
+	prevHash := make([]byte, 32)
+	copy(prevHash, j.Share.MinHeader.PreviousBlock[:])
+	for i := 0; i < 32; i += 4 {
+		prevHash[i], prevHash[i+1], prevHash[i+2], prevHash[i+3] = prevHash[i+3], prevHash[i+2], prevHash[i+1], prevHash[i]
+	}
+
+	branch := make([]string, len(j.Template.MerkleBranch))
+	for i, h := range j.Template.MerkleBranch {
+		branch[i] = hex.EncodeToString(h[:])
+	}
+
+	return []interface{}{
+		jobID,
+		hex.EncodeToString(prevHash),
+		hex.EncodeToString(j.CoinbasePrefix),
+		hex.EncodeToString(j.CoinbaseSuffix),
+		branch,
+		fmt.Sprintf("%08x", uint32(j.Share.MinHeader.Version)),
+		fmt.Sprintf("%08x", j.Share.MinHeader.Bits),
+		fmt.Sprintf("%08x", uint32(j.Share.ShareInfo.Timestamp)),
+		clean,
+	}
+}
+
+func (c *Client) reply(id interface{}, result interface{}, err interface{}) error {
+	return c.write(Response{ID: id, Result: result, Error: err})
+}
+
+func (c *Client) notify(method string, params []interface{}) error {
+	return c.write(Notification{ID: nil, Method: method, Params: params})
+}
+
+func (c *Client) write(msg interface{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.send(append(b, '\n'))
+}
+
+// send queues a serialized message. It never blocks: a client that doesn't
+// keep up with its messages is disconnected.
+func (c *Client) send(b []byte) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+	select {
+	case c.sendQueue <- b:
+		return nil
+	default:
+		c.server.logger().Warnf("Stratum client %s is not reading its messages, disconnecting", c.RemoteAddr())
+		c.close()
+		return errClientClosed
+	}
+}
+
+// writeLoop writes queued messages to the connection, batching whatever is
+// queued into a single write
+func (c *Client) writeLoop() {
+	w := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.sendQueue:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			w.Write(b)
+			for more := true; more; {
+				select {
+				case b = <-c.sendQueue:
+					w.Write(b)
+				default:
+					more = false
+				}
+			}
+			err := w.Flush()
+			if err != nil {
+				c.server.logger().Debugf("Writing to stratum client %s failed: %s", c.RemoteAddr(), err.Error())
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
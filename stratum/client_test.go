@@ -0,0 +1,121 @@
+package stratum
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+)
+
+// TestSubmitChangedVersion resends a solution with another version, which
+// we don't hash and mustn't count as a new submission
+func TestSubmitChangedVersion(t *testing.T) {
+	s := benchServer(t)
+	m := newPipeMiner(s)
+	defer m.conn.Close()
+	address := benchAddress(t, s.Network, 0)
+	en1, params, err := m.login(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobID, versionHex, ntimeHex string
+	json.Unmarshal(params[0], &jobID)
+	json.Unmarshal(params[5], &versionHex)
+	json.Unmarshal(params[7], &ntimeHex)
+	var ntime, version uint32
+	fmt.Sscanf(ntimeHex, "%x", &ntime)
+	fmt.Sscanf(versionHex, "%x", &version)
+	j := benchJob(t, s, en1, jobID)
+
+	// A solution that isn't a share, so the job stays current
+	en2 := []byte{0, 0, 0, 1}
+	extranonce := binary.LittleEndian.Uint64(append(append([]byte{}, en1...), en2...))
+	nonce := uint32(0)
+	for ; ; nonce++ {
+		h, err := j.POWHash(s.Network, extranonce, ntime, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockchain.HashToBig(h).Cmp(j.ShareTarget) > 0 {
+			break
+		}
+	}
+
+	for i, v := range []uint32{version, version ^ 0x2000, version} {
+		err = m.send("mining.submit", address, jobID, hex.EncodeToString(en2), ntimeHex, fmt.Sprintf("%08x", nonce), fmt.Sprintf("%08x", v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := m.result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted := string(msg.Result) == "true"; accepted != (i == 0) {
+			t.Fatalf("Submission %d with version %08x accepted: %t, error %s", i, v, accepted, string(msg.Error))
+		}
+	}
+	for _, c := range s.Clients() {
+		if c.AcceptedShares != 1 {
+			t.Errorf("%d accepted shares counted, not 1", c.AcceptedShares)
+		}
+	}
+}
+
+// TestSetExtranonce1 moves a miner that subscribed to extranonce changes to
+// a new extranonce1, which it's told about before getting new work
+func TestSetExtranonce1(t *testing.T) {
+	s := benchServer(t)
+	m := newPipeMiner(s)
+	defer m.conn.Close()
+	err := m.send("mining.extranonce.subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := m.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Result) != "true" {
+		t.Fatalf("Extranonce subscription answered with %s, error %s", string(msg.Result), string(msg.Error))
+	}
+	en1, _, err := m.login(benchAddress(t, s.Network, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEn1 := []byte{0xde, 0xad, 0xbe, 0xef}
+	for _, c := range s.Clients() {
+		if string(c.Extranonce1) == string(en1) {
+			go c.SetExtranonce1(newEn1)
+		}
+	}
+	for {
+		msg, err := m.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Method == "mining.notify" {
+			t.Fatal("New work before the new extranonce1")
+		}
+		if msg.Method != "mining.set_extranonce" {
+			continue
+		}
+		var en1Hex string
+		if len(msg.Params) < 2 || json.Unmarshal(msg.Params[0], &en1Hex) != nil || en1Hex != hex.EncodeToString(newEn1) {
+			t.Fatalf("Extranonce1 set to %v, not %x", msg.Params, newEn1)
+		}
+		break
+	}
+	for {
+		msg, err := m.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Method == "mining.notify" {
+			return
+		}
+	}
+}
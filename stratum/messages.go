@@ -0,0 +1,100 @@
+package stratum
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/rejects"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type Request struct {
+	ID     interface{}     `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	ID     interface{} `json:"id"`
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+}
+
+type Notification struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// Error codes as used by most pools and understood by most mining software
+const (
+	ErrOther         = 20
+	ErrJobNotFound   = 21
+	ErrDuplicate     = 22
+	ErrLowDiff       = 23
+	ErrUnauthorized  = 24
+	ErrNotSubscribed = 25
+)
+
+func stratumError(code int, msg string) []interface{} {
+	return []interface{}{code, msg, nil}
+}
+
+// RejectReason is why a submission was refused, with the code and message
+// V1 miners get and the error code for V2 miners
+type RejectReason struct {
+	Code    int
+	Message string
+	V2Code  string
+}
+
+var (
+	RejectStale             = RejectReason{ErrJobNotFound, "Stale job", "stale-share"}
+	RejectJobNotFound       = RejectReason{ErrJobNotFound, "Job not found", "invalid-job-id"}
+	RejectDuplicate         = RejectReason{ErrDuplicate, "Duplicate share", "duplicate-share"}
+	RejectLowDifficulty     = RejectReason{ErrLowDiff, "Low difficulty share", "difficulty-too-low"}
+	RejectUnauthorized      = RejectReason{ErrUnauthorized, "Unauthorized worker", "invalid-channel-id"}
+	RejectInvalidNonce      = RejectReason{ErrOther, "Invalid nonce", "invalid-nonce"}
+	RejectInvalidNTime      = RejectReason{ErrOther, "Ntime out of range", "invalid-timestamp"}
+	RejectInvalidVersion    = RejectReason{ErrOther, "Invalid version", "invalid-version"}
+	RejectInvalidExtranonce = RejectReason{ErrOther, "Invalid extranonce2", "invalid-extranonce"}
+	RejectInternal          = RejectReason{ErrOther, "Internal error", "internal-error"}
+)
+
+// stratumError counts the rejection and returns the error for V1 miners
+func (r RejectReason) stratumError() []interface{} {
+	r.count()
+	return stratumError(r.Code, r.Message)
+}
+
+func (r RejectReason) count() {
+	switch r {
+	case RejectStale:
+		rejects.Add(rejects.Stratum, rejects.Stale)
+	case RejectDuplicate:
+		rejects.Add(rejects.Stratum, rejects.Duplicate)
+	case RejectLowDifficulty:
+		rejects.Add(rejects.Stratum, rejects.LowDifficulty)
+	default:
+		rejects.Add(rejects.Stratum, r.V2Code)
+	}
+}
+
+// maxNTimeFuture is how far ahead of our clock a miner may roll ntime
+const maxNTimeFuture = time.Hour * 2
+
+// checkNTime tells whether a submitted ntime is within range of the job
+func checkNTime(j *work.Job, ntime uint32) bool {
+	if ntime < uint32(j.Share.ShareInfo.Timestamp) {
+		return false
+	}
+	return int64(ntime) <= clock.Now().Add(maxNTimeFuture).Unix()
+}
+
+func doaPercent(accepted, stale uint64) float64 {
+	if accepted+stale == 0 {
+		return 0
+	}
+	return float64(stale) * 100 / float64(accepted+stale)
+}
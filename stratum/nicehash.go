@@ -0,0 +1,33 @@
+package stratum
+
+import (
+	"strings"
+)
+
+// niceHashMinDifficulty are the lowest difficulties NiceHash accepts per
+// algorithm, in stratum difficulty. Rented hashrate gets disconnected by
+// NiceHash when the pool asks for less.
+var niceHashMinDifficulty = map[string]float64{
+	"sha256d":   500000,
+	"scrypt":    65536,
+	"lyra2rev3": 4,
+	"verthash":  1,
+}
+
+// isNiceHash tells whether the user agent sent with mining.subscribe
+// belongs to NiceHash
+func isNiceHash(userAgent string) bool {
+	return strings.HasPrefix(strings.ToLower(userAgent), "nicehash")
+}
+
+// minDifficultyFor is the difficulty floor for a miner, which is higher for
+// rental services
+func (s *Server) minDifficultyFor(userAgent string) float64 {
+	if isNiceHash(userAgent) {
+		if s.NiceHashMinDifficulty > 0 {
+			return s.NiceHashMinDifficulty
+		}
+		return niceHashMinDifficulty[s.Network.PowAlgorithm]
+	}
+	return 0
+}
@@ -0,0 +1,370 @@
+package stratum
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var log = logging.For("stratum")
+
+const (
+	extranonce1Size = 4
+	extranonce2Size = 4
+)
+
+// WorkSource hands out the jobs for miners and checks their solutions. It's
+// the node's work.WorkManager, or for a stratum gateway the node it
+// forwards to.
+type WorkSource interface {
+	GetJob(pubKeyHash []byte, pubKeyHashVersion uint8) (*work.Job, error)
+	Submit(j *work.Job, extranonce uint64, timestamp uint32, nonce uint32) (*work.SubmitResult, error)
+	// IsStale tells whether a job was built on a block that was replaced
+	IsStale(j *work.Job) bool
+	Paused() (bool, string)
+	// NewWork is signaled when there is new work, and TakeClean then tells
+	// whether it invalidates all previous jobs
+	NewWork() <-chan bool
+	TakeClean() bool
+}
+
+type Server struct {
+	Port              int
+	Network           p2pnet.Network
+	Work              WorkSource
+	InitialDifficulty float64
+	StaleGrace        time.Duration
+
+	// DefaultAddress, if set, is mined to by miners that authorize with a
+	// username that isn't a valid address, instead of rejecting them
+	DefaultAddress string
+
+	// NiceHashMinDifficulty overrides the difficulty floor for NiceHash
+	// miners, if set
+	NiceHashMinDifficulty float64
+
+	// VarDiffTarget, VarDiffMin and VarDiffMax override the vardiff
+	// defaults when set. Change them with SetVarDiff once running.
+	VarDiffTarget time.Duration
+	VarDiffMin    float64
+	VarDiffMax    float64
+	varDiffLock   sync.Mutex
+
+	// V2CertValidity is how long the certificates handed to Stratum V2
+	// miners during the handshake stay valid
+	V2CertValidity time.Duration
+
+	// Log gets the records about miners, the package's logger if nil
+	Log *logging.SubsystemLogger
+
+	v2Authority     *btcec.PrivateKey
+	v2Conns         []*v2Conn
+	listeners       []net.Listener
+	closed          bool
+	workLoopOnce    sync.Once
+	clients         []*Client
+	clientsLock     sync.Mutex
+	extranonce1     uint32
+	extranonce1Lock sync.Mutex
+	jobID           uint64
+	pausedNotified  bool
+	stats           *minerStats
+}
+
+func NewServer(port int, n p2pnet.Network, ws WorkSource) *Server {
+	return &Server{
+		Port:              port,
+		Network:           n,
+		Work:              ws,
+		InitialDifficulty: 1,
+		StaleGrace:        time.Second * 5,
+		V2CertValidity:    time.Hour * 24,
+		clients:           make([]*Client, 0),
+		stats:             newMinerStats(),
+	}
+}
+
+func (s *Server) logger() *logging.SubsystemLogger {
+	return s.Log.Or(log)
+}
+
+// Listen opens the stratum port and starts accepting miners
+func (s *Server) Listen() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return err
+	}
+	s.logger().Infof("Stratum server listening on port %d", s.Port)
+	s.serve(l)
+	return nil
+}
+
+// ListenTLS opens an additional, TLS wrapped stratum port. Miners using it
+// can't have their payout address rewritten by anyone in between.
+func (s *Server) ListenTLS(port int, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load stratum TLS certificate: %s", err.Error())
+	}
+	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	s.logger().Infof("Stratum server listening for TLS on port %d", port)
+	s.serve(l)
+	return nil
+}
+
+// ListenV2 opens a Stratum V2 port. Connections are encrypted, and miners
+// verify the server against the public key of the authority. Miners can open
+// standard and extended channels; job negotiation, where they pick the
+// block's transactions themselves, is not supported.
+func (s *Server) ListenV2(port int, authority *btcec.PrivateKey) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	s.logger().Infof("Stratum V2 server listening on port %d", port)
+	s.clientsLock.Lock()
+	s.v2Authority = authority
+	s.listeners = append(s.listeners, l)
+	s.clientsLock.Unlock()
+	go s.acceptV2Loop(l)
+	s.workLoopOnce.Do(func() {
+		go s.workLoop()
+	})
+	return nil
+}
+
+func (s *Server) serve(l net.Listener) {
+	s.clientsLock.Lock()
+	s.listeners = append(s.listeners, l)
+	s.clientsLock.Unlock()
+	go s.acceptLoop(l)
+	s.workLoopOnce.Do(func() {
+		go s.workLoop()
+	})
+}
+
+func (s *Server) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				s.logger().Errorf("Stratum accept failed: %s", err.Error())
+			}
+			return
+		}
+		s.ServeConn(conn)
+	}
+}
+
+// ServeConn handles a miner on a connection accepted elsewhere, like one end
+// of a net.Pipe
+func (s *Server) ServeConn(conn net.Conn) {
+	c := newClient(conn, s)
+	s.clientsLock.Lock()
+	s.clients = append(s.clients, c)
+	s.clientsLock.Unlock()
+	s.workLoopOnce.Do(func() {
+		go s.workLoop()
+	})
+	go c.handle()
+}
+
+func (s *Server) acceptV2Loop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				s.logger().Errorf("Stratum V2 accept failed: %s", err.Error())
+			}
+			return
+		}
+		c := &v2Conn{server: s, conn: conn, channels: map[uint32]*v2Channel{}}
+		s.clientsLock.Lock()
+		s.v2Conns = append(s.v2Conns, c)
+		s.clientsLock.Unlock()
+		go c.handle()
+	}
+}
+
+// Close stops accepting miners. Connected miners stay connected.
+func (s *Server) Close() {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	return s.closed
+}
+
+// workLoop sends new jobs to all miners when the work manager has new work
+func (s *Server) workLoop() {
+	for range s.Work.NewWork() {
+		s.BroadcastJobs(s.Work.TakeClean())
+	}
+}
+
+func (s *Server) BroadcastJobs(clean bool) {
+	if paused, reason := s.Work.Paused(); paused {
+		// Let miners know why they're not getting work, most mining
+		// software shows this to the user
+		if !s.pausedNotified {
+			s.pausedNotified = true
+			for _, c := range s.Clients() {
+				c.notify("client.show_message", []interface{}{fmt.Sprintf("Pool paused: %s", reason)})
+			}
+		}
+		return
+	}
+	s.pausedNotified = false
+	s.sendJobs(s.Clients(), clean)
+
+	s.clientsLock.Lock()
+	v2Conns := make([]*v2Conn, len(s.v2Conns))
+	copy(v2Conns, s.v2Conns)
+	s.clientsLock.Unlock()
+	for _, c := range v2Conns {
+		c.sendJobs(clean)
+	}
+}
+
+// sendJobs creates one job per payout address among clients and sends it to
+// all of them that mine to that address, serializing the notification once
+func (s *Server) sendJobs(clients []*Client, clean bool) {
+	groups := map[string][]*Client{}
+	payouts := map[string]*clientPayout{}
+	for _, c := range clients {
+		p := c.payout.Load()
+		if p == nil {
+			continue
+		}
+		key := string(append([]byte{p.pubKeyHashVersion}, p.pubKeyHash...))
+		groups[key] = append(groups[key], c)
+		payouts[key] = p
+	}
+
+	for key, group := range groups {
+		p := payouts[key]
+		j, err := s.Work.GetJob(p.pubKeyHash, p.pubKeyHashVersion)
+		if err != nil {
+			s.logger().Warnf("Could not create job for %s: %s", p.username, err.Error())
+			continue
+		}
+		jobID := strconv.FormatUint(atomic.AddUint64(&s.jobID, 1), 16)
+		b, err := json.Marshal(Notification{ID: nil, Method: "mining.notify", Params: jobNotifyParams(jobID, j, clean)})
+		if err != nil {
+			s.logger().Errorf("Could not serialize job: %s", err.Error())
+			continue
+		}
+		b = append(b, '\n')
+		for _, c := range group {
+			c.addJob(jobID, j, clean)
+			c.send(b)
+		}
+	}
+}
+
+// Reconnect asks all miners to move to another node, for instance before a
+// restart. Miners wait the given time before reconnecting.
+func (s *Server) Reconnect(host string, port int, wait time.Duration) {
+	clients := s.Clients()
+	v2Conns := s.v2Connections()
+
+	s.logger().Infof("Asking %d stratum client(s) to reconnect to %s:%d", len(clients)+len(v2Conns), host, port)
+	for _, c := range clients {
+		c.notify("client.reconnect", []interface{}{host, port, int(wait.Seconds())})
+	}
+	for _, c := range v2Conns {
+		c.reconnect(host, port)
+	}
+}
+
+func (s *Server) Clients() []*Client {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	clients := make([]*Client, len(s.clients))
+	copy(clients, s.clients)
+	return clients
+}
+
+func (s *Server) removeClient(c *Client) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	newClients := make([]*Client, 0, len(s.clients))
+	for _, cl := range s.clients {
+		if cl != c {
+			newClients = append(newClients, cl)
+		}
+	}
+	s.clients = newClients
+}
+
+func (s *Server) removeV2Conn(c *v2Conn) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	newConns := make([]*v2Conn, 0, len(s.v2Conns))
+	for _, cl := range s.v2Conns {
+		if cl != c {
+			newConns = append(newConns, cl)
+		}
+	}
+	s.v2Conns = newConns
+}
+
+// resolvePayout splits a stratum username into the payout address and the
+// worker name, and decodes the address. Invalid addresses mine to the default
+// address if there is one.
+func (s *Server) resolvePayout(username string, remote string) (worker string, pkh []byte, version uint8, err error) {
+	address := username
+	if i := strings.IndexAny(username, "._"); i >= 0 {
+		address = username[:i]
+		worker = username[i+1:]
+	}
+
+	address = work.NormalizeAddress(address, s.Network)
+	pkh, version, err = work.AddressToPubKeyHash(address, s.Network)
+	if err != nil {
+		if s.DefaultAddress == "" {
+			s.logger().Warnf("Stratum client %s authorized with invalid address %s: %s", remote, address, err.Error())
+			return "", nil, 0, fmt.Errorf("%s is not a valid %s address: %s", address, s.Network.ChainParams.Name, err.Error())
+		}
+		s.logger().Warnf("Stratum client %s authorized with invalid address %s, mining to default address %s", remote, address, s.DefaultAddress)
+		pkh, version, err = work.AddressToPubKeyHash(s.DefaultAddress, s.Network)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("Invalid default payout address")
+		}
+	}
+	return worker, pkh, version, nil
+}
+
+func (s *Server) nextExtranonce1() []byte {
+	s.extranonce1Lock.Lock()
+	defer s.extranonce1Lock.Unlock()
+	s.extranonce1++
+	b := make([]byte, extranonce1Size)
+	binary.BigEndian.PutUint32(b, s.extranonce1)
+	return b
+}
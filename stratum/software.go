@@ -0,0 +1,100 @@
+package stratum
+
+import (
+	"sort"
+	"strings"
+)
+
+// SoftwareStats sums up the connected miners running one version of mining
+// software or firmware
+type SoftwareStats struct {
+	Software       string   `json:"software"`
+	Version        string   `json:"version"`
+	Connections    int      `json:"connections"`
+	HashRate       float64  `json:"hash_rate"`
+	AcceptedShares uint64   `json:"accepted_shares"`
+	StaleShares    uint64   `json:"stale_shares"`
+	Duplicates     uint64   `json:"duplicates"`
+	Extensions     []string `json:"extensions,omitempty"`
+}
+
+// ParseUserAgent splits a user agent like "cgminer/4.11.1" or
+// "bmminer/2.0.0/Antminer S9" into software and version. Agents without a
+// version get an empty one.
+func ParseUserAgent(agent string) (software, version string) {
+	agent = strings.TrimSpace(agent)
+	if agent == "" {
+		return "unknown", ""
+	}
+	software, version, _ = strings.Cut(agent, "/")
+	return strings.TrimSpace(software), strings.TrimSpace(version)
+}
+
+// SoftwareBreakdown groups the connected miners by the software they
+// announced, busiest first, to spot rejections that only hit some firmware
+func (s *Server) SoftwareBreakdown() []SoftwareStats {
+	rates, _ := s.stats.rates()
+	groups := map[string]*SoftwareStats{}
+	counted := map[string]bool{}
+	add := func(agent, user string, extensions []string, accepted, stale, dups uint64) *SoftwareStats {
+		software, version := ParseUserAgent(agent)
+		key := software + "/" + version
+		g, ok := groups[key]
+		if !ok {
+			g = &SoftwareStats{Software: software, Version: version}
+			groups[key] = g
+		}
+		// Users can be on several connections, their rate counts once
+		if !counted[key+"\x00"+user] {
+			counted[key+"\x00"+user] = true
+			g.HashRate += rates[user]
+		}
+		g.AcceptedShares += accepted
+		g.StaleShares += stale
+		g.Duplicates += dups
+		for _, e := range extensions {
+			if !containsString(g.Extensions, e) {
+				g.Extensions = append(g.Extensions, e)
+			}
+		}
+		return g
+	}
+
+	for _, c := range s.Clients() {
+		add(c.UserAgent, c.Username, c.Extensions, c.AcceptedShares, c.StaleShares, c.Duplicates).Connections++
+	}
+	for _, c := range s.v2Connections() {
+		c.lock.Lock()
+		var g *SoftwareStats
+		for _, ch := range c.channels {
+			g = add(c.userAgent, ch.Username, nil, ch.AcceptedShares, ch.StaleShares, ch.Duplicates)
+		}
+		if g == nil {
+			g = add(c.userAgent, "", nil, 0, 0, 0)
+		}
+		g.Connections++
+		c.lock.Unlock()
+	}
+
+	res := make([]SoftwareStats, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g.Extensions)
+		res = append(res, *g)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].HashRate != res[j].HashRate {
+			return res[i].HashRate > res[j].HashRate
+		}
+		return res[i].Software+res[i].Version < res[j].Software+res[j].Version
+	})
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+package stratum
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// minerStatsWindow is how far back miner hashrates are averaged, the same
+// ten minutes p2pool uses
+const minerStatsWindow = time.Minute * 10
+
+type shareRecord struct {
+	time     time.Time
+	user     string
+	attempts float64
+	dead     bool
+}
+
+// workerInfo is what we remember of a stratum user since the node started
+type workerInfo struct {
+	address    string
+	worker     string
+	userAgent  string
+	difficulty float64
+	lastShare  time.Time
+	accepted   uint64
+	dead       uint64
+}
+
+// minerStats keeps the shares miners submitted over the last
+// minerStatsWindow, to estimate their hashrates
+type minerStats struct {
+	started time.Time
+	records []shareRecord
+	workers map[string]*workerInfo
+	lock    sync.Mutex
+}
+
+func newMinerStats() *minerStats {
+	return &minerStats{started: clock.Now(), workers: map[string]*workerInfo{}}
+}
+
+// record registers a share of the given stratum user, mining to address with
+// the software in userAgent
+func (m *minerStats) record(user, address, worker, userAgent string, difficulty float64, dumbScryptDiff float64, dead bool) {
+	att, _ := big.NewFloat(0).SetInt(work.TargetToAverageAttempts(work.DifficultyToTarget(difficulty / dumbScryptDiff))).Float64()
+	now := clock.Now()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune(now)
+	m.records = append(m.records, shareRecord{time: now, user: user, attempts: att, dead: dead})
+	w, ok := m.workers[user]
+	if !ok {
+		w = &workerInfo{}
+		m.workers[user] = w
+	}
+	w.address = address
+	w.worker = worker
+	w.userAgent = userAgent
+	w.difficulty = difficulty
+	w.lastShare = now
+	if dead {
+		w.dead++
+	} else {
+		w.accepted++
+	}
+}
+
+func (m *minerStats) prune(now time.Time) {
+	i := 0
+	for i < len(m.records) && now.Sub(m.records[i].time) > minerStatsWindow {
+		i++
+	}
+	m.records = m.records[i:]
+}
+
+// rates returns the hashrate and the dead hashrate of every miner that
+// submitted shares within the window
+func (m *minerStats) rates() (map[string]float64, map[string]float64) {
+	now := clock.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune(now)
+
+	seconds := m.windowSeconds(now)
+	rates := map[string]float64{}
+	dead := map[string]float64{}
+	for _, r := range m.records {
+		rates[r.user] += r.attempts / seconds
+		if r.dead {
+			dead[r.user] += r.attempts / seconds
+		}
+	}
+	return rates, dead
+}
+
+// windowSeconds is the time the records cover, which is shorter than
+// minerStatsWindow right after starting
+func (m *minerStats) windowSeconds(now time.Time) float64 {
+	window := now.Sub(m.started)
+	if window > minerStatsWindow {
+		window = minerStatsWindow
+	}
+	if window < time.Second {
+		return 1
+	}
+	return window.Seconds()
+}
+
+func (m *minerStats) difficulties() map[string]float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d := make(map[string]float64, len(m.workers))
+	for user, w := range m.workers {
+		d[user] = w.difficulty
+	}
+	return d
+}
+
+// WorkerStats describes one stratum user mining to an address
+type WorkerStats struct {
+	Name         string  `json:"name"`
+	UserAgent    string  `json:"user_agent,omitempty"`
+	HashRate     float64 `json:"hash_rate"`
+	DeadHashRate float64 `json:"dead_hash_rate"`
+	Difficulty   float64 `json:"difficulty"`
+	DOAPercent   float64 `json:"doa_percent"`
+	LastShare    int64   `json:"last_share"`
+}
+
+// AddressStats sums up the workers mining to an address
+type AddressStats struct {
+	Address      string        `json:"address"`
+	HashRate     float64       `json:"hash_rate"`
+	DeadHashRate float64       `json:"dead_hash_rate"`
+	DOAPercent   float64       `json:"doa_percent"`
+	LastShare    int64         `json:"last_share"`
+	Workers      []WorkerStats `json:"workers"`
+}
+
+func (m *minerStats) address(address string) AddressStats {
+	now := clock.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune(now)
+
+	st := AddressStats{Address: address, Workers: []WorkerStats{}}
+	seconds := m.windowSeconds(now)
+	rates := map[string]float64{}
+	dead := map[string]float64{}
+	for _, r := range m.records {
+		rates[r.user] += r.attempts / seconds
+		if r.dead {
+			dead[r.user] += r.attempts / seconds
+		}
+	}
+
+	accepted, stale := uint64(0), uint64(0)
+	for user, w := range m.workers {
+		if w.address != address {
+			continue
+		}
+		st.Workers = append(st.Workers, WorkerStats{
+			Name:         w.worker,
+			UserAgent:    w.userAgent,
+			HashRate:     rates[user],
+			DeadHashRate: dead[user],
+			Difficulty:   w.difficulty,
+			DOAPercent:   doaPercent(w.accepted, w.dead),
+			LastShare:    w.lastShare.Unix(),
+		})
+		st.HashRate += rates[user]
+		st.DeadHashRate += dead[user]
+		accepted += w.accepted
+		stale += w.dead
+		if w.lastShare.Unix() > st.LastShare {
+			st.LastShare = w.lastShare.Unix()
+		}
+	}
+	sort.Slice(st.Workers, func(i, j int) bool { return st.Workers[i].Name < st.Workers[j].Name })
+	st.DOAPercent = doaPercent(accepted, stale)
+	return st
+}
+
+// lastDifficulty returns the difficulty of the last share of a stratum user,
+// 0 if it has none
+func (m *minerStats) lastDifficulty(user string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if w, ok := m.workers[user]; ok {
+		return w.difficulty
+	}
+	return 0
+}
+
+// MinerRecord is what the node remembers of a stratum user, as standby
+// nodes get it replicated
+type MinerRecord struct {
+	User       string  `json:"user"`
+	Address    string  `json:"address"`
+	Worker     string  `json:"worker"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Difficulty float64 `json:"difficulty"`
+	LastShare  int64   `json:"last_share"`
+	Accepted   uint64  `json:"accepted"`
+	Dead       uint64  `json:"dead"`
+}
+
+// Miners returns the registry of the stratum users that submitted shares
+// since the node started
+func (s *Server) Miners() []MinerRecord {
+	m := s.stats
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	miners := make([]MinerRecord, 0, len(m.workers))
+	for user, w := range m.workers {
+		miners = append(miners, MinerRecord{
+			User:       user,
+			Address:    w.address,
+			Worker:     w.worker,
+			UserAgent:  w.userAgent,
+			Difficulty: w.difficulty,
+			LastShare:  w.lastShare.Unix(),
+			Accepted:   w.accepted,
+			Dead:       w.dead,
+		})
+	}
+	return miners
+}
+
+// RestoreMiners takes over the registry of another node, for the users
+// that haven't submitted shares here since
+func (s *Server) RestoreMiners(miners []MinerRecord) {
+	m := s.stats
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range miners {
+		if w, ok := m.workers[r.User]; ok && w.lastShare.Unix() > r.LastShare {
+			continue
+		}
+		m.workers[r.User] = &workerInfo{
+			address:    r.Address,
+			worker:     r.Worker,
+			userAgent:  r.UserAgent,
+			difficulty: r.Difficulty,
+			lastShare:  time.Unix(r.LastShare, 0),
+			accepted:   r.Accepted,
+			dead:       r.Dead,
+		}
+	}
+}
+
+// MinerHashRates returns the estimated hashrate of every miner active within
+// the last ten minutes, and the part of it that went into dead shares
+func (s *Server) MinerHashRates() (rates map[string]float64, deadRates map[string]float64) {
+	return s.stats.rates()
+}
+
+// AddressStats returns hashrate and share statistics of the miners mining
+// to the given address since the node started
+func (s *Server) AddressStats(address string) AddressStats {
+	return s.stats.address(address)
+}
+
+// PayoutHashRate returns the hashrate of the miners mining to the given
+// pubkey hash
+func (s *Server) PayoutHashRate(pkh []byte, version uint8) float64 {
+	address := s.payoutAddress(pkh, version)
+	if address == "" {
+		return 0
+	}
+	return s.AddressStats(address).HashRate
+}
+
+// payoutAddress returns the address a miner with the given pubkey hash is
+// paid to, as used for statistics
+func (s *Server) payoutAddress(pkh []byte, version uint8) string {
+	addr, err := work.PubKeyHashToAddress(pkh, version, s.Network)
+	if err != nil {
+		return ""
+	}
+	return addr.EncodeAddress()
+}
+
+// MinerLastDifficulties returns the difficulty of the last share every miner
+// submitted
+func (s *Server) MinerLastDifficulties() map[string]float64 {
+	return s.stats.difficulties()
+}
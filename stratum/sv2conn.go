@@ -0,0 +1,545 @@
+package stratum
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type v2Job struct {
+	job       *work.Job
+	expires   time.Time
+	submitted map[submission]struct{}
+}
+
+// v2Channel is a mining channel. On a standard channel the miner only gets
+// block headers to work on, so every channel has its own fixed extranonce.
+// On an extended channel the miner gets the coinbase and fills in the last
+// extranonce2Size bytes of the extranonce itself.
+type v2Channel struct {
+	ID                uint32
+	Username          string
+	WorkerName        string
+	PubKeyHash        []byte
+	PubKeyHashVersion uint8
+	Difficulty        float64
+	FixedDifficulty   bool
+	MaxTarget         *big.Int
+	AcceptedShares    uint64
+	StaleShares       uint64
+	Duplicates        uint64
+	Extended          bool
+
+	// extranonce is the fixed extranonce of a standard channel, and the
+	// prefix with the miner's part zeroed for an extended one
+	extranonce uint64
+	vardiff    *VarDiff
+	jobs       map[uint32]*v2Job
+	jobOrder   []uint32
+	nextJobID  uint32
+	prevBlock  *chainhash.Hash
+}
+
+// DOAPercent is the percentage of this channel's submissions that were for
+// work that was already stale
+func (ch *v2Channel) DOAPercent() float64 {
+	return doaPercent(ch.AcceptedShares, ch.StaleShares)
+}
+
+// v2Conn is a Stratum V2 connection, which can carry multiple channels
+type v2Conn struct {
+	server *Server
+	conn   net.Conn
+	noise  *noiseConn
+
+	setup         bool
+	userAgent     string
+	channels      map[uint32]*v2Channel
+	nextChannelID uint32
+	lock          sync.Mutex
+	writeLock     sync.Mutex
+}
+
+func (c *v2Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *v2Conn) handle() {
+	defer func() {
+		c.conn.Close()
+		c.server.removeV2Conn(c)
+		c.server.logger().Debugf("Stratum V2 client %s disconnected", c.RemoteAddr())
+	}()
+
+	var err error
+	c.noise, err = noiseAccept(c.conn, c.server.v2Authority, c.server.V2CertValidity)
+	if err != nil {
+		c.server.logger().Debugf("Stratum V2 handshake with %s failed: %s", c.RemoteAddr(), err.Error())
+		return
+	}
+	c.server.logger().Debugf("Stratum V2 client %s connected", c.RemoteAddr())
+
+	for {
+		_, msgType, payload, err := c.noise.readFrame()
+		if err != nil {
+			c.server.logger().Debugf("Reading from stratum V2 client %s failed: %s", c.RemoteAddr(), err.Error())
+			return
+		}
+		err = c.handleMessage(msgType, payload)
+		if err != nil {
+			c.server.logger().Warnf("Error handling stratum V2 message from %s: %s", c.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+func (c *v2Conn) write(msgType uint8, payload *sv2Writer) error {
+	extensionType := uint16(0)
+	switch msgType {
+	case sv2NewMiningJob, sv2NewExtendedMiningJob, sv2SetNewPrevHash, sv2SetTarget, sv2SubmitSharesSuccess, sv2SubmitSharesError, sv2CloseChannel:
+		extensionType = sv2ChannelBit
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(c.noise.encodeFrame(extensionType, msgType, payload.Bytes()))
+	return err
+}
+
+func (c *v2Conn) reconnect(host string, port int) error {
+	w := &sv2Writer{}
+	w.str([]byte(host))
+	w.u16(uint16(port))
+	return c.write(sv2Reconnect, w)
+}
+
+func (c *v2Conn) handleMessage(msgType uint8, payload []byte) error {
+	if msgType != sv2SetupConnection && !c.setup {
+		return fmt.Errorf("Message %x before SetupConnection", msgType)
+	}
+	switch msgType {
+	case sv2SetupConnection:
+		return c.handleSetupConnection(payload)
+	case sv2OpenStandardMiningChannel:
+		return c.handleOpenStandardMiningChannel(payload)
+	case sv2OpenExtendedMiningChannel:
+		return c.handleOpenExtendedMiningChannel(payload)
+	case sv2UpdateChannel:
+		return c.handleUpdateChannel(payload)
+	case sv2CloseChannel:
+		id, err := readChannelID(payload)
+		if err != nil {
+			return err
+		}
+		c.lock.Lock()
+		delete(c.channels, id)
+		c.lock.Unlock()
+		return nil
+	case sv2SubmitSharesStandard:
+		return c.handleSubmitSharesStandard(payload)
+	case sv2SubmitSharesExtended:
+		return c.handleSubmitSharesExtended(payload)
+	}
+	c.server.logger().Debugf("Ignoring unsupported stratum V2 message %x from %s", msgType, c.RemoteAddr())
+	return nil
+}
+
+func (c *v2Conn) handleSetupConnection(payload []byte) error {
+	m, err := readSetupConnection(payload)
+	if err != nil {
+		return err
+	}
+
+	errCode := ""
+	switch {
+	case m.Protocol != sv2ProtocolMining:
+		errCode = "unsupported-protocol"
+	case m.MinVersion > sv2ProtocolVersion || m.MaxVersion < sv2ProtocolVersion:
+		errCode = "protocol-version-mismatch"
+	case m.Flags&sv2UnsupportedSetupFlags != 0:
+		errCode = "unsupported-feature-flags"
+	}
+	if errCode != "" {
+		w := &sv2Writer{}
+		w.u32(m.Flags & sv2UnsupportedSetupFlags)
+		w.str([]byte(errCode))
+		c.write(sv2SetupConnectionError, w)
+		return fmt.Errorf("SetupConnection refused: %s", errCode)
+	}
+
+	c.server.logger().Debugf("Stratum V2 client %s is %s %s (firmware %s)", c.RemoteAddr(), m.Vendor, m.HardwareVersion, m.Firmware)
+	c.setup = true
+	c.userAgent = strings.TrimSpace(m.Vendor+" "+m.HardwareVersion) + "/" + m.Firmware
+	w := &sv2Writer{}
+	w.u16(sv2ProtocolVersion)
+	// We don't allow version rolling, since shares commit to the version
+	w.u32(sv2FlagRequiresFixedVersion)
+	return c.write(sv2SetupConnectionSuccess, w)
+}
+
+func (c *v2Conn) openChannelError(requestID uint32, code string) error {
+	w := &sv2Writer{}
+	w.u32(requestID)
+	w.str([]byte(code))
+	return c.write(sv2OpenMiningChannelError, w)
+}
+
+// openChannel creates a channel for the miner and registers it on the
+// connection. The extranonce prefix is returned to be sent to the miner, it
+// is empty if the user is unknown.
+func (c *v2Conn) openChannel(m sv2OpenStandardMiningChannelMsg, extended bool) (*v2Channel, []byte) {
+	username, fixedDiff := parseFixedDifficulty(m.UserIdentity, "")
+	worker, pkh, version, err := c.server.resolvePayout(username, c.RemoteAddr())
+	if err != nil {
+		return nil, nil
+	}
+
+	extranonce1 := c.server.nextExtranonce1()
+	ch := &v2Channel{
+		Username:          username,
+		WorkerName:        worker,
+		PubKeyHash:        pkh,
+		PubKeyHashVersion: version,
+		MaxTarget:         m.MaxTarget,
+		Extended:          extended,
+		extranonce:        binary.LittleEndian.Uint64(append(extranonce1, make([]byte, extranonce2Size)...)),
+		vardiff:           c.server.newVarDiff(c.userAgent),
+		jobs:              map[uint32]*v2Job{},
+	}
+	ch.Difficulty = c.initialDifficulty(ch, float64(m.NominalHashRate))
+	if fixedDiff > 0 {
+		ch.Difficulty = fixedDiff
+		ch.FixedDifficulty = true
+	}
+
+	c.lock.Lock()
+	c.nextChannelID++
+	ch.ID = c.nextChannelID
+	c.channels[ch.ID] = ch
+	c.lock.Unlock()
+	return ch, extranonce1
+}
+
+func (c *v2Conn) handleOpenStandardMiningChannel(payload []byte) error {
+	m, err := readOpenStandardMiningChannel(payload)
+	if err != nil {
+		return err
+	}
+	ch, extranonce1 := c.openChannel(m, false)
+	if ch == nil {
+		return c.openChannelError(m.RequestID, "unknown-user")
+	}
+
+	w := &sv2Writer{}
+	w.u32(m.RequestID)
+	w.u32(ch.ID)
+	w.u256(c.channelTarget(ch))
+	w.str(append(extranonce1, make([]byte, extranonce2Size)...))
+	w.u32(0)
+	err = c.write(sv2OpenStandardMiningChannelOK, w)
+	if err != nil {
+		return err
+	}
+	return c.sendJob(ch, true)
+}
+
+func (c *v2Conn) handleOpenExtendedMiningChannel(payload []byte) error {
+	m, err := readOpenExtendedMiningChannel(payload)
+	if err != nil {
+		return err
+	}
+	if m.MinExtranonceSize > extranonce2Size {
+		return c.openChannelError(m.RequestID, "min-extranonce-size-too-large")
+	}
+	ch, extranonce1 := c.openChannel(m.sv2OpenStandardMiningChannelMsg, true)
+	if ch == nil {
+		return c.openChannelError(m.RequestID, "unknown-user")
+	}
+
+	w := &sv2Writer{}
+	w.u32(m.RequestID)
+	w.u32(ch.ID)
+	w.u256(c.channelTarget(ch))
+	w.u16(extranonce2Size)
+	w.str(extranonce1)
+	err = c.write(sv2OpenExtendedMiningChannelOK, w)
+	if err != nil {
+		return err
+	}
+	return c.sendJob(ch, true)
+}
+
+// initialDifficulty picks the difficulty at which a miner with the given
+// hashrate finds a share every vardiff target time
+func (c *v2Conn) initialDifficulty(ch *v2Channel, hashrate float64) float64 {
+	diff := c.server.InitialDifficulty
+	if hashrate > 0 {
+		attempts := big.NewInt(int64(hashrate * ch.vardiff.TargetTime.Seconds()))
+		if attempts.Sign() > 0 {
+			diff = work.TargetToDifficulty(work.AverageAttemptsToTarget(attempts)) * c.server.Network.DumbScryptDiff
+		}
+	}
+	if diff < ch.vardiff.MinDifficulty {
+		diff = ch.vardiff.MinDifficulty
+	}
+	if diff > ch.vardiff.MaxDifficulty {
+		diff = ch.vardiff.MaxDifficulty
+	}
+	return diff
+}
+
+// channelTarget is the target for the channel's difficulty, capped by the
+// maximum target the miner asked for
+func (c *v2Conn) channelTarget(ch *v2Channel) *big.Int {
+	target := work.DifficultyToTarget(ch.Difficulty / c.server.Network.DumbScryptDiff)
+	if ch.MaxTarget != nil && ch.MaxTarget.Sign() > 0 && target.Cmp(ch.MaxTarget) > 0 {
+		target = ch.MaxTarget
+	}
+	return target
+}
+
+func (c *v2Conn) handleUpdateChannel(payload []byte) error {
+	m, err := readUpdateChannel(payload)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	ch, ok := c.channels[m.ChannelID]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	ch.MaxTarget = m.MaxTarget
+	if !ch.FixedDifficulty {
+		ch.Difficulty = c.initialDifficulty(ch, float64(m.NominalHashRate))
+	}
+	return c.sendTarget(ch)
+}
+
+func (c *v2Conn) sendTarget(ch *v2Channel) error {
+	w := &sv2Writer{}
+	w.u32(ch.ID)
+	w.u256(c.channelTarget(ch))
+	return c.write(sv2SetTarget, w)
+}
+
+// sendJobs sends new jobs to all channels on this connection
+func (c *v2Conn) sendJobs(clean bool) {
+	c.lock.Lock()
+	channels := make([]*v2Channel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	c.lock.Unlock()
+	for _, ch := range channels {
+		err := c.sendJob(ch, clean)
+		if err != nil {
+			c.server.logger().Debugf("Could not send job to stratum V2 client %s: %s", c.RemoteAddr(), err.Error())
+		}
+	}
+}
+
+// sendJob creates a job for a channel. On a new block the job is sent as a
+// future job and activated with SetNewPrevHash, otherwise it replaces the
+// current job right away.
+func (c *v2Conn) sendJob(ch *v2Channel, clean bool) error {
+	j, err := c.server.Work.GetJob(ch.PubKeyHash, ch.PubKeyHashVersion)
+	if err != nil {
+		return err
+	}
+	var merkleRoot *chainhash.Hash
+	if !ch.Extended {
+		gentxHash, _ := chainhash.NewHash(util.Sha256d(work.SpliceGenTx(j.CoinbasePrefix, ch.extranonce, j.CoinbaseSuffix)))
+		merkleRoot, err = wire.CalcMerkleLink(gentxHash, j.Template.MerkleBranch, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	newBlock := ch.prevBlock == nil || !ch.prevBlock.IsEqual(j.Share.MinHeader.PreviousBlock)
+	ch.prevBlock = j.Share.MinHeader.PreviousBlock
+	ch.nextJobID++
+	jobID := ch.nextJobID
+	if clean || newBlock {
+		expires := clock.Now().Add(c.server.StaleGrace)
+		for _, vj := range ch.jobs {
+			if vj.expires.IsZero() {
+				vj.expires = expires
+			}
+		}
+	}
+	ch.jobs[jobID] = &v2Job{job: j, submitted: map[submission]struct{}{}}
+	ch.jobOrder = append(ch.jobOrder, jobID)
+	if len(ch.jobOrder) > maxJobsPerClient {
+		delete(ch.jobs, ch.jobOrder[0])
+		ch.jobOrder = ch.jobOrder[1:]
+	}
+	c.lock.Unlock()
+
+	w := &sv2Writer{}
+	w.u32(ch.ID)
+	w.u32(jobID)
+	if newBlock {
+		// Future job, without min_ntime
+		w.u8(0)
+	} else {
+		w.u8(1)
+		w.u32(uint32(j.Share.ShareInfo.Timestamp))
+	}
+	w.u32(uint32(j.Share.MinHeader.Version))
+	if ch.Extended {
+		// No version rolling, shares commit to the version
+		w.u8(0)
+		w.hashes(j.Template.MerkleBranch)
+		w.bytes64k(j.CoinbasePrefix)
+		w.bytes64k(j.CoinbaseSuffix)
+		err = c.write(sv2NewExtendedMiningJob, w)
+	} else {
+		w.Write(merkleRoot[:])
+		err = c.write(sv2NewMiningJob, w)
+	}
+	if err != nil || !newBlock {
+		return err
+	}
+
+	w = &sv2Writer{}
+	w.u32(ch.ID)
+	w.u32(jobID)
+	w.Write(j.Share.MinHeader.PreviousBlock[:])
+	w.u32(uint32(j.Share.ShareInfo.Timestamp))
+	w.u32(j.Share.MinHeader.Bits)
+	return c.write(sv2SetNewPrevHash, w)
+}
+
+func (c *v2Conn) submitError(m sv2SubmitSharesStandardMsg, reason RejectReason) error {
+	reason.count()
+	w := &sv2Writer{}
+	w.u32(m.ChannelID)
+	w.u32(m.SequenceNumber)
+	w.str([]byte(reason.V2Code))
+	return c.write(sv2SubmitSharesError, w)
+}
+
+func (c *v2Conn) handleSubmitSharesStandard(payload []byte) error {
+	m, err := readSubmitSharesStandard(payload)
+	if err != nil {
+		return err
+	}
+	return c.submitShare(m, false, nil)
+}
+
+func (c *v2Conn) handleSubmitSharesExtended(payload []byte) error {
+	m, err := readSubmitSharesExtended(payload)
+	if err != nil {
+		return err
+	}
+	return c.submitShare(m.sv2SubmitSharesStandardMsg, true, m.Extranonce)
+}
+
+// submitShare checks a share submitted on a channel and hands it to the work
+// source. Submissions on extended channels come with the miner's part of the
+// extranonce.
+func (c *v2Conn) submitShare(m sv2SubmitSharesStandardMsg, extended bool, minerExtranonce []byte) error {
+	c.lock.Lock()
+	ch, ok := c.channels[m.ChannelID]
+	var vj *v2Job
+	if ok {
+		vj = ch.jobs[m.JobID]
+	}
+	c.lock.Unlock()
+	if !ok {
+		return c.submitError(m, RejectUnauthorized)
+	}
+	if vj == nil {
+		if m.JobID <= ch.nextJobID {
+			ch.StaleShares++
+			return c.submitError(m, RejectStale)
+		}
+		return c.submitError(m, RejectJobNotFound)
+	}
+	stale := !vj.expires.IsZero()
+	if stale && clock.Now().After(vj.expires) {
+		ch.StaleShares++
+		return c.submitError(m, RejectStale)
+	}
+	if m.Version != uint32(vj.job.Share.MinHeader.Version) {
+		return c.submitError(m, RejectInvalidVersion)
+	}
+	if !checkNTime(vj.job, m.NTime) {
+		return c.submitError(m, RejectInvalidNTime)
+	}
+	extranonce := ch.extranonce
+	if extended != ch.Extended || (extended && len(minerExtranonce) != extranonce2Size) {
+		return c.submitError(m, RejectInvalidExtranonce)
+	}
+	if extended {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, ch.extranonce)
+		copy(b[extranonce1Size:], minerExtranonce)
+		extranonce = binary.LittleEndian.Uint64(b)
+	}
+	sub := submission{extranonce, m.NTime, m.Nonce, m.Version}
+	c.lock.Lock()
+	_, dup := vj.submitted[sub]
+	vj.submitted[sub] = struct{}{}
+	c.lock.Unlock()
+	if dup {
+		ch.Duplicates++
+		err := c.submitError(m, RejectDuplicate)
+		if err == nil && ch.Duplicates >= maxDuplicateSubmissions {
+			err = fmt.Errorf("Too many duplicate submissions")
+		}
+		return err
+	}
+
+	res, err := c.server.Work.Submit(vj.job, extranonce, m.NTime, m.Nonce)
+	if err != nil {
+		c.server.logger().Errorf("Could not process stratum V2 submission from %s: %s", ch.Username, err.Error())
+		return c.submitError(m, RejectInternal)
+	}
+	if blockchain.HashToBig(res.POWHash).Cmp(c.channelTarget(ch)) > 0 && !res.IsShare {
+		return c.submitError(m, RejectLowDifficulty)
+	}
+
+	dead := stale || c.server.Work.IsStale(vj.job)
+	if dead {
+		ch.StaleShares++
+	} else {
+		ch.AcceptedShares++
+	}
+	c.server.stats.record(ch.Username, c.server.payoutAddress(ch.PubKeyHash, ch.PubKeyHashVersion), ch.WorkerName, c.userAgent, ch.Difficulty, c.server.Network.DumbScryptDiff, dead)
+
+	w := &sv2Writer{}
+	w.u32(ch.ID)
+	w.u32(m.SequenceNumber)
+	w.u32(1)
+	w.u64(uint64(ch.Difficulty))
+	err = c.write(sv2SubmitSharesSuccess, w)
+	if err != nil {
+		return err
+	}
+
+	if ch.FixedDifficulty {
+		return nil
+	}
+	newDiff, changed := ch.vardiff.Submitted(ch.Difficulty)
+	if changed {
+		ch.Difficulty = newDiff
+		events.PublishOn(c.server.Network.Name, events.DifficultyChanged, events.Difficulty{User: ch.Username, Difficulty: newDiff})
+		return c.sendTarget(ch)
+	}
+	return nil
+}
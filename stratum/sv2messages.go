@@ -0,0 +1,269 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Stratum V2 message types of the common and mining protocols
+const (
+	sv2SetupConnection             = 0x00
+	sv2SetupConnectionSuccess      = 0x01
+	sv2SetupConnectionError        = 0x02
+	sv2OpenStandardMiningChannel   = 0x10
+	sv2OpenStandardMiningChannelOK = 0x11
+	sv2OpenMiningChannelError      = 0x12
+	sv2OpenExtendedMiningChannel   = 0x13
+	sv2OpenExtendedMiningChannelOK = 0x14
+	sv2NewMiningJob                = 0x15
+	sv2UpdateChannel               = 0x16
+	sv2CloseChannel                = 0x18
+	sv2SubmitSharesStandard        = 0x1a
+	sv2SubmitSharesExtended        = 0x1b
+	sv2SubmitSharesSuccess         = 0x1c
+	sv2SubmitSharesError           = 0x1d
+	sv2NewExtendedMiningJob        = 0x1f
+	sv2SetNewPrevHash              = 0x20
+	sv2SetTarget                   = 0x21
+	sv2Reconnect                   = 0x25
+	sv2ChannelBit                  = 0x8000
+	sv2ProtocolMining              = 0
+	sv2ProtocolVersion             = 2
+	sv2FlagRequiresFixedVersion    = 1
+	sv2FlagRequiresWorkSelection   = 2
+	sv2FlagRequiresVersionRolling  = 4
+	// Miners selecting their own work need job negotiation, which isn't
+	// implemented: shares commit to the transactions of our template
+	sv2UnsupportedSetupFlags = sv2FlagRequiresWorkSelection | sv2FlagRequiresVersionRolling
+)
+
+// sv2Writer serializes Stratum V2 data types
+type sv2Writer struct {
+	bytes.Buffer
+}
+
+func (w *sv2Writer) u8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *sv2Writer) u16(v uint16) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *sv2Writer) u32(v uint32) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *sv2Writer) u64(v uint64) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+// u256 writes a target as a little endian 256 bit number
+func (w *sv2Writer) u256(v *big.Int) {
+	b := make([]byte, 32)
+	v.FillBytes(b)
+	for i := 0; i < 16; i++ {
+		b[i], b[31-i] = b[31-i], b[i]
+	}
+	w.Write(b)
+}
+
+// str writes a STR0_255 or B0_32, which are both length prefixed
+func (w *sv2Writer) str(s []byte) {
+	w.u8(uint8(len(s)))
+	w.Write(s)
+}
+
+// bytes64k writes a B0_64K, which has a two byte length prefix
+func (w *sv2Writer) bytes64k(b []byte) {
+	w.u16(uint16(len(b)))
+	w.Write(b)
+}
+
+// hashes writes a SEQ0_255[U256] of hashes
+func (w *sv2Writer) hashes(hs []*chainhash.Hash) {
+	w.u8(uint8(len(hs)))
+	for _, h := range hs {
+		w.Write(h[:])
+	}
+}
+
+// sv2Reader deserializes Stratum V2 data types. The first error is kept and
+// all reads after it return zero values.
+type sv2Reader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newSv2Reader(b []byte) *sv2Reader {
+	return &sv2Reader{r: bytes.NewReader(b)}
+}
+
+func (r *sv2Reader) read(n int) []byte {
+	b := make([]byte, n)
+	if r.err != nil {
+		return b
+	}
+	_, err := io.ReadFull(r.r, b)
+	if err != nil {
+		r.err = fmt.Errorf("Stratum V2 message too short")
+	}
+	return b
+}
+
+func (r *sv2Reader) u8() uint8 {
+	return r.read(1)[0]
+}
+
+func (r *sv2Reader) u16() uint16 {
+	return binary.LittleEndian.Uint16(r.read(2))
+}
+
+func (r *sv2Reader) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.read(4))
+}
+
+func (r *sv2Reader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+func (r *sv2Reader) u256() *big.Int {
+	b := r.read(32)
+	for i := 0; i < 16; i++ {
+		b[i], b[31-i] = b[31-i], b[i]
+	}
+	return big.NewInt(0).SetBytes(b)
+}
+
+func (r *sv2Reader) str() string {
+	n := r.u8()
+	return string(r.read(int(n)))
+}
+
+type sv2SetupConnectionMsg struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceID        string
+}
+
+func readSetupConnection(b []byte) (sv2SetupConnectionMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2SetupConnectionMsg{}
+	m.Protocol = r.u8()
+	m.MinVersion = r.u16()
+	m.MaxVersion = r.u16()
+	m.Flags = r.u32()
+	m.EndpointHost = r.str()
+	m.EndpointPort = r.u16()
+	m.Vendor = r.str()
+	m.HardwareVersion = r.str()
+	m.Firmware = r.str()
+	m.DeviceID = r.str()
+	return m, r.err
+}
+
+type sv2OpenStandardMiningChannelMsg struct {
+	RequestID       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       *big.Int
+}
+
+func readOpenStandardMiningChannel(b []byte) (sv2OpenStandardMiningChannelMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2OpenStandardMiningChannelMsg{}
+	m.RequestID = r.u32()
+	m.UserIdentity = r.str()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	return m, r.err
+}
+
+type sv2OpenExtendedMiningChannelMsg struct {
+	sv2OpenStandardMiningChannelMsg
+	MinExtranonceSize uint16
+}
+
+func readOpenExtendedMiningChannel(b []byte) (sv2OpenExtendedMiningChannelMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2OpenExtendedMiningChannelMsg{}
+	m.RequestID = r.u32()
+	m.UserIdentity = r.str()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	m.MinExtranonceSize = r.u16()
+	return m, r.err
+}
+
+type sv2UpdateChannelMsg struct {
+	ChannelID       uint32
+	NominalHashRate float32
+	MaxTarget       *big.Int
+}
+
+func readUpdateChannel(b []byte) (sv2UpdateChannelMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2UpdateChannelMsg{}
+	m.ChannelID = r.u32()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	return m, r.err
+}
+
+type sv2SubmitSharesStandardMsg struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+}
+
+func readSubmitSharesStandard(b []byte) (sv2SubmitSharesStandardMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2SubmitSharesStandardMsg{}
+	m.ChannelID = r.u32()
+	m.SequenceNumber = r.u32()
+	m.JobID = r.u32()
+	m.Nonce = r.u32()
+	m.NTime = r.u32()
+	m.Version = r.u32()
+	return m, r.err
+}
+
+type sv2SubmitSharesExtendedMsg struct {
+	sv2SubmitSharesStandardMsg
+	Extranonce []byte
+}
+
+func readSubmitSharesExtended(b []byte) (sv2SubmitSharesExtendedMsg, error) {
+	r := newSv2Reader(b)
+	m := sv2SubmitSharesExtendedMsg{}
+	m.ChannelID = r.u32()
+	m.SequenceNumber = r.u32()
+	m.JobID = r.u32()
+	m.Nonce = r.u32()
+	m.NTime = r.u32()
+	m.Version = r.u32()
+	m.Extranonce = []byte(r.str())
+	return m, r.err
+}
+
+func readChannelID(b []byte) (uint32, error) {
+	r := newSv2Reader(b)
+	id := r.u32()
+	return id, r.err
+}
@@ -0,0 +1,280 @@
+package stratum
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ellswift"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil/base58"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Stratum V2 connections are encrypted with the Noise NX handshake. The
+// server authenticates its static key with a certificate signed by an
+// authority key that miners are configured with.
+const (
+	noiseProtocolName  = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+	noiseKeyLength     = 64
+	noiseMACLength     = 16
+	noiseMaxMessage    = 65535
+	noiseCertLength    = 2 + 4 + 4 + 64
+	sv2FrameHeaderSize = 6
+)
+
+// cipherState encrypts or decrypts one direction of the connection
+type cipherState struct {
+	k [32]byte
+	n uint64
+}
+
+func (cs *cipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.n)
+	cs.n++
+	return nonce
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(cs.k[:])
+	return aead.Seal(nil, cs.nonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(cs.k[:])
+	return aead.Open(nil, cs.nonce(), ciphertext, ad)
+}
+
+// handshakeState is the symmetric state of the handshake
+type handshakeState struct {
+	h  [32]byte
+	ck [32]byte
+	cs *cipherState
+}
+
+func newHandshakeState() *handshakeState {
+	hs := &handshakeState{}
+	hs.ck = sha256.Sum256([]byte(noiseProtocolName))
+	// The prologue is empty
+	hs.h = sha256.Sum256(hs.ck[:])
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	hs.h = sha256.Sum256(append(hs.h[:], data...))
+}
+
+func hkdf(ck [32]byte, ikm []byte) ([32]byte, [32]byte) {
+	var out1, out2 [32]byte
+	mac := hmac.New(sha256.New, ck[:])
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	copy(out1[:], mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{0x02})
+	copy(out2[:], mac.Sum(nil))
+	return out1, out2
+}
+
+func (hs *handshakeState) mixKey(ikm []byte) {
+	var k [32]byte
+	hs.ck, k = hkdf(hs.ck, ikm)
+	hs.cs = &cipherState{k: k}
+}
+
+func (hs *handshakeState) encryptAndHash(plaintext []byte) []byte {
+	c := hs.cs.encrypt(hs.h[:], plaintext)
+	hs.mixHash(c)
+	return c
+}
+
+// split derives the transport ciphers: the first for messages from the
+// initiator (the miner), the second for messages to it
+func (hs *handshakeState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(hs.ck, []byte{})
+	return &cipherState{k: k1}, &cipherState{k: k2}
+}
+
+// sv2Certificate authorizes the server's static key. Miners check the
+// signature against the authority key they were given.
+type sv2Certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+}
+
+func (c sv2Certificate) sign(authority *btcec.PrivateKey, static *btcec.PrivateKey) ([]byte, error) {
+	msg := make([]byte, 0, 10+32)
+	msg = binary.LittleEndian.AppendUint16(msg, c.Version)
+	msg = binary.LittleEndian.AppendUint32(msg, c.ValidFrom)
+	msg = binary.LittleEndian.AppendUint32(msg, c.NotValidAfter)
+	msg = append(msg, schnorr.SerializePubKey(static.PubKey())...)
+	hash := sha256.Sum256(msg)
+	sig, err := schnorr.Sign(authority, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, noiseCertLength)
+	b = append(b, msg[:10]...)
+	return append(b, sig.Serialize()...), nil
+}
+
+// noiseConn is an established, encrypted Stratum V2 connection
+type noiseConn struct {
+	conn net.Conn
+	recv *cipherState
+	send *cipherState
+}
+
+// noiseAccept performs the responder side of the handshake on a freshly
+// accepted connection
+func noiseAccept(conn net.Conn, authority *btcec.PrivateKey, certValidity time.Duration) (*noiseConn, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newHandshakeState()
+
+	// -> e
+	var re [noiseKeyLength]byte
+	_, err := io.ReadFull(conn, re[:])
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(re[:])
+	hs.mixHash([]byte{})
+
+	// <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+	e, ePub, err := ellswift.EllswiftCreate()
+	if err != nil {
+		return nil, err
+	}
+	s, sPub, err := ellswift.EllswiftCreate()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 0, noiseKeyLength*2+noiseMACLength*2+noiseCertLength)
+	msg = append(msg, ePub[:]...)
+	hs.mixHash(ePub[:])
+
+	ee, err := ellswift.V2Ecdh(e, re, ePub, false)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(ee[:])
+	msg = append(msg, hs.encryptAndHash(sPub[:])...)
+
+	es, err := ellswift.V2Ecdh(s, re, sPub, false)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(es[:])
+
+	now := time.Now()
+	cert := sv2Certificate{
+		Version:       0,
+		ValidFrom:     uint32(now.Add(-time.Hour).Unix()),
+		NotValidAfter: uint32(now.Add(certValidity).Unix()),
+	}
+	certBytes, err := cert.sign(authority, s)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(certBytes)...)
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	recv, send := hs.split()
+	return &noiseConn{conn: conn, recv: recv, send: send}, nil
+}
+
+// readFrame reads and decrypts one frame. The header is encrypted on its
+// own, the payload in chunks of at most noiseMaxMessage bytes.
+func (nc *noiseConn) readFrame() (extensionType uint16, msgType uint8, payload []byte, err error) {
+	encHeader := make([]byte, sv2FrameHeaderSize+noiseMACLength)
+	_, err = io.ReadFull(nc.conn, encHeader)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	header, err := nc.recv.decrypt(nil, encHeader)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Could not decrypt frame header: %s", err.Error())
+	}
+	extensionType = binary.LittleEndian.Uint16(header[0:])
+	msgType = header[2]
+	length := int(header[3]) | int(header[4])<<8 | int(header[5])<<16
+
+	payload = make([]byte, 0, length)
+	for len(payload) < length {
+		chunk := length - len(payload)
+		if chunk > noiseMaxMessage-noiseMACLength {
+			chunk = noiseMaxMessage - noiseMACLength
+		}
+		enc := make([]byte, chunk+noiseMACLength)
+		_, err = io.ReadFull(nc.conn, enc)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		plain, err := nc.recv.decrypt(nil, enc)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("Could not decrypt frame payload: %s", err.Error())
+		}
+		payload = append(payload, plain...)
+	}
+	return extensionType, msgType, payload, nil
+}
+
+// encodeFrame encrypts a frame for sending
+func (nc *noiseConn) encodeFrame(extensionType uint16, msgType uint8, payload []byte) []byte {
+	header := make([]byte, sv2FrameHeaderSize)
+	binary.LittleEndian.PutUint16(header[0:], extensionType)
+	header[2] = msgType
+	header[3], header[4], header[5] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16)
+
+	b := nc.send.encrypt(nil, header)
+	for len(payload) > 0 {
+		chunk := len(payload)
+		if chunk > noiseMaxMessage-noiseMACLength {
+			chunk = noiseMaxMessage - noiseMACLength
+		}
+		b = append(b, nc.send.encrypt(nil, payload[:chunk])...)
+		payload = payload[chunk:]
+	}
+	return b
+}
+
+// LoadAuthorityKey decodes a hex encoded authority private key, or creates
+// a new one if none is given
+func LoadAuthorityKey(keyHex string) (*btcec.PrivateKey, error) {
+	if keyHex == "" {
+		return btcec.NewPrivateKey()
+	}
+	b, err := hex.DecodeString(keyHex)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("Authority key must be 32 bytes of hex")
+	}
+	priv, _ := btcec.PrivKeyFromBytes(b)
+	return priv, nil
+}
+
+// AuthorityPubKeyString encodes the authority public key the way Stratum V2
+// miners are configured with it
+func AuthorityPubKeyString(authority *btcec.PrivateKey) string {
+	return base58.CheckEncode(append([]byte{0x00}, schnorr.SerializePubKey(authority.PubKey())...), 0x01)
+}
@@ -0,0 +1,150 @@
+package stratum
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+// VarDiff adjusts a connection's difficulty so it submits a share every
+// TargetTime on average
+type VarDiff struct {
+	TargetTime    time.Duration
+	RetargetTime  time.Duration
+	MinDifficulty float64
+	MaxDifficulty float64
+
+	lastRetarget time.Time
+	shares       int
+}
+
+func NewVarDiff() *VarDiff {
+	return &VarDiff{
+		TargetTime:    time.Second * 10,
+		RetargetTime:  time.Second * 90,
+		MinDifficulty: 0.01,
+		MaxDifficulty: 1e12,
+		lastRetarget:  clock.Now(),
+	}
+}
+
+// newVarDiff returns vardiff with the server's settings, the floor raised
+// for miners whose software needs it
+func (s *Server) newVarDiff(userAgent string) *VarDiff {
+	v := NewVarDiff()
+	s.configureVarDiff(v, userAgent)
+	return v
+}
+
+func (s *Server) configureVarDiff(v *VarDiff, userAgent string) {
+	def := NewVarDiff()
+	v.TargetTime, v.MinDifficulty, v.MaxDifficulty = def.TargetTime, def.MinDifficulty, def.MaxDifficulty
+	s.varDiffLock.Lock()
+	defer s.varDiffLock.Unlock()
+	if s.VarDiffTarget > 0 {
+		v.TargetTime = s.VarDiffTarget
+	}
+	if s.VarDiffMin > 0 {
+		v.MinDifficulty = s.VarDiffMin
+	}
+	if s.VarDiffMax > 0 {
+		v.MaxDifficulty = s.VarDiffMax
+	}
+	if min := s.minDifficultyFor(userAgent); min > v.MinDifficulty {
+		v.MinDifficulty = min
+	}
+}
+
+// SetVarDiff changes the vardiff settings, for new and connected miners.
+// Zero values go back to the defaults. Difficulties out of the new range
+// are corrected on the miners' next retarget.
+func (s *Server) SetVarDiff(target time.Duration, min, max float64) {
+	s.varDiffLock.Lock()
+	s.VarDiffTarget, s.VarDiffMin, s.VarDiffMax = target, min, max
+	s.varDiffLock.Unlock()
+	for _, c := range s.Clients() {
+		s.configureVarDiff(c.vardiff, c.UserAgent)
+	}
+	for _, c := range s.v2Connections() {
+		c.lock.Lock()
+		for _, ch := range c.channels {
+			s.configureVarDiff(ch.vardiff, c.userAgent)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Submitted registers a share at the current difficulty and returns the new
+// difficulty and whether it changed
+func (v *VarDiff) Submitted(current float64) (float64, bool) {
+	v.shares++
+	elapsed := clock.Since(v.lastRetarget)
+	if elapsed < v.RetargetTime && v.shares < 30 {
+		return current, false
+	}
+	return v.retarget(current, elapsed)
+}
+
+func (v *VarDiff) retarget(current float64, elapsed time.Duration) (float64, bool) {
+	avg := elapsed.Seconds() / float64(v.shares)
+	v.lastRetarget = clock.Now()
+	v.shares = 0
+
+	ratio := v.TargetTime.Seconds() / avg
+	if ratio > 4 {
+		ratio = 4
+	}
+	if ratio < 0.25 {
+		ratio = 0.25
+	}
+	// Don't bother for small deviations
+	if ratio > 0.8 && ratio < 1.25 {
+		return current, false
+	}
+	newDiff := current * ratio
+	if newDiff < v.MinDifficulty {
+		newDiff = v.MinDifficulty
+	}
+	if newDiff > v.MaxDifficulty {
+		newDiff = v.MaxDifficulty
+	}
+	return newDiff, newDiff != current
+}
+
+// parseFixedDifficulty looks for a difficulty pinned by the miner, either as
+// a +diff suffix on the username or a d=diff parameter in the password, and
+// returns the username without the suffix. The difficulty is clamped to the
+// vardiff bounds, and zero if none was given.
+func parseFixedDifficulty(username, password string) (string, float64) {
+	diff := 0.0
+	if i := strings.LastIndex(username, "+"); i >= 0 {
+		d, err := strconv.ParseFloat(username[i+1:], 64)
+		if err == nil {
+			username = username[:i]
+			diff = d
+		}
+	}
+	for _, param := range strings.FieldsFunc(password, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		if strings.HasPrefix(param, "d=") {
+			d, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil {
+				diff = d
+			}
+		}
+	}
+	if diff <= 0 || math.IsNaN(diff) {
+		return username, 0
+	}
+
+	v := NewVarDiff()
+	if diff < v.MinDifficulty {
+		diff = v.MinDifficulty
+	}
+	if diff > v.MaxDifficulty {
+		diff = v.MaxDifficulty
+	}
+	return username, diff
+}
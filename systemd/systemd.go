@@ -0,0 +1,101 @@
+// Package systemd tells systemd about the state of the node, for units with
+// Type=notify and optionally WatchdogSec, like:
+//
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/p2pool-go run -config /etc/p2pool-go.conf
+//	ExecReload=/bin/kill -HUP $MAINPID
+//	WatchdogSec=60
+//	Restart=on-failure
+//
+// Without NOTIFY_SOCKET in the environment, when not started by systemd,
+// everything here does nothing.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// Notify sends a state like READY=1 to systemd. It returns false when
+// systemd doesn't expect notifications.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells systemd the node is up
+func Ready() {
+	notify("READY=1")
+}
+
+// Reloading tells systemd the node is reloading its configuration, call
+// Ready when done
+func Reloading() {
+	notify("RELOADING=1")
+}
+
+// Stopping tells systemd the node is shutting down
+func Stopping() {
+	notify("STOPPING=1")
+}
+
+func notify(state string) {
+	_, err := Notify(state)
+	if err != nil {
+		logging.Warnf("Could not notify systemd: %s", err.Error())
+	}
+}
+
+// WatchdogInterval returns how often systemd expects to hear from us, or 0
+// if the watchdog is disabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog pings the systemd watchdog at half the interval it expects,
+// as long as alive returns nil. When it doesn't, we stop pinging and let
+// systemd restart us. Returns right away if the watchdog is disabled.
+func RunWatchdog(alive func() error) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logging.Infof("Pinging the systemd watchdog every %s", (interval / 2).String())
+	for {
+		time.Sleep(interval / 2)
+		err := alive()
+		if err != nil {
+			logging.Errorf("Not pinging the systemd watchdog: %s", err.Error())
+			continue
+		}
+		notify("WATCHDOG=1")
+	}
+}
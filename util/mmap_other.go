@@ -0,0 +1,14 @@
+//go:build windows
+
+package util
+
+import (
+	"os"
+)
+
+// MapFile reads the whole file, as memory mapping isn't supported here
+func MapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func UnmapFile(data []byte) {}
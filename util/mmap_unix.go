@@ -0,0 +1,36 @@
+//go:build !windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile maps a file read-only into memory, so pages are loaded by the
+// kernel as they're used and shared with other processes using the file
+func MapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		// Empty mappings aren't allowed
+		return []byte{}, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// UnmapFile releases a mapping made by MapFile. The data must not be used
+// after.
+func UnmapFile(data []byte) {
+	if len(data) > 0 {
+		syscall.Munmap(data)
+	}
+}
@@ -122,6 +122,16 @@ func (d *Sha256Digest) CalcMidState(data, state, buf []byte, len uint64) [Size]b
 	return d.checkSum()
 }
 
+// MidState returns the internal state after all complete blocks written so
+// far have been processed, which is what a hash link commits to
+func (d *Sha256Digest) MidState() []byte {
+	b := make([]byte, 0, 32)
+	for i := 0; i < 8; i++ {
+		b = appendUint32(b, d.h[i])
+	}
+	return b
+}
+
 func (d *Sha256Digest) Reset() {
 	d.h[0] = init0
 	d.h[1] = init1
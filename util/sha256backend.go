@@ -0,0 +1,69 @@
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sha256Backend computes SHA256 checksums. Share hashes, merkle trees and
+// message checksums all go through the selected backend.
+type Sha256Backend func(data []byte) [Size]byte
+
+var (
+	sha256Backends = map[string]Sha256Backend{
+		// crypto/sha256 uses the SHA-NI or AVX2 instructions on amd64 and
+		// the SHA2 extensions on arm64 when the CPU has them, and pure Go
+		// otherwise
+		"native": sha256.Sum256,
+		// generic is the pure Go implementation of this package, for
+		// comparing against and for CPUs where the native one misbehaves
+		"generic": Sum256,
+	}
+	sha256Sum          Sha256Backend = sha256.Sum256
+	sha256Name                       = "native"
+	sha256BackendsLock sync.RWMutex
+)
+
+// RegisterSha256 makes a SHA256 implementation available to SetSha256, for
+// instance an assembly one behind a build tag. Registering an existing name
+// replaces it.
+func RegisterSha256(name string, f Sha256Backend) {
+	sha256BackendsLock.Lock()
+	defer sha256BackendsLock.Unlock()
+	sha256Backends[name] = f
+	if name == sha256Name {
+		sha256Sum = f
+	}
+}
+
+// SetSha256 selects the SHA256 backend. It's meant to be called at startup,
+// before anything is hashed.
+func SetSha256(name string) error {
+	sha256BackendsLock.Lock()
+	defer sha256BackendsLock.Unlock()
+	f, ok := sha256Backends[name]
+	if !ok {
+		return fmt.Errorf("Unknown SHA256 backend %s, available are %s", name, strings.Join(sha256BackendNames(), ", "))
+	}
+	sha256Sum, sha256Name = f, name
+	return nil
+}
+
+// Sha256Backends returns the names of the registered backends
+func Sha256Backends() []string {
+	sha256BackendsLock.RLock()
+	defer sha256BackendsLock.RUnlock()
+	return sha256BackendNames()
+}
+
+func sha256BackendNames() []string {
+	names := make([]string, 0, len(sha256Backends))
+	for n := range sha256Backends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
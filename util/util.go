@@ -2,7 +2,6 @@ package util
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -30,12 +29,28 @@ func GetMyPublicIP() (net.IP, error) {
 	return net.ParseIP(string(ip)), nil
 }
 
+// Sha256d returns the double SHA256 of b, with the selected backend
 func Sha256d(b []byte) []byte {
-	h := sha256.Sum256(b)
-	h = sha256.Sum256(h[:])
+	h := Sha256dSum(b)
 	return h[:]
 }
 
+// Sha256dSum is Sha256d returning an array, which spares an allocation
+func Sha256dSum(b []byte) [Size]byte {
+	h := sha256Sum(b)
+	return sha256Sum(h[:])
+}
+
+// Sha256dResume finishes the double SHA256 of data whose start was written
+// to d, leaving d as it is. Hashing a long prefix once and resuming from it
+// is much cheaper than hashing it all again.
+func Sha256dResume(d *Sha256Digest, tail []byte) [Size]byte {
+	c := *d
+	c.Write(tail)
+	h := c.checkSum()
+	return sha256Sum(h[:])
+}
+
 func GetRandomId() *chainhash.Hash {
 	idBytes := make([]byte, 32)
 	rand.Read(idBytes)
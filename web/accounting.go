@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return work.ParseTime(v)
+}
+
+// handleAccountingCSV serves the blocks report at /web/blocks.csv and the
+// payouts report at /web/payouts.csv, for the from and to (exclusive) times
+// given as RFC 3339 or dates. The payouts can be limited to one address.
+func (s *Server) handleAccountingCSV(w http.ResponseWriter, r *http.Request) {
+	if s.Blocks == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "No block log kept"})
+		return
+	}
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	if r.URL.Path == "/web/blocks.csv" {
+		err = work.WriteBlocksCSV(w, s.Blocks.Blocks(), from, to)
+	} else {
+		err = work.WritePayoutsCSV(w, s.Blocks.Blocks(), from, to, r.URL.Query().Get("address"))
+	}
+	if err != nil {
+		s.logger().Debugf("Could not write web response: %s", err.Error())
+	}
+}
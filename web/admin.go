@@ -0,0 +1,240 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+// adminRequest holds the parameters of all admin operations, each uses the
+// fields it needs
+type adminRequest struct {
+	IP         string  `json:"ip"`
+	Address    string  `json:"address"`
+	Target     string  `json:"target"`
+	Username   string  `json:"username"`
+	Difficulty float64 `json:"difficulty"`
+	Subsystem  string  `json:"subsystem"`
+	Level      string  `json:"level"`
+}
+
+type adminHandler func(req adminRequest) (interface{}, error)
+
+func (s *Server) registerAdminHandlers() {
+	if s.AdminToken == "" {
+		return
+	}
+	handlers := map[string]adminHandler{
+		"/admin/peers/ban":          s.adminBanPeer,
+		"/admin/peers/unban":        s.adminUnbanPeer,
+		"/admin/peers/banned":       s.adminBannedPeers,
+		"/admin/peers/add":          s.adminAddPeer,
+		"/admin/stratum/disconnect": s.adminDisconnect,
+		"/admin/stratum/difficulty": s.adminSetDifficulty,
+		"/admin/template/refresh":   s.adminRefreshTemplate,
+		"/admin/caches/flush":       s.adminFlushCaches,
+		"/admin/shutdown":           s.adminShutdown,
+		"/admin/reload":             s.adminReload,
+		"/admin/loglevel":           s.adminLogLevel,
+	}
+	for path, h := range handlers {
+		s.mux.HandleFunc(path, s.adminEndpoint(h))
+	}
+}
+
+// adminEndpoint checks the admin token and decodes the request for an
+// admin operation. Operations are POSTs with a JSON body, answered with a
+// JSON result.
+func (s *Server) adminEndpoint(h adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAdminToken(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use POST"})
+			return
+		}
+		var req adminRequest
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		s.logger().Infof("Admin request %s from %s", r.URL.Path, r.RemoteAddr)
+		res, err := h(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": res})
+	}
+}
+
+// checkAdminToken answers requests without the admin token with 401 and
+// returns false for them
+func (s *Server) checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !tokenMatches(token, s.AdminToken) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid admin token"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) requirePeers() error {
+	if s.Peers == nil {
+		return fmt.Errorf("Not connected to the p2pool network")
+	}
+	return nil
+}
+
+func (s *Server) requireStratum() error {
+	if s.Stratum == nil {
+		return fmt.Errorf("Stratum server not running")
+	}
+	return nil
+}
+
+func parseIP(ip string) (net.IP, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("Invalid IP address %s", ip)
+	}
+	return parsed, nil
+}
+
+func (s *Server) adminBanPeer(req adminRequest) (interface{}, error) {
+	if err := s.requirePeers(); err != nil {
+		return nil, err
+	}
+	ip, err := parseIP(req.IP)
+	if err != nil {
+		return nil, err
+	}
+	s.Peers.Ban(ip)
+	return true, nil
+}
+
+func (s *Server) adminUnbanPeer(req adminRequest) (interface{}, error) {
+	if err := s.requirePeers(); err != nil {
+		return nil, err
+	}
+	ip, err := parseIP(req.IP)
+	if err != nil {
+		return nil, err
+	}
+	s.Peers.Unban(ip)
+	return true, nil
+}
+
+func (s *Server) adminBannedPeers(req adminRequest) (interface{}, error) {
+	if err := s.requirePeers(); err != nil {
+		return nil, err
+	}
+	return s.Peers.Banned(), nil
+}
+
+// adminAddPeer connects to a peer given as host:port, or host for the
+// network's default port
+func (s *Server) adminAddPeer(req adminRequest) (interface{}, error) {
+	if err := s.requirePeers(); err != nil {
+		return nil, err
+	}
+	host, port := req.Address, 0
+	if h, p, err := net.SplitHostPort(req.Address); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port %s", p)
+		}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("Could not resolve %s", host)
+	}
+	err = s.Peers.AddPeerWithPort(ips[0], port)
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func (s *Server) adminDisconnect(req adminRequest) (interface{}, error) {
+	if err := s.requireStratum(); err != nil {
+		return nil, err
+	}
+	return s.Stratum.Disconnect(req.Target), nil
+}
+
+func (s *Server) adminSetDifficulty(req adminRequest) (interface{}, error) {
+	if err := s.requireStratum(); err != nil {
+		return nil, err
+	}
+	if req.Difficulty <= 0 {
+		return nil, fmt.Errorf("Invalid difficulty")
+	}
+	return s.Stratum.SetDifficulty(req.Username, req.Difficulty), nil
+}
+
+func (s *Server) adminRefreshTemplate(req adminRequest) (interface{}, error) {
+	if s.WorkManager.Daemons == nil {
+		return nil, fmt.Errorf("No daemon configured")
+	}
+	err := s.WorkManager.RefreshTemplate()
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func (s *Server) adminFlushCaches(req adminRequest) (interface{}, error) {
+	return map[string]int{"transactions": s.WorkManager.TxCache.Clear()}, nil
+}
+
+func (s *Server) adminShutdown(req adminRequest) (interface{}, error) {
+	if s.Shutdown == nil {
+		return nil, fmt.Errorf("Shutdown not supported")
+	}
+	// Let the response go out first
+	go s.Shutdown()
+	return true, nil
+}
+
+func (s *Server) adminReload(req adminRequest) (interface{}, error) {
+	if s.Reload == nil {
+		return nil, fmt.Errorf("Reloading is not supported")
+	}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// adminLogLevel sets the log level of a subsystem, or of the default when
+// none is given, until the next reload. Without a level it only returns the
+// current levels.
+func (s *Server) adminLogLevel(req adminRequest) (interface{}, error) {
+	if req.Level != "" {
+		level, err := logging.ParseLogLevel(req.Level)
+		if err != nil {
+			return nil, err
+		}
+		subsystem := req.Subsystem
+		if subsystem == "" {
+			subsystem = "default"
+		}
+		err = logging.SetSubsystemLevel(subsystem, level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return logging.Levels(), nil
+}
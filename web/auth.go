@@ -0,0 +1,111 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// publicPaths are served without a read token even when one is required:
+// the health check for load balancers and the dashboard files, which pass
+// the token from their own URL on to the API
+func isPublicPath(path string) bool {
+	if path == "/health" || path == "/" {
+		return true
+	}
+	return strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".css") || strings.HasSuffix(path, ".js")
+}
+
+// isAdminPath tells the paths that are guarded by the admin token, those
+// are never opened up to other origins
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// requestToken returns the bearer token of a request, or the token query
+// parameter for clients that can't set headers, like browser WebSockets
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func tokenMatches(token string, tokens ...string) bool {
+	match := false
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			match = true
+		}
+	}
+	return match
+}
+
+// checkReadToken answers read requests without a valid read token with 401
+// and returns false for them. The admin token can read too.
+func (s *Server) checkReadToken(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.ReadTokens) == 0 || isPublicPath(r.URL.Path) {
+		return true
+	}
+	if !tokenMatches(requestToken(r), append(s.ReadTokens, s.AdminToken)...) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+		return false
+	}
+	return true
+}
+
+// allowedOrigin returns the value for Access-Control-Allow-Origin, empty if
+// the origin isn't allowed
+func (s *Server) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range s.CORSOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// isReadMethod tells the methods of the read API. Everything that changes
+// the node is an admin endpoint.
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// handler wraps the routes with CORS, the read token check and the rate
+// limit. Requests that could change something must go to the admin API,
+// which checks the admin token.
+func (s *Server) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			if !isReadMethod(r.Method) {
+				w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "The read API only takes GET"})
+				return
+			}
+			if origin := s.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+				if origin != "*" {
+					w.Header().Add("Vary", "Origin")
+				}
+				if r.Method == http.MethodOptions {
+					w.Header().Set("Access-Control-Max-Age", "3600")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			if !s.checkReadToken(w, r) || !s.checkRateLimit(w, r) {
+				return
+			}
+		}
+		s.mux.ServeHTTP(w, r)
+	})
+}
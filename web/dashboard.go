@@ -0,0 +1,85 @@
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// registerDashboard serves the built-in dashboard at the root. It is a
+// static page that polls the stats API, so it needs nothing from the server
+// beyond the files.
+func (s *Server) registerDashboard() {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	s.mux.Handle("/", http.FileServer(http.FS(static)))
+	s.mux.HandleFunc("/peers", s.cached(s.handlePeers))
+	s.mux.HandleFunc("/recent_shares", s.cached(s.handleRecentShares))
+}
+
+type peerInfo struct {
+	Address string `json:"address"`
+	Version string `json:"version"`
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := make([]peerInfo, 0)
+	if s.Peers != nil {
+		for _, p := range s.Peers.GetPeers() {
+			peers = append(peers, peerInfo{
+				Address: net.JoinHostPort(p.RemoteIP.String(), strconv.Itoa(p.RemotePort)),
+				Version: p.RemoteVersion(),
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// recentSharesCount is how many shares from the tip of the sharechain the
+// dashboard lists
+const recentSharesCount = 20
+
+type recentShare struct {
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"ts"`
+	Address   string `json:"address"`
+	Stale     string `json:"stale,omitempty"`
+	Block     bool   `json:"block"`
+}
+
+func (s *Server) handleRecentShares(w http.ResponseWriter, r *http.Request) {
+	sc := s.WorkManager.ShareChain
+	shares := make([]recentShare, 0, recentSharesCount)
+	cs := sc.GetShare(sc.GetTipHash())
+	for i := 0; i < recentSharesCount && cs != nil; i++ {
+		sh := cs.Share
+		rs := recentShare{
+			Hash:      sh.Hash.String(),
+			Timestamp: int64(sh.ShareInfo.Timestamp),
+			Block:     sh.IsBlock(),
+		}
+		sd := sh.ShareInfo.ShareData
+		if addr, err := work.PubKeyHashToAddress(sd.PubKeyHash, sd.PubKeyHashVersion, s.WorkManager.Network); err == nil {
+			rs.Address = addr.EncodeAddress()
+		}
+		switch sd.StaleInfo {
+		case wire.StaleInfoOrphan:
+			rs.Stale = "orphan"
+		case wire.StaleInfoDOA:
+			rs.Stale = "doa"
+		}
+		shares = append(shares, rs)
+		cs = cs.Previous()
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
@@ -0,0 +1,61 @@
+package web
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// registerDiagnostics serves pprof and expvar behind the admin token, so a
+// production node can be profiled without a rebuild. The standard handlers
+// are mounted on our own mux, not the default one.
+func (s *Server) registerDiagnostics() {
+	if !s.Diagnostics || s.AdminToken == "" {
+		return
+	}
+	s.mux.HandleFunc("/debug/pprof/", s.adminOnly(pprof.Index))
+	s.mux.HandleFunc("/debug/pprof/cmdline", s.adminOnly(pprof.Cmdline))
+	s.mux.HandleFunc("/debug/pprof/profile", s.adminOnly(pprof.Profile))
+	s.mux.HandleFunc("/debug/pprof/symbol", s.adminOnly(pprof.Symbol))
+	s.mux.HandleFunc("/debug/pprof/trace", s.adminOnly(pprof.Trace))
+	s.mux.HandleFunc("/debug/vars", s.adminOnly(expvar.Handler().ServeHTTP))
+	s.mux.HandleFunc("/admin/dump", s.adminEndpoint(s.adminDump))
+}
+
+func (s *Server) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.checkAdminToken(w, r) {
+			h(w, r)
+		}
+	}
+}
+
+// adminDump writes goroutine and heap profiles to files in the working
+// directory, for when attaching a profiler is no option
+func (s *Server) adminDump(req adminRequest) (interface{}, error) {
+	stamp := time.Now().Format("20060102-150405")
+	files := map[string]string{}
+	for _, name := range []string{"goroutine", "heap"} {
+		if name == "heap" {
+			// Up to date statistics
+			runtime.GC()
+		}
+		path := fmt.Sprintf("%s-%s.pprof", name, stamp)
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		err = rpprof.Lookup(name).WriteTo(f, 0)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[name] = path
+	}
+	return files, nil
+}
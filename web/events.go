@@ -0,0 +1,68 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/events"
+)
+
+const (
+	// Events buffered per WebSocket client before it starts missing them
+	eventsBuffer = 256
+	// Keeps idle connections from being cut by proxies
+	eventsPingInterval = time.Second * 30
+)
+
+// handleEvents streams the events of the node's network as JSON over a
+// WebSocket. The types parameter takes a comma separated list of event types
+// to limit the stream to.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var types []events.Type
+	if t := r.URL.Query().Get("types"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			types = append(types, events.Type(strings.TrimSpace(name)))
+		}
+	}
+
+	c, err := upgradeWebSocket(w, r)
+	if err != nil {
+		s.logger().Debugf("Event stream from %s refused: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	defer c.Close()
+
+	sub := events.SubscribeNetwork(s.WorkManager.Network.Name, eventsBuffer, types...)
+	defer sub.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		c.readLoop()
+		close(closed)
+	}()
+
+	ping := clock.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-sub.Events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				s.logger().Warnf("Could not encode %s event: %s", e.Type, err.Error())
+				continue
+			}
+			if c.writeFrame(wsOpText, b) != nil {
+				return
+			}
+		case <-ping.C:
+			if c.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// handleExportShares exports a range of the sharechain as JSON. The from
+// and to parameters take a share height or an RFC 3339 time.
+func (s *Server) handleExportShares(w http.ResponseWriter, r *http.Request) {
+	var rng work.ExportRange
+	q := r.URL.Query()
+	err := rng.SetBound(q.Get("from"), true)
+	if err == nil {
+		err = rng.SetBound(q.Get("to"), false)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.WorkManager.ShareChain.Export(rng, s.WorkManager.Network))
+}
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type feeStatsResponse struct {
+	MinFeeRate float64                `json:"min_fee_rate"`
+	Template   *work.TemplateFeeStats `json:"template"`
+	Daemon     *work.FeeEstimates     `json:"daemon"`
+}
+
+// handleFeeStats reports the fees in the current template next to the
+// daemon's fee estimates and mempool state
+func (s *Server) handleFeeStats(w http.ResponseWriter, r *http.Request) {
+	resp := feeStatsResponse{MinFeeRate: s.WorkManager.MinFeeRate}
+	if bt := s.WorkManager.CurrentTemplate(); bt != nil {
+		st := bt.FeeStats()
+		resp.Template = &st
+	}
+	fe, err := s.WorkManager.FeeEstimates()
+	if err != nil {
+		s.logger().Debugf("Could not get fee estimates: %s", err.Error())
+	} else {
+		resp.Daemon = fe
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+const (
+	// graphSampleInterval is how often statistics are recorded, which is
+	// the bin width of the shortest view
+	graphSampleInterval = time.Second * 10
+	graphSaveInterval   = time.Minute * 5
+)
+
+// sampleGraphsLoop records the node's statistics into the graph database
+// and saves it regularly
+func (s *Server) sampleGraphsLoop() {
+	lastSave := clock.Now()
+	for {
+		clock.Sleep(graphSampleInterval)
+		now := clock.Now()
+		s.sampleGraphs(now)
+		if now.Sub(lastSave) < graphSaveInterval {
+			continue
+		}
+		lastSave = now
+		s.Graphs.Prune(now)
+		err := s.Graphs.Save()
+		if err != nil {
+			s.logger().Warnf("Could not save graph data: %s", err.Error())
+		}
+	}
+}
+
+func (s *Server) sampleGraphs(now time.Time) {
+	g := s.Graphs
+	nonstale, total, staleProp := s.poolRates()
+	g.AddMulti("pool_rates", now, map[string]float64{"good": nonstale, "stale": total - nonstale})
+	g.Add("pool_stale_prop", now, staleProp)
+
+	if s.Stratum != nil {
+		rates, dead := s.Stratum.MinerHashRates()
+		local, localDead := 0.0, 0.0
+		for _, r := range rates {
+			local += r
+		}
+		for _, r := range dead {
+			localDead += r
+		}
+		g.Add("local_hash_rate", now, local)
+		g.Add("local_dead_hash_rate", now, localDead)
+		g.Add("worker_count", now, float64(len(rates)))
+		g.AddMulti("miner_hash_rates", now, rates)
+		g.AddMulti("miner_dead_hash_rates", now, dead)
+	}
+	if s.Peers != nil {
+		g.AddMulti("peers", now, map[string]float64{"incoming": 0, "outgoing": float64(s.Peers.GetPeerCount())})
+	}
+
+	c := s.WorkManager.StaleCounts()
+	g.AddMulti("local_shares", now, map[string]float64{"total": float64(c.Shares), "orphan": float64(c.Orphans), "dead": float64(c.DOA)})
+	if c.Shares > 0 {
+		g.Add("local_stale_prop", now, float64(c.Orphans+c.DOA)/float64(c.Shares))
+	}
+
+	if addr := s.payoutAddress(); addr != "" {
+		payout, err := s.expectedPayout(addr)
+		if err == nil {
+			g.Add("current_payout", now, payout)
+		}
+	}
+}
+
+// handleGraphData serves /web/graph_data/<source>/<view> like the Python
+// p2pool, as a list of [time, value] pairs
+func (s *Server) handleGraphData(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/web/graph_data/"), "/")
+	if s.Graphs == nil || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := s.Graphs.Data(parts[0], parts[1], clock.Now())
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (s *Server) handleGraphSources(w http.ResponseWriter, r *http.Request) {
+	sources := []string{}
+	if s.Graphs != nil {
+		sources = s.Graphs.Sources()
+	}
+	writeJSON(w, http.StatusOK, sources)
+}
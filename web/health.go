@@ -0,0 +1,36 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type healthResponse struct {
+	Status  string              `json:"status"`
+	Reason  string              `json:"reason,omitempty"`
+	Solo    bool                `json:"solo"`
+	Peers   int                 `json:"peers"`
+	Daemons []work.DaemonStatus `json:"daemons"`
+}
+
+// handleHealth reports whether the node can hand out work. It answers 503
+// while it can't, so load balancers and monitoring pick it up.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok", Daemons: []work.DaemonStatus{}}
+	if s.WorkManager.Daemons != nil {
+		resp.Daemons = s.WorkManager.Daemons.Status()
+	}
+	if s.Peers != nil {
+		resp.Peers = s.Peers.GetPeerCount()
+	}
+	resp.Solo = s.WorkManager.IsSolo()
+
+	status := http.StatusOK
+	if paused, reason := s.WorkManager.Paused(); paused {
+		resp.Status = "degraded"
+		resp.Reason = reason
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,167 @@
+package web
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+// maxCacheEntries bounds the response cache, urls with many distinct query
+// strings would grow it forever otherwise
+const maxCacheEntries = 1000
+
+type cachedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// responseCache keeps computed responses by request URL
+type responseCache struct {
+	lock    sync.Mutex
+	entries map[string]cachedResponse
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || clock.Now().After(e.expires) {
+		return cachedResponse{}, false
+	}
+	return e, true
+}
+
+func (c *responseCache) put(key string, e cachedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCacheEntries {
+		now := clock.Now()
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if c.entries == nil || len(c.entries) >= maxCacheEntries {
+			c.entries = map[string]cachedResponse{}
+		}
+	}
+	c.entries[key] = e
+}
+
+// recorder captures a response so it can be cached
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *recorder) WriteHeader(status int)      { r.status = status }
+
+// cached serves successful responses of h from the cache for CacheTTL, so
+// expensive stats are computed once however many clients ask for them
+func (s *Server) cached(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.CacheTTL <= 0 || r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
+		key := r.URL.RequestURI()
+		e, ok := s.cache.get(key)
+		if !ok {
+			rec := &recorder{header: http.Header{}, status: http.StatusOK}
+			h(rec, r)
+			e = cachedResponse{
+				status:      rec.status,
+				contentType: rec.header.Get("Content-Type"),
+				body:        rec.body.Bytes(),
+				expires:     clock.Now().Add(s.CacheTTL),
+			}
+			if e.status == http.StatusOK {
+				s.cache.put(key, e)
+			}
+		}
+		if e.contentType != "" {
+			w.Header().Set("Content-Type", e.contentType)
+		}
+		w.WriteHeader(e.status)
+		w.Write(e.body)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// allow takes a token from the bucket of ip, refilled at rate per second up
+// to burst, and returns false if there was none
+func (l *rateLimiter) allow(ip string, rate float64, burst int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := clock.Now()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	if now.Sub(l.pruned) > time.Minute {
+		// Buckets idle long enough to be full again can go
+		full := time.Duration(float64(burst) / rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// checkRateLimit answers requests over the client's rate limit with 429 and
+// returns false for them
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if s.RateLimit <= 0 {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	burst := s.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	if !s.limiter.allow(ip, s.RateLimit, burst) {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many requests"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type minerResponse struct {
+	stratum.AddressStats
+	// ExpectedPayout is what the address would get, in coins, if the pool
+	// found a block right now
+	ExpectedPayout float64 `json:"expected_payout"`
+}
+
+// handleMiner reports the statistics of a payout address, given as
+// /miner/<address>, for miner facing status pages
+func (s *Server) handleMiner(w http.ResponseWriter, r *http.Request) {
+	address := work.NormalizeAddress(strings.TrimPrefix(r.URL.Path, "/miner/"), s.WorkManager.Network)
+	payout, err := s.expectedPayout(address)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := minerResponse{
+		AddressStats:   stratum.AddressStats{Address: address, Workers: []stratum.WorkerStats{}},
+		ExpectedPayout: payout,
+	}
+	if s.Stratum != nil {
+		resp.AddressStats = s.Stratum.AddressStats(address)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// expectedPayout returns what address would get, in coins, if the pool found
+// a block right now
+func (s *Server) expectedPayout(address string) (float64, error) {
+	n := s.WorkManager.Network
+	script, err := s.addressToScript(address)
+	if err != nil {
+		return 0, err
+	}
+	bt := s.WorkManager.CurrentTemplate()
+	if bt == nil {
+		return 0, nil
+	}
+	sc := s.WorkManager.ShareChain
+	amounts := sc.GetExpectedPayouts(sc.GetTipHash(), bt.CoinbaseValue, bt.Target, n)
+	return float64(amounts[string(script)]) / 1e8, nil
+}
+
+func (s *Server) addressToScript(address string) ([]byte, error) {
+	n := s.WorkManager.Network
+	pkh, version, err := work.AddressToPubKeyHash(address, n)
+	if err != nil {
+		return nil, err
+	}
+	return work.PubKeyHashToScript(pkh, version, n)
+}
@@ -0,0 +1,254 @@
+package web
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// The endpoints in this file mirror the JSON API of the Python p2pool, so
+// existing front-ends and scanners work against us unchanged. Response shapes
+// and units follow the original, not our own conventions.
+
+// statsLookbehind is how many shares back pool wide statistics are taken
+// over, like p2pool's decent height
+const statsLookbehind = 720
+
+func (s *Server) registerP2PoolHandlers() {
+	s.mux.HandleFunc("/rate", s.cached(s.handleRate))
+	s.mux.HandleFunc("/users", s.cached(s.handleUsers))
+	s.mux.HandleFunc("/current_payouts", s.cached(s.handleCurrentPayouts))
+	s.mux.HandleFunc("/payout_addr", s.cached(s.handlePayoutAddr))
+	s.mux.HandleFunc("/payout_projection", s.cached(s.handlePayoutProjection))
+	s.mux.HandleFunc("/recent_blocks", s.cached(s.handleRecentBlocks))
+	s.mux.HandleFunc("/global_stats", s.cached(s.handleGlobalStats))
+	s.mux.HandleFunc("/local_stats", s.cached(s.handleLocalStats))
+}
+
+func bigToFloat(b *big.Int) float64 {
+	f, _ := big.NewFloat(0).SetInt(b).Float64()
+	return f
+}
+
+func (s *Server) scriptToAddress(script []byte) string {
+	addr, err := work.ScriptToAddress(script, s.WorkManager.Network)
+	if err != nil {
+		return hex.EncodeToString(script)
+	}
+	return addr
+}
+
+// poolRates returns the pool's hashrate without and with stale shares, and
+// the stale proportion
+func (s *Server) poolRates() (nonstale float64, total float64, staleProp float64) {
+	return s.WorkManager.ShareChain.PoolRates(statsLookbehind)
+}
+
+func (s *Server) handleRate(w http.ResponseWriter, r *http.Request) {
+	_, rate, _ := s.poolRates()
+	writeJSON(w, http.StatusOK, rate)
+}
+
+// handleUsers reports every payout address's share of the work in the last
+// shares
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	sc := s.WorkManager.ShareChain
+	tip := sc.GetTipHash()
+	height := sc.GetHeight(tip, statsLookbehind)
+	unlimited := big.NewInt(0).Lsh(big.NewInt(65535), 256)
+	weights, totalWeight, _ := sc.GetCumulativeWeights(tip, height, unlimited, s.WorkManager.Network)
+
+	users := map[string]float64{}
+	if totalWeight.Sign() > 0 {
+		for script, weight := range weights {
+			users[s.scriptToAddress([]byte(script))], _ = big.NewRat(0, 1).SetFrac(weight, totalWeight).Float64()
+		}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// handleCurrentPayouts reports what every address would get, in coins, if
+// the pool found a block right now
+func (s *Server) handleCurrentPayouts(w http.ResponseWriter, r *http.Request) {
+	payouts := map[string]float64{}
+	bt := s.WorkManager.CurrentTemplate()
+	if bt != nil {
+		sc := s.WorkManager.ShareChain
+		amounts := sc.GetExpectedPayouts(sc.GetTipHash(), bt.CoinbaseValue, bt.Target, s.WorkManager.Network)
+		for script, amount := range amounts {
+			payouts[s.scriptToAddress([]byte(script))] += float64(amount) / 1e8
+		}
+	}
+	writeJSON(w, http.StatusOK, payouts)
+}
+
+// handlePayoutAddr reports the address miners without a valid address of
+// their own mine to
+func (s *Server) handlePayoutAddr(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.payoutAddress())
+}
+
+func (s *Server) payoutAddress() string {
+	if s.Stratum != nil && s.Stratum.DefaultAddress != "" {
+		return s.Stratum.DefaultAddress
+	}
+	return s.WorkManager.FeeAddress
+}
+
+type recentBlock struct {
+	Timestamp int64   `json:"ts"`
+	Hash      string  `json:"hash"`
+	Number    *int64  `json:"number"`
+	Share     string  `json:"share"`
+	Finder    string  `json:"finder"`
+	Value     float64 `json:"value"`
+	URL       string  `json:"url,omitempty"`
+}
+
+func (s *Server) recentBlock(b work.PoolBlock) recentBlock {
+	rb := recentBlock{
+		Timestamp: b.Timestamp,
+		Hash:      b.Hash,
+		Share:     b.Hash,
+		Finder:    b.Finder,
+		Value:     float64(b.Value) / 1e8,
+	}
+	if b.Height >= 0 {
+		height := b.Height
+		rb.Number = &height
+	}
+	if u := s.WorkManager.Network.BlockExplorerURL; u != "" {
+		rb.URL = fmt.Sprintf(u, b.Hash)
+	}
+	return rb
+}
+
+// handleRecentBlocks lists the blocks found by the pool, from the block log
+// if there is one, or else the last day's worth of shares
+func (s *Server) handleRecentBlocks(w http.ResponseWriter, r *http.Request) {
+	blocks := make([]recentBlock, 0)
+	if s.Blocks != nil {
+		for _, b := range s.Blocks.Blocks() {
+			blocks = append(blocks, s.recentBlock(b))
+		}
+		writeJSON(w, http.StatusOK, blocks)
+		return
+	}
+	sc := s.WorkManager.ShareChain
+	n := s.WorkManager.Network
+	cs := sc.GetShare(sc.GetTipHash())
+	for i := 0; i < 24*60*60/n.SharePeriod && cs != nil; i++ {
+		if cs.Share.IsBlock() {
+			blocks = append(blocks, s.recentBlock(work.PoolBlockFromShare(cs.Share, n)))
+		}
+		cs = cs.Previous()
+	}
+	writeJSON(w, http.StatusOK, blocks)
+}
+
+type globalStats struct {
+	PoolNonstaleHashRate   float64 `json:"pool_nonstale_hash_rate"`
+	PoolHashRate           float64 `json:"pool_hash_rate"`
+	PoolStaleProp          float64 `json:"pool_stale_prop"`
+	MinDifficulty          float64 `json:"min_difficulty"`
+	NetworkBlockDifficulty float64 `json:"network_block_difficulty"`
+	NetworkHashrate        float64 `json:"network_hashrate"`
+}
+
+func (s *Server) handleGlobalStats(w http.ResponseWriter, r *http.Request) {
+	n := s.WorkManager.Network
+	var st globalStats
+	st.PoolNonstaleHashRate, st.PoolHashRate, st.PoolStaleProp = s.poolRates()
+	if tip := s.WorkManager.ShareChain.GetShare(s.WorkManager.ShareChain.GetTipHash()); tip != nil {
+		maxTarget := blockchain.CompactToBig(uint32(tip.Share.ShareInfo.MaxBits))
+		st.MinDifficulty = work.TargetToDifficulty(maxTarget) * n.DumbScryptDiff
+	}
+	if bt := s.WorkManager.CurrentTemplate(); bt != nil {
+		st.NetworkBlockDifficulty = work.TargetToDifficulty(bt.Target) * n.DumbScryptDiff
+		if n.ChainParams.TargetTimePerBlock > 0 {
+			st.NetworkHashrate = bigToFloat(work.TargetToAverageAttempts(bt.Target)) / n.ChainParams.TargetTimePerBlock.Seconds()
+		}
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+type localPeers struct {
+	Incoming int `json:"incoming"`
+	Outgoing int `json:"outgoing"`
+}
+
+type localShares struct {
+	Total  int `json:"total"`
+	Orphan int `json:"orphan"`
+	Dead   int `json:"dead"`
+}
+
+type localStats struct {
+	Peers                    localPeers         `json:"peers"`
+	Uptime                   float64            `json:"uptime"`
+	MinerHashRates           map[string]float64 `json:"miner_hash_rates"`
+	MinerDeadHashRates       map[string]float64 `json:"miner_dead_hash_rates"`
+	MinerLastDifficulties    map[string]float64 `json:"miner_last_difficulties"`
+	Shares                   localShares        `json:"shares"`
+	EfficiencyIfMinerPerfect *float64           `json:"efficiency_if_miner_perfect"`
+	Efficiency               *float64           `json:"efficiency"`
+	Fee                      float64            `json:"fee"`
+	DonationProportion       float64            `json:"donation_proportion"`
+	Version                  string             `json:"version"`
+	ProtocolVersion          int                `json:"protocol_version"`
+	AttemptsToShare          float64            `json:"attempts_to_share"`
+	AttemptsToBlock          float64            `json:"attempts_to_block"`
+	BlockValue               float64            `json:"block_value"`
+	Warnings                 []string           `json:"warnings"`
+}
+
+func (s *Server) handleLocalStats(w http.ResponseWriter, r *http.Request) {
+	wm := s.WorkManager
+	st := localStats{
+		Uptime:                clock.Since(s.started).Seconds(),
+		MinerHashRates:        map[string]float64{},
+		MinerDeadHashRates:    map[string]float64{},
+		MinerLastDifficulties: map[string]float64{},
+		Fee:                   wm.FeePercent,
+		DonationProportion:    wm.DonationPercent() / 100,
+		Version:               p2p.SubVersion,
+		ProtocolVersion:       p2p.ProtocolVersion,
+		Warnings:              []string{},
+	}
+	if s.Peers != nil {
+		// We don't accept incoming p2pool connections
+		st.Peers.Outgoing = s.Peers.GetPeerCount()
+	}
+	if s.Stratum != nil {
+		st.MinerHashRates, st.MinerDeadHashRates = s.Stratum.MinerHashRates()
+		st.MinerLastDifficulties = s.Stratum.MinerLastDifficulties()
+	}
+
+	counts := wm.StaleCounts()
+	st.Shares = localShares{Total: counts.Shares, Orphan: counts.Orphans, Dead: counts.DOA}
+	if counts.Shares > 0 {
+		_, _, staleProp := s.poolRates()
+		perfect := (1 - float64(counts.Orphans)/float64(counts.Shares)) / (1 - staleProp)
+		efficiency := (1 - float64(counts.Orphans+counts.DOA)/float64(counts.Shares)) / (1 - staleProp)
+		st.EfficiencyIfMinerPerfect = &perfect
+		st.Efficiency = &efficiency
+	}
+
+	if tip := wm.ShareChain.GetShare(wm.ShareChain.GetTipHash()); tip != nil {
+		st.AttemptsToShare = bigToFloat(work.TargetToAverageAttempts(blockchain.CompactToBig(uint32(tip.Share.ShareInfo.MaxBits))))
+	}
+	if bt := wm.CurrentTemplate(); bt != nil {
+		st.AttemptsToBlock = bigToFloat(work.TargetToAverageAttempts(bt.Target))
+		st.BlockValue = float64(bt.CoinbaseValue) / 1e8
+	}
+	if paused, reason := wm.Paused(); paused {
+		st.Warnings = append(st.Warnings, "Pool paused: "+reason)
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+type projectedOutput struct {
+	Address string  `json:"address"`
+	Script  string  `json:"script"`
+	Amount  float64 `json:"amount"`
+}
+
+type payoutProjection struct {
+	Height       int64             `json:"height"`
+	Finder       string            `json:"finder"`
+	Solo         bool              `json:"solo"`
+	Total        float64           `json:"total"`
+	Subsidy      float64           `json:"subsidy"`
+	Fees         float64           `json:"fees"`
+	Donation     float64           `json:"donation"`
+	FeePercent   float64           `json:"operator_fee_percent"`
+	FeeAddress   string            `json:"operator_fee_address,omitempty"`
+	FeeAmount    float64           `json:"operator_fee_amount"`
+	Outputs      []projectedOutput `json:"outputs"`
+	Transactions int               `json:"transactions"`
+}
+
+// handlePayoutProjection returns the coinbase outputs of the block we would
+// mine if the next share on the current template were a block, found by the
+// address in the finder parameter, or the node's payout address. The node
+// fee isn't an output of its own, it is what the fee address earns from
+// the shares assigned to it.
+func (s *Server) handlePayoutProjection(w http.ResponseWriter, r *http.Request) {
+	wm := s.WorkManager
+	bt := wm.CurrentTemplate()
+	if bt == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "No block template yet"})
+		return
+	}
+	finder := r.URL.Query().Get("finder")
+	if finder == "" {
+		finder = s.payoutAddress()
+	}
+	finderScript, err := s.addressToScript(finder)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	fees := int64(0)
+	for _, f := range bt.TxFees {
+		fees += f
+	}
+	p := payoutProjection{
+		Height:       bt.Height,
+		Finder:       finder,
+		Solo:         wm.IsSolo(),
+		Total:        float64(bt.CoinbaseValue) / 1e8,
+		Subsidy:      float64(bt.CoinbaseValue-uint64(fees)) / 1e8,
+		Fees:         float64(fees) / 1e8,
+		FeePercent:   wm.FeePercent,
+		FeeAddress:   wm.FeeAddress,
+		Outputs:      make([]projectedOutput, 0),
+		Transactions: len(bt.Transactions),
+	}
+	var feeScript []byte
+	if wm.FeeAddress != "" {
+		feeScript, _ = s.addressToScript(wm.FeeAddress)
+	}
+
+	var outputs []work.Payout
+	if p.Solo {
+		outputs = []work.Payout{{Script: finderScript, Amount: bt.CoinbaseValue}}
+	} else {
+		sc := wm.ShareChain
+		outputs = sc.GetPayouts(sc.GetTipHash(), bt.CoinbaseValue, finderScript, bt.Target, wm.Network)
+	}
+	for _, o := range outputs {
+		amount := float64(o.Amount) / 1e8
+		if bytes.Equal(o.Script, wire.DonationScript(wm.Network)) {
+			p.Donation += amount
+		}
+		if feeScript != nil && bytes.Equal(o.Script, feeScript) {
+			p.FeeAmount += amount
+		}
+		p.Outputs = append(p.Outputs, projectedOutput{
+			Address: s.scriptToAddress(o.Script),
+			Script:  hex.EncodeToString(o.Script),
+			Amount:  amount,
+		})
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,196 @@
+package web
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/control"
+	"github.com/gertjaap/p2pool-go/graph"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/p2p"
+	"github.com/gertjaap/p2pool-go/stratum"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+var log = logging.For("web")
+
+// Server serves the node's HTTP API
+type Server struct {
+	// Port is the port of the HTTP API, not served if 0
+	Port int
+	// TLSCert and TLSKey, if set, are the certificate and key files the
+	// HTTP API is served over TLS with
+	TLSCert string
+	TLSKey  string
+	// ACMEDomains, if set, serve the HTTP API over TLS with certificates
+	// for these domains from Let's Encrypt, kept in ACMECache. ACMEEmail is
+	// the optional contact for the account.
+	ACMEDomains []string
+	ACMEEmail   string
+	ACMECache   string
+	// ControlPort, if set, serves the API as control API too, see package
+	// control
+	ControlPort int
+	WorkManager *work.WorkManager
+	Stratum     *stratum.Server
+	Peers       *p2p.PeerManager
+	// Graphs, if set, gets the node's statistics recorded over time
+	Graphs *graph.DB
+	// Blocks, if set, is the history of blocks found by the pool
+	Blocks *work.PoolBlockLog
+	// AdminToken enables the admin API for requests bearing it
+	AdminToken string
+	// GatewayToken lets stratum gateways get work over the control API,
+	// disabled if empty
+	GatewayToken string
+	// ReadTokens, if set, are required for the read API, as bearer token or
+	// token query parameter
+	ReadTokens []string
+	// CORSOrigins are the origins browsers may query the read API from,
+	// "*" for any
+	CORSOrigins []string
+	// CacheTTL is how long computed stats responses are served from cache
+	CacheTTL time.Duration
+	// RateLimit is the requests per second each client IP may make to the
+	// read API, with bursts up to RateBurst. Unlimited if 0.
+	RateLimit float64
+	RateBurst int
+	// Diagnostics serves pprof and expvar to admins
+	Diagnostics bool
+	// Reload is called to reload the configuration on request of the admin
+	// API
+	Reload func() error
+	// Shutdown is called to stop the node on request of the admin API
+	Shutdown func()
+	// Log gets the records of the API, the package's logger if nil
+	Log *logging.SubsystemLogger
+
+	mux        *http.ServeMux
+	httpServer *http.Server
+	control    *control.Server
+	started    time.Time
+	cache      responseCache
+	limiter    rateLimiter
+}
+
+func NewServer(port int, wm *work.WorkManager, ss *stratum.Server, pm *p2p.PeerManager) *Server {
+	s := &Server{
+		Port:        port,
+		WorkManager: wm,
+		Stratum:     ss,
+		Peers:       pm,
+		mux:         http.NewServeMux(),
+		started:     clock.Now(),
+	}
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/fee_stats", s.cached(s.handleFeeStats))
+	s.registerP2PoolHandlers()
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/miner/", s.cached(s.handleMiner))
+	s.mux.HandleFunc("/web/miner_software", s.cached(s.handleMinerSoftware))
+	s.mux.HandleFunc("/web/graph_data/", s.cached(s.handleGraphData))
+	s.mux.HandleFunc("/web/graph_sources", s.cached(s.handleGraphSources))
+	s.mux.HandleFunc("/web/export_shares", s.cached(s.handleExportShares))
+	s.mux.HandleFunc("/web/blocks.csv", s.cached(s.handleAccountingCSV))
+	s.mux.HandleFunc("/web/payouts.csv", s.cached(s.handleAccountingCSV))
+	s.registerDashboard()
+	return s
+}
+
+func (s *Server) logger() *logging.SubsystemLogger {
+	return s.Log.Or(log)
+}
+
+func (s *Server) Listen() error {
+	s.registerAdminHandlers()
+	s.registerDiagnostics()
+	// The control port is served with the certificates of the web port
+	var tlsConfig *tls.Config
+	if s.usesTLS() {
+		var err error
+		tlsConfig, err = s.tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	if s.ControlPort != 0 {
+		s.control = control.NewServer(s.ControlPort, s.handler(), s.WorkManager.Network.Name)
+		s.control.Log = s.logger().For("control")
+		s.control.TLSConfig = tlsConfig
+		if tlsConfig == nil && (s.AdminToken != "" || s.GatewayToken != "" || len(s.ReadTokens) > 0) {
+			s.logger().Warnf("Tokens are sent to the control port unencrypted, serve the web port with TLS to encrypt it too")
+		}
+		s.control.CanRead = func(token string) bool {
+			return len(s.ReadTokens) == 0 || tokenMatches(token, append(s.ReadTokens, s.AdminToken)...)
+		}
+		if s.GatewayToken != "" {
+			s.control.Work = s.WorkManager
+			s.control.CanGateway = func(token string) bool {
+				return tokenMatches(token, s.GatewayToken)
+			}
+		}
+		err := s.control.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Graphs != nil {
+		go s.sampleGraphsLoop()
+	}
+	if s.Port == 0 {
+		return nil
+	}
+	l, err := s.listen(tlsConfig)
+	if err != nil {
+		if s.control != nil {
+			s.control.Close()
+		}
+		return err
+	}
+	if tlsConfig != nil {
+		s.logger().Infof("Web server listening for TLS on port %d", s.Port)
+	} else {
+		s.logger().Infof("Web server listening on port %d", s.Port)
+		if s.AdminToken != "" {
+			s.logger().Warnf("The admin token is sent unencrypted, only use the admin API over a trusted network")
+		}
+	}
+	s.httpServer = &http.Server{Handler: s.handler()}
+	go func() {
+		err := s.httpServer.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			s.logger().Errorf("Web server stopped: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Close saves the graph data and stops the web server, dropping open
+// connections such as event streams
+func (s *Server) Close() error {
+	if s.Graphs != nil {
+		err := s.Graphs.Save()
+		if err != nil {
+			s.logger().Warnf("Could not save graph data: %s", err.Error())
+		}
+	}
+	if s.control != nil {
+		s.control.Close()
+	}
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Debugf("Could not write web response: %s", err.Error())
+	}
+}
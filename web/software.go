@@ -0,0 +1,17 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gertjaap/p2pool-go/stratum"
+)
+
+// handleMinerSoftware breaks the connected miners down by the software and
+// firmware they announced
+func (s *Server) handleMinerSoftware(w http.ResponseWriter, r *http.Request) {
+	if s.Stratum == nil {
+		writeJSON(w, http.StatusOK, []stratum.SoftwareStats{})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Stratum.SoftwareBreakdown())
+}
@@ -0,0 +1,176 @@
+(function () {
+	"use strict";
+
+	var refreshInterval = 15000;
+	// Hashrate samples kept for the chart, one per refresh
+	var maxSamples = 240;
+	var samples = [];
+	// Nodes that require a read token get it passed in the dashboard URL
+	var token = new URLSearchParams(window.location.search).get("token");
+
+	function getJSON(path) {
+		var headers = token ? { Authorization: "Bearer " + token } : {};
+		return fetch(path, { headers: headers }).then(function (r) {
+			return r.json();
+		});
+	}
+
+	function formatRate(h) {
+		var units = ["H/s", "kH/s", "MH/s", "GH/s", "TH/s", "PH/s", "EH/s"];
+		var i = 0;
+		while (h >= 1000 && i < units.length - 1) {
+			h /= 1000;
+			i++;
+		}
+		return h.toFixed(2) + " " + units[i];
+	}
+
+	function formatDuration(seconds) {
+		var d = Math.floor(seconds / 86400);
+		var h = Math.floor((seconds % 86400) / 3600);
+		var m = Math.floor((seconds % 3600) / 60);
+		return (d > 0 ? d + "d " : "") + h + "h " + m + "m";
+	}
+
+	function formatTime(ts) {
+		return new Date(ts * 1000).toLocaleString();
+	}
+
+	function shortHash(h) {
+		return h.substring(0, 16) + "…";
+	}
+
+	function setText(id, text) {
+		document.getElementById(id).textContent = text;
+	}
+
+	function fillTable(id, rows) {
+		var body = document.querySelector("#" + id + " tbody");
+		body.innerHTML = "";
+		rows.forEach(function (cells) {
+			var tr = document.createElement("tr");
+			cells.forEach(function (c) {
+				var td = document.createElement("td");
+				if (typeof c === "object" && c !== null && c.href) {
+					var a = document.createElement("a");
+					a.href = c.href;
+					a.textContent = c.text;
+					td.appendChild(a);
+				} else if (typeof c === "object" && c !== null) {
+					td.textContent = c.text;
+					td.className = c.className || "";
+				} else {
+					td.textContent = c;
+				}
+				tr.appendChild(td);
+			});
+			body.appendChild(tr);
+		});
+	}
+
+	function sum(obj) {
+		return Object.keys(obj).reduce(function (a, k) {
+			return a + obj[k];
+		}, 0);
+	}
+
+	function drawChart() {
+		var canvas = document.getElementById("rate-chart");
+		var ctx = canvas.getContext("2d");
+		ctx.clearRect(0, 0, canvas.width, canvas.height);
+		if (samples.length < 2) {
+			return;
+		}
+		var max = samples.reduce(function (m, s) {
+			return Math.max(m, s.pool, s.local);
+		}, 1);
+		var pad = 30;
+		var w = canvas.width - pad;
+		var h = canvas.height - pad;
+
+		ctx.fillStyle = "#666";
+		ctx.font = "11px sans-serif";
+		ctx.fillText(formatRate(max), 2, 12);
+		ctx.strokeStyle = "#ddd";
+		ctx.beginPath();
+		ctx.moveTo(pad, h);
+		ctx.lineTo(canvas.width, h);
+		ctx.stroke();
+
+		function line(key, color) {
+			ctx.strokeStyle = color;
+			ctx.lineWidth = 2;
+			ctx.beginPath();
+			samples.forEach(function (s, i) {
+				var x = pad + (w * i) / (maxSamples - 1);
+				var y = h - (h - 15) * (s[key] / max);
+				if (i === 0) {
+					ctx.moveTo(x, y);
+				} else {
+					ctx.lineTo(x, y);
+				}
+			});
+			ctx.stroke();
+		}
+		line("pool", "#1b5e20");
+		line("local", "#ef6c00");
+	}
+
+	function refresh() {
+		Promise.all([
+			getJSON("/local_stats"),
+			getJSON("/global_stats"),
+			getJSON("/current_payouts"),
+			getJSON("/recent_blocks"),
+			getJSON("/recent_shares"),
+			getJSON("/peers"),
+		]).then(function (r) {
+			var local = r[0], global = r[1], payouts = r[2], blocks = r[3], shares = r[4], peers = r[5];
+			var localRate = sum(local.miner_hash_rates);
+
+			setText("version", local.version);
+			setText("warnings", local.warnings.join(" "));
+			setText("pool-rate", formatRate(global.pool_hash_rate));
+			setText("local-rate", formatRate(localRate));
+			setText("network-rate", formatRate(global.network_hashrate));
+			setText("share-diff", global.min_difficulty.toFixed(2));
+			setText("block-value", local.block_value.toFixed(8));
+			setText("efficiency", local.efficiency === null ? "-" : (local.efficiency * 100).toFixed(1) + "%");
+			setText("shares", local.shares.total + " (" + local.shares.orphan + " / " + local.shares.dead + ")");
+			setText("uptime", formatDuration(local.uptime));
+
+			samples.push({ pool: global.pool_hash_rate, local: localRate });
+			if (samples.length > maxSamples) {
+				samples.shift();
+			}
+			drawChart();
+
+			fillTable("workers", Object.keys(local.miner_hash_rates).sort().map(function (u) {
+				var dead = local.miner_dead_hash_rates[u] || 0;
+				var diff = local.miner_last_difficulties[u];
+				return [u, formatRate(local.miner_hash_rates[u]), formatRate(dead), diff === undefined ? "-" : diff.toFixed(3)];
+			}));
+			fillTable("payouts", Object.keys(payouts).sort(function (a, b) {
+				return payouts[b] - payouts[a];
+			}).map(function (a) {
+				return [a, payouts[a].toFixed(8)];
+			}));
+			fillTable("shares-table", shares.map(function (s) {
+				var flag = s.block ? { text: "block", className: "block" } : { text: s.stale || "", className: "stale" };
+				return [formatTime(s.ts), shortHash(s.hash), s.address, flag];
+			}));
+			fillTable("blocks", blocks.map(function (b) {
+				var hash = b.url ? { text: shortHash(b.hash), href: b.url } : shortHash(b.hash);
+				return [formatTime(b.ts), b.number === null ? "-" : b.number, hash, b.finder, b.value.toFixed(8)];
+			}));
+			fillTable("peers", peers.map(function (p) {
+				return [p.address, p.version];
+			}));
+		}).catch(function (e) {
+			setText("warnings", "Could not reach the node: " + e);
+		});
+	}
+
+	refresh();
+	setInterval(refresh, refreshInterval);
+})();
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// usesTLS tells whether the web port is served over TLS
+func (s *Server) usesTLS() bool {
+	return s.TLSCert != "" || len(s.ACMEDomains) > 0
+}
+
+// tlsConfig is the TLS configuration of the web port: the configured
+// certificate, or certificates from an ACME CA for ACMEDomains. The CA
+// checks we own the domains with the TLS-ALPN challenge, so the web port
+// must be reachable on port 443 of the domains.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load web TLS certificate: %s", err.Error())
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+	if s.ACMECache == "" {
+		return nil, fmt.Errorf("ACME needs a directory to keep certificates in")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.ACMEDomains...),
+		Cache:      autocert.DirCache(s.ACMECache),
+		Email:      s.ACMEEmail,
+	}
+	config := m.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	return config, nil
+}
+
+// listen binds the web port, wrapped in TLS if config is set
+func (s *Server) listen(config *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return l, nil
+	}
+	return tls.NewListener(l, config), nil
+}
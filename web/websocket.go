@@ -0,0 +1,177 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side WebSocket (RFC 6455), enough to push JSON to
+// browsers and bots. Messages from the client are read only to handle
+// pings and closing; fragmented messages are not supported.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	// Clients have no reason to send us anything big
+	wsMaxPayload = 64 * 1024
+	wsWriteWait  = time.Second * 10
+)
+
+type wsConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket connection expected", http.StatusBadRequest)
+		return nil, fmt.Errorf("Not a WebSocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("Unsupported WebSocket version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("Connection can't be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	_, err = conn.Write([]byte(resp))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: brw.Reader}, nil
+}
+
+// writeFrame sends a single, unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	hdr := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		hdr = append(hdr, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	_, err := c.conn.Write(append(hdr, payload...))
+	return err
+}
+
+// readFrame reads a single frame from the client and unmasks it
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(c.reader, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var l [2]byte
+		_, err = io.ReadFull(c.reader, l[:])
+		length = uint64(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		_, err = io.ReadFull(c.reader, l[:])
+		length = binary.BigEndian.Uint64(l[:])
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if !masked {
+		return 0, nil, fmt.Errorf("Unmasked frame from client")
+	}
+	if length > wsMaxPayload {
+		return 0, nil, fmt.Errorf("Frame of %d bytes too large", length)
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers pings and returns when the client closes the connection
+// or it breaks
+func (c *wsConn) readLoop() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpPing:
+			if c.writeFrame(wsOpPong, payload) != nil {
+				return
+			}
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
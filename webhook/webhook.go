@@ -0,0 +1,170 @@
+// Package webhook POSTs node events to operator defined URLs, so outside
+// systems learn about found blocks, forks and outages as they happen.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+)
+
+const (
+	maxAttempts  = 5
+	firstBackoff = time.Second * 2
+)
+
+// DefaultEvents are the events hooks get when none are configured
+var DefaultEvents = []events.Type{
+	events.BlockFound,
+	events.Fork,
+	events.DaemonUnavailable,
+	events.DaemonAvailable,
+	events.ShareChainSynced,
+}
+
+// Hook is an URL events are POSTed to
+type Hook struct {
+	URL string
+	// Secret, if set, signs every payload with HMAC-SHA256 in the
+	// X-P2Pool-Signature header
+	Secret string
+	Events []events.Type
+	// MinForkDepth leaves out forks shallower than this
+	MinForkDepth int
+	// Template, if set, renders the payload from the event instead of
+	// sending the event as JSON
+	Template *template.Template
+
+	client *http.Client
+}
+
+func NewHook(url string) *Hook {
+	return &Hook{
+		URL:    url,
+		Events: DefaultEvents,
+		client: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// LoadTemplate reads a payload template from a file. The template gets the
+// event, and its data as JSON through the json function.
+func (h *Hook) LoadTemplate(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(path).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(string(b))
+	if err != nil {
+		return fmt.Errorf("Invalid webhook template %s: %s", path, err.Error())
+	}
+	h.Template = t
+	return nil
+}
+
+func (h *Hook) wants(e events.Event) bool {
+	if e.Type == events.Fork {
+		if f, ok := e.Data.(events.ForkInfo); ok && f.Depth < h.MinForkDepth {
+			return false
+		}
+	}
+	for _, t := range h.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hook) payload(e events.Event) ([]byte, error) {
+	if h.Template == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	err := h.Template.Execute(&buf, e)
+	return buf.Bytes(), err
+}
+
+// Sign returns the signature of a payload as sent in X-P2Pool-Signature
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Hook) post(e events.Event, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-P2Pool-Event", string(e.Type))
+	if h.Secret != "" {
+		req.Header.Set("X-P2Pool-Signature", Sign(h.Secret, payload))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// deliver sends an event, retrying with exponential backoff when the
+// receiver is down or answers with an error
+func (h *Hook) deliver(e events.Event) {
+	payload, err := h.payload(e)
+	if err != nil {
+		logging.Errorf("Could not build webhook payload for %s: %s", e.Type, err.Error())
+		return
+	}
+	backoff := firstBackoff
+	for attempt := 1; ; attempt++ {
+		err = h.post(e, payload)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			logging.Warnf("Giving up on webhook %s for %s: %s", h.URL, e.Type, err.Error())
+			return
+		}
+		logging.Debugf("Webhook %s for %s failed, retrying in %s: %s", h.URL, e.Type, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Run delivers events to the hooks as they are published
+func Run(hooks []*Hook) {
+	types := make([]events.Type, 0)
+	for _, h := range hooks {
+		types = append(types, h.Events...)
+	}
+	sub := events.Subscribe(256, types...)
+	for e := range sub.Events {
+		for _, h := range hooks {
+			if h.wants(e) {
+				go h.deliver(e)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wire_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+	"github.com/gertjaap/p2pool-go/work"
+)
+
+// benchShare mines a short sharechain on the benchmark network and returns
+// its tip, encoded as in a shares message
+func benchShare(b *testing.B) (p2pnet.Network, wire.Share, []byte) {
+	n := p2pnet.Benchmark()
+	wm, err := work.NewSyntheticWorkManager(n, b.TempDir(), 2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var share *wire.Share
+	for i := 0; i < 50; i++ {
+		pkh := make([]byte, 20)
+		binary.BigEndian.PutUint32(pkh, uint32(i+1))
+		share, err = wm.MineShare(pkh)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := *share
+	s.Raw = nil
+	var buf bytes.Buffer
+	err = wire.WriteShares(&buf, []wire.Share{s})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return n, s, buf.Bytes()
+}
+
+func BenchmarkWriteShares(b *testing.B) {
+	_, share, _ := benchShare(b)
+	shares := []wire.Share{share}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := wire.WriteShares(&buf, shares)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadShares(b *testing.B) {
+	n, _, encoded := benchShare(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := wire.ReadShares(bytes.NewReader(encoded), n)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCalcHashes(b *testing.B) {
+	n, share, _ := benchShare(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := share
+		err := s.CalcHashes(n)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !s.IsValid() {
+			b.Fatal("Share is not valid")
+		}
+	}
+}
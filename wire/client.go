@@ -1,21 +1,33 @@
 package wire
 
 import (
-	"fmt"
+	"context"
 	"net"
+	"strconv"
 	"time"
 
 	p2pnet "github.com/gertjaap/p2pool-go/net"
 )
 
 func NewP2PoolClient(ip net.IP, port int, network p2pnet.Network) (*P2PoolConnection, error) {
-	if port == 0 {
-		port = network.P2PPort
-	}
-	d := net.Dialer{Timeout: time.Second * 5}
-	conn, err := d.Dial("tcp", fmt.Sprintf("%s:%d", ip.String(), port))
+	conn, err := DialP2Pool(ip, port, network)
 	if err != nil {
 		return nil, err
 	}
 	return NewP2PoolConnection(conn, network), nil
 }
+
+// DialP2Pool connects to the node at ip and port, or the network's p2pool
+// port if 0
+func DialP2Pool(ip net.IP, port int, network p2pnet.Network) (net.Conn, error) {
+	return DialP2PoolContext(context.Background(), ip, port, network)
+}
+
+// DialP2PoolContext dials like DialP2Pool, giving up once ctx is done
+func DialP2PoolContext(ctx context.Context, ip net.IP, port int, network p2pnet.Network) (net.Conn, error) {
+	if port == 0 {
+		port = network.P2PPort
+	}
+	d := net.Dialer{Timeout: time.Second * 5}
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
@@ -2,16 +2,36 @@ package wire
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/gertjaap/p2pool-go/logging"
 	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rejects"
+	"github.com/gertjaap/p2pool-go/util"
 )
 
+var log = logging.For("wire")
+
+// MaxPayloadLength is the largest message payload we accept, the same limit
+// p2pool has
+const MaxPayloadLength = 8000000
+
+// ErrNonCanonical is wrapped by errors about data that isn't encoded the
+// one way it should be
+var ErrNonCanonical = errors.New("Varint not canonically packed")
+
+// ReadTimeout is how long a peer may stay silent before we disconnect. Peers
+// ping more often than this, it's p2pool's timeout.
+const ReadTimeout = time.Second * 100
+
+// WriteTimeout is how long writing a message may take
+const WriteTimeout = time.Second * 30
+
 type P2PoolMessage interface {
 	Command() string
 	FromBytes(b []byte) error
@@ -19,15 +39,26 @@ type P2PoolMessage interface {
 }
 
 type P2PoolConnection struct {
-	conn         net.Conn
-	network      p2pnet.Network
-	connLock     sync.Mutex
+	conn     net.Conn
+	network  p2pnet.Network
+	connLock sync.Mutex
+	// Incoming is closed once the connection is
 	Incoming     chan P2PoolMessage
 	Outgoing     chan P2PoolMessage
 	Disconnected chan bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	log          *logging.SubsystemLogger
 }
 
 func NewP2PoolConnection(c net.Conn, n p2pnet.Network) *P2PoolConnection {
+	return NewP2PoolConnectionContext(context.Background(), c, n, nil)
+}
+
+// NewP2PoolConnectionContext sets up a connection like NewP2PoolConnection,
+// which is closed once ctx is done and logs to l, or the package's logger if
+// l is nil
+func NewP2PoolConnectionContext(ctx context.Context, c net.Conn, n p2pnet.Network, l *logging.SubsystemLogger) *P2PoolConnection {
 	in := make(chan P2PoolMessage, 10)
 	out := make(chan P2PoolMessage, 10)
 	dis := make(chan bool, 1) // Need a buffer here. Client could be processing a message when disconnect happens
@@ -38,13 +69,34 @@ func NewP2PoolConnection(c net.Conn, n p2pnet.Network) *P2PoolConnection {
 		Incoming:     in,
 		Outgoing:     out,
 		Disconnected: dis,
+		log:          l.Or(log),
 	}
+	p2pc.ctx, p2pc.cancel = context.WithCancel(ctx)
+	context.AfterFunc(p2pc.ctx, func() {
+		c.Close()
+	})
 
 	go p2pc.IncomingLoop()
 	go p2pc.OutgoingLoop()
 	return p2pc
 }
 
+// Done is closed once the connection is
+func (c *P2PoolConnection) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Send queues msg to be sent, returning false if the connection is closed
+// before it could be
+func (c *P2PoolConnection) Send(msg P2PoolMessage) bool {
+	select {
+	case c.Outgoing <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
 func (c *P2PoolConnection) ReadBytes(len int) ([]byte, error) {
 	buf := make([]byte, len)
 	if len == 0 {
@@ -70,6 +122,8 @@ func (c *P2PoolConnection) ReadBytes(len int) ([]byte, error) {
 
 func (c *P2PoolConnection) IncomingLoop() {
 	defer func() {
+		c.Close()
+		close(c.Incoming)
 		select {
 		case c.Disconnected <- true:
 		default:
@@ -77,58 +131,94 @@ func (c *P2PoolConnection) IncomingLoop() {
 	}()
 
 	for {
+		// The whole message has to arrive within the timeout
+		c.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
 		prefix, err := c.ReadBytes(len(c.network.MessagePrefix))
 		if err != nil {
-			logging.Errorf("Error reading from connection: %s", err.Error())
+			c.log.Errorf("Error reading from connection: %s", err.Error())
 			break
 		}
 
 		if !bytes.Equal(prefix, c.network.MessagePrefix) {
-			logging.Errorf("Received transport message with mismatching prefix")
+			rejects.Add(rejects.P2P, "bad-prefix")
+			c.log.Errorf("Received transport message with mismatching prefix")
 			break
 		}
 
 		commandBytes, err := c.ReadBytes(12)
 		if err != nil {
-			logging.Errorf("Error reading from connection: %s", err.Error())
+			c.log.Errorf("Error reading from connection: %s", err.Error())
 			break
 		}
 		command := string(bytes.Trim(commandBytes, "\x00"))
 
-		var length int32
-		err = binary.Read(c.conn, binary.LittleEndian, &length)
+		rawLength, err := readUint32(c.conn)
+		length := int32(rawLength)
 		if err != nil {
-			logging.Errorf("Error reading from connection: %s", err.Error())
+			c.log.Errorf("Error reading from connection: %s", err.Error())
+			break
+		}
+
+		if length < 0 || length > MaxPayloadLength {
+			rejects.Add(rejects.P2P, rejects.Oversized)
+			c.log.Errorf("Received %s message of %d bytes, more than the allowed %d", command, length, MaxPayloadLength)
 			break
 		}
 
 		checksum, err := c.ReadBytes(4)
 		if err != nil {
-			logging.Errorf("Error reading from connection: %s", err.Error())
+			c.log.Errorf("Error reading from connection: %s", err.Error())
 			break
 		}
 
 		payload, err := c.ReadBytes(int(length))
 		if err != nil {
-			logging.Errorf("Error reading from connection: %s", err.Error())
+			c.log.Errorf("Error reading from connection: %s", err.Error())
 			break
 		}
-		calcChecksum := sha256.Sum256(payload)
-		calcChecksum = sha256.Sum256(calcChecksum[:])
+		calcChecksum := util.Sha256dSum(payload)
 		if !bytes.Equal(checksum, calcChecksum[:4]) {
-			logging.Errorf("Wrong checksum - expected [%x] got [%x]", calcChecksum, checksum)
+			rejects.Add(rejects.P2P, "bad-checksum")
+			c.log.Errorf("Wrong checksum - expected [%x] got [%x]", calcChecksum, checksum)
 			break
 		}
 
-		logging.Debugf("Received message of type [%s] length [%d]", command, length)
+		trace := logging.NewTraceID()
+		tlog := c.log.Trace(trace)
+		tlog.Debugf("Received message of type [%s] length [%d]", command, length)
 
 		// TODO: Actually parse it :)
 		msg, err := c.ParseMessage(command, payload)
 		if err != nil {
-			logging.Errorf("Could not parse message: %s", err.Error())
+			if errors.Is(err, ErrNonCanonical) {
+				rejects.Add(rejects.P2P, rejects.NonCanonical)
+			} else {
+				rejects.Add(rejects.P2P, "malformed")
+			}
+			tlog.Errorf("Could not parse message: %s", err.Error())
 			break
 		}
-		c.Incoming <- msg
+		traceShares(msg, trace)
+		select {
+		case c.Incoming <- msg:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// traceShares gives the shares in a message the trace ID of the message,
+// numbered by their position in it
+func traceShares(msg P2PoolMessage, trace string) {
+	var shares []Share
+	switch t := msg.(type) {
+	case *MsgShares:
+		shares = t.Shares
+	case *MsgShareReply:
+		shares = t.Shares
+	}
+	for i := range shares {
+		shares[i].TraceID = fmt.Sprintf("%s.%d", trace, i)
 	}
 }
 
@@ -156,9 +246,9 @@ func (c *P2PoolConnection) ParseMessage(command string, payload []byte) (P2PoolM
 	case "losing_tx":
 		msg = &MsgLosingTx{}
 	case "shares":
-		msg = &MsgShares{}
+		msg = &MsgShares{Network: c.network}
 	case "sharereply":
-		msg = &MsgShareReply{}
+		msg = &MsgShareReply{Network: c.network}
 	case "sharereq":
 		msg = &MsgShareReq{}
 	default:
@@ -169,27 +259,43 @@ func (c *P2PoolConnection) ParseMessage(command string, payload []byte) (P2PoolM
 }
 
 func (c *P2PoolConnection) OutgoingLoop() {
-	for msg := range c.Outgoing {
+	for {
+		var msg P2PoolMessage
+		select {
+		case msg = <-c.Outgoing:
+		case <-c.ctx.Done():
+			return
+		}
 		payload, err := msg.ToBytes()
 		if err != nil {
 			continue
 		}
 
-		calcChecksum := sha256.Sum256(payload)
-		calcChecksum = sha256.Sum256(calcChecksum[:])
-		command := make([]byte, 12)
-		copy(command, []byte(msg.Command()))
+		calcChecksum := util.Sha256dSum(payload)
+		var command [12]byte
+		copy(command[:], msg.Command())
 
-		logging.Debugf("Sending p2pool message [%s] length [%d]", msg.Command(), len(payload))
+		c.log.Debugf("Sending p2pool message [%s] length [%d]", msg.Command(), len(payload))
 
-		c.conn.Write(c.network.MessagePrefix)
-		c.conn.Write(command)
-		binary.Write(c.conn, binary.LittleEndian, int32(len(payload)))
-		c.conn.Write(calcChecksum[:4])
-		c.conn.Write(payload)
+		// One write per message rather than one per field
+		buf := getBuffer()
+		buf.Write(c.network.MessagePrefix)
+		buf.Write(command[:])
+		writeUint32(buf, uint32(len(payload)))
+		buf.Write(calcChecksum[:4])
+		buf.Write(payload)
+		c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		_, err = c.conn.Write(buf.Bytes())
+		putBuffer(buf)
+		if err != nil {
+			c.log.Errorf("Error writing to connection: %s", err.Error())
+			c.Close()
+			return
+		}
 	}
 }
 
 func (c *P2PoolConnection) Close() error {
+	c.cancel()
 	return c.conn.Close()
 }
@@ -0,0 +1,197 @@
+package wire
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+// FuzzCase is a message payload for differential decoding, where the same
+// bytes go to our decoders and to another implementation's
+type FuzzCase struct {
+	Command string `json:"command"`
+	Payload string `json:"payload"`
+}
+
+// Verdict is what an implementation made of a FuzzCase: whether it decoded
+// the payload and, if so, the payload it encodes the result back to. Two
+// implementations agree on the fields when they encode them the same way.
+type Verdict struct {
+	OK      bool   `json:"ok"`
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Decode is our Verdict on a FuzzCase, decoding shares for network n. A
+// decoder that panics rejects the payload, with the panic as error.
+func (fc FuzzCase) Decode(n p2pnet.Network) (v Verdict) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = Verdict{Error: fmt.Sprintf("panic: %v", r)}
+		}
+	}()
+	payload, err := hex.DecodeString(fc.Payload)
+	if err != nil {
+		return Verdict{Error: err.Error()}
+	}
+	msg, err := (&P2PoolConnection{network: n}).ParseMessage(fc.Command, payload)
+	if err != nil {
+		return Verdict{Error: err.Error()}
+	}
+	b, err := msg.ToBytes()
+	if err != nil {
+		return Verdict{Error: fmt.Sprintf("Could not encode decoded message: %s", err.Error())}
+	}
+	return Verdict{OK: true, Payload: hex.EncodeToString(b)}
+}
+
+// Diverges describes how two verdicts on the same case differ, or returns
+// an empty string if they agree
+func (v Verdict) Diverges(other Verdict) string {
+	switch {
+	case v.OK && !other.OK:
+		return fmt.Sprintf("accepted here, rejected there (%s)", other.Error)
+	case !v.OK && other.OK:
+		return fmt.Sprintf("rejected here (%s), accepted there", v.Error)
+	case v.OK && v.Payload != other.Payload:
+		return fmt.Sprintf("decoded differently, re-encoded as %s here and %s there", v.Payload, other.Payload)
+	}
+	return ""
+}
+
+// Fuzzer makes FuzzCases by mutating valid messages of every type
+type Fuzzer struct {
+	rand  *rand.Rand
+	seeds []FuzzCase
+}
+
+// NewFuzzer creates a fuzzer mutating sample messages and shares messages
+// carrying the given shares. The seed makes the cases the same every run.
+func NewFuzzer(seed int64, shares []Share) (*Fuzzer, error) {
+	f := &Fuzzer{rand: rand.New(rand.NewSource(seed))}
+	for _, msg := range sampleMessages(shares) {
+		b, err := msg.ToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode sample %s message: %s", msg.Command(), err.Error())
+		}
+		f.seeds = append(f.seeds, FuzzCase{Command: msg.Command(), Payload: hex.EncodeToString(b)})
+	}
+	return f, nil
+}
+
+// interestingBytes are byte values at the edges of the encodings, like the
+// varint length markers
+var interestingBytes = []byte{0x00, 0x01, 0x7f, 0x80, 0xfc, 0xfd, 0xfe, 0xff}
+
+// Next returns a new case: one of the sample messages, mostly with a few
+// mutations
+func (f *Fuzzer) Next() FuzzCase {
+	fc := f.seeds[f.rand.Intn(len(f.seeds))]
+	b, _ := hex.DecodeString(fc.Payload)
+	if f.rand.Intn(10) > 0 {
+		for n := 1 + f.rand.Intn(3); n > 0; n-- {
+			b = f.mutate(b)
+		}
+	}
+	fc.Payload = hex.EncodeToString(b)
+	return fc
+}
+
+func (f *Fuzzer) mutate(b []byte) []byte {
+	if len(b) == 0 {
+		return f.randomBytes(1 + f.rand.Intn(8))
+	}
+	i := f.rand.Intn(len(b))
+	switch f.rand.Intn(8) {
+	case 0:
+		// Flip a bit
+		b[i] ^= 1 << uint(f.rand.Intn(8))
+	case 1:
+		b[i] = interestingBytes[f.rand.Intn(len(interestingBytes))]
+	case 2:
+		// Insert bytes
+		ins := f.randomBytes(1 + f.rand.Intn(8))
+		b = append(b[:i:i], append(ins, b[i:]...)...)
+	case 3:
+		// Delete bytes
+		end := i + 1 + f.rand.Intn(8)
+		if end > len(b) {
+			end = len(b)
+		}
+		b = append(b[:i:i], b[end:]...)
+	case 4:
+		b = b[:i]
+	case 5:
+		b = append(b, f.randomBytes(1+f.rand.Intn(8))...)
+	case 6:
+		// Splice in part of another sample
+		other, _ := hex.DecodeString(f.seeds[f.rand.Intn(len(f.seeds))].Payload)
+		if len(other) > 0 {
+			j := f.rand.Intn(len(other))
+			end := j + 1 + f.rand.Intn(32)
+			if end > len(other) {
+				end = len(other)
+			}
+			b = append(b[:i:i], append(append([]byte{}, other[j:end]...), b[i:]...)...)
+		}
+	case 7:
+		// A long varint marker followed by junk
+		marker := []byte{0xfd, 0xfe, 0xff}[f.rand.Intn(3)]
+		b = append(b[:i:i], append(append([]byte{marker}, f.randomBytes(8)...), b[i:]...)...)
+	}
+	return b
+}
+
+func (f *Fuzzer) randomBytes(n int) []byte {
+	b := make([]byte, n)
+	f.rand.Read(b)
+	return b
+}
+
+// sampleMessages returns a valid message of every type
+func sampleMessages(shares []Share) []P2PoolMessage {
+	hash := func(i byte) *chainhash.Hash {
+		h := chainhash.Hash{}
+		for j := range h {
+			h[j] = i + byte(j)
+		}
+		return &h
+	}
+	addr := P2PoolAddress{Services: 1, Address: net.IPv4(10, 1, 2, 3), Port: 9346}
+	tx := btcwire.NewMsgTx(1)
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(hash(7), 1), []byte{0x51}, nil))
+	tx.AddTxOut(btcwire.NewTxOut(100000, []byte{0x51}))
+	segwitTx := tx.Copy()
+	segwitTx.TxIn[0].Witness = btcwire.TxWitness{[]byte{1, 2, 3}}
+
+	msgs := []P2PoolMessage{
+		&MsgVersion{Version: 3501, Services: 0, AddrTo: addr, AddrFrom: addr, Nonce: 12345, SubVersion: "p2pool-go", Mode: 1, BestShareHash: hash(1)},
+		&MsgVersion{Version: 3501, AddrTo: addr, AddrFrom: addr, SubVersion: "", Mode: 1, BestShareHash: &chainhash.Hash{}},
+		&MsgPing{},
+		&MsgAddrMe{Port: 9346},
+		&MsgGetAddrs{Count: 8},
+		&MsgAddrs{Addresses: []Addr{{Timestamp: 1700000000, Address: addr}, {Timestamp: 0, Address: P2PoolAddress{Address: net.ParseIP("2001:db8::1"), Port: 1}}}},
+		&MsgHaveTx{TXHashes: []*chainhash.Hash{hash(2), hash(3)}},
+		&MsgLosingTx{TXHashes: []*chainhash.Hash{hash(4)}},
+		&MsgForgetTx{TXHashes: []*chainhash.Hash{hash(5)}},
+		&MsgRememberTx{TXHashes: []*chainhash.Hash{hash(6)}, TXs: []*btcwire.MsgTx{tx, segwitTx}},
+		&MsgBestBlock{BestBlock: btcwire.NewBlockHeader(0x20000000, hash(8), hash(9), 0x1d00ffff, 42)},
+		&MsgShareReq{ID: hash(10), Hashes: []*chainhash.Hash{hash(11)}, Parents: 100, Stops: []*chainhash.Hash{hash(12)}},
+		&MsgShareReq{ID: hash(13), Hashes: []*chainhash.Hash{}, Stops: []*chainhash.Hash{}},
+		&MsgShares{Shares: []Share{}},
+		&MsgShareReply{ID: hash(14), Result: MsgShareReplyResultGood, Shares: []Share{}},
+		&MsgShareReply{ID: hash(15), Result: MsgShareReplyResultTooLong, Shares: []Share{}},
+	}
+	for i := range shares {
+		msgs = append(msgs, &MsgShares{Shares: shares[i : i+1]})
+	}
+	if len(shares) > 1 {
+		msgs = append(msgs, &MsgShareReply{ID: hash(16), Result: MsgShareReplyResultGood, Shares: shares[:2]})
+	}
+	return msgs
+}
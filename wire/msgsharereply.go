@@ -4,6 +4,7 @@ import (
 	"bytes"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
 )
 
 var _ P2PoolMessage = &MsgShareReply{}
@@ -24,6 +25,8 @@ type MsgShareReply struct {
 	ID     *chainhash.Hash
 	Result MsgShareReplyResult
 	Shares []Share
+	// Network is the network the shares are decoded for
+	Network p2pnet.Network
 }
 
 func (m *MsgShareReply) FromBytes(b []byte) error {
@@ -40,7 +43,7 @@ func (m *MsgShareReply) FromBytes(b []byte) error {
 
 	m.Result = MsgShareReplyResult(result)
 
-	m.Shares, err = ReadShares(r)
+	m.Shares, err = ReadShares(r, m.Network)
 	if err != nil {
 		return err
 	}
@@ -61,7 +64,10 @@ func (m *MsgShareReply) ToBytes() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	//err = WriteShares(&buf, m.Shares)
+	err = WriteShares(&buf, m.Shares)
+	if err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
@@ -2,11 +2,9 @@ package wire
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"time"
 
@@ -14,7 +12,6 @@ import (
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	btcwire "github.com/btcsuite/btcd/wire"
-	"github.com/gertjaap/p2pool-go/logging"
 	p2pnet "github.com/gertjaap/p2pool-go/net"
 	"github.com/gertjaap/p2pool-go/util"
 )
@@ -23,6 +20,8 @@ var _ P2PoolMessage = &MsgShares{}
 
 type MsgShares struct {
 	Shares []Share
+	// Network is the network the shares are decoded for
+	Network p2pnet.Network
 }
 
 type Share struct {
@@ -38,6 +37,17 @@ type Share struct {
 	RefHash        *chainhash.Hash
 	Hash           *chainhash.Hash
 	POWHash        *chainhash.Hash
+	// TraceID tags the log records about the share, from the message it
+	// came in with or its submission. It is not sent to peers.
+	TraceID string
+	// Raw holds the encoded contents of a share we received, which are
+	// written as they are instead of encoding the share again. It must be
+	// cleared when changing a received share.
+	Raw []byte
+
+	// lazy is set for shares loaded from a sharechain file with only some
+	// of their contents decoded, see Decoded
+	lazy bool
 }
 
 type HashLink struct {
@@ -96,22 +106,31 @@ const (
 	StaleInfoDOA    = StaleInfo(254)
 )
 
-var DonationScript []byte
-var GenTxBeforeRefHash []byte
+// SegwitShareVersion is the first share version that carries segwit data
+const SegwitShareVersion = 17
 
 type SegwitData struct {
 	TXIDMerkleLink  []*chainhash.Hash
 	WTXIDMerkleRoot *chainhash.Hash
 }
 
-func GetRefHash(n p2pnet.Network, si ShareInfo, refMerkleLink []*chainhash.Hash, segwit bool) (*chainhash.Hash, error) {
+var noneWTXIDMerkleRoot, _ = chainhash.NewHashFromStr("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+
+// IsNone tells whether the segwit data is the value the Python p2pool
+// encodes a missing one with. Segwit shares must have segwit data, the
+// Python p2pool fails to hash shares without it.
+func (sd SegwitData) IsNone() bool {
+	return len(sd.TXIDMerkleLink) == 0 && sd.WTXIDMerkleRoot != nil && sd.WTXIDMerkleRoot.IsEqual(noneWTXIDMerkleRoot)
+}
+
+func GetRefHash(n p2pnet.Network, si ShareInfo, refMerkleLink []*chainhash.Hash, shareType uint64) (*chainhash.Hash, error) {
 	r := Ref{
 		Identifier: string(n.Identifier),
 		ShareInfo:  si,
 	}
 	var buf bytes.Buffer
 
-	err := WriteRef(&buf, r, segwit)
+	err := WriteRef(&buf, r, shareType)
 	if err != nil {
 		return nil, err
 	}
@@ -151,13 +170,15 @@ func CalcHashLink(hl HashLink, data []byte, ending []byte) (*chainhash.Hash, err
 	return chainhash.NewHash(s.Sum(nil))
 }
 
-func ReadShares(r io.Reader) ([]Share, error) {
+// ReadShares decodes a list of shares of network n and calculates their
+// hashes
+func ReadShares(r io.Reader, n p2pnet.Network) ([]Share, error) {
 	shares := make([]Share, 0)
 	count, err := ReadVarInt(r)
 	if err != nil {
 		return shares, err
 	}
-	logging.Debugf("Deserializing %d shares", count)
+	log.Debugf("Deserializing %d shares", count)
 	for i := uint64(0); i < count; i++ {
 		s := Share{}
 		s.Type, err = ReadVarInt(r)
@@ -165,75 +186,109 @@ func ReadShares(r io.Reader) ([]Share, error) {
 			return shares, err
 		}
 
-		// REad length - not needed for us
-		_, err := ReadVarInt(r)
+		length, err := ReadVarInt(r)
 		if err != nil {
 			return shares, err
 		}
-
-		s.MinHeader, err = ReadSmallBlockHeader(r)
-		if err != nil {
-			return shares, err
+		if length > MaxPayloadLength {
+			return shares, fmt.Errorf("Share of %d bytes is too large", length)
 		}
-
-		s.ShareInfo, err = ReadShareInfo(r, s.Type >= 17)
+		s.Raw = make([]byte, length)
+		_, err = io.ReadFull(r, s.Raw)
 		if err != nil {
 			return shares, err
 		}
-
-		s.RefMerkleLink, err = ReadChainHashList(r)
+		err = s.readContents(bytes.NewReader(s.Raw), n)
 		if err != nil {
 			return shares, err
 		}
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
 
-		err = binary.Read(r, binary.LittleEndian, &s.LastTxOutNonce)
-		if err != nil {
-			return shares, err
-		}
+// readContents decodes the share from its encoded contents, which come after
+// its type and length
+func (s *Share) readContents(r io.Reader, n p2pnet.Network) error {
+	err := s.readFields(r)
+	if err != nil {
+		return err
+	}
+	return s.CalcHashes(n)
+}
 
-		s.HashLink, err = ReadHashLink(r)
-		if err != nil {
-			return shares, err
-		}
+func (s *Share) readFields(r io.Reader) error {
+	var err error
+	s.MinHeader, err = ReadSmallBlockHeader(r)
+	if err != nil {
+		return err
+	}
 
-		s.MerkleLink, err = ReadChainHashList(r)
-		if err != nil {
-			return shares, err
-		}
+	s.ShareInfo, err = ReadShareInfo(r, s.Type)
+	if err != nil {
+		return err
+	}
 
-		s.RefHash, _ = GetRefHash(p2pnet.ActiveNetwork, s.ShareInfo, s.RefMerkleLink, s.Type >= 17)
+	s.RefMerkleLink, err = ReadChainHashList(r)
+	if err != nil {
+		return err
+	}
 
-		var buf bytes.Buffer
-		buf.Write(s.RefHash.CloneBytes())
-		binary.Write(&buf, binary.LittleEndian, s.LastTxOutNonce)
-		binary.Write(&buf, binary.LittleEndian, int32(0))
-		s.GenTXHash, err = CalcHashLink(s.HashLink, buf.Bytes(), GenTxBeforeRefHash)
-		if err != nil {
-			return shares, err
-		}
+	s.LastTxOutNonce, err = readUint64(r)
+	if err != nil {
+		return err
+	}
 
-		merkleLink := s.MerkleLink
-		if s.Type >= 17 {
-			merkleLink = s.ShareInfo.SegwitData.TXIDMerkleLink
-		}
-		s.MerkleRoot, err = CalcMerkleLink(s.GenTXHash, merkleLink, 0)
-		if err != nil {
-			return shares, err
-		}
+	s.HashLink, err = ReadHashLink(r)
+	if err != nil {
+		return err
+	}
 
-		buf.Reset()
+	s.MerkleLink, err = ReadChainHashList(r)
+	return err
+}
 
-		hdr := btcwire.NewBlockHeader(s.MinHeader.Version, s.MinHeader.PreviousBlock, s.MerkleRoot, s.MinHeader.Bits, s.MinHeader.Nonce)
-		hdr.Timestamp = time.Unix(int64(s.MinHeader.Timestamp), 0)
-		hdr.Serialize(&buf)
-		headerBytes := buf.Bytes()
+// readSummary decodes what linking shares and computing payouts needs: the
+// header and the share info, without the segwit data and transaction hashes
+func (s *Share) readSummary(r io.Reader) error {
+	var err error
+	s.MinHeader, err = ReadSmallBlockHeader(r)
+	if err != nil {
+		return err
+	}
+	s.ShareInfo, err = readShareInfo(r, s.Type, true)
+	return err
+}
 
-		s.POWHash, _ = chainhash.NewHash(p2pnet.ActiveNetwork.POWHash(headerBytes[:]))
-		s.Hash, _ = chainhash.NewHash(util.Sha256d(headerBytes[:]))
+// Lazy returns whether the share was loaded with parts of it left encoded:
+// the segwit data, transaction hashes, merkle links and hash link. Use
+// Decoded to get them.
+func (s *Share) Lazy() bool {
+	return s.lazy
+}
 
-		shares = append(shares, s)
+// Decoded returns the share with all its contents decoded, s itself unless
+// it's lazy. The hashes are checked against the ones the share was stored
+// with, except the proof of work hash, which is expensive and was checked
+// before storing. n is the network the share was loaded for.
+func (s *Share) Decoded(n p2pnet.Network) (*Share, error) {
+	if !s.lazy {
+		return s, nil
 	}
-	return shares, nil
+	full := &Share{Type: s.Type, TraceID: s.TraceID, Raw: s.Raw}
+	err := full.readFields(bytes.NewReader(s.Raw))
+	if err != nil {
+		return nil, err
+	}
+	err = full.calcHashes(n, false)
+	if err != nil {
+		return nil, err
+	}
+	if !full.Hash.IsEqual(s.Hash) {
+		return nil, fmt.Errorf("Share %s does not match its contents", s.Hash.String())
+	}
+	full.POWHash = s.POWHash
+	return full, nil
 }
 
 func (s Share) IsValid() bool {
@@ -245,94 +300,169 @@ func (s Share) IsValid() bool {
 	return true
 }
 
-func WriteShares(w io.Writer, shares []Share) error {
-	err := WriteVarInt(w, uint64(len(shares)))
+// CalcHashes derives the ref hash, generation transaction hash, merkle root,
+// share hash and proof of work hash from the share's contents, as a share
+// of network n
+func (s *Share) CalcHashes(n p2pnet.Network) error {
+	return s.calcHashes(n, true)
+}
+
+// calcHashes derives the hashes, the proof of work hash only if pow is set.
+// It is by far the most expensive.
+func (s *Share) calcHashes(n p2pnet.Network, pow bool) error {
+	var err error
+	s.RefHash, err = GetRefHash(n, s.ShareInfo, s.RefMerkleLink, s.Type)
 	if err != nil {
 		return err
 	}
-	for _, s := range shares {
-		err = WriteVarInt(w, uint64(s.Type))
-		if err != nil {
-			return err
-		}
 
-		var buf bytes.Buffer
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Write(s.RefHash[:])
+	writeUint64(buf, s.LastTxOutNonce)
+	writeUint32(buf, 0)
+	s.GenTXHash, err = CalcHashLink(s.HashLink, buf.Bytes(), genTxBeforeRefHash(n))
+	if err != nil {
+		return err
+	}
 
-		err = WriteSmallBlockHeader(&buf, s.MinHeader)
-		if err != nil {
-			return err
+	merkleLink := s.MerkleLink
+	if s.Type >= SegwitShareVersion {
+		if s.ShareInfo.SegwitData.IsNone() {
+			return fmt.Errorf("Share of version %d has no segwit data", s.Type)
 		}
+		merkleLink = s.ShareInfo.SegwitData.TXIDMerkleLink
+	}
+	s.MerkleRoot, err = CalcMerkleLink(s.GenTXHash, merkleLink, 0)
+	if err != nil {
+		return err
+	}
 
-		err = WriteShareInfo(&buf, s.ShareInfo, s.Type >= 17)
-		if err != nil {
-			return err
-		}
+	buf.Reset()
 
-		err = WriteChainHashList(&buf, s.RefMerkleLink)
-		if err != nil {
-			return err
-		}
+	hdr := s.Header()
+	hdr.Serialize(buf)
+	headerBytes := buf.Bytes()
 
-		err = binary.Write(&buf, binary.LittleEndian, s.LastTxOutNonce)
-		if err != nil {
-			return err
-		}
-		err = WriteHashLink(&buf, s.HashLink)
+	if pow {
+		s.POWHash, err = chainhash.NewHash(powHash(n, headerBytes))
 		if err != nil {
-			return err
-		}
-		err = WriteChainHashList(&buf, s.MerkleLink)
-		if err != nil {
-			return err
+			return fmt.Errorf("Could not hash the proof of work: %s", err.Error())
 		}
+	}
+	hash := chainhash.Hash(util.Sha256dSum(headerBytes))
+	s.Hash = &hash
+	return nil
+}
 
-		b := buf.Bytes()
+// powHash hashes a share's header, waiting for one of the network's share
+// hash slots if it has them
+func powHash(n p2pnet.Network, header []byte) []byte {
+	if slots := n.ShareHashSlots; slots != nil {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+	}
+	return n.POWHash(header)
+}
 
-		err = WriteVarInt(w, uint64(len(b)))
+// Header returns the full block header this share commits to
+func (s Share) Header() btcwire.BlockHeader {
+	hdr := btcwire.NewBlockHeader(s.MinHeader.Version, s.MinHeader.PreviousBlock, s.MerkleRoot, s.MinHeader.Bits, s.MinHeader.Nonce)
+	hdr.Timestamp = time.Unix(int64(s.MinHeader.Timestamp), 0)
+	return *hdr
+}
+
+// IsBlock returns true if the share's proof of work also satisfies the target
+// of the block header, meaning it solved a block on the coin network
+func (s Share) IsBlock() bool {
+	target := blockchain.CompactToBig(s.MinHeader.Bits)
+	bnHash := blockchain.HashToBig(s.POWHash)
+	return bnHash.Cmp(target) <= 0
+}
+
+func WriteShares(w io.Writer, shares []Share) error {
+	err := WriteVarInt(w, uint64(len(shares)))
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		err = WriteVarInt(w, uint64(s.Type))
 		if err != nil {
 			return err
 		}
 
-		i, err := w.Write(b)
+		if len(s.Raw) > 0 {
+			// Received shares go out exactly as they came in
+			err = WriteVarInt(w, uint64(len(s.Raw)))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(s.Raw)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		buf := getBuffer()
+		err = writeShareContents(buf, &s)
+		if err == nil {
+			err = WriteVarInt(w, uint64(buf.Len()))
+		}
+		if err == nil {
+			_, err = w.Write(buf.Bytes())
+		}
+		putBuffer(buf)
 		if err != nil {
 			return err
 		}
-		if i != len(b) {
-			return fmt.Errorf("Could not write share data: %d vs %d", i, len(b))
-		}
 	}
 	return nil
 }
 
+// writeShareContents encodes what follows the type and length of a share
+func writeShareContents(buf *bytes.Buffer, s *Share) error {
+	err := WriteSmallBlockHeader(buf, s.MinHeader)
+	if err != nil {
+		return err
+	}
+	err = WriteShareInfo(buf, s.ShareInfo, s.Type)
+	if err != nil {
+		return err
+	}
+	err = WriteChainHashList(buf, s.RefMerkleLink)
+	if err != nil {
+		return err
+	}
+	err = writeUint64(buf, s.LastTxOutNonce)
+	if err != nil {
+		return err
+	}
+	err = WriteHashLink(buf, s.HashLink)
+	if err != nil {
+		return err
+	}
+	return WriteChainHashList(buf, s.MerkleLink)
+}
+
 func (m *MsgShares) FromBytes(b []byte) error {
 	var err error
 
 	r := bytes.NewReader(b)
-	m.Shares, err = ReadShares(r)
+	m.Shares, err = ReadShares(r, m.Network)
 	if err != nil {
 		return err
 	}
-	log.Printf("Deserialized %d shares", len(m.Shares))
+	log.Debugf("Deserialized %d shares", len(m.Shares))
 	return nil
 }
 
 func (m *MsgShares) ToBytes() ([]byte, error) {
 	var buf bytes.Buffer
-
-	err := WriteVarInt(&buf, uint64(len(m.Shares)))
+	err := WriteShares(&buf, m.Shares)
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range m.Shares {
-		err = WriteVarInt(&buf, s.Type)
-		if err != nil {
-			return nil, err
-		}
-		err = WriteSmallBlockHeader(&buf, s.MinHeader)
-		if err != nil {
-			return nil, err
-		}
-	}
 	return buf.Bytes(), nil
 }
 
@@ -340,11 +470,25 @@ func (m *MsgShares) Command() string {
 	return "shares"
 }
 
-func init() {
-	DonationScript, _ = hex.DecodeString("410418a74130b2f4fad899d8ed2bff272bc43a03c8ca72897ae3da584d7a770b5a9ea8dd1b37a620d27c6cf6d5a7a9bbd6872f5981e95816d701d94f201c5d093be6ac")
-	GenTxBeforeRefHash = make([]byte, len(DonationScript)+12)
-	copy(GenTxBeforeRefHash, []byte{byte(len(DonationScript))})
-	copy(GenTxBeforeRefHash[1:], DonationScript)
-	copy(GenTxBeforeRefHash[len(DonationScript)+9:], []byte{42, 0x6A, 0x28})
+// DefaultDonationScript is the p2pool developers' donation script, used by
+// networks that don't define their own
+var DefaultDonationScript, _ = hex.DecodeString("410418a74130b2f4fad899d8ed2bff272bc43a03c8ca72897ae3da584d7a770b5a9ea8dd1b37a620d27c6cf6d5a7a9bbd6872f5981e95816d701d94f201c5d093be6ac")
+
+// DonationScript returns the donation output script of network n
+func DonationScript(n p2pnet.Network) []byte {
+	if len(n.DonationScript) > 0 {
+		return n.DonationScript
+	}
+	return DefaultDonationScript
+}
 
+// genTxBeforeRefHash returns the gentx bytes before the ref hash, which end
+// with the donation output of network n
+func genTxBeforeRefHash(n p2pnet.Network) []byte {
+	script := DonationScript(n)
+	b := make([]byte, len(script)+12)
+	b[0] = byte(len(script))
+	copy(b[1:], script)
+	copy(b[len(script)+9:], []byte{42, 0x6A, 0x28})
+	return b
 }
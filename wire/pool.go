@@ -0,0 +1,104 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Buffers and scratch space reused across messages and shares. binary.Read
+// and binary.Write allocate for every field, which adds up to a lot of
+// garbage while syncing a sharechain, so the fixed size fields go through
+// pooled scratch arrays instead.
+
+var (
+	bufferPool  = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	scratchPool = sync.Pool{New: func() interface{} { return new([8]byte) }}
+)
+
+// maxPooledBuffer is the largest buffer that is put back in the pool, so one
+// huge message doesn't stay around forever
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+func readFixed(r io.Reader, n int) (*[8]byte, error) {
+	b := scratchPool.Get().(*[8]byte)
+	_, err := io.ReadFull(r, b[:n])
+	return b, err
+}
+
+func readUint8(r io.Reader) (uint8, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	b, err := readFixed(r, 1)
+	v := b[0]
+	scratchPool.Put(b)
+	return v, err
+}
+
+func readUint16(r io.Reader) (uint16, error) {
+	b, err := readFixed(r, 2)
+	v := binary.LittleEndian.Uint16(b[:])
+	scratchPool.Put(b)
+	return v, err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	b, err := readFixed(r, 4)
+	v := binary.LittleEndian.Uint32(b[:])
+	scratchPool.Put(b)
+	return v, err
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	b, err := readFixed(r, 8)
+	v := binary.LittleEndian.Uint64(b[:])
+	scratchPool.Put(b)
+	return v, err
+}
+
+func writeFixed(w io.Writer, b *[8]byte, n int) error {
+	_, err := w.Write(b[:n])
+	scratchPool.Put(b)
+	return err
+}
+
+func writeUint8(w io.Writer, v uint8) error {
+	if bw, ok := w.(io.ByteWriter); ok {
+		return bw.WriteByte(v)
+	}
+	b := scratchPool.Get().(*[8]byte)
+	b[0] = v
+	return writeFixed(w, b, 1)
+}
+
+func writeUint16(w io.Writer, v uint16) error {
+	b := scratchPool.Get().(*[8]byte)
+	binary.LittleEndian.PutUint16(b[:], v)
+	return writeFixed(w, b, 2)
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	b := scratchPool.Get().(*[8]byte)
+	binary.LittleEndian.PutUint32(b[:], v)
+	return writeFixed(w, b, 4)
+}
+
+func writeUint64(w io.Writer, v uint64) error {
+	b := scratchPool.Get().(*[8]byte)
+	binary.LittleEndian.PutUint64(b[:], v)
+	return writeFixed(w, b, 8)
+}
@@ -0,0 +1,239 @@
+package wire_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// quickConfig is how many random values each property is tried on
+var quickConfig = &quick.Config{MaxCount: 10000}
+
+func TestVarIntRoundTrip(t *testing.T) {
+	err := quick.Check(func(v Uint64) bool {
+		var buf bytes.Buffer
+		if wire.WriteVarInt(&buf, uint64(v)) != nil {
+			return false
+		}
+		got, err := wire.ReadVarInt(&buf)
+		return err == nil && got == uint64(v) && buf.Len() == 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestVarIntCanonical checks the shortest encoding is written and longer
+// ones are rejected
+func TestVarIntCanonical(t *testing.T) {
+	err := quick.Check(func(v Uint64) bool {
+		var buf bytes.Buffer
+		wire.WriteVarInt(&buf, uint64(v))
+		if buf.Len() != varIntSize(uint64(v)) {
+			return false
+		}
+		for _, long := range []struct {
+			prefix byte
+			size   int
+		}{{0xfd, 2}, {0xfe, 4}, {0xff, 8}} {
+			if 1+long.size <= buf.Len() {
+				continue
+			}
+			b := []byte{long.prefix}
+			for i := 0; i < long.size; i++ {
+				b = append(b, byte(uint64(v)>>(8*uint(i))))
+			}
+			_, err := wire.ReadVarInt(bytes.NewReader(b))
+			if !errors.Is(err, wire.ErrNonCanonical) {
+				return false
+			}
+		}
+		return true
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestVarIntOrder checks larger values never encode shorter
+func TestVarIntOrder(t *testing.T) {
+	err := quick.Check(func(a, b Uint64) bool {
+		if a > b {
+			a, b = b, a
+		}
+		return varIntLen(uint64(a)) <= varIntLen(uint64(b))
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVarStringRoundTrip(t *testing.T) {
+	err := quick.Check(func(s string) bool {
+		var buf bytes.Buffer
+		if wire.WriteVarString(&buf, s) != nil {
+			return false
+		}
+		got, err := wire.ReadVarString(&buf)
+		return err == nil && got == s && buf.Len() == 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBigInt256RoundTrip(t *testing.T) {
+	err := quick.Check(func(v Uint256) bool {
+		var buf bytes.Buffer
+		if wire.WriteBigInt256(&buf, v.Int) != nil || buf.Len() != 32 {
+			return false
+		}
+		got, err := wire.ReadBigInt256(&buf)
+		return err == nil && got.Cmp(v.Int) == 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUint128RoundTrip(t *testing.T) {
+	err := quick.Check(func(v Uint128) bool {
+		var buf bytes.Buffer
+		if wire.WriteUint128(&buf, v.Int) != nil || buf.Len() != 16 {
+			return false
+		}
+		got, err := wire.ReadUint128(&buf)
+		return err == nil && got.Cmp(v.Int) == 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestUint128Bytes checks the encoding of 128 bit numbers, like the
+// abswork of shares, against known bytes: little endian, like the Python
+// p2pool's IntType(128)
+func TestUint128Bytes(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		bytes string
+	}{
+		{"0", "00000000000000000000000000000000"},
+		{"1", "01000000000000000000000000000000"},
+		{"256", "00010000000000000000000000000000"},
+		{"0x0102030405060708090a0b0c0d0e0f10", "100f0e0d0c0b0a090807060504030201"},
+		{"0xffffffffffffffffffffffffffffffff", "ffffffffffffffffffffffffffffffff"},
+	} {
+		v, _ := big.NewInt(0).SetString(c.value, 0)
+		var buf bytes.Buffer
+		err := wire.WriteUint128(&buf, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(buf.Bytes()) != c.bytes {
+			t.Errorf("%s encoded as %x, expected %s", c.value, buf.Bytes(), c.bytes)
+		}
+		b, _ := hex.DecodeString(c.bytes)
+		got, err := wire.ReadUint128(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Cmp(v) != 0 {
+			t.Errorf("%s decoded as %s, expected %s", c.bytes, got.String(), c.value)
+		}
+	}
+}
+
+// TestUint128Overflow checks values over 128 bits are refused rather than
+// cut short
+func TestUint128Overflow(t *testing.T) {
+	err := quick.Check(func(v Uint256) bool {
+		err := wire.WriteUint128(&bytes.Buffer{}, v.Int)
+		return (err == nil) == (v.BitLen() <= 128)
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// varIntSize is the length of the canonical encoding of v
+func varIntSize(v uint64) int {
+	switch {
+	case v < 0xfd:
+		return 1
+	case v <= math.MaxUint16:
+		return 3
+	case v <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
+
+func varIntLen(v uint64) int {
+	var buf bytes.Buffer
+	wire.WriteVarInt(&buf, v)
+	return buf.Len()
+}
+
+// Uint64 is a uint64 that is often at or next to the size limits of the
+// varint encodings, which uniform values almost never are
+type Uint64 uint64
+
+var uint64Edges = []uint64{0, 1, 0xfc, 0xfd, 0xfe, 0xff, 0x100, math.MaxUint16, math.MaxUint16 + 1, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64 - 1, math.MaxUint64}
+
+func (Uint64) Generate(r *rand.Rand, size int) reflect.Value {
+	if r.Intn(4) == 0 {
+		return reflect.ValueOf(Uint64(uint64Edges[r.Intn(len(uint64Edges))]))
+	}
+	// Uniform over bit lengths, so every encoding size comes up
+	bits := uint(r.Intn(65))
+	v := r.Uint64()
+	if bits < 64 {
+		v &= 1<<bits - 1
+	}
+	return reflect.ValueOf(Uint64(v))
+}
+
+// Uint256 is a number below 2^256, of any bit length, often all zeros or
+// all ones
+type Uint256 struct{ *big.Int }
+
+func (Uint256) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(Uint256{randomBits(r, 256)})
+}
+
+// Uint128 is a number below 2^128, like Uint256
+type Uint128 struct{ *big.Int }
+
+func (Uint128) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(Uint128{randomBits(r, 128)})
+}
+
+func randomBits(r *rand.Rand, max int) *big.Int {
+	bits := r.Intn(max + 1)
+	v := big.NewInt(0)
+	switch r.Intn(8) {
+	case 0:
+		// 2^bits - 1, all ones
+		v.Lsh(big.NewInt(1), uint(bits))
+		return v.Sub(v, big.NewInt(1))
+	case 1:
+		// A power of two
+		if bits == max {
+			bits--
+		}
+		return v.Lsh(big.NewInt(1), uint(bits))
+	}
+	b := make([]byte, (bits+7)/8)
+	r.Read(b)
+	v.SetBytes(b)
+	return v.Rsh(v, uint(len(b)*8-bits))
+}
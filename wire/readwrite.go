@@ -5,7 +5,6 @@
 package wire
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
@@ -22,6 +21,9 @@ func ReadVarString(r io.Reader) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if len > MaxPayloadLength {
+		return "", fmt.Errorf("String of %d bytes is too long", len)
+	}
 
 	b := make([]byte, len)
 	rl, err := r.Read(b)
@@ -32,8 +34,7 @@ func ReadVarString(r io.Reader) (string, error) {
 }
 
 func ReadVarInt(r io.Reader) (uint64, error) {
-	var discriminant uint8
-	err := binary.Read(r, binary.LittleEndian, &discriminant)
+	discriminant, err := readUint8(r)
 	if err != nil {
 		return 0, err
 	}
@@ -41,7 +42,7 @@ func ReadVarInt(r io.Reader) (uint64, error) {
 	var rv uint64
 	switch discriminant {
 	case 0xff:
-		err = binary.Read(r, binary.LittleEndian, &rv)
+		rv, err = readUint64(r)
 		if err != nil {
 			return 0, err
 		}
@@ -50,11 +51,10 @@ func ReadVarInt(r io.Reader) (uint64, error) {
 		// encoded using fewer bytes.
 		min := uint64(0x100000000)
 		if rv < min {
-			return 0, fmt.Errorf("Varint not canonically packed -- uint64")
+			return 0, fmt.Errorf("%w -- uint64", ErrNonCanonical)
 		}
 	case 0xfe:
-		var sv uint32
-		binary.Read(r, binary.LittleEndian, &sv)
+		sv, err := readUint32(r)
 		if err != nil {
 			return 0, err
 		}
@@ -64,11 +64,10 @@ func ReadVarInt(r io.Reader) (uint64, error) {
 		// encoded using fewer bytes.
 		min := uint64(0x10000)
 		if rv < min {
-			return 0, fmt.Errorf("Varint not canonically packed -- uint32")
+			return 0, fmt.Errorf("%w -- uint32", ErrNonCanonical)
 		}
 	case 0xfd:
-		var sv uint16
-		binary.Read(r, binary.LittleEndian, &sv)
+		sv, err := readUint16(r)
 		if err != nil {
 			return 0, err
 		}
@@ -78,7 +77,7 @@ func ReadVarInt(r io.Reader) (uint64, error) {
 		// encoded using fewer bytes.
 		min := uint64(0xfd)
 		if rv < min {
-			return 0, fmt.Errorf("Varint not canonically packed -- uint16")
+			return 0, fmt.Errorf("%w -- uint16", ErrNonCanonical)
 		}
 	default:
 		rv = uint64(discriminant)
@@ -123,33 +122,36 @@ func WriteVarString(w io.Writer, val string) error {
 
 func WriteVarInt(w io.Writer, val uint64) error {
 	if val < 0xfd {
-		return binary.Write(w, binary.LittleEndian, uint8(val))
+		return writeUint8(w, uint8(val))
 	}
 
 	if val <= math.MaxUint16 {
-		err := binary.Write(w, binary.LittleEndian, uint8(0xfd))
+		err := writeUint8(w, 0xfd)
 		if err != nil {
 			return err
 		}
-		return binary.Write(w, binary.LittleEndian, uint16(val))
+		return writeUint16(w, uint16(val))
 	}
 
 	if val <= math.MaxUint32 {
-		err := binary.Write(w, binary.LittleEndian, uint8(0xfe))
+		err := writeUint8(w, 0xfe)
 		if err != nil {
 			return err
 		}
-		return binary.Write(w, binary.LittleEndian, uint32(val))
+		return writeUint32(w, uint32(val))
 	}
 
-	err := binary.Write(w, binary.LittleEndian, uint8(0xff))
+	err := writeUint8(w, 0xff)
 	if err != nil {
 		return err
 	}
-	return binary.Write(w, binary.LittleEndian, val)
+	return writeUint64(w, val)
 }
 
 func WriteBigInt256(w io.Writer, i *big.Int) error {
+	if i.Sign() < 0 || i.BitLen() > 256 {
+		return fmt.Errorf("%s doesn't fit in 256 bits", i.String())
+	}
 	b := make([]byte, 32)
 	numBytes := i.Bytes()
 	b = append(b, numBytes...)
@@ -169,17 +171,53 @@ func ReadBigInt256(r io.Reader) (*big.Int, error) {
 	if err != nil {
 		return nil, err
 	}
-	for b[0] == 0x00 {
-		b = b[1:]
-	}
 	return big.NewInt(0).SetBytes(b), nil
 }
 
+var maxUint128 = big.NewInt(0).Sub(big.NewInt(0).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// WriteUint128 writes a 128 bit little endian number, like the abswork of
+// shares
+func WriteUint128(w io.Writer, i *big.Int) error {
+	if i.Sign() < 0 || i.Cmp(maxUint128) > 0 {
+		return fmt.Errorf("%s doesn't fit in 128 bits", i.String())
+	}
+	b := make([]byte, 16)
+	i.FillBytes(b)
+	reverse(b)
+	n, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	if n < 16 {
+		return fmt.Errorf("Could not write 16 bytes, wrote %d in stead", n)
+	}
+	return nil
+}
+
+func ReadUint128(r io.Reader) (*big.Int, error) {
+	var b [16]byte
+	n, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return nil, fmt.Errorf("Could not read 16 bytes, read %d in stead", n)
+	}
+	reverse(b[:])
+	return big.NewInt(0).SetBytes(b[:]), nil
+}
+
+// reverse reverses b in place, between the little endian byte order of the
+// protocol and the big endian one of big.Int
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
 func WriteChainHash(w io.Writer, i *chainhash.Hash) error {
 	if i == nil {
 		i = nullHash
 	}
-	l, err := w.Write(i.CloneBytes())
+	l, err := w.Write(i[:])
 	if l != 32 {
 		return fmt.Errorf("Couldn't write 32 bytes for chainhash")
 	}
@@ -187,15 +225,12 @@ func WriteChainHash(w io.Writer, i *chainhash.Hash) error {
 }
 
 func ReadChainHash(r io.Reader) (*chainhash.Hash, error) {
-	b := make([]byte, 32)
-	i, err := r.Read(b)
-	if i != 32 {
-		return nil, fmt.Errorf("Couldn't read 32 bytes for chainhash")
-	}
+	h := new(chainhash.Hash)
+	_, err := io.ReadFull(r, h[:])
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Couldn't read 32 bytes for chainhash")
 	}
-	return chainhash.NewHash(b)
+	return h, nil
 }
 
 func init() {
@@ -213,15 +248,15 @@ func ReadSmallBlockHeader(r io.Reader) (SmallBlockHeader, error) {
 	if err != nil {
 		return sbh, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &sbh.Timestamp)
+	sbh.Timestamp, err = readUint32(r)
 	if err != nil {
 		return sbh, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &sbh.Bits)
+	sbh.Bits, err = readUint32(r)
 	if err != nil {
 		return sbh, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &sbh.Nonce)
+	sbh.Nonce, err = readUint32(r)
 	if err != nil {
 		return sbh, err
 	}
@@ -237,15 +272,15 @@ func WriteSmallBlockHeader(w io.Writer, sbh SmallBlockHeader) error {
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, &sbh.Timestamp)
+	err = writeUint32(w, sbh.Timestamp)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, &sbh.Bits)
+	err = writeUint32(w, sbh.Bits)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, &sbh.Nonce)
+	err = writeUint32(w, sbh.Nonce)
 	if err != nil {
 		return err
 	}
@@ -265,12 +300,14 @@ func WriteChainHashList(w io.Writer, list []*chainhash.Hash) error {
 }
 
 func ReadChainHashList(r io.Reader) ([]*chainhash.Hash, error) {
-	list := make([]*chainhash.Hash, 0)
 	count, err := ReadVarInt(r)
 	if err != nil {
-		return list, err
+		return []*chainhash.Hash{}, err
 	}
 
+	// Each hash takes 32 bytes, a bogus count fails on reading them before
+	// growing the list much
+	list := make([]*chainhash.Hash, 0, minCount(count, 64))
 	for i := uint64(0); i < count; i++ {
 		h, err := ReadChainHash(r)
 		if err != nil {
@@ -299,7 +336,7 @@ func ReadSegwitData(r io.Reader) (SegwitData, error) {
 	return sd, nil
 }
 
-func ReadShareData(r io.Reader) (ShareData, error) {
+func ReadShareData(r io.Reader, shareType uint64) (ShareData, error) {
 	var err error
 	sd := ShareData{}
 
@@ -313,36 +350,31 @@ func ReadShareData(r io.Reader) (ShareData, error) {
 		return sd, err
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &sd.Nonce)
+	sd.Nonce, err = readUint32(r)
 	if err != nil {
 		return sd, err
 	}
 
 	sd.PubKeyHash = make([]byte, 20)
-	i, err := r.Read(sd.PubKeyHash)
+	i, err := io.ReadFull(r, sd.PubKeyHash)
 	if err != nil {
-		return sd, err
-	}
-
-	if i < 20 {
 		return sd, fmt.Errorf("Could not read pubkeyhash. Expected 20, got %d", i)
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &sd.PubKeyHashVersion)
+	sd.PubKeyHashVersion, err = readUint8(r)
 	if err != nil {
 		return sd, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &sd.Subsidy)
+	sd.Subsidy, err = readUint64(r)
 	if err != nil {
 		return sd, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &sd.Donation)
+	sd.Donation, err = readUint16(r)
 	if err != nil {
 		return sd, err
 	}
 
-	var staleInfo int8
-	err = binary.Read(r, binary.LittleEndian, &staleInfo)
+	staleInfo, err := readUint8(r)
 	if err != nil {
 		return sd, err
 	}
@@ -433,7 +465,7 @@ func WriteFixedString(w io.Writer, len int, s string) error {
 	return nil
 }
 
-func ReadRef(r io.Reader, segwit bool) (Ref, error) {
+func ReadRef(r io.Reader, shareType uint64) (Ref, error) {
 	ref := Ref{}
 
 	var err error
@@ -441,43 +473,56 @@ func ReadRef(r io.Reader, segwit bool) (Ref, error) {
 	if err != nil {
 		return ref, err
 	}
-	ref.ShareInfo, err = ReadShareInfo(r, segwit)
+	ref.ShareInfo, err = ReadShareInfo(r, shareType)
 	return ref, err
 }
 
-func WriteRef(w io.Writer, ref Ref, segwit bool) error {
+func WriteRef(w io.Writer, ref Ref, shareType uint64) error {
 	var err error
 	err = WriteFixedString(w, 8, ref.Identifier)
 	if err != nil {
 		return err
 	}
-	return WriteShareInfo(w, ref.ShareInfo, segwit)
+	return WriteShareInfo(w, ref.ShareInfo, shareType)
 }
 
-func ReadShareInfo(r io.Reader, segwit bool) (ShareInfo, error) {
+func ReadShareInfo(r io.Reader, shareType uint64) (ShareInfo, error) {
+	return readShareInfo(r, shareType, false)
+}
+
+// readShareInfo reads share info, skipping over the segwit data and the
+// transaction hashes if summary is set
+func readShareInfo(r io.Reader, shareType uint64, summary bool) (ShareInfo, error) {
 	var err error
 
 	si := ShareInfo{}
-	si.ShareData, err = ReadShareData(r)
+	si.ShareData, err = ReadShareData(r, shareType)
 	if err != nil {
 		return si, err
 	}
 
-	if segwit {
-		si.SegwitData, err = ReadSegwitData(r)
+	if summary {
+		err = skipShareInfoLists(r, shareType)
 		if err != nil {
 			return si, err
 		}
-	}
+	} else {
+		if shareType >= SegwitShareVersion {
+			si.SegwitData, err = ReadSegwitData(r)
+			if err != nil {
+				return si, err
+			}
+		}
 
-	si.NewTransactionHashes, err = ReadChainHashList(r)
-	if err != nil {
-		return si, err
-	}
+		si.NewTransactionHashes, err = ReadChainHashList(r)
+		if err != nil {
+			return si, err
+		}
 
-	si.TransactionHashRefs, err = ReadTransactionHashRefList(r)
-	if err != nil {
-		return si, err
+		si.TransactionHashRefs, err = ReadTransactionHashRefList(r)
+		if err != nil {
+			return si, err
+		}
 	}
 
 	si.FarShareHash, err = ReadChainHash(r)
@@ -485,44 +530,81 @@ func ReadShareInfo(r io.Reader, segwit bool) (ShareInfo, error) {
 		return si, err
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &si.MaxBits)
-	if err != nil {
-		return si, err
+	for _, field := range []*int32{&si.MaxBits, &si.Bits, &si.Timestamp, &si.AbsHeight} {
+		v, err := readUint32(r)
+		if err != nil {
+			return si, err
+		}
+		*field = int32(v)
 	}
-	err = binary.Read(r, binary.LittleEndian, &si.Bits)
+	si.AbsWork, err = ReadUint128(r)
 	if err != nil {
-		return si, err
+		return si, fmt.Errorf("Could not read abswork: %s", err.Error())
 	}
-	err = binary.Read(r, binary.LittleEndian, &si.Timestamp)
+
+	return si, nil
+}
+
+// skipShareInfoLists reads past the segwit data, new transaction hashes and
+// transaction hash refs of share info
+func skipShareInfoLists(r io.Reader, shareType uint64) error {
+	if shareType >= SegwitShareVersion {
+		// The txid merkle link and the wtxid merkle root
+		err := skipHashList(r)
+		if err != nil {
+			return err
+		}
+		err = skip(r, chainhash.HashSize)
+		if err != nil {
+			return err
+		}
+	}
+	err := skipHashList(r)
 	if err != nil {
-		return si, err
+		return err
 	}
-	err = binary.Read(r, binary.LittleEndian, &si.AbsHeight)
+	count, err := ReadVarInt(r)
 	if err != nil {
-		return si, err
+		return err
 	}
-	absWork := make([]byte, 16) // 128 bit
-	i, err := r.Read(absWork)
+	for i := uint64(0); i < count*2; i++ {
+		_, err = ReadVarInt(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skipHashList(r io.Reader) error {
+	count, err := ReadVarInt(r)
 	if err != nil {
-		return si, err
+		return err
 	}
-	if i < 16 {
-		return si, fmt.Errorf("Could not read abswork 16 bytes, read %d in stead", i)
+	if count > MaxPayloadLength/chainhash.HashSize {
+		return fmt.Errorf("Hash list of %d entries is too long", count)
 	}
-	si.AbsWork = big.NewInt(0).SetBytes(absWork)
+	return skip(r, int64(count)*chainhash.HashSize)
+}
 
-	return si, nil
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
 }
 
-func WriteShareInfo(w io.Writer, si ShareInfo, segwit bool) error {
+func WriteShareInfo(w io.Writer, si ShareInfo, shareType uint64) error {
 	var err error
 
-	err = WriteShareData(w, si.ShareData)
+	err = WriteShareData(w, si.ShareData, shareType)
 	if err != nil {
 		return err
 	}
 
-	if segwit {
+	if shareType >= SegwitShareVersion {
 		err = WriteSegwitData(w, si.SegwitData)
 		if err != nil {
 			return err
@@ -544,39 +626,17 @@ func WriteShareInfo(w io.Writer, si ShareInfo, segwit bool) error {
 		return err
 	}
 
-	err = binary.Write(w, binary.LittleEndian, si.MaxBits)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, si.Bits)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, si.Timestamp)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, si.AbsHeight)
-	if err != nil {
-		return err
-	}
-
-	absWork := make([]byte, 16) // 128 bit
-	absWorkBytes := si.AbsWork.Bytes()
-	copy(absWork[16-len(absWorkBytes):], absWorkBytes)
-
-	i, err := w.Write(absWork)
-	if err != nil {
-		return err
-	}
-	if i < 16 {
-		return fmt.Errorf("Could not write abswork 16 bytes, wrote %d in stead", i)
+	for _, field := range []int32{si.MaxBits, si.Bits, si.Timestamp, si.AbsHeight} {
+		err = writeUint32(w, uint32(field))
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return WriteUint128(w, si.AbsWork)
 }
 
-func WriteShareData(w io.Writer, sd ShareData) error {
+func WriteShareData(w io.Writer, sd ShareData, shareType uint64) error {
 	var err error
 	err = WriteChainHash(w, sd.PreviousShareHash)
 	if err != nil {
@@ -588,11 +648,14 @@ func WriteShareData(w io.Writer, sd ShareData) error {
 		return err
 	}
 
-	err = binary.Write(w, binary.LittleEndian, sd.Nonce)
+	err = writeUint32(w, sd.Nonce)
 	if err != nil {
 		return err
 	}
 
+	if len(sd.PubKeyHash) != 20 {
+		return fmt.Errorf("Share version %d can only hold 20 byte pubkeyhashes, got %d", shareType, len(sd.PubKeyHash))
+	}
 	i, err := w.Write(sd.PubKeyHash)
 	if err != nil {
 		return err
@@ -602,20 +665,20 @@ func WriteShareData(w io.Writer, sd ShareData) error {
 		return fmt.Errorf("Could not write pubkeyhash. Expected 20 bytes, got %d", i)
 	}
 
-	err = binary.Write(w, binary.LittleEndian, sd.PubKeyHashVersion)
+	err = writeUint8(w, sd.PubKeyHashVersion)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, sd.Subsidy)
+	err = writeUint64(w, sd.Subsidy)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, sd.Donation)
+	err = writeUint16(w, sd.Donation)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(w, binary.LittleEndian, uint8(sd.StaleInfo))
+	err = writeUint8(w, uint8(sd.StaleInfo))
 	if err != nil {
 		return err
 	}
@@ -669,3 +732,10 @@ func WriteTransactionHashRef(w io.Writer, thr TransactionHashRef) error {
 
 	return nil
 }
+
+func minCount(count, max uint64) uint64 {
+	if count < max {
+		return count
+	}
+	return max
+}
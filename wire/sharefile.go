@@ -0,0 +1,189 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+// Sharechain files start with shareFileMagic, the version and the number of
+// shares. An index with an entry of fixed size per share follows, then the
+// encoded contents of the shares. The index holds the hashes of each share,
+// so loading doesn't hash them again, and where its contents are, so they
+// can be used right from a memory mapped file without copying.
+//
+// Older files are just the shares as in a shares message. Their first byte
+// is the start of the share count, where 0xff would announce a count of
+// more than 2^32 shares, which no file has.
+var shareFileMagic = []byte{0xff, 'p', '2', 'p', 's', 'h', 'r', 's'}
+
+const (
+	shareFileVersion = 2
+	shareFileHeader  = 16
+	// Type, hash, proof of work hash, offset and length of the contents
+	shareFileEntry = 8 + chainhash.HashSize*2 + 8 + 4
+)
+
+// ErrTruncatedJournal is returned by ParseShareJournal when the journal ends
+// in the middle of a sharechain file, like appending it was cut short by a
+// crash
+var ErrTruncatedJournal = errors.New("Sharechain journal is cut short")
+
+// IsShareFile returns whether data is in the sharechain file format, rather
+// than the older list of shares
+func IsShareFile(data []byte) bool {
+	return bytes.HasPrefix(data, shareFileMagic)
+}
+
+// WriteShareFile writes shares in the sharechain file format. Their hashes
+// must have been calculated.
+func WriteShareFile(w io.Writer, shares []Share) error {
+	contents := make([][]byte, len(shares))
+	offset := uint64(shareFileHeader + len(shares)*shareFileEntry)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Write(shareFileMagic)
+	writeUint32(buf, shareFileVersion)
+	writeUint32(buf, uint32(len(shares)))
+	for i := range shares {
+		s := &shares[i]
+		if s.Hash == nil || s.POWHash == nil {
+			return fmt.Errorf("Share without hashes can't be stored")
+		}
+		contents[i] = s.Raw
+		if contents[i] == nil {
+			var b bytes.Buffer
+			err := writeShareContents(&b, s)
+			if err != nil {
+				return err
+			}
+			contents[i] = b.Bytes()
+		}
+		writeUint64(buf, s.Type)
+		buf.Write(s.Hash[:])
+		buf.Write(s.POWHash[:])
+		writeUint64(buf, offset)
+		writeUint32(buf, uint32(len(contents[i])))
+		offset += uint64(len(contents[i]))
+	}
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, b := range contents {
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseShareFile decodes the shares of a sharechain file, or of the older
+// format. With lazy set, shares in the sharechain file format only have
+// their header and share info decoded and keep the rest encoded in Raw,
+// see Decoded. Their Raw points into data, which must not change while
+// they're used. Otherwise shares are decoded in full and their hashes
+// calculated and checked, as shares of network n.
+func ParseShareFile(data []byte, lazy bool, n p2pnet.Network) ([]Share, error) {
+	if !IsShareFile(data) {
+		return ReadShares(bytes.NewReader(data), n)
+	}
+	if len(data) < shareFileHeader {
+		return nil, fmt.Errorf("Sharechain file is truncated")
+	}
+	version := binary.LittleEndian.Uint32(data[8:])
+	if version != shareFileVersion {
+		return nil, fmt.Errorf("Unknown sharechain file version %d", version)
+	}
+	count := int(binary.LittleEndian.Uint32(data[12:]))
+	if len(data) < shareFileHeader+count*shareFileEntry {
+		return nil, fmt.Errorf("Sharechain file is truncated")
+	}
+
+	shares := make([]Share, count)
+	for i := range shares {
+		entry := data[shareFileHeader+i*shareFileEntry:]
+		s := &shares[i]
+		s.Type = binary.LittleEndian.Uint64(entry)
+		hash, _ := chainhash.NewHash(entry[8:40])
+		powHash, _ := chainhash.NewHash(entry[40:72])
+		offset := binary.LittleEndian.Uint64(entry[72:])
+		length := uint64(binary.LittleEndian.Uint32(entry[80:]))
+		if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+			return nil, fmt.Errorf("Share %s lies outside the sharechain file", hash.String())
+		}
+		s.Raw = data[offset : offset+length : offset+length]
+
+		if lazy {
+			err := s.readSummary(bytes.NewReader(s.Raw))
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode share %s: %s", hash.String(), err.Error())
+			}
+			s.Hash, s.POWHash, s.lazy = hash, powHash, true
+			continue
+		}
+		err := s.readContents(bytes.NewReader(s.Raw), n)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode share %s: %s", hash.String(), err.Error())
+		}
+		if !s.Hash.IsEqual(hash) {
+			return nil, fmt.Errorf("Share %s does not match its contents", hash.String())
+		}
+	}
+	return shares, nil
+}
+
+// ParseShareJournal decodes the shares of a journal: sharechain files
+// written one after the other, each parsed like ParseShareFile does. If the
+// last one is cut short, the shares before it are returned along with
+// ErrTruncatedJournal.
+func ParseShareJournal(data []byte, lazy bool, n p2pnet.Network) ([]Share, error) {
+	shares := make([]Share, 0)
+	for len(data) > 0 {
+		length, err := shareFileLength(data)
+		if err != nil {
+			return shares, err
+		}
+		file, err := ParseShareFile(data[:length:length], lazy, n)
+		if err != nil {
+			return shares, err
+		}
+		shares = append(shares, file...)
+		data = data[length:]
+	}
+	return shares, nil
+}
+
+// shareFileLength returns the length of the sharechain file data starts
+// with, which is where the last share's contents end
+func shareFileLength(data []byte) (int, error) {
+	if !IsShareFile(data) {
+		return 0, fmt.Errorf("Sharechain journal holds something else than sharechain files")
+	}
+	if len(data) < shareFileHeader {
+		return 0, ErrTruncatedJournal
+	}
+	count := uint64(binary.LittleEndian.Uint32(data[12:]))
+	length := shareFileHeader + count*shareFileEntry
+	if length > uint64(len(data)) {
+		return 0, ErrTruncatedJournal
+	}
+	for i := uint64(0); i < count; i++ {
+		entry := data[shareFileHeader+i*shareFileEntry:]
+		end := binary.LittleEndian.Uint64(entry[72:]) + uint64(binary.LittleEndian.Uint32(entry[80:]))
+		if end > length {
+			length = end
+		}
+	}
+	if length > uint64(len(data)) {
+		return 0, ErrTruncatedJournal
+	}
+	return int(length), nil
+}
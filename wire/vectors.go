@@ -0,0 +1,67 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+// ShareVector is a share with the hashes another implementation, like the
+// Python p2pool, computed for it. Any difference forks the sharechain, so
+// checking a corpus of them catches incompatibilities before peers do.
+// Hashes are hex in the usual byte order of block hashes, an empty one
+// isn't checked.
+type ShareVector struct {
+	Name string `json:"name"`
+	// Share is the hex of the share as in a shares message: type, length
+	// and contents
+	Share     string `json:"share"`
+	Hash      string `json:"hash"`
+	RefHash   string `json:"ref_hash"`
+	GenTxHash string `json:"gentx_hash"`
+	POWHash   string `json:"pow_hash"`
+}
+
+// Check decodes the share and compares the hashes calculated for it on
+// network n with the expected ones
+func (v ShareVector) Check(n p2pnet.Network) error {
+	b, err := hex.DecodeString(strings.TrimSpace(v.Share))
+	if err != nil {
+		return fmt.Errorf("Invalid hex: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	WriteVarInt(&buf, 1)
+	buf.Write(b)
+	shares, err := ReadShares(&buf, n)
+	if err != nil {
+		return fmt.Errorf("Could not decode share: %s", err.Error())
+	}
+	if len(shares) != 1 || buf.Len() != 0 {
+		return fmt.Errorf("Expected exactly one share")
+	}
+
+	s := shares[0]
+	mismatches := make([]string, 0)
+	for _, c := range []struct {
+		name     string
+		expected string
+		actual   *chainhash.Hash
+	}{
+		{"hash", v.Hash, s.Hash},
+		{"ref hash", v.RefHash, s.RefHash},
+		{"gentx hash", v.GenTxHash, s.GenTXHash},
+		{"pow hash", v.POWHash, s.POWHash},
+	} {
+		if c.expected != "" && !strings.EqualFold(c.expected, c.actual.String()) {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s, expected %s", c.name, c.actual.String(), c.expected))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
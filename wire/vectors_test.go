@@ -0,0 +1,102 @@
+package wire_test
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// TestShareVectors checks the hashes of the shares in testdata against
+// those of contrib/sharevectors.py, a rewrite of how the Python p2pool
+// hashes shares. The shares are made up, not dumped from p2pool.
+func TestShareVectors(t *testing.T) {
+	b, err := os.ReadFile("testdata/share_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []wire.ShareVector
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No share vectors")
+	}
+	n := p2pnet.Vertcoin()
+	for _, v := range vectors {
+		err := v.Check(n)
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err.Error())
+		}
+	}
+}
+
+// TestShareWithoutPOWHash checks that a share is rejected if its proof of
+// work can't be hashed, rather than decoded without a proof of work hash
+func TestShareWithoutPOWHash(t *testing.T) {
+	b, err := os.ReadFile("testdata/share_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []wire.ShareVector
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := p2pnet.Vertcoin()
+	n.POWHash = func(header []byte) []byte { return nil }
+	for _, v := range vectors {
+		if v.Check(n) == nil {
+			t.Errorf("%s: decoded without a proof of work hash", v.Name)
+		}
+	}
+}
+
+// TestShareHashSlots decodes shares at once on a network with one hash
+// slot, and checks their proof of work is hashed one at a time
+func TestShareHashSlots(t *testing.T) {
+	b, err := os.ReadFile("testdata/share_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []wire.ShareVector
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := p2pnet.Vertcoin()
+	n.ShareHashSlots = make(chan struct{}, 1)
+	var hashing, most int32
+	powHash := n.POWHash
+	n.POWHash = func(header []byte) []byte {
+		now := atomic.AddInt32(&hashing, 1)
+		defer atomic.AddInt32(&hashing, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if now <= m || atomic.CompareAndSwapInt32(&most, m, now) {
+				break
+			}
+		}
+		return powHash(header)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, v := range vectors {
+				v.Check(n)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("Hashed %d shares at the same time", most)
+	}
+}
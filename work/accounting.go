@@ -0,0 +1,79 @@
+package work
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The accounting reports list pool blocks as they were found. Whether a
+// block stayed in the coin's main chain isn't checked, blocks that were
+// orphaned there show up all the same.
+
+// blocksBetween returns the blocks found in [from, to), oldest first. Zero
+// times leave that side open.
+func blocksBetween(blocks []PoolBlock, from, to time.Time) []PoolBlock {
+	res := make([]PoolBlock, 0)
+	for _, b := range blocks {
+		ts := time.Unix(b.Timestamp, 0)
+		if (!from.IsZero() && ts.Before(from)) || (!to.IsZero() && !ts.Before(to)) {
+			continue
+		}
+		res = append(res, b)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+	return res
+}
+
+// formatCoins formats satoshis as coins without going through a float, so
+// the amounts add up exactly
+func formatCoins(satoshis uint64) string {
+	return fmt.Sprintf("%d.%08d", satoshis/1e8, satoshis%1e8)
+}
+
+func blockRow(b PoolBlock) []string {
+	return []string{
+		time.Unix(b.Timestamp, 0).UTC().Format(time.RFC3339),
+		strconv.FormatInt(b.Height, 10),
+		b.Hash,
+	}
+}
+
+// WriteBlocksCSV writes the blocks found between from and to as CSV, one
+// row per block
+func WriteBlocksCSV(w io.Writer, blocks []PoolBlock, from, to time.Time) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "height", "hash", "finder", "value"})
+	for _, b := range blocksBetween(blocks, from, to) {
+		cw.Write(append(blockRow(b), b.Finder, formatCoins(b.Value)))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePayoutsCSV writes what the blocks found between from and to paid out
+// as CSV, one row per block and address. If address is set, only its
+// payouts are written.
+func WritePayoutsCSV(w io.Writer, blocks []PoolBlock, from, to time.Time, address string) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "height", "hash", "address", "amount"})
+	for _, b := range blocksBetween(blocks, from, to) {
+		addrs := make([]string, 0, len(b.Payouts))
+		for a := range b.Payouts {
+			if address == "" || a == address {
+				addrs = append(addrs, a)
+			}
+		}
+		sort.Strings(addrs)
+		for _, a := range addrs {
+			cw.Write(append(blockRow(b), a, formatCoins(b.Payouts[a])))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,87 @@
+package work
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+// PubKeyHashVersionWitness is the PubKeyHashVersion used in share data for
+// native segwit (P2WPKH) payout addresses. Base58 addresses use their own
+// version byte.
+const PubKeyHashVersionWitness = uint8(0xff)
+
+// NormalizeAddress trims whitespace and lowercases bech32 addresses, which
+// some wallets display in upper or mixed case. Base58 addresses are case
+// sensitive and returned as they are.
+func NormalizeAddress(address string, n p2pnet.Network) string {
+	address = strings.TrimSpace(address)
+	lower := strings.ToLower(address)
+	if n.ChainParams.Bech32HRPSegwit != "" && strings.HasPrefix(lower, n.ChainParams.Bech32HRPSegwit+"1") {
+		return lower
+	}
+	return address
+}
+
+// AddressToPubKeyHash decodes an address into the hash and version pair that
+// is stored in the share data
+func AddressToPubKeyHash(address string, n p2pnet.Network) ([]byte, uint8, error) {
+	addr, err := btcutil.DecodeAddress(address, n.ChainParams)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !addr.IsForNet(n.ChainParams) {
+		return nil, 0, fmt.Errorf("Address %s is not valid for network %s", address, n.ChainParams.Name)
+	}
+	switch a := addr.(type) {
+	case *btcutil.AddressPubKeyHash:
+		return a.Hash160()[:], n.ChainParams.PubKeyHashAddrID, nil
+	case *btcutil.AddressScriptHash:
+		return a.Hash160()[:], n.ChainParams.ScriptHashAddrID, nil
+	case *btcutil.AddressWitnessPubKeyHash:
+		return a.Hash160()[:], PubKeyHashVersionWitness, nil
+	case *btcutil.AddressTaproot:
+		// Share data holds a 20 byte hash, a taproot output key doesn't fit
+		return nil, 0, fmt.Errorf("Taproot address %s can't be paid out to, use a segwit, P2PKH or P2SH address", address)
+	}
+	return nil, 0, fmt.Errorf("Unsupported address type for %s", address)
+}
+
+// PubKeyHashToAddress is the reverse of AddressToPubKeyHash
+func PubKeyHashToAddress(hash []byte, version uint8, n p2pnet.Network) (btcutil.Address, error) {
+	switch version {
+	case PubKeyHashVersionWitness:
+		return btcutil.NewAddressWitnessPubKeyHash(hash, n.ChainParams)
+	case n.ChainParams.ScriptHashAddrID:
+		return btcutil.NewAddressScriptHashFromHash(hash, n.ChainParams)
+	case n.ChainParams.PubKeyHashAddrID:
+		return btcutil.NewAddressPubKeyHash(hash, n.ChainParams)
+	}
+	return nil, fmt.Errorf("Unknown pubkey hash version %d", version)
+}
+
+// PubKeyHashToScript returns the output script paying to the given hash
+func PubKeyHashToScript(hash []byte, version uint8, n p2pnet.Network) ([]byte, error) {
+	addr, err := PubKeyHashToAddress(hash, version, n)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// ScriptToAddress returns the address an output script pays to. Pay to
+// pubkey scripts, like the donation script, are shown as the matching pubkey
+// hash address.
+func ScriptToAddress(script []byte, n p2pnet.Network) (string, error) {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, n.ChainParams)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) != 1 {
+		return "", fmt.Errorf("Script %x does not pay to a single address", script)
+	}
+	return addrs[0].EncodeAddress(), nil
+}
@@ -0,0 +1,75 @@
+package work
+
+import (
+	"encoding/binary"
+	"testing"
+
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+func benchPubKeyHash(i int) []byte {
+	pkh := make([]byte, 20)
+	binary.BigEndian.PutUint32(pkh, uint32(i+1))
+	return pkh
+}
+
+// benchWorkManager returns a work manager on the benchmark network with a
+// template of 2000 transactions and a sharechain of 50 shares, each paying
+// a different address
+func benchWorkManager(b *testing.B) (*WorkManager, *wire.Share) {
+	wm, err := NewSyntheticWorkManager(p2pnet.Benchmark(), b.TempDir(), 2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var share *wire.Share
+	for i := 0; i < 50; i++ {
+		share, err = wm.MineShare(benchPubKeyHash(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return wm, share
+}
+
+func BenchmarkBuildGenTx(b *testing.B) {
+	wm, share := benchWorkManager(b)
+	n := wm.Network
+	bt := wm.CurrentTemplate()
+	tip := wm.ShareChain.GetTipHash()
+	finderScript, err := PubKeyHashToScript(benchPubKeyHash(0), n.ChainParams.PubKeyHashAddrID, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	coinbase := CoinbaseScript(bt.Height, []byte("/p2pool-go/"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		payouts := wm.ShareChain.GetPayouts(tip, bt.CoinbaseValue, finderScript, bt.Target, n)
+		SerializeGenTx(BuildGenTx(coinbase, payouts, share.RefHash, bt.WitnessCommitment))
+	}
+}
+
+func BenchmarkCalcMerkleBranch(b *testing.B) {
+	bt, err := TemplateFromRPC(SyntheticTemplate(1, 2000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CalcMerkleBranch(bt.TxHashes)
+	}
+}
+
+func BenchmarkCalcWitnessMerkleRoot(b *testing.B) {
+	bt, err := TemplateFromRPC(SyntheticTemplate(1, 2000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CalcWitnessMerkleRoot(bt.Transactions)
+	}
+}
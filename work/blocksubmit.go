@@ -0,0 +1,254 @@
+package work
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// BlockSubmitter sends solved blocks to all configured daemons at once, so the
+// block propagates even if one of them is slow or unreachable
+type BlockSubmitter struct {
+	Daemons    []*rpc.Client
+	Retries    int
+	RetryDelay time.Duration
+	// Network is the name of the network in the events of found blocks
+	Network string
+	// Log gets the records about found blocks, the chain's logger if nil
+	Log *logging.SubsystemLogger
+
+	journal *FoundBlockJournal
+}
+
+func NewBlockSubmitter(daemons []*rpc.Client, journal *FoundBlockJournal) *BlockSubmitter {
+	return &BlockSubmitter{
+		Daemons:    daemons,
+		Retries:    5,
+		RetryDelay: time.Second,
+		journal:    journal,
+	}
+}
+
+func (bs *BlockSubmitter) logger() *logging.SubsystemLogger {
+	return bs.Log.Or(log)
+}
+
+// AssembleBlock builds the full block from a solved header, the generation
+// transaction and the other transactions from the template it was mined on
+func AssembleBlock(hdr btcwire.BlockHeader, gentx *btcwire.MsgTx, txs []*btcwire.MsgTx) *btcwire.MsgBlock {
+	b := btcwire.NewMsgBlock(&hdr)
+	if hasWitnessCommitment(gentx) {
+		// The coinbase has to reveal the witness reserved value the
+		// commitment was made with
+		gentx = gentx.Copy()
+		gentx.TxIn[0].Witness = btcwire.TxWitness{make([]byte, 32)}
+	}
+	b.AddTransaction(gentx)
+	for _, tx := range txs {
+		b.AddTransaction(tx)
+	}
+	return b
+}
+
+// JobBlock assembles the block for a solution to a job
+func JobBlock(j *Job, extranonce uint64, timestamp uint32, nonce uint32) (*btcwire.MsgBlock, error) {
+	gentxBytes := SpliceGenTx(j.CoinbasePrefix, extranonce, j.CoinbaseSuffix)
+	gentx := btcwire.NewMsgTx(1)
+	err := gentx.Deserialize(bytes.NewReader(gentxBytes))
+	if err != nil {
+		return nil, err
+	}
+	gentxHash := gentx.TxHash()
+	merkleRoot, err := wire.CalcMerkleLink(&gentxHash, j.Template.MerkleBranch, 0)
+	if err != nil {
+		return nil, err
+	}
+	hdr := btcwire.NewBlockHeader(j.Share.MinHeader.Version, j.Share.MinHeader.PreviousBlock, merkleRoot, j.Share.MinHeader.Bits, nonce)
+	hdr.Timestamp = time.Unix(int64(timestamp), 0)
+	return AssembleBlock(*hdr, gentx, j.Template.Transactions), nil
+}
+
+func hasWitnessCommitment(gentx *btcwire.MsgTx) bool {
+	for _, out := range gentx.TxOut {
+		if len(out.PkScript) >= 38 && bytes.Equal(out.PkScript[:len(witnessCommitmentHeader)], witnessCommitmentHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bs *BlockSubmitter) SubmitBlock(b *btcwire.MsgBlock) error {
+	var buf bytes.Buffer
+	err := b.Serialize(&buf)
+	if err != nil {
+		return err
+	}
+
+	fb := FoundBlock{
+		Hash:      b.BlockHash().String(),
+		Timestamp: clock.Now().Unix(),
+		Hex:       hex.EncodeToString(buf.Bytes()),
+		Status:    FoundBlockPending,
+	}
+
+	bs.logger().Infof("Found block %s, submitting to %d daemon(s)", fb.Hash, len(bs.Daemons))
+	go bs.logProposal(fb.Hash, fb.Hex)
+
+	// Record the block before submitting it, so it survives a crash mid-submit
+	err = bs.journal.Append(fb)
+	if err != nil {
+		bs.logger().Errorf("Could not record found block %s: %s", fb.Hash, err.Error())
+	}
+
+	return bs.submit(fb)
+}
+
+// ResubmitPending submits all blocks that were found but whose submission never
+// completed, for instance because the process crashed
+func (bs *BlockSubmitter) ResubmitPending() error {
+	blocks, err := bs.journal.Blocks()
+	if err != nil {
+		return err
+	}
+	for _, fb := range blocks {
+		if fb.Status != FoundBlockPending || fb.Hex == "" {
+			continue
+		}
+		bs.logger().Infof("Resubmitting block %s left pending by previous run", fb.Hash)
+		err = bs.submit(fb)
+		if err != nil {
+			bs.logger().Warnf("Resubmitting block %s failed: %s", fb.Hash, err.Error())
+		}
+	}
+	return nil
+}
+
+func (bs *BlockSubmitter) submit(fb FoundBlock) error {
+	if len(bs.Daemons) == 0 {
+		return fmt.Errorf("No daemons configured to submit block %s to", fb.Hash)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(bs.Daemons))
+	for i := range bs.Daemons {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = bs.submitToDaemon(bs.Daemons[i], fb.Hex)
+			if errs[i] != nil {
+				bs.logger().Warnf("Submitting block %s to %s failed: %s", fb.Hash, bs.Daemons[i].URL, errs[i].Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := bs.verify(fb.Hash)
+
+	final := FoundBlock{Hash: fb.Hash, Timestamp: fb.Timestamp, Status: FoundBlockAccepted}
+	if !accepted {
+		final.Status = FoundBlockRejected
+		for _, err := range errs {
+			if err != nil {
+				final.Reason = err.Error()
+				break
+			}
+		}
+	}
+
+	err := bs.journal.Append(final)
+	if err != nil {
+		bs.logger().Errorf("Could not record result for block %s: %s", fb.Hash, err.Error())
+	}
+	events.PublishOn(bs.Network, events.BlockFound, events.Block{
+		Hash:      final.Hash,
+		Timestamp: final.Timestamp,
+		Hex:       final.Hex,
+		Status:    string(final.Status),
+		Reason:    final.Reason,
+	})
+
+	if !accepted {
+		return fmt.Errorf("Block %s was not accepted by any daemon", fb.Hash)
+	}
+	bs.logger().Infof("Block %s accepted", fb.Hash)
+	return nil
+}
+
+// Propose has the first daemon check a block without submitting it, and
+// returns its reject reason, which is empty for a valid block
+func (bs *BlockSubmitter) Propose(b *btcwire.MsgBlock) (string, error) {
+	if len(bs.Daemons) == 0 {
+		return "", fmt.Errorf("No daemons configured to propose block to")
+	}
+	var buf bytes.Buffer
+	err := b.Serialize(&buf)
+	if err != nil {
+		return "", err
+	}
+	return bs.Daemons[0].ProposeBlock(hex.EncodeToString(buf.Bytes()))
+}
+
+// logProposal checks a found block as proposal alongside its submission.
+// The verdict only tells us whether our block construction is sound, the
+// submission goes ahead regardless.
+func (bs *BlockSubmitter) logProposal(hash string, blockHex string) {
+	if len(bs.Daemons) == 0 || !bs.Daemons[0].Adapter.Proposals() {
+		return
+	}
+	reason, err := bs.Daemons[0].ProposeBlock(blockHex)
+	if err != nil {
+		bs.logger().Warnf("Could not propose block %s: %s", hash, err.Error())
+		return
+	}
+	switch reason {
+	case "", "duplicate", "inconclusive", "inconclusive-not-best-prevblk":
+		bs.logger().Debugf("Daemon accepted proposal of block %s", hash)
+	default:
+		bs.logger().Errorf("Daemon rejected proposal of block %s: %s", hash, reason)
+	}
+}
+
+func (bs *BlockSubmitter) submitToDaemon(d *rpc.Client, blockHex string) error {
+	var err error
+	for attempt := 0; attempt <= bs.Retries; attempt++ {
+		if attempt > 0 {
+			clock.Sleep(bs.RetryDelay * time.Duration(attempt))
+		}
+		var reason string
+		reason, err = d.SubmitBlock(blockHex)
+		if err == nil {
+			if d.Adapter.SubmitAccepted(reason) {
+				return nil
+			}
+			return fmt.Errorf("Block rejected: %s", reason)
+		}
+		if !rpc.IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// verify asks the daemons whether they know the block and have it in their
+// main chain
+func (bs *BlockSubmitter) verify(hash string) bool {
+	for _, d := range bs.Daemons {
+		bi, err := d.GetBlock(hash)
+		if err != nil {
+			continue
+		}
+		if bi.Confirmations > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package work
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// DefaultClockSkew is how far ahead of our clock share timestamps may be,
+// as in the Python p2pool
+const DefaultClockSkew = time.Minute * 10
+
+const (
+	// minClockSamples is how many peers must have sent shares before their
+	// clocks adjust ours
+	minClockSamples = 5
+	maxClockSamples = 200
+)
+
+// NetworkClock is our clock, adjusted by the median offset of the clocks of
+// our peers, as seen from the timestamps of the new shares they send. A
+// node with a wrong clock would create shares peers reject, or reject
+// theirs.
+type NetworkClock struct {
+	// Tolerance is how far share timestamps may be ahead of our clock,
+	// and how far peers may move the network time
+	Tolerance time.Duration
+	// Base is the local clock, clock.Now if nil
+	Base func() time.Time
+	// Log gets the clock's warnings, the chain's logger if nil
+	Log *logging.SubsystemLogger
+
+	lock    sync.Mutex
+	samples map[string]time.Duration
+	order   []string
+	warned  bool
+}
+
+func NewNetworkClock(tolerance time.Duration) *NetworkClock {
+	return &NetworkClock{Tolerance: tolerance, samples: map[string]time.Duration{}}
+}
+
+func (c *NetworkClock) logger() *logging.SubsystemLogger {
+	return c.Log.Or(log)
+}
+
+// AddSample records the offset of a peer's clock, given the timestamp of a
+// valid share it just created. Each peer counts once, with its latest
+// sample.
+func (c *NetworkClock) AddSample(peer string, timestamp time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.samples[peer]; !ok {
+		c.order = append(c.order, peer)
+		if len(c.order) > maxClockSamples {
+			delete(c.samples, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.samples[peer] = timestamp.Sub(c.local())
+}
+
+// Offset returns how far the network time is ahead of our clock, limited to
+// the tolerance. It's 0 until enough peers have been sampled.
+func (c *NetworkClock) Offset() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.samples) < minClockSamples {
+		return 0
+	}
+	offsets := make([]time.Duration, 0, len(c.samples))
+	for _, o := range c.samples {
+		offsets = append(offsets, o)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	offset := offsets[len(offsets)/2]
+	if offset > c.Tolerance || offset < -c.Tolerance {
+		if !c.warned {
+			c.logger().Warnf("Peers' clocks are %s off from ours, check your system clock", offset.Round(time.Second))
+			c.warned = true
+		}
+		if offset > 0 {
+			return c.Tolerance
+		}
+		return -c.Tolerance
+	}
+	c.warned = false
+	return offset
+}
+
+// Now returns the network time
+func (c *NetworkClock) Now() time.Time {
+	return c.local().Add(c.Offset())
+}
+
+func (c *NetworkClock) local() time.Time {
+	if c.Base != nil {
+		return c.Base()
+	}
+	return clock.Now()
+}
+
+// ClampTimestamp limits the timestamp of a share on top of previous to
+// between one second and almost two share periods after previous, like the
+// Python p2pool does. Shares can't go back in time, and after a pause the
+// timestamps catch up over a few shares.
+func ClampTimestamp(timestamp int32, previous *wire.Share, n p2pnet.Network) int32 {
+	if previous == nil {
+		return timestamp
+	}
+	prev := previous.ShareInfo.Timestamp
+	if timestamp < prev+1 {
+		return prev + 1
+	}
+	if max := prev + int32(2*n.SharePeriod-1); timestamp > max {
+		return max
+	}
+	return timestamp
+}
+
+// checkTimestamp tells whether the timestamp of a share from a peer isn't
+// more than the tolerance ahead of our own clock, like the Python p2pool
+// checks, and follows the rules of ClampTimestamp, if we have its previous
+// share. The network time isn't used, or peers could move the limit.
+func (sc *ShareChain) checkTimestamp(s *wire.Share, previous *wire.Share, n p2pnet.Network) bool {
+	if int64(s.ShareInfo.Timestamp) > sc.Clock.local().Add(sc.Clock.Tolerance).Unix() {
+		return false
+	}
+	return ClampTimestamp(s.ShareInfo.Timestamp, previous, n) == s.ShareInfo.Timestamp
+}
@@ -0,0 +1,282 @@
+package work
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rpc"
+)
+
+// rpcLog logs our side of talking to the daemons
+var rpcLog = logging.For("rpc")
+
+// maxHeaderLag is how many blocks a daemon may be behind the headers it
+// knows of and still be considered synced
+const maxHeaderLag = 2
+
+// DaemonStatus is the last known state of a daemon
+type DaemonStatus struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Syncing   bool   `json:"syncing"`
+	Blocks    int64  `json:"blocks"`
+	Headers   int64  `json:"headers"`
+	Active    bool   `json:"active"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Healthy tells whether the daemon can be used for templates
+func (s DaemonStatus) Healthy() bool {
+	return s.Reachable && !s.Syncing && s.Error == ""
+}
+
+// DaemonPool keeps track of which of the configured daemons are usable, and
+// picks the best one to get templates from
+type DaemonPool struct {
+	Daemons       []*rpc.Client
+	Network       p2pnet.Network
+	CheckInterval time.Duration
+	// Log gets the records about the daemons, the rpc logger if nil
+	Log *logging.SubsystemLogger
+
+	lock    sync.Mutex
+	active  int
+	healthy []bool
+	heights []int64
+	status  []DaemonStatus
+	// Whether we confirmed each daemon is on our network, and the ones that
+	// turned out not to be
+	verified     []bool
+	wrongNetwork []bool
+}
+
+func NewDaemonPool(daemons []*rpc.Client, n p2pnet.Network) *DaemonPool {
+	p := &DaemonPool{
+		Daemons:       daemons,
+		Network:       n,
+		CheckInterval: time.Second * 30,
+		healthy:       make([]bool, len(daemons)),
+		heights:       make([]int64, len(daemons)),
+		status:        make([]DaemonStatus, len(daemons)),
+		verified:      make([]bool, len(daemons)),
+		wrongNetwork:  make([]bool, len(daemons)),
+	}
+	// Until the first health check, assume they're all fine
+	for i := range p.healthy {
+		p.healthy[i] = true
+	}
+	return p
+}
+
+func (p *DaemonPool) logger() *logging.SubsystemLogger {
+	return p.Log.Or(rpcLog)
+}
+
+// Active returns the daemon to use for templates
+func (p *DaemonPool) Active() *rpc.Client {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.Daemons[p.active]
+}
+
+// Failed marks a daemon unusable after a call to it failed, and switches to
+// another one if it was the active one
+func (p *DaemonPool) Failed(d *rpc.Client, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, c := range p.Daemons {
+		if c == d && p.healthy[i] {
+			p.logger().Warnf("Daemon %s failed: %s", d.URL, err.Error())
+			p.healthy[i] = false
+		}
+	}
+	p.pickBest()
+}
+
+// Run checks the health of all daemons periodically, until ctx is done
+func (p *DaemonPool) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		p.Check()
+		clock.SleepContext(ctx, p.CheckInterval)
+	}
+}
+
+// Check asks every daemon for its chain state. Daemons that don't answer or
+// are still syncing are unhealthy, and the healthy one with the most blocks
+// becomes active.
+func (p *DaemonPool) Check() {
+	status := make([]DaemonStatus, len(p.Daemons))
+	var wg sync.WaitGroup
+	for i, d := range p.Daemons {
+		wg.Add(1)
+		go func(i int, d *rpc.Client) {
+			defer wg.Done()
+			status[i] = p.checkDaemon(i, d)
+		}(i, d)
+	}
+	wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, st := range status {
+		healthy := st.Healthy()
+		if healthy != p.healthy[i] {
+			switch {
+			case healthy:
+				p.logger().Infof("Daemon %s is healthy", st.URL)
+			case st.Syncing:
+				p.logger().Warnf("Daemon %s is syncing (%d of %d blocks)", st.URL, st.Blocks, st.Headers)
+			default:
+				p.logger().Warnf("Daemon %s is unhealthy", st.URL)
+			}
+		}
+		p.healthy[i] = healthy
+		p.heights[i] = st.Blocks
+	}
+	p.status = status
+	p.pickBest()
+}
+
+func (p *DaemonPool) checkDaemon(i int, d *rpc.Client) DaemonStatus {
+	st := DaemonStatus{URL: d.URL}
+	bi, err := d.GetBlockchainInfo()
+	if err != nil {
+		p.logger().Debugf("Health check of daemon %s failed: %s", d.URL, err.Error())
+		if rpcErr, ok := err.(*rpc.Error); ok && rpcErr.Code == rpc.ErrCodeInWarmup {
+			// Still loading, but it's there
+			st.Reachable = true
+			st.Syncing = true
+		}
+		return st
+	}
+	st.Reachable = true
+	st.Blocks = bi.Blocks
+	st.Headers = bi.Headers
+	st.Syncing = bi.InitialBlockDownload || bi.Headers-bi.Blocks > maxHeaderLag
+	if !p.isVerified(i) {
+		err = CheckDaemonNetwork(d, bi, p.Network)
+		p.setVerified(i, err)
+		if err != nil {
+			p.logger().Errorf("Not using daemon %s: %s", d.URL, err.Error())
+		}
+	}
+	if p.isWrongNetwork(i) {
+		st.Error = "wrong network"
+	}
+	return st
+}
+
+// Status returns the state of all daemons as of the last check
+func (p *DaemonPool) Status() []DaemonStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := make([]DaemonStatus, len(p.status))
+	copy(status, p.status)
+	for i := range status {
+		status[i].URL = p.Daemons[i].URL
+		status[i].Active = i == p.active
+	}
+	return status
+}
+
+// Usable tells whether any daemon can give us templates. Until the first
+// check all daemons are assumed to be.
+func (p *DaemonPool) Usable() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.healthy[p.active]
+}
+
+// Syncing tells whether the daemons are reachable but still catching up
+// with the chain, as opposed to down
+func (p *DaemonPool) Syncing() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, st := range p.status {
+		if st.Reachable && st.Syncing {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DaemonPool) isVerified(i int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.verified[i]
+}
+
+func (p *DaemonPool) isWrongNetwork(i int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.wrongNetwork[i]
+}
+
+func (p *DaemonPool) setVerified(i int, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.verified[i] = true
+	p.wrongNetwork[i] = err != nil
+}
+
+// VerifyNetwork checks that all reachable daemons are on our network.
+// Daemons that can't be reached are checked once they come up.
+func (p *DaemonPool) VerifyNetwork() error {
+	for i, d := range p.Daemons {
+		bi, err := d.GetBlockchainInfo()
+		if err != nil {
+			p.logger().Warnf("Could not reach daemon %s to check its network: %s", d.URL, err.Error())
+			continue
+		}
+		err = CheckDaemonNetwork(d, bi, p.Network)
+		p.setVerified(i, err)
+		if err != nil {
+			return fmt.Errorf("Daemon %s: %s", d.URL, err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckDaemonNetwork makes sure a daemon runs the chain the network is for,
+// by its chain name and genesis block. Mining on the wrong chain only
+// produces shares no peer will accept.
+func CheckDaemonNetwork(d *rpc.Client, bi *rpc.BlockchainInfo, n p2pnet.Network) error {
+	if n.DaemonChain != "" && bi.Chain != n.DaemonChain {
+		return fmt.Errorf("Daemon is on chain %s, network %s needs %s", bi.Chain, n.ChainParams.Name, n.DaemonChain)
+	}
+	if n.ChainParams.GenesisHash == nil {
+		return nil
+	}
+	genesis, err := d.GetBlockHash(0)
+	if err != nil {
+		return err
+	}
+	if genesis != n.ChainParams.GenesisHash.String() {
+		return fmt.Errorf("Daemon has genesis block %s, network %s has %s", genesis, n.ChainParams.Name, n.ChainParams.GenesisHash.String())
+	}
+	return nil
+}
+
+// pickBest switches to the healthy daemon with the most blocks. The active
+// one is kept on a tie, and the configured order decides otherwise.
+func (p *DaemonPool) pickBest() {
+	best := -1
+	for i := range p.Daemons {
+		if !p.healthy[i] {
+			continue
+		}
+		if best == -1 || p.heights[i] > p.heights[best] || (p.heights[i] == p.heights[best] && i == p.active) {
+			best = i
+		}
+	}
+	if best == -1 || best == p.active {
+		return
+	}
+	p.logger().Infof("Switching to daemon %s", p.Daemons[best].URL)
+	p.active = best
+}
@@ -0,0 +1,124 @@
+package work
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// ExportedShare is a share as exported for analysis outside the node
+type ExportedShare struct {
+	Hash       string  `json:"hash"`
+	Previous   string  `json:"previous"`
+	Height     int32   `json:"height"`
+	Timestamp  int64   `json:"timestamp"`
+	Miner      string  `json:"miner"`
+	Difficulty float64 `json:"difficulty"`
+	// Stale is the stale info the share announces: "orphan" or "doa" when
+	// the miner's previous share went stale
+	Stale string `json:"stale,omitempty"`
+	Block bool   `json:"block"`
+}
+
+// ExportRange selects shares by height, time, or both. Zero values leave
+// that side of the range open.
+type ExportRange struct {
+	FromHeight int32
+	ToHeight   int32
+	From       time.Time
+	To         time.Time
+}
+
+// SetBound sets the start (from) or end of the range from a share height or
+// a time as accepted by ParseTime
+func (r *ExportRange) SetBound(bound string, from bool) error {
+	if bound == "" {
+		return nil
+	}
+	if h, err := strconv.ParseInt(bound, 10, 32); err == nil {
+		if from {
+			r.FromHeight = int32(h)
+		} else {
+			r.ToHeight = int32(h)
+		}
+		return nil
+	}
+	t, err := ParseTime(bound)
+	if err != nil {
+		return fmt.Errorf("Invalid range bound %s, expected a share height or time", bound)
+	}
+	if from {
+		r.From = t
+	} else {
+		r.To = t
+	}
+	return nil
+}
+
+// ParseTime parses an RFC 3339 time or a date (2006-01-02, in UTC)
+func ParseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	return t, err
+}
+
+func (r ExportRange) contains(s *wire.Share) bool {
+	h := s.ShareInfo.AbsHeight
+	ts := time.Unix(int64(s.ShareInfo.Timestamp), 0)
+	if h < r.FromHeight || (r.ToHeight > 0 && h > r.ToHeight) {
+		return false
+	}
+	if (!r.From.IsZero() && ts.Before(r.From)) || (!r.To.IsZero() && ts.After(r.To)) {
+		return false
+	}
+	return true
+}
+
+// Export returns the shares of the best chain in the range, oldest first
+func (sc *ShareChain) Export(r ExportRange, n p2pnet.Network) []ExportedShare {
+	shares := make([]ExportedShare, 0)
+	for cs := sc.GetShare(sc.GetTipHash()); cs != nil; cs = cs.Previous() {
+		s := cs.Share
+		if !r.contains(s) {
+			// Heights only go down from here, and timestamps nearly so
+			if s.ShareInfo.AbsHeight < r.FromHeight {
+				break
+			}
+			continue
+		}
+		shares = append(shares, ExportShare(s, n))
+	}
+	for i, j := 0, len(shares)-1; i < j; i, j = i+1, j-1 {
+		shares[i], shares[j] = shares[j], shares[i]
+	}
+	return shares
+}
+
+// ExportShare converts a share to its exported form
+func ExportShare(s *wire.Share, n p2pnet.Network) ExportedShare {
+	sd := s.ShareInfo.ShareData
+	e := ExportedShare{
+		Hash:       s.Hash.String(),
+		Previous:   sd.PreviousShareHash.String(),
+		Height:     s.ShareInfo.AbsHeight,
+		Timestamp:  int64(s.ShareInfo.Timestamp),
+		Difficulty: TargetToDifficulty(blockchain.CompactToBig(uint32(s.ShareInfo.Bits))) * n.DumbScryptDiff,
+		Block:      s.IsBlock(),
+	}
+	if addr, err := PubKeyHashToAddress(sd.PubKeyHash, sd.PubKeyHashVersion, n); err == nil {
+		e.Miner = addr.EncodeAddress()
+	}
+	switch sd.StaleInfo {
+	case wire.StaleInfoOrphan:
+		e.Stale = "orphan"
+	case wire.StaleInfoDOA:
+		e.Stale = "doa"
+	}
+	return e
+}
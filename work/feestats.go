@@ -0,0 +1,94 @@
+package work
+
+import "sort"
+
+// FeeEstimateTargets are the confirmation targets, in blocks, we ask the
+// daemon fee estimates for
+var FeeEstimateTargets = []int{1, 3, 6, 12, 24}
+
+// TemplateFeeStats summarizes the fees of the transactions in a template.
+// Fee rates are in satoshis per virtual byte.
+type TemplateFeeStats struct {
+	Height        int64   `json:"height"`
+	Transactions  int     `json:"transactions"`
+	Weight        int64   `json:"weight"`
+	TotalFees     int64   `json:"total_fees"`
+	MinFeeRate    float64 `json:"min_fee_rate"`
+	MedianFeeRate float64 `json:"median_fee_rate"`
+	MaxFeeRate    float64 `json:"max_fee_rate"`
+	AvgFeeRate    float64 `json:"avg_fee_rate"`
+}
+
+// FeeStats returns fee statistics for the transactions currently in the
+// template
+func (bt *BlockTemplate) FeeStats() TemplateFeeStats {
+	st := TemplateFeeStats{Height: bt.Height, Transactions: len(bt.Transactions)}
+	if len(bt.Transactions) == 0 {
+		return st
+	}
+	rates := make([]float64, len(bt.Transactions))
+	for i := range bt.Transactions {
+		st.Weight += bt.TxWeights[i]
+		st.TotalFees += bt.TxFees[i]
+		rates[i] = feeRate(bt.TxFees[i], bt.TxWeights[i])
+	}
+	sort.Float64s(rates)
+	st.MinFeeRate = rates[0]
+	st.MaxFeeRate = rates[len(rates)-1]
+	st.MedianFeeRate = rates[len(rates)/2]
+	if len(rates)%2 == 0 {
+		st.MedianFeeRate = (rates[len(rates)/2-1] + rates[len(rates)/2]) / 2
+	}
+	st.AvgFeeRate = feeRate(st.TotalFees, st.Weight)
+	return st
+}
+
+func feeRate(fee, weight int64) float64 {
+	if weight <= 0 {
+		return 0
+	}
+	return float64(fee) * 4 / float64(weight)
+}
+
+// FeeEstimates holds what the daemon knows about current fee rates. Rates
+// are in satoshis per virtual byte; targets the daemon has no estimate for
+// are left out.
+type FeeEstimates struct {
+	Estimates     map[int]float64 `json:"estimates"`
+	MempoolTxs    int64           `json:"mempool_txs"`
+	MempoolBytes  int64           `json:"mempool_bytes"`
+	MempoolMinFee float64         `json:"mempool_min_fee"`
+	MinRelayTxFee float64         `json:"min_relay_fee"`
+}
+
+// FeeEstimates queries the active daemon for smart fee estimates and mempool
+// statistics
+func (wm *WorkManager) FeeEstimates() (*FeeEstimates, error) {
+	d := wm.Daemons.Active()
+	mi, err := d.GetMempoolInfo()
+	if err != nil {
+		return nil, err
+	}
+	fe := &FeeEstimates{
+		Estimates:     map[int]float64{},
+		MempoolTxs:    mi.Size,
+		MempoolBytes:  mi.Bytes,
+		MempoolMinFee: coinPerKvBToSatPerVB(mi.MempoolMinFee),
+		MinRelayTxFee: coinPerKvBToSatPerVB(mi.MinRelayTxFee),
+	}
+	for _, target := range FeeEstimateTargets {
+		est, err := d.EstimateSmartFee(target)
+		if err != nil {
+			return nil, err
+		}
+		if len(est.Errors) > 0 || est.FeeRate <= 0 {
+			continue
+		}
+		fe.Estimates[target] = coinPerKvBToSatPerVB(est.FeeRate)
+	}
+	return fe, nil
+}
+
+func coinPerKvBToSatPerVB(rate float64) float64 {
+	return rate * 1e8 / 1000
+}
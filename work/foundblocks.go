@@ -0,0 +1,98 @@
+package work
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+type FoundBlockStatus string
+
+const (
+	FoundBlockPending  = FoundBlockStatus("pending")
+	FoundBlockAccepted = FoundBlockStatus("accepted")
+	FoundBlockRejected = FoundBlockStatus("rejected")
+)
+
+type FoundBlock struct {
+	Hash      string           `json:"hash"`
+	Timestamp int64            `json:"timestamp"`
+	Hex       string           `json:"hex,omitempty"`
+	Status    FoundBlockStatus `json:"status"`
+	Reason    string           `json:"reason,omitempty"`
+}
+
+// FoundBlockJournal is an append-only log of blocks we found. Every record is
+// synced to disk before we continue, so a block that was found right before a
+// crash is not lost and can be resubmitted on the next start.
+type FoundBlockJournal struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFoundBlockJournal(path string) *FoundBlockJournal {
+	return &FoundBlockJournal{path: path}
+}
+
+func (j *FoundBlockJournal) Append(fb FoundBlock) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(fb)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Blocks returns the latest known state of every block in the journal, in the
+// order they were first found
+func (j *FoundBlockJournal) Blocks() ([]FoundBlock, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return []FoundBlock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	order := make([]string, 0)
+	latest := map[string]FoundBlock{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var fb FoundBlock
+		if json.Unmarshal(scanner.Bytes(), &fb) != nil {
+			// Torn write from a crash, skip it
+			continue
+		}
+		prev, ok := latest[fb.Hash]
+		if !ok {
+			order = append(order, fb.Hash)
+		} else if fb.Hex == "" {
+			fb.Hex = prev.Hex
+		}
+		latest[fb.Hash] = fb
+	}
+
+	blocks := make([]FoundBlock, 0, len(order))
+	for _, h := range order {
+		blocks = append(blocks, latest[h])
+	}
+	return blocks, scanner.Err()
+}
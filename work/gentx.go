@@ -0,0 +1,140 @@
+package work
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	btcwire "github.com/btcsuite/btcd/wire"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// The generation transaction ends with an OP_RETURN output committing to the
+// share's ref hash and the last txout nonce, followed by the lock time. Miners
+// only get to change the nonce.
+const (
+	genTxNonceLength = 8
+	genTxSuffixLen   = 4
+	genTxRefLength   = 32 + genTxNonceLength + genTxSuffixLen
+)
+
+// MaxCoinbaseTagLength keeps the tag to a single byte push. The network's
+// MaxCoinbaseSize may allow less.
+const MaxCoinbaseTagLength = 75
+
+// coinbaseHeightSize is the most the height push takes of the coinbase
+// script, with the push of the tag
+const coinbaseHeightSize = 5 + 1
+
+// CoinbaseScript returns the coinbase input script for a block at height,
+// with the (optional) tag pushed after the height
+func CoinbaseScript(height int64, tag []byte) []byte {
+	b := txscript.NewScriptBuilder().AddInt64(height)
+	if len(tag) > 0 {
+		b.AddData(tag)
+	}
+	script, _ := b.Script()
+	return script
+}
+
+// CoinbaseHeight returns the block height pushed at the start of a coinbase
+// script, as required by BIP34
+func CoinbaseHeight(script []byte) (int64, bool) {
+	if len(script) == 0 {
+		return 0, false
+	}
+	op := script[0]
+	switch {
+	case op == txscript.OP_0:
+		return 0, true
+	case op >= txscript.OP_1 && op <= txscript.OP_16:
+		return int64(op - txscript.OP_1 + 1), true
+	case op >= 1 && op <= 8 && len(script) > int(op):
+		height := int64(0)
+		for i := int(op); i > 0; i-- {
+			height = height<<8 | int64(script[i])
+		}
+		return height, true
+	}
+	return 0, false
+}
+
+// ValidateCoinbaseTag checks that tag is short, printable ASCII, and fits in
+// the coinbase of network n
+func ValidateCoinbaseTag(tag string, n p2pnet.Network) error {
+	max := MaxCoinbaseTagLength
+	if room := n.MaxCoinbaseSize - coinbaseHeightSize; room < max {
+		max = room
+	}
+	if len(tag) > max {
+		return fmt.Errorf("Coinbase tag is %d bytes, at most %d are allowed", len(tag), max)
+	}
+	for _, c := range tag {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("Coinbase tag may only contain printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// BuildGenTx creates the generation transaction paying out to payouts, with
+// the (optional) witness commitment as the first output and the OP_RETURN
+// commitment to refHash as the last one. The last txout nonce is left zero.
+func BuildGenTx(coinbase []byte, payouts []Payout, refHash *chainhash.Hash, witnessCommitment []byte) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx(1)
+	tx.AddTxIn(&btcwire.TxIn{
+		PreviousOutPoint: btcwire.OutPoint{Index: math.MaxUint32},
+		SignatureScript:  coinbase,
+		Sequence:         math.MaxUint32,
+	})
+	if len(witnessCommitment) > 0 {
+		tx.AddTxOut(btcwire.NewTxOut(0, witnessCommitment))
+	}
+	for _, p := range payouts {
+		tx.AddTxOut(btcwire.NewTxOut(int64(p.Amount), p.Script))
+	}
+	opReturn := make([]byte, 0, 42)
+	opReturn = append(opReturn, txscript.OP_RETURN, txscript.OP_DATA_40)
+	opReturn = append(opReturn, refHash[:]...)
+	opReturn = append(opReturn, make([]byte, genTxNonceLength)...)
+	tx.AddTxOut(btcwire.NewTxOut(0, opReturn))
+	return tx
+}
+
+// SerializeGenTx returns the serialization of gentx that its hash commits to,
+// so without witness data
+func SerializeGenTx(gentx *btcwire.MsgTx) []byte {
+	var buf bytes.Buffer
+	gentx.SerializeNoWitness(&buf)
+	return buf.Bytes()
+}
+
+// SplitGenTx splits a serialized generation transaction into the parts before
+// and after the last txout nonce, which is where the extranonces go
+func SplitGenTx(gentxBytes []byte) (prefix []byte, suffix []byte) {
+	prefix = gentxBytes[:len(gentxBytes)-genTxNonceLength-genTxSuffixLen]
+	suffix = gentxBytes[len(gentxBytes)-genTxSuffixLen:]
+	return prefix, suffix
+}
+
+// GenTxHashLink calculates the hash link peers use to verify the generation
+// transaction without having to know all of it
+func GenTxHashLink(gentxBytes []byte) wire.HashLink {
+	prefix := gentxBytes[:len(gentxBytes)-genTxRefLength]
+	d := util.NewSha256()
+	d.Write(prefix)
+	return wire.HashLink{State: string(d.MidState()), Length: uint64(len(prefix))}
+}
+
+// SpliceGenTx puts the last txout nonce into a split generation transaction
+func SpliceGenTx(prefix []byte, nonce uint64, suffix []byte) []byte {
+	b := make([]byte, 0, len(prefix)+genTxNonceLength+len(suffix))
+	b = append(b, prefix...)
+	b = binary.LittleEndian.AppendUint64(b, nonce)
+	return append(b, suffix...)
+}
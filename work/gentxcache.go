@@ -0,0 +1,102 @@
+package work
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// maxGenTxCache caps the number of payout sets cached for a template and
+// sharechain tip
+const maxGenTxCache = 4096
+
+// genTxParts is a generation transaction with its ref hash left zero. All
+// of it but the ref hash and the nonce only depends on the template and the
+// payouts, so it's the same for every job of a miner until the template or
+// the sharechain tip changes.
+type genTxParts struct {
+	gentx []byte
+	// link is the hash link of everything before the ref hash, and state
+	// the hash state after it
+	link  wire.HashLink
+	state util.Sha256Digest
+}
+
+func newGenTxParts(gentx []byte) *genTxParts {
+	p := &genTxParts{gentx: gentx, link: GenTxHashLink(gentx)}
+	prefix := gentx[:len(gentx)-genTxRefLength]
+	p.state.Reset()
+	p.state.Write(prefix)
+	return p
+}
+
+// withRef returns the generation transaction committing to refHash, and the
+// hash state after everything before the nonce
+func (p *genTxParts) withRef(refHash *chainhash.Hash) ([]byte, *util.Sha256Digest) {
+	gentx := make([]byte, len(p.gentx))
+	copy(gentx, p.gentx)
+	copy(gentx[len(gentx)-genTxRefLength:], refHash[:])
+	state := p.state
+	state.Write(refHash[:])
+	return gentx, &state
+}
+
+type genTxKey struct {
+	finderScript string
+	coinbase     string
+	solo         bool
+}
+
+// genTxCache keeps the generation transactions built for the current
+// template and sharechain tip, by payout set. Computing the payouts walks
+// the whole sharechain window, which was most of the work of a job.
+type genTxCache struct {
+	lock     sync.Mutex
+	template *BlockTemplate
+	tip      chainhash.Hash
+	parts    map[genTxKey]*genTxParts
+}
+
+// get returns the cached parts for the key, building them with build if the
+// key, template or tip is new
+func (c *genTxCache) get(bt *BlockTemplate, tip *chainhash.Hash, key genTxKey, build func() []byte) *genTxParts {
+	c.lock.Lock()
+	if c.template != bt || c.tip != *tip || len(c.parts) >= maxGenTxCache {
+		c.template, c.tip, c.parts = bt, *tip, map[genTxKey]*genTxParts{}
+	}
+	p, ok := c.parts[key]
+	c.lock.Unlock()
+	if ok {
+		return p
+	}
+
+	// Built outside the lock, two jobs racing for the same key build the
+	// same parts
+	p = newGenTxParts(build())
+	c.lock.Lock()
+	if c.template == bt && c.tip == *tip {
+		c.parts[key] = p
+	}
+	c.lock.Unlock()
+	return p
+}
+
+// genTxHash returns the hash of the job's generation transaction with the
+// given last txout nonce. Only the nonce and lock time are hashed when the
+// hash state of the prefix is known.
+func (j *Job) genTxHash(extranonce uint64) *chainhash.Hash {
+	var h [util.Size]byte
+	if j.coinbaseState != nil && len(j.CoinbaseSuffix) == genTxSuffixLen {
+		var tail [genTxNonceLength + genTxSuffixLen]byte
+		binary.LittleEndian.PutUint64(tail[:], extranonce)
+		copy(tail[genTxNonceLength:], j.CoinbaseSuffix)
+		h = util.Sha256dResume(j.coinbaseState, tail[:])
+	} else {
+		h = util.Sha256dSum(SpliceGenTx(j.CoinbasePrefix, extranonce, j.CoinbaseSuffix))
+	}
+	hash := chainhash.Hash(h)
+	return &hash
+}
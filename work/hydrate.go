@@ -0,0 +1,117 @@
+package work
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/rejects"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// TxPeerWait is how long we wait for peers to send transactions that
+// neither our cache nor the daemon has. Peers send the transactions of a
+// share along with it, in remember_tx, so they are usually underway.
+var TxPeerWait = time.Second * 5
+
+// ResolveTransactions finds transactions by their hashes: in the cache, in
+// the daemon's mempool and finally among the ones peers send us
+func (wm *WorkManager) ResolveTransactions(hashes []*chainhash.Hash) ([]*btcwire.MsgTx, error) {
+	_, missing := wm.TxCache.GetAll(hashes)
+	if len(missing) > 0 && wm.Daemons != nil {
+		d := wm.Daemons.Active()
+		for _, h := range missing {
+			tx, err := d.GetRawTransaction(h)
+			if err != nil {
+				continue
+			}
+			wm.TxCache.Add(tx)
+		}
+	}
+
+	deadline := clock.Now().Add(TxPeerWait)
+	for {
+		txs, missing := wm.TxCache.GetAll(hashes)
+		if len(missing) == 0 {
+			wm.TxCache.Touch(hashes)
+			return txs, nil
+		}
+		if clock.Now().After(deadline) {
+			return nil, fmt.Errorf("Could not find %d of %d transactions, including %s", len(missing), len(hashes), missing[0].String())
+		}
+		clock.Sleep(time.Millisecond * 250)
+	}
+}
+
+// ShareBlock rebuilds the full block of a share, which needs the generation
+// transaction recreated from the sharechain and all transactions the share
+// refers to
+func (wm *WorkManager) ShareBlock(s *wire.Share) (*btcwire.MsgBlock, error) {
+	s, err := s.Decoded(wm.Network)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := wm.ShareChain.GetShareTxHashes(s)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := wm.ResolveTransactions(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := s.ShareInfo.ShareData
+	payouts, err := wm.ShareChain.GetSharePayouts(s, wm.Network)
+	if err != nil {
+		return nil, err
+	}
+	refHash, err := wire.GetRefHash(wm.Network, s.ShareInfo, s.RefMerkleLink, s.Type)
+	if err != nil {
+		return nil, err
+	}
+	var witnessCommitment []byte
+	if s.Type >= wire.SegwitShareVersion {
+		witnessCommitment = WitnessCommitmentScript(s.ShareInfo.SegwitData.WTXIDMerkleRoot)
+	}
+	gentxBytes := SerializeGenTx(BuildGenTx([]byte(sd.CoinBase), payouts, refHash, witnessCommitment))
+	prefix, suffix := SplitGenTx(gentxBytes)
+	gentxBytes = SpliceGenTx(prefix, s.LastTxOutNonce, suffix)
+	gentxHash, _ := chainhash.NewHash(util.Sha256d(gentxBytes))
+	if !gentxHash.IsEqual(s.GenTXHash) {
+		wm.ShareChain.rejectShare(s, rejects.BadGenTx)
+		return nil, fmt.Errorf("Recreated generation transaction of share %s does not match its hash", s.Hash.String())
+	}
+
+	j := &Job{
+		Template:       &BlockTemplate{MerkleBranch: s.MerkleLink, Transactions: txs},
+		Share:          *s,
+		CoinbasePrefix: prefix,
+		CoinbaseSuffix: suffix,
+	}
+	return JobBlock(j, s.LastTxOutNonce, s.MinHeader.Timestamp, s.MinHeader.Nonce)
+}
+
+// WatchBlockSolutions submits blocks solved by shares from peers. The
+// finder submits them too, but more nodes submitting makes it more likely
+// the block propagates in time.
+func (wm *WorkManager) WatchBlockSolutions() {
+	for s := range wm.ShareChain.BlockSolutionChannel {
+		if wm.stale.has(s.Hash) {
+			// Ours, submitted already
+			continue
+		}
+		wm.logger().Infof("Share %s from a peer solves a block, submitting it", s.Hash.String())
+		b, err := wm.ShareBlock(s)
+		if err != nil {
+			wm.logger().Warnf("Could not rebuild block of share %s: %s", s.Hash.String(), err.Error())
+			continue
+		}
+		err = wm.Submitter.SubmitBlock(b)
+		if err != nil {
+			wm.logger().Warnf("Submitting block of share %s failed: %s", s.Hash.String(), err.Error())
+		}
+	}
+}
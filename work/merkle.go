@@ -0,0 +1,123 @@
+package work
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/util"
+)
+
+// nodePool holds the scratch space to concatenate two merkle nodes in
+var nodePool = sync.Pool{New: func() interface{} { return new([64]byte) }}
+
+func hashMerkleNodes(left, right *chainhash.Hash) *chainhash.Hash {
+	b := nodePool.Get().(*[64]byte)
+	copy(b[:], left[:])
+	copy(b[32:], right[:])
+	h := chainhash.Hash(util.Sha256dSum(b[:]))
+	nodePool.Put(b)
+	return &h
+}
+
+// MerkleParallelThreshold is the number of hashes from which the levels of
+// a merkle tree, and the wtxids of a template, are hashed by several
+// goroutines. 0 always hashes serially.
+var MerkleParallelThreshold = 1024
+
+// parallelFor calls f for 0 to n-1, split over the CPUs when n reaches
+// MerkleParallelThreshold
+func parallelFor(n int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if MerkleParallelThreshold == 0 || n < MerkleParallelThreshold || workers == 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	chunk := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				f(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// hashPairs hashes the pairs of a tree level of even length into the next
+func hashPairs(level []*chainhash.Hash) []*chainhash.Hash {
+	next := make([]*chainhash.Hash, len(level)/2)
+	parallelFor(len(next), func(i int) {
+		next[i] = hashMerkleNodes(level[2*i], level[2*i+1])
+	})
+	return next
+}
+
+// CalcMerkleBranch returns the merkle link for the generation transaction (at
+// index 0) given the hashes of all other transactions in the block
+func CalcMerkleBranch(txHashes []*chainhash.Hash) []*chainhash.Hash {
+	branch := make([]*chainhash.Hash, 0)
+	level := append([]*chainhash.Hash{nil}, txHashes...)
+	for len(level) > 1 {
+		branch = append(branch, level[1])
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		level = append([]*chainhash.Hash{nil}, hashPairs(level[2:])...)
+	}
+	return branch
+}
+
+// CalcMerkleRoot calculates the merkle root over a full list of hashes
+func CalcMerkleRoot(hashes []*chainhash.Hash) *chainhash.Hash {
+	if len(hashes) == 0 {
+		return &chainhash.Hash{}
+	}
+	level := make([]*chainhash.Hash, len(hashes))
+	copy(level, hashes)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		level = hashPairs(level)
+	}
+	return level[0]
+}
+
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// CalcWitnessMerkleRoot returns the merkle root over the wtxids of txs,
+// which are all transactions in the block except the coinbase
+func CalcWitnessMerkleRoot(txs []*btcwire.MsgTx) *chainhash.Hash {
+	wtxids := make([]*chainhash.Hash, len(txs)+1)
+	// The coinbase's wtxid is defined to be all zeroes
+	wtxids[0] = &chainhash.Hash{}
+	parallelFor(len(txs), func(i int) {
+		h := txs[i].WitnessHash()
+		wtxids[i+1] = &h
+	})
+	return CalcMerkleRoot(wtxids)
+}
+
+// WitnessCommitmentScript returns the output script committing to the
+// witness merkle root
+func WitnessCommitmentScript(witnessRoot *chainhash.Hash) []byte {
+	// The witness reserved value in the coinbase is all zeroes
+	b := make([]byte, 64)
+	copy(b, witnessRoot[:])
+	commitment := util.Sha256d(b)
+
+	script := make([]byte, 0, len(witnessCommitmentHeader)+len(commitment))
+	script = append(script, witnessCommitmentHeader...)
+	return append(script, commitment...)
+}
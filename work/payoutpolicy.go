@@ -0,0 +1,172 @@
+package work
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// PayoutPolicy splits the block reward among the miners of the sharechain.
+// The outputs of every share's generation transaction are checked against
+// it, so all nodes of a network must use the same one: the public networks
+// use PPLNS, a private network can name another in its definition.
+type PayoutPolicy interface {
+	// Payouts returns the outputs of the generation transaction of a new
+	// share on top of previous, found by the miner paid to finderScript.
+	// The donation output is always included and always the last one.
+	Payouts(sc *ShareChain, previous *chainhash.Hash, subsidy uint64, finderScript []byte, blockTarget *big.Int, n p2pnet.Network) []Payout
+	// Expected returns what every payout script would get from a block
+	// found on top of best right now, by any miner
+	Expected(sc *ShareChain, best *chainhash.Hash, subsidy uint64, blockTarget *big.Int, n p2pnet.Network) map[string]uint64
+}
+
+// DefaultPayoutPolicy is the policy of networks that don't name one
+const DefaultPayoutPolicy = "pplns"
+
+var (
+	payoutPolicies     = map[string]PayoutPolicy{}
+	payoutPoliciesLock sync.RWMutex
+)
+
+func init() {
+	RegisterPayoutPolicy(DefaultPayoutPolicy, PPLNS{})
+}
+
+// RegisterPayoutPolicy makes a payout policy available to network
+// definitions. Registering an existing name replaces it.
+func RegisterPayoutPolicy(name string, p PayoutPolicy) {
+	payoutPoliciesLock.Lock()
+	defer payoutPoliciesLock.Unlock()
+	payoutPolicies[name] = p
+}
+
+// GetPayoutPolicy returns the payout policy with the given name, the
+// default one if name is empty
+func GetPayoutPolicy(name string) (PayoutPolicy, error) {
+	if name == "" {
+		name = DefaultPayoutPolicy
+	}
+	payoutPoliciesLock.RLock()
+	defer payoutPoliciesLock.RUnlock()
+	p, ok := payoutPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown payout policy %s", name)
+	}
+	return p, nil
+}
+
+// PayoutPolicies returns the names of all registered payout policies
+func PayoutPolicies() []string {
+	payoutPoliciesLock.RLock()
+	defer payoutPoliciesLock.RUnlock()
+	names := make([]string, 0, len(payoutPolicies))
+	for n := range payoutPolicies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// payoutPolicy returns the policy of the sharechain's network. Networks are
+// checked for a known policy before a node starts, tools that read a
+// sharechain of an unknown one get the default.
+func (sc *ShareChain) payoutPolicy() PayoutPolicy {
+	p, err := GetPayoutPolicy(sc.Network.PayoutPolicy)
+	if err != nil {
+		return PPLNS{}
+	}
+	return p
+}
+
+// PPLNS is the payout of the p2pool network: every miner is paid by the
+// work of their shares in the last Spread blocks' worth of work, pay per
+// last N shares.
+type PPLNS struct{}
+
+// Payouts pays the miners of the shares before previous by their work, and
+// the finder a bonus.
+//
+// The amounts must match those of the Python p2pool to the satoshi, so this
+// follows its order of operations: each payee gets subsidy*199*weight /
+// (200*total weight) rounded down, the finder gets subsidy/200 on top and
+// everything left, the donation weight and the rounding, goes to the
+// donation. Like there, the weights are counted from the share before
+// previous, so previous itself earns nothing from the block.
+func (PPLNS) Payouts(sc *ShareChain, previous *chainhash.Hash, subsidy uint64, finderScript []byte, blockTarget *big.Int, n p2pnet.Network) []Payout {
+	height := sc.GetHeight(previous, n.ChainLength)
+	maxShares := height - 1
+	if maxShares < 0 {
+		maxShares = 0
+	}
+	var start *chainhash.Hash
+	if s := sc.GetShare(previous); s != nil {
+		start = s.Share.ShareInfo.ShareData.PreviousShareHash
+	}
+	desiredWeight := big.NewInt(0).Mul(big.NewInt(int64(65535*n.Spread)), TargetToAverageAttempts(blockTarget))
+	weights, totalWeight, _ := sc.GetCumulativeWeights(start, maxShares, desiredWeight, n)
+
+	bigSubsidy := big.NewInt(0).SetUint64(subsidy)
+	amounts := map[string]uint64{}
+	donationKey := string(wire.DonationScript(n))
+
+	if totalWeight.Sign() > 0 {
+		denominator := big.NewInt(0).Mul(big.NewInt(200), totalWeight)
+		for script, weight := range weights {
+			a := big.NewInt(0).Mul(bigSubsidy, big.NewInt(0).Mul(big.NewInt(199), weight))
+			amounts[script] = a.Div(a, denominator).Uint64()
+		}
+	}
+	amounts[string(finderScript)] += subsidy / 200
+
+	sum := uint64(0)
+	for _, a := range amounts {
+		sum += a
+	}
+	amounts[donationKey] += subsidy - sum
+
+	payouts := make([]Payout, 0, len(amounts))
+	for script, amount := range amounts {
+		payouts = append(payouts, Payout{Script: []byte(script), Amount: amount})
+	}
+	sortPayouts(payouts, []byte(donationKey))
+	if len(payouts) > maxPayouts {
+		payouts = payouts[len(payouts)-maxPayouts:]
+	}
+	// Empty outputs are only left out after applying the limit, like the
+	// Python p2pool does
+	filtered := payouts[:0]
+	for _, p := range payouts {
+		if p.Amount > 0 || bytes.Equal(p.Script, []byte(donationKey)) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// Expected leaves out the finder's bonus. Rounding leftovers go to the
+// donation.
+func (PPLNS) Expected(sc *ShareChain, best *chainhash.Hash, subsidy uint64, blockTarget *big.Int, n p2pnet.Network) map[string]uint64 {
+	height := sc.GetHeight(best, n.ChainLength)
+	desiredWeight := big.NewInt(0).Mul(big.NewInt(int64(65535*n.Spread)), TargetToAverageAttempts(blockTarget))
+	weights, totalWeight, _ := sc.GetCumulativeWeights(best, height, desiredWeight, n)
+
+	amounts := map[string]uint64{}
+	if totalWeight.Sign() == 0 {
+		return amounts
+	}
+	bigSubsidy := big.NewInt(0).SetUint64(subsidy)
+	sum := uint64(0)
+	for script, weight := range weights {
+		a := big.NewInt(0).Mul(bigSubsidy, weight)
+		amounts[script] = a.Div(a, totalWeight).Uint64()
+		sum += amounts[script]
+	}
+	amounts[string(wire.DonationScript(n))] += subsidy - sum
+	return amounts
+}
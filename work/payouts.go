@@ -0,0 +1,131 @@
+package work
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+type Payout struct {
+	Script []byte
+	Amount uint64
+}
+
+// ShareScript returns the output script a share's miner is paid to
+func ShareScript(s *wire.Share, n p2pnet.Network) ([]byte, error) {
+	return PubKeyHashToScript(s.ShareInfo.ShareData.PubKeyHash, s.ShareInfo.ShareData.PubKeyHashVersion, n)
+}
+
+// GetCumulativeWeights walks back at most maxShares shares from start and sums
+// up the work done per payout script until desiredWeight is reached. The share
+// that crosses desiredWeight is only counted partially.
+func (sc *ShareChain) GetCumulativeWeights(start *chainhash.Hash, maxShares int, desiredWeight *big.Int, n p2pnet.Network) (weights map[string]*big.Int, totalWeight *big.Int, donationWeight *big.Int) {
+	weights = map[string]*big.Int{}
+	totalWeight = big.NewInt(0)
+	donationWeight = big.NewInt(0)
+
+	s := sc.GetShare(start)
+	for i := 0; i < maxShares && s != nil && totalWeight.Cmp(desiredWeight) < 0; i++ {
+		sd := s.Share.ShareInfo.ShareData
+		att := TargetToAverageAttempts(blockchain.CompactToBig(uint32(s.Share.ShareInfo.Bits)))
+		shareWeight := big.NewInt(0).Mul(att, big.NewInt(int64(65535-sd.Donation)))
+		shareDonation := big.NewInt(0).Mul(att, big.NewInt(int64(sd.Donation)))
+		shareTotal := big.NewInt(0).Mul(att, big.NewInt(65535))
+
+		if big.NewInt(0).Add(totalWeight, shareTotal).Cmp(desiredWeight) > 0 {
+			// Only count the part of this share that fits
+			remaining := big.NewInt(0).Sub(desiredWeight, totalWeight)
+			remaining.Div(remaining, big.NewInt(65535))
+			perUnit := big.NewInt(0).Div(shareTotal, big.NewInt(65535))
+			shareWeight.Mul(remaining, shareWeight).Div(shareWeight, perUnit)
+			shareDonation.Mul(remaining, shareDonation).Div(shareDonation, perUnit)
+			shareTotal = big.NewInt(0).Mul(remaining, big.NewInt(65535))
+		}
+
+		script, err := ShareScript(s.Share, n)
+		if err == nil {
+			key := string(script)
+			if _, ok := weights[key]; !ok {
+				weights[key] = big.NewInt(0)
+			}
+			weights[key].Add(weights[key], shareWeight)
+		} else {
+			// Unpayable share, its weight goes to the donation
+			shareDonation.Add(shareDonation, shareWeight)
+		}
+		donationWeight.Add(donationWeight, shareDonation)
+		totalWeight.Add(totalWeight, shareTotal)
+		s = s.Previous()
+	}
+	return weights, totalWeight, donationWeight
+}
+
+// GetDonationRate returns the fraction of the work in the last maxShares
+// shares before start that was donated, weighting each share's advertised
+// donation by its work
+func (sc *ShareChain) GetDonationRate(start *chainhash.Hash, maxShares int) float64 {
+	total := big.NewInt(0)
+	donated := big.NewInt(0)
+	s := sc.GetShare(start)
+	for i := 0; i < maxShares && s != nil; i++ {
+		att := TargetToAverageAttempts(blockchain.CompactToBig(uint32(s.Share.ShareInfo.Bits)))
+		total.Add(total, big.NewInt(0).Mul(att, big.NewInt(65535)))
+		donated.Add(donated, big.NewInt(0).Mul(att, big.NewInt(int64(s.Share.ShareInfo.ShareData.Donation))))
+		s = s.Previous()
+	}
+	if total.Sign() == 0 {
+		return 0
+	}
+	rate, _ := big.NewRat(0, 1).SetFrac(donated, total).Float64()
+	return rate
+}
+
+// maxPayouts limits the number of outputs of the generation transaction to
+// keep blocks below the size limit. The smallest payouts are left out.
+const maxPayouts = 4000
+
+// GetPayouts calculates the outputs of the generation transaction for a new
+// share on top of previous, found by the miner paid to finderScript, with
+// the payout policy of the sharechain
+func (sc *ShareChain) GetPayouts(previous *chainhash.Hash, subsidy uint64, finderScript []byte, blockTarget *big.Int, n p2pnet.Network) []Payout {
+	return sc.payoutPolicy().Payouts(sc, previous, subsidy, finderScript, blockTarget, n)
+}
+
+// GetSharePayouts returns the generation transaction outputs of a share, as
+// they are paid out if the share is a block
+func (sc *ShareChain) GetSharePayouts(s *wire.Share, n p2pnet.Network) ([]Payout, error) {
+	sd := s.ShareInfo.ShareData
+	finderScript, err := ShareScript(s, n)
+	if err != nil {
+		return nil, err
+	}
+	blockTarget := blockchain.CompactToBig(s.MinHeader.Bits)
+	return sc.GetPayouts(sd.PreviousShareHash, sd.Subsidy, finderScript, blockTarget, n), nil
+}
+
+// sortPayouts orders payouts by amount, then script, with the donation last
+func sortPayouts(payouts []Payout, donation []byte) {
+	sort.SliceStable(payouts, func(i, j int) bool {
+		iDonation := bytes.Equal(payouts[i].Script, donation)
+		jDonation := bytes.Equal(payouts[j].Script, donation)
+		if iDonation != jDonation {
+			return jDonation
+		}
+		if payouts[i].Amount != payouts[j].Amount {
+			return payouts[i].Amount < payouts[j].Amount
+		}
+		return bytes.Compare(payouts[i].Script, payouts[j].Script) < 0
+	})
+}
+
+// GetExpectedPayouts returns what every payout script would get from a block
+// found on top of best right now, with the payout policy of the sharechain.
+// This is what p2pool shows as the current payouts.
+func (sc *ShareChain) GetExpectedPayouts(best *chainhash.Hash, subsidy uint64, blockTarget *big.Int, n p2pnet.Network) map[string]uint64 {
+	return sc.payoutPolicy().Expected(sc, best, subsidy, blockTarget, n)
+}
@@ -0,0 +1,111 @@
+package work
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// payoutVector is a sharechain and the outputs the Python p2pool pays for
+// a block found on top of it, see contrib/payoutvectors.py. Miners are
+// numbered, -1 is the donation.
+type payoutVector struct {
+	Name        string      `json:"name"`
+	Spread      int         `json:"spread"`
+	ChainLength int         `json:"chain_length"`
+	Subsidy     uint64      `json:"subsidy"`
+	BlockBits   uint32      `json:"block_bits"`
+	Finder      int64       `json:"finder"`
+	Shares      [][3]uint32 `json:"shares"`
+	Payouts     [][2]int64  `json:"payouts"`
+}
+
+func minerPubKeyHash(miner int64) []byte {
+	pkh := make([]byte, 20)
+	binary.BigEndian.PutUint32(pkh[16:], uint32(miner))
+	return pkh
+}
+
+func minerScript(t *testing.T, miner int64, n p2pnet.Network) []byte {
+	if miner == -1 {
+		return wire.DonationScript(n)
+	}
+	script, err := PubKeyHashToScript(minerPubKeyHash(miner), n.ChainParams.PubKeyHashAddrID, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+// payoutChain links up the shares of v, oldest first, and returns the tip
+func payoutChain(v payoutVector, n p2pnet.Network) (*ShareChain, *chainhash.Hash) {
+	sc := &ShareChain{Network: n, AllShares: NewShareIndex(), AllSharesByPrev: NewShareIndex()}
+	var previous *ChainShare
+	prevHash := &chainhash.Hash{}
+	for i, s := range v.Shares {
+		hash := chainhash.Hash{}
+		binary.LittleEndian.PutUint32(hash[:], uint32(i+1))
+		share := &wire.Share{Hash: &hash}
+		share.ShareInfo.Bits = int32(s[1])
+		share.ShareInfo.ShareData = wire.ShareData{
+			PreviousShareHash: prevHash,
+			PubKeyHash:        minerPubKeyHash(int64(s[0])),
+			PubKeyHashVersion: n.ChainParams.PubKeyHashAddrID,
+			Donation:          uint16(s[2]),
+		}
+		cs := &ChainShare{Share: share}
+		if previous != nil {
+			link(previous, cs)
+		}
+		sc.AddChainShare(cs)
+		previous, prevHash = cs, &hash
+	}
+	sc.tip.Store(previous)
+	return sc, prevHash
+}
+
+// TestPayoutVectors checks PPLNS payouts to the satoshi against those of
+// contrib/payoutvectors.py, a port of the Python p2pool's payout
+// arithmetic: donations, rounding leftovers, the window cutting a share
+// short, tiny payouts and the limit of 4000 outputs
+func TestPayoutVectors(t *testing.T) {
+	b, err := os.ReadFile("testdata/payout_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []payoutVector
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			n := p2pnet.Vertcoin()
+			n.Spread = v.Spread
+			n.ChainLength = v.ChainLength
+			sc, tip := payoutChain(v, n)
+			blockTarget := blockchain.CompactToBig(v.BlockBits)
+
+			got := PPLNS{}.Payouts(sc, tip, v.Subsidy, minerScript(t, v.Finder, n), blockTarget, n)
+			expected := make([]Payout, len(v.Payouts))
+			for i, p := range v.Payouts {
+				expected[i] = Payout{Script: minerScript(t, p[0], n), Amount: uint64(p[1])}
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("Got %d payouts, expected %d", len(got), len(expected))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i].Script, expected[i].Script) || got[i].Amount != expected[i].Amount {
+					t.Fatalf("Payout %d is %d to %x, expected %d to %x", i, got[i].Amount, got[i].Script, expected[i].Amount, expected[i].Script)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package work
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// PoolBlock is a block found by anyone in the pool
+type PoolBlock struct {
+	Hash      string `json:"hash"`
+	Height    int64  `json:"height"`
+	Finder    string `json:"finder"`
+	Timestamp int64  `json:"timestamp"`
+	// Value is the coinbase value in satoshis
+	Value uint64 `json:"value"`
+	// Payouts are the coinbase outputs in satoshis by address, or by script
+	// in hex for outputs that don't pay to an address
+	Payouts map[string]uint64 `json:"payouts,omitempty"`
+}
+
+// PoolBlockLog keeps every block the pool found in an append-only file, so
+// the history outlives the sharechain, which only reaches back a few days.
+type PoolBlockLog struct {
+	// Log gets the records of the block log, the chain's logger if nil
+	Log *logging.SubsystemLogger
+
+	path   string
+	lock   sync.Mutex
+	blocks []PoolBlock
+	known  map[string]bool
+}
+
+func NewPoolBlockLog(path string) *PoolBlockLog {
+	return &PoolBlockLog{path: path, known: map[string]bool{}}
+}
+
+func (l *PoolBlockLog) logger() *logging.SubsystemLogger {
+	return l.Log.Or(log)
+}
+
+// Load reads the blocks recorded before
+func (l *PoolBlockLog) Load() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var b PoolBlock
+		if json.Unmarshal(scanner.Bytes(), &b) != nil || l.known[b.Hash] {
+			continue
+		}
+		l.known[b.Hash] = true
+		l.blocks = append(l.blocks, b)
+	}
+	return scanner.Err()
+}
+
+// Record adds a block, if it isn't known yet
+func (l *PoolBlockLog) Record(b PoolBlock) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.known[b.Hash] {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	j, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(j, '\n'))
+	if err != nil {
+		return err
+	}
+	l.known[b.Hash] = true
+	l.blocks = append(l.blocks, b)
+	return nil
+}
+
+// Blocks returns the recorded blocks, newest first
+func (l *PoolBlockLog) Blocks() []PoolBlock {
+	l.lock.Lock()
+	blocks := make([]PoolBlock, len(l.blocks))
+	copy(blocks, l.blocks)
+	l.lock.Unlock()
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Timestamp > blocks[j].Timestamp
+	})
+	return blocks
+}
+
+// Run records the blocks already in the sharechain and then every new share
+// of its network that is a block
+func (l *PoolBlockLog) Run(sc *ShareChain) {
+	sub := events.SubscribeNetwork(sc.Network.Name, 256, events.LocalShare, events.RemoteShare)
+	go func() {
+		for e := range sub.Events {
+			se, ok := e.Data.(events.Share)
+			if !ok || !se.Block {
+				continue
+			}
+			h, err := chainhash.NewHashFromStr(se.Hash)
+			if err != nil {
+				continue
+			}
+			if cs := sc.GetShare(h); cs != nil {
+				l.record(sc, cs.Share)
+			}
+		}
+	}()
+	for cs := sc.GetShare(sc.GetTipHash()); cs != nil; cs = cs.Previous() {
+		if cs.Share.IsBlock() {
+			l.record(sc, cs.Share)
+		}
+	}
+}
+
+func (l *PoolBlockLog) record(sc *ShareChain, s *wire.Share) {
+	n := sc.Network
+	b := PoolBlockFromShare(s, n)
+	payouts, err := sc.GetSharePayouts(s, n)
+	if err == nil {
+		b.Payouts = map[string]uint64{}
+		for _, p := range payouts {
+			addr, err := ScriptToAddress(p.Script, n)
+			if err != nil {
+				addr = hex.EncodeToString(p.Script)
+			}
+			b.Payouts[addr] += p.Amount
+		}
+	}
+	err = l.Record(b)
+	if err != nil {
+		l.logger().Warnf("Could not record block %s: %s", s.Hash.String(), err.Error())
+	}
+}
+
+// PoolBlockFromShare describes a block share of network n
+func PoolBlockFromShare(s *wire.Share, n p2pnet.Network) PoolBlock {
+	sd := s.ShareInfo.ShareData
+	b := PoolBlock{
+		Hash:      s.Hash.String(),
+		Timestamp: int64(s.ShareInfo.Timestamp),
+		Value:     sd.Subsidy,
+		Height:    -1,
+	}
+	if height, ok := CoinbaseHeight([]byte(sd.CoinBase)); ok {
+		b.Height = height
+	}
+	b.Finder = shareEvent(s, n).Address
+	return b
+}
@@ -0,0 +1,143 @@
+package work
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/btcsuite/btcd/blockchain"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+// quickConfig is how many random values each property is tried on
+var quickConfig = &quick.Config{MaxCount: 10000}
+
+// TestAddressRoundTrip checks the payout addresses of every kind on the
+// Vertcoin networks decode to the hash and version they were made from
+func TestAddressRoundTrip(t *testing.T) {
+	for _, n := range []p2pnet.Network{p2pnet.Vertcoin(), p2pnet.VertcoinTestnet(), p2pnet.VertcoinRegtest()} {
+		for _, version := range []uint8{n.ChainParams.PubKeyHashAddrID, n.ChainParams.ScriptHashAddrID, PubKeyHashVersionWitness} {
+			err := quick.Check(func(hash [20]byte) bool {
+				address, err := PubKeyHashToAddress(hash[:], version, n)
+				if err != nil {
+					return false
+				}
+				gotHash, gotVersion, err := AddressToPubKeyHash(address.EncodeAddress(), n)
+				return err == nil && bytes.Equal(gotHash, hash[:]) && gotVersion == version
+			}, &quick.Config{MaxCount: 100})
+			if err != nil {
+				t.Errorf("%s, version %d: %s", n.Name, version, err.Error())
+			}
+		}
+	}
+}
+
+// TestAttemptsOrder checks an easier target never takes more attempts
+func TestAttemptsOrder(t *testing.T) {
+	err := quick.Check(func(a, b Uint256) bool {
+		if a.Cmp(b.Int) > 0 {
+			a, b = b, a
+		}
+		return TargetToAverageAttempts(a.Int).Cmp(TargetToAverageAttempts(b.Int)) >= 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAttemptsInverse checks converting attempts back gives a target at
+// least as easy that takes the same attempts
+func TestAttemptsInverse(t *testing.T) {
+	err := quick.Check(func(target Uint256) bool {
+		attempts := TargetToAverageAttempts(target.Int)
+		back := AverageAttemptsToTarget(attempts)
+		return back.Cmp(target.Int) >= 0 && TargetToAverageAttempts(back).Cmp(attempts) == 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestDifficultyOrder checks a higher difficulty never has an easier target
+func TestDifficultyOrder(t *testing.T) {
+	err := quick.Check(func(a, b Difficulty) bool {
+		if a > b {
+			a, b = b, a
+		}
+		return DifficultyToTarget(float64(a)).Cmp(DifficultyToTarget(float64(b))) >= 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDifficultyInverse(t *testing.T) {
+	err := quick.Check(func(d Difficulty) bool {
+		target := DifficultyToTarget(float64(d))
+		if target.Sign() == 0 || target.Cmp(big.NewInt(0).Sub(two256, big.NewInt(1))) == 0 {
+			// Clipped, nothing to get back
+			return true
+		}
+		back := TargetToDifficulty(target)
+		// Flooring the target loses precision once it's small
+		f, _ := big.NewFloat(0).SetInt(target).Float64()
+		tolerance := 1e-12 + 1/f
+		return math.Abs(back-float64(d))/float64(d) <= tolerance
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCompactRounding checks bits round targets down, keeping 23 bits of
+// precision
+func TestCompactRounding(t *testing.T) {
+	err := quick.Check(func(target Uint256) bool {
+		if target.Sign() == 0 {
+			return true
+		}
+		back := blockchain.CompactToBig(blockchain.BigToCompact(target.Int))
+		if back.Cmp(target.Int) > 0 {
+			return false
+		}
+		lost := big.NewInt(0).Sub(target.Int, back)
+		return lost.Lsh(lost, 15).Cmp(target.Int) <= 0
+	}, quickConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Uint256 is a number below 2^256, of any bit length, often all zeros, all
+// ones or a power of two
+type Uint256 struct{ *big.Int }
+
+func (Uint256) Generate(r *rand.Rand, size int) reflect.Value {
+	bits := r.Intn(257)
+	v := big.NewInt(0)
+	switch r.Intn(8) {
+	case 0:
+		v.Lsh(big.NewInt(1), uint(bits))
+		return reflect.ValueOf(Uint256{v.Sub(v, big.NewInt(1))})
+	case 1:
+		if bits == 256 {
+			bits--
+		}
+		return reflect.ValueOf(Uint256{v.Lsh(big.NewInt(1), uint(bits))})
+	}
+	b := make([]byte, (bits+7)/8)
+	r.Read(b)
+	v.SetBytes(b)
+	return reflect.ValueOf(Uint256{v.Rsh(v, uint(len(b)*8-bits))})
+}
+
+// Difficulty is a positive difficulty between 1e-30 and 1e30
+type Difficulty float64
+
+func (Difficulty) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(Difficulty(math.Pow(10, r.Float64()*60-30)))
+}
@@ -0,0 +1,56 @@
+package work
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// checkRules checks a share against the rules of the network, returning
+// the reason it is rejected for if it breaks one. The transactions of lazy
+// shares, which we stored ourselves, aren't checked again. The targets are
+// checked against the previous share's if the chain has enough shares
+// before it to tell what they should be.
+func (sc *ShareChain) checkRules(s *wire.Share) (string, error) {
+	r := sc.Network.Rules
+	si := s.ShareInfo
+	if n := len(si.ShareData.CoinBase); n < r.MinCoinbaseSize || n > r.MaxCoinbaseSize {
+		return "bad-coinbase", fmt.Errorf("Coinbase of %d bytes, not %d to %d", n, r.MinCoinbaseSize, r.MaxCoinbaseSize)
+	}
+	if !s.Lazy() {
+		if r.MaxNewTransactions > 0 && len(si.NewTransactionHashes) > r.MaxNewTransactions {
+			return "bad-tx-refs", fmt.Errorf("%d new transactions, at most %d are allowed", len(si.NewTransactionHashes), r.MaxNewTransactions)
+		}
+		for _, ref := range si.TransactionHashRefs {
+			if ref.ShareCount >= uint64(r.TxRefLimit) {
+				return "bad-tx-refs", fmt.Errorf("Refers to a transaction %d shares back, less than %d are allowed", ref.ShareCount, r.TxRefLimit)
+			}
+		}
+	}
+
+	// Targets are rounded down to their compact form, so are the bounds
+	maxTarget := blockchain.CompactToBig(uint32(si.MaxBits))
+	target := blockchain.CompactToBig(uint32(si.Bits))
+	if maxTarget.Sign() <= 0 || maxTarget.Cmp(r.MaxTarget) > 0 {
+		return "bad-target", fmt.Errorf("Maximum target %064x is out of range", maxTarget)
+	}
+	if target.Cmp(maxTarget) > 0 || target.Cmp(compactFloor(big.NewInt(0).Div(maxTarget, big.NewInt(int64(r.ShareTargetRange))))) < 0 {
+		return "bad-target", fmt.Errorf("Target %064x is out of the range of maximum target %064x", target, maxTarget)
+	}
+	prevHash := si.ShareData.PreviousShareHash
+	prev := sc.GetShare(prevHash)
+	if prev != nil && sc.GetHeight(prevHash, r.TargetLookbehind) >= r.TargetLookbehind {
+		low, high := maxTargetBounds(blockchain.CompactToBig(uint32(prev.Share.ShareInfo.MaxBits)), r)
+		if maxTarget.Cmp(compactFloor(low)) < 0 || maxTarget.Cmp(high) > 0 {
+			return "bad-target", fmt.Errorf("Maximum target %064x moved too far from the previous share's", maxTarget)
+		}
+	}
+	return "", nil
+}
+
+// compactFloor rounds a target down to what its compact form holds
+func compactFloor(target *big.Int) *big.Int {
+	return blockchain.CompactToBig(blockchain.BigToCompact(target))
+}
@@ -1,97 +1,232 @@
 package work
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/events"
 	"github.com/gertjaap/p2pool-go/logging"
 	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rejects"
+	"github.com/gertjaap/p2pool-go/util"
 	"github.com/gertjaap/p2pool-go/wire"
 )
 
+var log = logging.For("chain")
+
 type ShareChain struct {
-	SharesChannel    chan []wire.Share
+	// Network is the network of the shares, which sets the chain length
+	// and how shares are checked
+	Network          p2pnet.Network
+	SharesChannel    chan ReceivedShares
 	NeedShareChannel chan *chainhash.Hash
-	Tip              *ChainShare
-	Tail             *ChainShare
-	AllShares        map[string]*ChainShare
-	AllSharesByPrev  map[string]*ChainShare
-
-	disconnectedShares    []*wire.Share
-	disconnectedShareLock sync.Mutex
-	allSharesLock         sync.Mutex
+	// BlockSolutionChannel gets new shares that are also valid blocks
+	BlockSolutionChannel chan *wire.Share
+	AllShares            *ShareIndex
+	// AllSharesByPrev indexes shares by the hash of their previous share
+	AllSharesByPrev *ShareIndex
+	DataFile        string
+	// MaxShares caps the shares kept below the tip, if set. It's never less
+	// than the chain length payouts are computed over.
+	MaxShares int
+	// CommitDelay is how long new shares wait to be written, so the shares
+	// arriving meanwhile are written together. 0 writes every change right
+	// away.
+	CommitDelay time.Duration
+	// Clock is the network time of our shares, adjusted by the valid shares
+	// of peers
+	Clock *NetworkClock
+	// Added, if set, is called with the shares AddShares added, once they
+	// are in the chain
+	Added func(shares []*wire.Share)
+	// Log gets the chain's records, the package's logger if nil
+	Log *logging.SubsystemLogger
+
+	commitLock  sync.Mutex
+	commitTimer *time.Timer
+	// unsaved are the shares added since they were last written. pruned
+	// counts the shares dropped since DataFile was last rewritten, and
+	// rewrite is set once the journal won't do, see Flush. They're guarded
+	// by lock.
+	unsaved []*wire.Share
+	pruned  int
+	rewrite bool
+	// loading is set while LoadAsync runs
+	loading int32
+
+	// lock is held while the chain changes shape: it guards the
+	// disconnected shares, and serializes the changes of the tip, the tail
+	// and the links between shares. Those are atomic, so the chain can be
+	// walked without it.
+	lock               sync.Mutex
+	disconnectedShares []*wire.Share
+	tip                atomic.Pointer[ChainShare]
+	tail               atomic.Pointer[ChainShare]
 }
 
 type ChainShare struct {
-	Share    *wire.Share
-	Previous *ChainShare
-	Next     *ChainShare
+	Share *wire.Share
+
+	previous atomic.Pointer[ChainShare]
+	next     atomic.Pointer[ChainShare]
+	full     atomic.Pointer[wire.Share]
+}
+
+// Previous returns the share cs builds on, nil if it isn't known or pruned
+func (cs *ChainShare) Previous() *ChainShare {
+	return cs.previous.Load()
 }
 
-func NewShareChain() *ShareChain {
-	sc := &ShareChain{disconnectedShares: make([]*wire.Share, 0), allSharesLock: sync.Mutex{}, AllSharesByPrev: map[string]*ChainShare{}, AllShares: map[string]*ChainShare{}, disconnectedShareLock: sync.Mutex{}, SharesChannel: make(chan []wire.Share, 10), NeedShareChannel: make(chan *chainhash.Hash, 10)}
+// Next returns the share building on cs that was linked last, nil if none
+func (cs *ChainShare) Next() *ChainShare {
+	return cs.next.Load()
+}
+
+// link makes next build on previous
+func link(previous, next *ChainShare) {
+	next.previous.Store(previous)
+	previous.next.Store(next)
+}
+
+// Full returns the share with all its contents decoded. Shares loaded from
+// disk are lazy, they're decoded for network n the first time this is
+// called.
+func (cs *ChainShare) Full(n p2pnet.Network) (*wire.Share, error) {
+	if !cs.Share.Lazy() {
+		return cs.Share, nil
+	}
+	if full := cs.full.Load(); full != nil {
+		return full, nil
+	}
+	full, err := cs.Share.Decoded(n)
+	if err != nil {
+		return nil, err
+	}
+	cs.full.Store(full)
+	return full, nil
+}
+
+func NewShareChain(n p2pnet.Network) *ShareChain {
+	sc := &ShareChain{Network: n, disconnectedShares: make([]*wire.Share, 0), AllSharesByPrev: NewShareIndex(), AllShares: NewShareIndex(), SharesChannel: make(chan ReceivedShares, 10), NeedShareChannel: make(chan *chainhash.Hash, 10), BlockSolutionChannel: make(chan *wire.Share, 10), DataFile: "sharechain.dat", Clock: NewNetworkClock(DefaultClockSkew)}
 	go sc.ReadShareChan()
 	return sc
 }
 
+func (sc *ShareChain) logger() *logging.SubsystemLogger {
+	return sc.Log.Or(log)
+}
+
+// ReceivedShares are shares a peer sent us. New ones were just made, so
+// once they are found valid they tell the peer's time; replies to our
+// requests can be old.
+type ReceivedShares struct {
+	Peer   string
+	Shares []wire.Share
+	New    bool
+}
+
 func (sc *ShareChain) ReadShareChan() {
-	for s := range sc.SharesChannel {
-		sc.AddShares(s)
+	for r := range sc.SharesChannel {
+		added := sc.AddShares(r.Shares)
+		if r.New && len(added) > 0 {
+			newest := added[0].ShareInfo.Timestamp
+			for _, s := range added {
+				if s.ShareInfo.Timestamp > newest {
+					newest = s.ShareInfo.Timestamp
+				}
+			}
+			sc.Clock.AddSample(r.Peer, time.Unix(int64(newest), 0))
+		}
+		for _, s := range added {
+			events.PublishOn(sc.Network.Name, events.RemoteShare, shareEvent(s, sc.Network))
+		}
 	}
 }
 
 func (sc *ShareChain) AddChainShare(newChainShare *ChainShare) {
-	sc.allSharesLock.Lock()
-	sc.AllShares[newChainShare.Share.Hash.String()] = newChainShare
-	sc.AllSharesByPrev[newChainShare.Share.ShareInfo.ShareData.PreviousShareHash.String()] = newChainShare
-	sc.allSharesLock.Unlock()
+	sc.AllShares.Set(newChainShare.Share.Hash, newChainShare)
+	sc.AllSharesByPrev.Set(newChainShare.Share.ShareInfo.ShareData.PreviousShareHash, newChainShare)
+}
+
+// Tip returns the share at the top of the chain, nil if the chain is empty
+func (sc *ShareChain) Tip() *ChainShare {
+	return sc.tip.Load()
+}
+
+// Tail returns the lowest share of the chain the tip builds on, nil if the
+// chain is empty
+func (sc *ShareChain) Tail() *ChainShare {
+	return sc.tail.Load()
 }
 
 func (sc *ShareChain) Resolve(skipCommit bool) {
-	logging.Debugf("Resolving sharechain")
+	sc.logger().Debugf("Resolving sharechain")
+	sc.lock.Lock()
 	if len(sc.disconnectedShares) == 0 {
+		sc.lock.Unlock()
 		return
 	}
 
-	if sc.Tip == nil {
-		sc.disconnectedShareLock.Lock()
+	if sc.Tip() == nil {
 		newChainShare := &ChainShare{Share: sc.disconnectedShares[0]}
-		sc.Tip = newChainShare
 		sc.disconnectedShares = sc.disconnectedShares[1:]
-		sc.disconnectedShareLock.Unlock()
 		sc.AddChainShare(newChainShare)
-		sc.Tail = sc.Tip
+		sc.tip.Store(newChainShare)
+		sc.tail.Store(newChainShare)
 	}
 
 	for {
 		extended := false
-		sc.disconnectedShareLock.Lock()
 		newDisconnectedShares := make([]*wire.Share, 0)
 		for _, s := range sc.disconnectedShares {
-			_, ok := sc.AllShares[s.Hash.String()]
-			if ok {
+			if sc.AllShares.Has(s.Hash) {
 				// Duplicate
 				continue
 			}
 
-			es, ok := sc.AllShares[s.ShareInfo.ShareData.PreviousShareHash.String()]
-			if ok {
-				newChainShare := &ChainShare{Share: s, Previous: es}
-				es.Next = newChainShare
-				if es.Share.Hash.IsEqual(sc.Tip.Share.Hash) {
-					sc.Tip = newChainShare
+			if es := sc.AllShares.Get(s.ShareInfo.ShareData.PreviousShareHash); es != nil {
+				newChainShare := &ChainShare{Share: s}
+				link(es, newChainShare)
+				tip := sc.Tip()
+				if es == tip {
+					sc.tip.Store(newChainShare)
+					if s.TraceID != "" {
+						sc.logger().Trace(s.TraceID).Debugf("Share %s is the new tip", s.Hash.String())
+					}
+				} else {
+					sc.logger().Trace(s.TraceID).Debugf("Share %s forks off %d shares below the tip", s.Hash.String(), sc.depthOf(es))
+					events.PublishOn(sc.Network.Name, events.Fork, events.ForkInfo{
+						Share: shareEvent(s, sc.Network),
+						Tip:   tip.Share.Hash.String(),
+						Depth: sc.depthOf(es),
+					})
+					if sc.heavier(newChainShare) {
+						sc.logger().Trace(s.TraceID).Infof("Fork at share %s has more work, switching the tip to it from %s", s.Hash.String(), tip.Share.Hash.String())
+						events.PublishOn(sc.Network.Name, events.Reorg, events.ReorgInfo{
+							OldTip: tip.Share.Hash.String(),
+							NewTip: s.Hash.String(),
+							Depth:  sc.depthOf(es),
+						})
+						sc.tip.Store(newChainShare)
+					}
 				}
 				sc.AddChainShare(newChainShare)
 				extended = true
 			} else {
-				es, ok := sc.AllSharesByPrev[s.Hash.String()]
-				if ok {
-					newChainShare := &ChainShare{Share: s, Next: es}
-					es.Previous = newChainShare
-					if es.Share.Hash.IsEqual(sc.Tail.Share.Hash) {
-						sc.Tail = newChainShare
+				if es := sc.AllSharesByPrev.Get(s.Hash); es != nil {
+					newChainShare := &ChainShare{Share: s}
+					link(newChainShare, es)
+					if es == sc.Tail() {
+						sc.tail.Store(newChainShare)
 					}
 					sc.AddChainShare(newChainShare)
 					extended = true
@@ -102,113 +237,475 @@ func (sc *ShareChain) Resolve(skipCommit bool) {
 		}
 
 		sc.disconnectedShares = newDisconnectedShares
-
-		sc.disconnectedShareLock.Unlock()
 		if !extended || len(sc.disconnectedShares) == 0 {
 			break
 		}
 	}
 
-	logging.Debugf("Tip is now %s - disconnected: %d - Length: %d", sc.Tip.Share.Hash.String(), len(sc.disconnectedShares), len(sc.AllShares))
+	sc.prune()
+	sc.logger().Debugf("Tip is now %s - disconnected: %d - Length: %d", sc.Tip().Share.Hash.String(), len(sc.disconnectedShares), sc.AllShares.Len())
+	tail := sc.Tail()
+	sc.lock.Unlock()
 
-	if len(sc.AllShares) < p2pnet.ActiveNetwork.ChainLength {
-		sc.NeedShareChannel <- sc.Tail.Share.ShareInfo.ShareData.PreviousShareHash
+	if sc.AllShares.Len() < sc.Network.ChainLength && !sc.Loading() {
+		sc.NeedShareChannel <- tail.Share.ShareInfo.ShareData.PreviousShareHash
 	}
 	if !skipCommit {
-		sc.Commit()
+		sc.scheduleCommit()
 	}
 }
 
-func (sc *ShareChain) Commit() error {
-	sc.allSharesLock.Lock()
+// prune forgets the shares more than MaxShares below the tip, forks
+// included. It's called with the lock held.
+func (sc *ShareChain) prune() {
+	limit := sc.MaxShares
+	if limit <= 0 || sc.Tip() == nil {
+		return
+	}
+	if limit < sc.Network.ChainLength {
+		limit = sc.Network.ChainLength
+	}
+	if sc.AllShares.Len() <= limit {
+		return
+	}
 
-	shares := make([]wire.Share, 0)
-	i := 0
-	s := sc.Tip
-	for s != nil {
-		shares = append(shares, *(s.Share))
-		s = s.Previous
-		i++
+	cut := sc.Tip()
+	for i := 1; i < limit && cut.Previous() != nil; i++ {
+		cut = cut.Previous()
+	}
+	minHeight := cut.Share.ShareInfo.AbsHeight
+	sc.AllShares.Range(func(cs *ChainShare) bool {
+		if cs.Share.ShareInfo.AbsHeight < minHeight {
+			sc.AllShares.Delete(cs.Share.Hash, cs)
+			sc.AllSharesByPrev.Delete(cs.Share.ShareInfo.ShareData.PreviousShareHash, cs)
+			sc.pruned++
+		}
+		return true
+	})
+	// Once the files hold as many dropped shares as kept ones, they're
+	// rewritten with just the chain
+	if sc.pruned >= limit {
+		sc.rewrite = true
+	}
+	if previous := cut.Previous(); previous != nil {
+		previous.next.Store(nil)
+		cut.previous.Store(nil)
+	}
+	sc.tail.Store(cut)
+}
+
+// scheduleCommit writes the new shares after CommitDelay, unless a write
+// is already scheduled
+func (sc *ShareChain) scheduleCommit() {
+	if sc.CommitDelay == 0 {
+		err := sc.Flush()
+		if err != nil {
+			sc.logger().Errorf("Could not save sharechain: %s", err.Error())
+		}
+		return
+	}
+	sc.commitLock.Lock()
+	defer sc.commitLock.Unlock()
+	if sc.commitTimer != nil {
+		return
+	}
+	sc.commitTimer = time.AfterFunc(sc.CommitDelay, func() {
+		err := sc.Flush()
+		if err != nil {
+			sc.logger().Errorf("Could not save sharechain: %s", err.Error())
+		}
+	})
+}
+
+// journalFile is where the shares added since DataFile was written are
+// appended
+func (sc *ShareChain) journalFile() string {
+	return sc.DataFile + ".journal"
+}
+
+// Flush writes the shares added since the last write now, taking the place
+// of a scheduled write. They're appended to the journal next to DataFile,
+// so a write doesn't grow with the chain. DataFile is rewritten instead
+// once pruning dropped as many shares as the chain keeps, or the journal
+// can't be appended to.
+func (sc *ShareChain) Flush() error {
+	if sc.Loading() {
+		// Shares added meanwhile are written once it's done
+		sc.logger().Debugf("Not saving the sharechain while it's loading")
+		return nil
+	}
+	sc.commitLock.Lock()
+	defer sc.commitLock.Unlock()
+	sc.stopCommitTimer()
+
+	sc.lock.Lock()
+	if sc.rewrite {
+		sc.lock.Unlock()
+		return sc.commit()
+	}
+	shares := make([]wire.Share, len(sc.unsaved))
+	for i, s := range sc.unsaved {
+		shares[i] = *s
+	}
+	sc.unsaved = nil
+	sc.lock.Unlock()
+	if len(shares) == 0 {
+		return nil
+	}
+
+	err := sc.appendJournal(shares)
+	if err != nil {
+		// The journal may end in part of a write now
+		sc.lock.Lock()
+		sc.rewrite = true
+		sc.lock.Unlock()
+	}
+	return err
+}
+
+func (sc *ShareChain) appendJournal(shares []wire.Share) error {
+	f, err := os.OpenFile(sc.journalFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<16)
+	err = wire.WriteShareFile(w, shares)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
 	}
-	f, err := os.Create("sharechain-new.dat")
 	if err != nil {
+		f.Close()
 		return err
 	}
+	return f.Close()
+}
 
-	wire.WriteShares(f, shares)
+// Commit rewrites DataFile with the sharechain now and empties the journal,
+// taking the place of a scheduled write. Nodes do so when they stop.
+func (sc *ShareChain) Commit() error {
+	if sc.Loading() {
+		// Writing now would replace the file with the part read so far
+		sc.logger().Debugf("Not saving the sharechain while it's loading")
+		return nil
+	}
+	sc.commitLock.Lock()
+	defer sc.commitLock.Unlock()
+	sc.stopCommitTimer()
+	return sc.commit()
+}
 
-	f.Close()
+// stopCommitTimer cancels a scheduled write. It's called with commitLock
+// held.
+func (sc *ShareChain) stopCommitTimer() {
+	if sc.commitTimer != nil {
+		sc.commitTimer.Stop()
+		sc.commitTimer = nil
+	}
+}
 
-	if _, err := os.Stat("sharechain.dat"); err == nil {
-		err = os.Remove("sharechain.dat")
-		if err != nil {
-			return err
+// commit rewrites DataFile. It's called with commitLock held.
+func (sc *ShareChain) commit() error {
+	// The chain is written as one piece, not as it changes shape
+	sc.lock.Lock()
+	shares := make([]wire.Share, 0, sc.AllShares.Len())
+	for s := sc.Tip(); s != nil; s = s.Previous() {
+		shares = append(shares, *(s.Share))
+	}
+	sc.unsaved = nil
+	sc.pruned = 0
+	sc.rewrite = false
+	sc.lock.Unlock()
+
+	err := sc.writeDataFile(shares)
+	if err == nil {
+		err = os.Remove(sc.journalFile())
+		if os.IsNotExist(err) {
+			err = nil
 		}
 	}
+	if err != nil {
+		sc.lock.Lock()
+		sc.rewrite = true
+		sc.lock.Unlock()
+	}
+	return err
+}
 
-	os.Rename("sharechain-new.dat", "sharechain.dat")
+func (sc *ShareChain) writeDataFile(shares []wire.Share) error {
+	f, err := os.Create(sc.DataFile + ".new")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<16)
+	err = wire.WriteShareFile(w, shares)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
 
-	sc.allSharesLock.Unlock()
-	return nil
+	// Rename replaces the old file in one step, also on Windows
+	return os.Rename(sc.DataFile+".new", sc.DataFile)
 }
 
+// Load reads the shares in DataFile and its journal. The file is memory
+// mapped and the shares decode the parts only needed for building blocks
+// when they're used, see ChainShare.Full. The mapping stays for as long as
+// the node runs, commits replace the file rather than change it. The
+// journal is read into memory, it's appended to.
 func (sc *ShareChain) Load() error {
+	return sc.LoadContext(context.Background())
+}
 
-	if _, err := os.Stat("sharechain.dat"); os.IsNotExist(err) {
-		return nil // Sharechain data absent, no need to do anything then.
-	}
-
-	f, err := os.Open("sharechain.dat")
+// LoadContext loads DataFile like Load, giving up once ctx is done. Nothing
+// is added to the chain then.
+func (sc *ShareChain) LoadContext(ctx context.Context) error {
+	shares, err := sc.readDataFile()
 	if err != nil {
 		return err
 	}
-	shares, err := wire.ReadShares(f)
-	if err != nil {
+
+	rewrite := false
+	journal, err := os.ReadFile(sc.journalFile())
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if len(journal) > 0 {
+		added, err := wire.ParseShareJournal(journal, true, sc.Network)
+		if errors.Is(err, wire.ErrTruncatedJournal) {
+			// A crash while writing, what follows it would be lost too
+			sc.logger().Warnf("The sharechain journal was cut short, loaded the %d shares before", len(added))
+			rewrite = true
+		} else if err != nil {
+			return err
+		}
+		shares = append(shares, added...)
+	}
 
-	for _, s := range shares {
+	for i, s := range shares {
+		if i%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if !s.IsValid() {
 			return fmt.Errorf("Invalid share found")
 		}
 	}
 
-	sc.disconnectedShareLock.Lock()
-	sc.disconnectedShares = make([]*wire.Share, len(shares))
+	sc.lock.Lock()
+	// Peers may have sent shares while loading in the background
 	for i := range shares {
-		sc.disconnectedShares[i] = &shares[i]
+		sc.disconnectedShares = append(sc.disconnectedShares, &shares[i])
 	}
-	sc.disconnectedShareLock.Unlock()
+	sc.rewrite = sc.rewrite || rewrite
+	sc.lock.Unlock()
 
-	logging.Debugf("Loaded %d shares from disk", len(sc.disconnectedShares))
+	sc.logger().Debugf("Loaded %d shares from disk", len(shares))
 
 	sc.Resolve(true)
 
 	return nil
 }
 
-func (sc *ShareChain) AddShares(s []wire.Share) {
-	// Decode
+// readDataFile returns the shares in DataFile, none if there is none
+func (sc *ShareChain) readDataFile() ([]wire.Share, error) {
+	if _, err := os.Stat(sc.DataFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+	data, err := util.MapFile(sc.DataFile)
+	if err != nil {
+		return nil, err
+	}
+	if !wire.IsShareFile(data) {
+		// Files of the old format are decoded in full and copied
+		defer util.UnmapFile(data)
+	}
+	return wire.ParseShareFile(data, true, sc.Network)
+}
+
+// LoadAsync loads DataFile like Load, in the background. Until it's done
+// the chain counts as loading: work is solo, missing shares aren't asked
+// for and nothing is written, so the file isn't replaced with part of it.
+// The result is sent on the returned channel, ctx.Err() if ctx is done
+// before.
+func (sc *ShareChain) LoadAsync(ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	atomic.StoreInt32(&sc.loading, 1)
+	go func() {
+		start := time.Now()
+		err := sc.LoadContext(ctx)
+		atomic.StoreInt32(&sc.loading, 0)
+		if err == nil {
+			sc.logger().Infof("Loaded the sharechain in %s, %d shares", time.Since(start).Round(time.Millisecond), sc.AllShares.Len())
+			// Save the shares that came in meanwhile
+			sc.scheduleCommit()
+		}
+		done <- err
+	}()
+	return done
+}
+
+// Loading returns whether LoadAsync is still loading the sharechain
+func (sc *ShareChain) Loading() bool {
+	return atomic.LoadInt32(&sc.loading) == 1
+}
+
+// AddShares adds valid shares to the sharechain and returns the ones that
+// were new to us
+func (sc *ShareChain) AddShares(s []wire.Share) []*wire.Share {
+	added := make([]*wire.Share, 0, len(s))
+	// Shares often come with the ones they build on
+	batch := make(map[chainhash.Hash]*wire.Share, len(s))
+	for i := range s {
+		batch[*s[i].Hash] = &s[i]
+	}
 
-	sc.disconnectedShareLock.Lock()
+	sc.lock.Lock()
 	for i := range s {
+		prevHash := s[i].ShareInfo.ShareData.PreviousShareHash
+		previous := batch[*prevHash]
+		if cs := sc.GetShare(prevHash); cs != nil {
+			previous = cs.Share
+		}
+		if !sc.checkTimestamp(&s[i], previous, sc.Network) {
+			sc.rejectShare(&s[i], rejects.BadTimestamp)
+			sc.logger().Trace(s[i].TraceID).Warnf("Ignoring share %s with an invalid timestamp", s[i].Hash.String())
+			continue
+		}
+		if reason, err := sc.checkRules(&s[i]); err != nil {
+			sc.rejectShare(&s[i], reason)
+			sc.logger().Trace(s[i].TraceID).Warnf("Ignoring share %s: %s", s[i].Hash.String(), err.Error())
+			continue
+		}
 		if s[i].IsValid() {
-			_, ok := sc.AllShares[s[i].Hash.String()]
-			if !ok {
+			if !sc.AllShares.Has(s[i].Hash) {
+				sc.logger().Trace(s[i].TraceID).Debugf("Accepted share %s", s[i].Hash.String())
 				sc.disconnectedShares = append(sc.disconnectedShares, &s[i])
+				added = append(added, &s[i])
+				sc.unsaved = append(sc.unsaved, &s[i])
+				if blockchain.HashToBig(s[i].POWHash).Cmp(blockchain.CompactToBig(s[i].MinHeader.Bits)) <= 0 {
+					select {
+					case sc.BlockSolutionChannel <- &s[i]:
+					default:
+					}
+				}
 			}
 		} else {
-			logging.Warnf("Ignoring invalid share %s", s[i].Hash.String())
+			sc.rejectShare(&s[i], rejects.BadPoW)
+			sc.logger().Trace(s[i].TraceID).Warnf("Ignoring invalid share %s", s[i].Hash.String())
 		}
 	}
-	sc.disconnectedShareLock.Unlock()
+	sc.lock.Unlock()
 
 	sc.Resolve(false)
+	if sc.Added != nil && len(added) > 0 {
+		sc.Added(added)
+	}
+	return added
+}
+
+func (sc *ShareChain) GetShare(h *chainhash.Hash) *ChainShare {
+	if h == nil {
+		return nil
+	}
+	return sc.AllShares.Get(h)
 }
 
 func (sc *ShareChain) GetTipHash() *chainhash.Hash {
-	if sc.Tip != nil {
-		return sc.Tip.Share.Hash
+	if tip := sc.Tip(); tip != nil {
+		return tip.Share.Hash
 	}
 	return nil
 }
+
+// heavier tells whether the fork ending in cs has more work than the chain
+// ending in the tip, counted from where they split. Forks deeper than the
+// chain length never are.
+func (sc *ShareChain) heavier(cs *ChainShare) bool {
+	// Work of the tip's chain above each of its shares
+	above := map[*ChainShare]*big.Int{}
+	work := big.NewInt(0)
+	for s, i := sc.Tip(), 0; s != nil && i < sc.Network.ChainLength; s, i = s.Previous(), i+1 {
+		above[s] = big.NewInt(0).Set(work)
+		work.Add(work, TargetToAverageAttempts(blockchain.CompactToBig(uint32(s.Share.ShareInfo.Bits))))
+	}
+	forkWork := big.NewInt(0)
+	for s, i := cs, 0; s != nil && i < sc.Network.ChainLength; s, i = s.Previous(), i+1 {
+		if tipWork, ok := above[s]; ok {
+			return forkWork.Cmp(tipWork) > 0
+		}
+		forkWork.Add(forkWork, TargetToAverageAttempts(blockchain.CompactToBig(uint32(s.Share.ShareInfo.Bits))))
+	}
+	return false
+}
+
+// GetShares returns the shares peers ask for in a share request: for each
+// of hashes, the share and up to parents shares before it, stopping at any
+// of stops. Like the Python p2pool, at most 1000 shares are sent.
+func (sc *ShareChain) GetShares(hashes []*chainhash.Hash, parents uint64, stops []*chainhash.Hash) ([]wire.Share, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	if max := uint64(1000 / len(hashes)); parents > max {
+		parents = max
+	}
+	stop := make(map[chainhash.Hash]bool, len(stops))
+	for _, h := range stops {
+		stop[*h] = true
+	}
+	shares := make([]wire.Share, 0)
+	for _, h := range hashes {
+		s := sc.GetShare(h)
+		for i := uint64(0); i <= parents && s != nil && !stop[*s.Share.Hash]; i++ {
+			full, err := s.Full(sc.Network)
+			if err != nil {
+				return nil, err
+			}
+			shares = append(shares, *full)
+			s = s.Previous()
+		}
+	}
+	return shares, nil
+}
+
+// depthOf returns how many shares the tip is ahead of cs, at most the chain
+// length
+func (sc *ShareChain) depthOf(cs *ChainShare) int {
+	depth := 0
+	for s := sc.Tip(); s != nil && s != cs && depth < sc.Network.ChainLength; s = s.Previous() {
+		depth++
+	}
+	return depth
+}
+
+// rejectShare counts a share from a peer we refused and announces it
+func (sc *ShareChain) rejectShare(s *wire.Share, reason string) {
+	rejects.Add(rejects.P2P, reason)
+	events.PublishOn(sc.Network.Name, events.ShareRejected, events.Rejection{Hash: s.Hash.String(), Reason: reason, Trace: s.TraceID})
+}
+
+func shareEvent(s *wire.Share, n p2pnet.Network) events.Share {
+	e := events.Share{
+		Hash:     s.Hash.String(),
+		Previous: s.ShareInfo.ShareData.PreviousShareHash.String(),
+		Block:    s.IsBlock(),
+		Trace:    s.TraceID,
+	}
+	sd := s.ShareInfo.ShareData
+	addr, err := PubKeyHashToAddress(sd.PubKeyHash, sd.PubKeyHashVersion, n)
+	if err == nil {
+		e.Address = addr.EncodeAddress()
+	}
+	return e
+}
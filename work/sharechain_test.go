@@ -0,0 +1,266 @@
+package work
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/events"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// chainTestShare is a share at height building on previous, with a hash
+// made from height and fork, that doesn't solve a block
+func chainTestShare(height, fork uint32, previous *chainhash.Hash) *wire.Share {
+	hash := chainhash.Hash{}
+	binary.LittleEndian.PutUint32(hash[:], height)
+	binary.LittleEndian.PutUint32(hash[4:], fork)
+	pow := chainhash.Hash{}
+	for i := range pow {
+		pow[i] = 0xff
+	}
+	s := &wire.Share{Hash: &hash, POWHash: &pow}
+	s.MinHeader.Bits = 0x1d00ffff
+	s.ShareInfo.AbsHeight = int32(height)
+	s.ShareInfo.Bits = 0x1d00ffff
+	s.ShareInfo.ShareData.PreviousShareHash = previous
+	return s
+}
+
+// TestConcurrentChain resolves and prunes shares, forks included, while
+// the chain is read the way the work loop, peers and the web API read it.
+// It finds nothing without -race.
+func TestConcurrentChain(t *testing.T) {
+	n := p2pnet.Benchmark()
+	n.ChainLength = 20
+	sc := NewShareChain(n)
+	sc.MaxShares = 30
+	go func() {
+		for range sc.NeedShareChannel {
+		}
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				sc.GetHeight(sc.GetTipHash(), n.ChainLength)
+				for s := sc.Tip(); s != nil; s = s.Previous() {
+					s.Next()
+				}
+				if tail := sc.Tail(); tail != nil {
+					for s := tail; s != nil; s = s.Next() {
+					}
+				}
+			}
+		}()
+	}
+
+	previous := &chainhash.Hash{}
+	for height := uint32(1); height <= 500; height++ {
+		s := chainTestShare(height, 0, previous)
+		shares := []*wire.Share{s}
+		if height%7 == 0 && height > 1 {
+			// A fork off the share below, which doesn't become the tip
+			shares = append(shares, chainTestShare(height, 1, sc.Tip().Share.ShareInfo.ShareData.PreviousShareHash))
+		}
+		sc.lock.Lock()
+		sc.disconnectedShares = append(sc.disconnectedShares, shares...)
+		sc.lock.Unlock()
+		sc.Resolve(true)
+		previous = s.Hash
+	}
+	close(done)
+	wg.Wait()
+
+	if !sc.GetTipHash().IsEqual(previous) {
+		t.Fatalf("Tip is %s, not the last share %s", sc.GetTipHash(), previous)
+	}
+	if height := sc.GetHeight(previous, 1000); height != sc.MaxShares {
+		t.Fatalf("Chain of %d shares after pruning, not %d", height, sc.MaxShares)
+	}
+}
+
+// TestForkChoice builds a chain of 10 shares and a fork off it, and checks
+// that the tip moves to the fork only if it has more work since they split
+// and doesn't fork off deeper than the chain length
+func TestForkChoice(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		chainLength int
+		// forkBase is the height of the share the fork builds on
+		forkBase uint32
+		// forkBits are the targets of the fork's shares
+		forkBits []uint32
+		switched bool
+	}{
+		{"shorter", 20, 7, []uint32{0x1d00ffff, 0x1d00ffff}, false},
+		{"as long", 20, 7, []uint32{0x1d00ffff, 0x1d00ffff, 0x1d00ffff}, false},
+		{"longer", 20, 7, []uint32{0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff}, true},
+		{"shorter with more work", 20, 7, []uint32{0x1d00ffff, 0x1c00ffff}, true},
+		{"longer with less work", 20, 7, []uint32{0x1d01ffff, 0x1d01ffff, 0x1d01ffff, 0x1d01ffff}, false},
+		{"deeper than the chain length", 5, 2, []uint32{0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff, 0x1d00ffff}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			n := p2pnet.Benchmark()
+			n.ChainLength = c.chainLength
+			sc := NewShareChain(n)
+			go func() {
+				for range sc.NeedShareChannel {
+				}
+			}()
+			reorgs := events.SubscribeNetwork(n.Name, 100, events.Reorg)
+			defer reorgs.Close()
+			add := func(s *wire.Share) {
+				sc.lock.Lock()
+				sc.disconnectedShares = append(sc.disconnectedShares, s)
+				sc.lock.Unlock()
+				sc.Resolve(true)
+			}
+
+			previous := &chainhash.Hash{}
+			hashes := map[uint32]*chainhash.Hash{}
+			for height := uint32(1); height <= 10; height++ {
+				s := chainTestShare(height, 0, previous)
+				add(s)
+				hashes[height] = s.Hash
+				previous = s.Hash
+			}
+			mainTip := previous
+
+			previous = hashes[c.forkBase]
+			for i, bits := range c.forkBits {
+				s := chainTestShare(c.forkBase+uint32(i)+1, 1, previous)
+				s.ShareInfo.Bits = int32(bits)
+				add(s)
+				previous = s.Hash
+			}
+
+			expected := mainTip
+			if c.switched {
+				expected = previous
+			}
+			if !sc.GetTipHash().IsEqual(expected) {
+				t.Errorf("Tip is %s, expected %s", sc.GetTipHash(), expected)
+			}
+			if switched := len(reorgs.Events) > 0; switched != c.switched {
+				t.Errorf("Reorg published: %t", switched)
+			}
+		})
+	}
+}
+
+// TestShareJournal mines shares, which are appended to the journal, and
+// loads them back, also from a journal cut short by a crash
+func TestShareJournal(t *testing.T) {
+	n := p2pnet.Benchmark()
+	wm, err := NewSyntheticWorkManager(n, t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := wm.ShareChain
+	for i := 0; i < 5; i++ {
+		_, err = wm.MineShare(make([]byte, 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(sc.DataFile); !os.IsNotExist(err) {
+		t.Fatalf("Sharechain file written for new shares: %v", err)
+	}
+
+	load := func(expected int) *ShareChain {
+		loaded := NewShareChain(n)
+		loaded.DataFile = sc.DataFile
+		go func() {
+			for range loaded.NeedShareChannel {
+			}
+		}()
+		err := loaded.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.AllShares.Len() != expected {
+			t.Fatalf("Loaded %d shares, expected %d", loaded.AllShares.Len(), expected)
+		}
+		return loaded
+	}
+	loaded := load(5)
+	if !loaded.GetTipHash().IsEqual(sc.GetTipHash()) {
+		t.Fatalf("Loaded tip %s, expected %s", loaded.GetTipHash(), sc.GetTipHash())
+	}
+
+	// The last share was cut short, it's left out and the rest rewritten
+	journal, err := os.ReadFile(sc.journalFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(sc.journalFile(), journal[:len(journal)-10], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = load(4).Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sc.journalFile()); !os.IsNotExist(err) {
+		t.Fatalf("Journal kept after rewriting the sharechain: %v", err)
+	}
+	load(4)
+
+	err = sc.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	load(5)
+}
+
+// TestShareJournalPrune checks new shares are appended to the journal until
+// pruning dropped as many shares as the chain keeps, which rewrites the
+// sharechain file
+func TestShareJournalPrune(t *testing.T) {
+	n := p2pnet.Benchmark()
+	n.ChainLength = 5
+	sc := NewShareChain(n)
+	sc.MaxShares = 5
+	sc.DataFile = filepath.Join(t.TempDir(), "sharechain.dat")
+	go func() {
+		for range sc.NeedShareChannel {
+		}
+	}()
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	wm, err := NewSyntheticWorkManager(p2pnet.Benchmark(), t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height <= 10; height++ {
+		s, err := wm.MineShare(make([]byte, 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.lock.Lock()
+		sc.disconnectedShares = append(sc.disconnectedShares, s)
+		sc.unsaved = append(sc.unsaved, s)
+		sc.lock.Unlock()
+		sc.Resolve(false)
+		if rewritten := height == 10; exists(sc.DataFile) != rewritten || exists(sc.journalFile()) == rewritten {
+			t.Fatalf("After %d shares, sharechain file written: %t, journal written: %t", height, exists(sc.DataFile), exists(sc.journalFile()))
+		}
+	}
+}
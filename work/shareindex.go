@@ -0,0 +1,100 @@
+package work
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// indexShards is the number of independently locked parts of a ShareIndex
+const indexShards = 64
+
+// ShareIndex maps share hashes to shares. It's split in shards by hash, each
+// with its own lock, so validation, relay, stats and the web API reading
+// and adding shares at the same time rarely wait for each other.
+type ShareIndex struct {
+	shards [indexShards]indexShard
+	count  int64
+}
+
+type indexShard struct {
+	lock   sync.RWMutex
+	shares map[chainhash.Hash]*ChainShare
+}
+
+func NewShareIndex() *ShareIndex {
+	x := &ShareIndex{}
+	for i := range x.shards {
+		x.shards[i].shares = map[chainhash.Hash]*ChainShare{}
+	}
+	return x
+}
+
+// The first byte of a hash is as random as any other
+func (x *ShareIndex) shard(h *chainhash.Hash) *indexShard {
+	return &x.shards[int(h[0])%indexShards]
+}
+
+// Get returns the share for a hash, or nil
+func (x *ShareIndex) Get(h *chainhash.Hash) *ChainShare {
+	if h == nil {
+		return nil
+	}
+	s := x.shard(h)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.shares[*h]
+}
+
+// Has returns whether there is a share for a hash
+func (x *ShareIndex) Has(h *chainhash.Hash) bool {
+	return x.Get(h) != nil
+}
+
+// Set stores the share for a hash
+func (x *ShareIndex) Set(h *chainhash.Hash, cs *ChainShare) {
+	s := x.shard(h)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.shares[*h]; !ok {
+		atomic.AddInt64(&x.count, 1)
+	}
+	s.shares[*h] = cs
+}
+
+// Delete removes the share for a hash if it is cs, or whatever it is for a
+// nil cs
+func (x *ShareIndex) Delete(h *chainhash.Hash, cs *ChainShare) {
+	s := x.shard(h)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.shares[*h]; ok && (cs == nil || existing == cs) {
+		delete(s.shares, *h)
+		atomic.AddInt64(&x.count, -1)
+	}
+}
+
+// Len returns the number of shares
+func (x *ShareIndex) Len() int {
+	return int(atomic.LoadInt64(&x.count))
+}
+
+// Range calls f for the shares until it returns false. Shares added or
+// removed meanwhile may or may not be seen.
+func (x *ShareIndex) Range(f func(cs *ChainShare) bool) {
+	for i := range x.shards {
+		s := &x.shards[i]
+		s.lock.RLock()
+		shares := make([]*ChainShare, 0, len(s.shares))
+		for _, cs := range s.shares {
+			shares = append(shares, cs)
+		}
+		s.lock.RUnlock()
+		for _, cs := range shares {
+			if !f(cs) {
+				return
+			}
+		}
+	}
+}
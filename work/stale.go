@@ -0,0 +1,135 @@
+package work
+
+import (
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// staleWindow is how many shares back from the tip we look for our own
+// shares, to find out which of them didn't make it into the chain
+const staleWindow = 100
+
+// StaleCounts summarizes what became of the shares this node found recently
+type StaleCounts struct {
+	Shares int
+	// Orphans were valid when found, but another share won the race
+	Orphans int
+	// DOA shares were built on a tip that was already replaced when they
+	// were found
+	DOA int
+}
+
+type localShare struct {
+	height int32
+	doa    bool
+}
+
+// staleTracker remembers the shares found by this node, so the next shares
+// can announce the ones that went stale in their StaleInfo, as p2pool does
+type staleTracker struct {
+	lock   sync.Mutex
+	shares map[chainhash.Hash]localShare
+}
+
+func newStaleTracker() *staleTracker {
+	return &staleTracker{shares: map[chainhash.Hash]localShare{}}
+}
+
+func (t *staleTracker) record(s *wire.Share, doa bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.shares[*s.Hash] = localShare{height: s.ShareInfo.AbsHeight, doa: doa}
+}
+
+// has tells whether a share was found by this node
+func (t *staleTracker) has(h *chainhash.Hash) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.shares[*h]
+	return ok
+}
+
+// counts compares our recent shares with the chain ending in tip, and also
+// returns how many orphans and DOA shares our shares in it announced
+func (t *staleTracker) counts(sc *ShareChain, tip *chainhash.Hash) (c StaleCounts, orphansAnnounced, doaAnnounced int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := sc.GetShare(tip)
+	if s == nil {
+		return c, 0, 0
+	}
+	minHeight := s.Share.ShareInfo.AbsHeight - staleWindow + 1
+	inChain, doaInChain := 0, 0
+	for i := 0; i < staleWindow && s != nil; i, s = i+1, s.Previous() {
+		ls, ok := t.shares[*s.Share.Hash]
+		if !ok {
+			continue
+		}
+		inChain++
+		if ls.doa {
+			doaInChain++
+		}
+		switch s.Share.ShareInfo.ShareData.StaleInfo {
+		case wire.StaleInfoOrphan:
+			orphansAnnounced++
+		case wire.StaleInfoDOA:
+			doaAnnounced++
+		}
+	}
+
+	doa := 0
+	for h, ls := range t.shares {
+		if ls.height < minHeight {
+			delete(t.shares, h)
+			continue
+		}
+		c.Shares++
+		if ls.doa {
+			doa++
+		}
+	}
+	c.DOA = doa - doaInChain
+	c.Orphans = c.Shares - inChain - c.DOA
+	return c, orphansAnnounced, doaAnnounced
+}
+
+// staleInfo picks what a new share on top of tip should announce: an orphan
+// or DOA share of ours that isn't accounted for by our shares in the chain
+func (wm *WorkManager) staleInfo(tip *chainhash.Hash) wire.StaleInfo {
+	c, orphansAnnounced, doaAnnounced := wm.stale.counts(wm.ShareChain, tip)
+	if c.Orphans > orphansAnnounced {
+		return wire.StaleInfoOrphan
+	}
+	if c.DOA > doaAnnounced {
+		return wire.StaleInfoDOA
+	}
+	return wire.StaleInfoNone
+}
+
+// StaleCounts returns what became of the shares this node found in the
+// last shares of the chain
+func (wm *WorkManager) StaleCounts() StaleCounts {
+	c, _, _ := wm.stale.counts(wm.ShareChain, wm.ShareChain.GetTipHash())
+	return c
+}
+
+// GetAverageStaleProp estimates the fraction of the pool's work lost to
+// stale shares, from the orphans and dead shares announced in the last
+// lookbehind shares before hash
+func (sc *ShareChain) GetAverageStaleProp(hash *chainhash.Hash, lookbehind int) float64 {
+	stale := 0
+	s := sc.GetShare(hash)
+	for i := 0; i < lookbehind && s != nil; i++ {
+		if s.Share.ShareInfo.ShareData.StaleInfo != wire.StaleInfoNone {
+			stale++
+		}
+		s = s.Previous()
+	}
+	if stale+lookbehind == 0 {
+		return 0
+	}
+	return float64(stale) / float64(stale+lookbehind)
+}
@@ -0,0 +1,126 @@
+package work
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/clock"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// SyntheticTemplate returns a fake block template for benchmarking without a
+// daemon. The template at a given height always has the same contents.
+func SyntheticTemplate(height int64, txCount int) *rpc.BlockTemplate {
+	seed := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seed, uint64(height))
+	prev, _ := chainhash.NewHash(util.Sha256d(seed))
+
+	r := &rpc.BlockTemplate{
+		Version:           0x20000000,
+		Rules:             []string{"segwit"},
+		PreviousBlockHash: prev.String(),
+		Transactions:      make([]rpc.BlockTemplateTransaction, 0, txCount),
+		CoinbaseValue:     25 * 100000000,
+		Target:            "00000000ffff0000000000000000000000000000000000000000000000000000",
+		Bits:              "1d00ffff",
+		CurTime:           clock.Now().Unix(),
+		MinTime:           clock.Now().Unix() - 3600,
+		Height:            height,
+	}
+	opTrue := []byte{txscript.OP_TRUE}
+	for i := 0; i < txCount; i++ {
+		outpoint := make([]byte, 12)
+		binary.LittleEndian.PutUint64(outpoint, uint64(height))
+		binary.LittleEndian.PutUint32(outpoint[8:], uint32(i))
+		prevOut, _ := chainhash.NewHash(util.Sha256d(outpoint))
+
+		tx := btcwire.NewMsgTx(1)
+		tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(prevOut, 0), opTrue, nil))
+		tx.AddTxOut(btcwire.NewTxOut(100000, opTrue))
+		var buf bytes.Buffer
+		tx.Serialize(&buf)
+
+		r.Transactions = append(r.Transactions, rpc.BlockTemplateTransaction{
+			Data: hex.EncodeToString(buf.Bytes()),
+			TxID: tx.TxHash().String(),
+			Hash: tx.WitnessHash().String(),
+			Fee:  1000 + int64(i%100)*10,
+		})
+		r.CoinbaseValue += r.Transactions[i].Fee
+	}
+	return r
+}
+
+// NewSyntheticWorkManager returns a work manager on network n without a
+// daemon or peers, working on a synthetic template with txCount
+// transactions. Its sharechain and found blocks are kept in dir. The shares
+// it makes and requests for missing ones go nowhere.
+func NewSyntheticWorkManager(n p2pnet.Network, dir string, txCount int) (*WorkManager, error) {
+	sc := NewShareChain(n)
+	sc.DataFile = filepath.Join(dir, "sharechain.dat")
+	wm := NewWorkManager(n, sc, nil, NewBlockSubmitter(nil, NewFoundBlockJournal(filepath.Join(dir, "foundblocks.dat"))))
+	// There are no peers to get a sharechain from, we start our own
+	wm.SoloTimeout = 0
+	go func() {
+		for range wm.LocalSharesChannel {
+		}
+	}()
+	go func() {
+		for range sc.NeedShareChannel {
+		}
+	}()
+	err := wm.SetTemplate(SyntheticTemplate(1, txCount))
+	if err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// MineShare grinds nonces on a job paying to the pubkey hash until it makes
+// a share. That only finishes quickly on networks with an easy share
+// target, like the benchmark network.
+func (wm *WorkManager) MineShare(pubKeyHash []byte) (*wire.Share, error) {
+	j, err := wm.GetJob(pubKeyHash, wm.Network.ChainParams.PubKeyHashAddrID)
+	if err != nil {
+		return nil, err
+	}
+	for nonce := uint32(0); nonce < math.MaxUint32; nonce++ {
+		res, err := wm.Submit(j, 0, uint32(j.Share.ShareInfo.Timestamp), nonce)
+		if err != nil {
+			return nil, err
+		}
+		if res.IsShare {
+			return res.Share, nil
+		}
+	}
+	return nil, fmt.Errorf("No share found")
+}
+
+// RunSynthetic is Run for benchmark mode: instead of polling a daemon it
+// moves to a new synthetic block every blockInterval
+func (wm *WorkManager) RunSynthetic(blockInterval time.Duration, txCount int) {
+	go func() {
+		for height := int64(1); ; height++ {
+			err := wm.SetTemplate(SyntheticTemplate(height, txCount))
+			if err != nil {
+				wm.logger().Errorf("Invalid synthetic template: %s", err.Error())
+			}
+			clock.Sleep(blockInterval)
+		}
+	}()
+	for {
+		wm.checkTip()
+		clock.Sleep(time.Second)
+	}
+}
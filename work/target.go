@@ -0,0 +1,146 @@
+package work
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+)
+
+var two256 = big.NewInt(0).Lsh(big.NewInt(1), 256)
+
+// TargetToAverageAttempts returns the number of hashes that are needed on
+// average to find a hash at or below target
+func TargetToAverageAttempts(target *big.Int) *big.Int {
+	return big.NewInt(0).Div(two256, big.NewInt(0).Add(target, big.NewInt(1)))
+}
+
+// AverageAttemptsToTarget is the inverse of TargetToAverageAttempts
+func AverageAttemptsToTarget(attempts *big.Int) *big.Int {
+	if attempts.Sign() <= 0 {
+		return big.NewInt(0).Sub(two256, big.NewInt(1))
+	}
+	t := big.NewInt(0).Div(two256, attempts)
+	t.Sub(t, big.NewInt(1))
+	return clipBig(t, big.NewInt(0), big.NewInt(0).Sub(two256, big.NewInt(1)))
+}
+
+func clipBig(v, low, high *big.Int) *big.Int {
+	if v.Cmp(low) < 0 {
+		return big.NewInt(0).Set(low)
+	}
+	if v.Cmp(high) > 0 {
+		return big.NewInt(0).Set(high)
+	}
+	return v
+}
+
+// GetHeight returns the number of shares we have that lead up to (and include)
+// the share with the given hash, up to a maximum of max
+func (sc *ShareChain) GetHeight(hash *chainhash.Hash, max int) int {
+	height := 0
+	s := sc.GetShare(hash)
+	for s != nil && height < max {
+		height++
+		s = s.Previous()
+	}
+	return height
+}
+
+// GetNthParent walks back n shares from the share with the given hash
+func (sc *ShareChain) GetNthParent(hash *chainhash.Hash, n int) *ChainShare {
+	s := sc.GetShare(hash)
+	for i := 0; i < n && s != nil; i++ {
+		s = s.Previous()
+	}
+	return s
+}
+
+// GetPoolAttemptsPerSecond estimates the pool hashrate over the last dist
+// shares before the share with the given hash
+func (sc *ShareChain) GetPoolAttemptsPerSecond(hash *chainhash.Hash, dist int) *big.Int {
+	near := sc.GetShare(hash)
+	if near == nil {
+		return big.NewInt(0)
+	}
+	attempts := big.NewInt(0)
+	far := near
+	for i := 0; i < dist-1 && far.Previous() != nil; i++ {
+		attempts.Add(attempts, TargetToAverageAttempts(blockchain.CompactToBig(uint32(far.Share.ShareInfo.MaxBits))))
+		far = far.Previous()
+	}
+	elapsed := int64(near.Share.ShareInfo.Timestamp) - int64(far.Share.ShareInfo.Timestamp)
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	return attempts.Div(attempts, big.NewInt(elapsed))
+}
+
+// PoolRates estimates the pool's hashrate over the last lookbehind shares,
+// both counting only shares in the chain and including the estimated stale
+// shares, and returns the stale proportion
+func (sc *ShareChain) PoolRates(lookbehind int) (nonstale float64, total float64, staleProp float64) {
+	tip := sc.GetTipHash()
+	lookbehind = sc.GetHeight(tip, lookbehind)
+	if lookbehind < 2 {
+		return 0, 0, 0
+	}
+	nonstale, _ = big.NewFloat(0).SetInt(sc.GetPoolAttemptsPerSecond(tip, lookbehind)).Float64()
+	staleProp = sc.GetAverageStaleProp(tip, lookbehind)
+	return nonstale, nonstale / (1 - staleProp), staleProp
+}
+
+// GetNextShareTargets calculates the maximum target and the actual target for
+// a share building on top of previous. desiredTarget is the target the miner
+// wants to work at, which can be harder than the maximum.
+func (sc *ShareChain) GetNextShareTargets(previous *chainhash.Hash, desiredTarget *big.Int, n p2pnet.Network) (maxTarget *big.Int, target *big.Int) {
+	preTarget := n.MaxTarget
+	prev := sc.GetShare(previous)
+	if prev != nil && sc.GetHeight(previous, n.TargetLookbehind) >= n.TargetLookbehind {
+		aps := sc.GetPoolAttemptsPerSecond(previous, n.TargetLookbehind)
+		preTarget = AverageAttemptsToTarget(aps.Mul(aps, big.NewInt(int64(n.SharePeriod))))
+		prevMax := blockchain.CompactToBig(uint32(prev.Share.ShareInfo.MaxBits))
+		low, high := maxTargetBounds(prevMax, n.Rules)
+		preTarget = clipBig(preTarget, low, high)
+		preTarget = clipBig(preTarget, big.NewInt(0), n.MaxTarget)
+	}
+
+	maxTarget = blockchain.CompactToBig(blockchain.BigToCompact(preTarget))
+	if desiredTarget == nil {
+		desiredTarget = preTarget
+	}
+	target = clipBig(big.NewInt(0).Set(desiredTarget), big.NewInt(0).Div(preTarget, big.NewInt(int64(n.ShareTargetRange))), preTarget)
+	target = blockchain.CompactToBig(blockchain.BigToCompact(target))
+	return maxTarget, target
+}
+
+// maxTargetBounds returns how far the maximum share target may move from
+// that of the previous share
+func maxTargetBounds(prevMax *big.Int, r p2pnet.Rules) (low *big.Int, high *big.Int) {
+	low = big.NewInt(0).Mul(prevMax, big.NewInt(int64(100-r.MaxTargetChange)))
+	low.Div(low, big.NewInt(100))
+	high = big.NewInt(0).Mul(prevMax, big.NewInt(int64(100+r.MaxTargetChange)))
+	high.Div(high, big.NewInt(100))
+	return low, high
+}
+
+var diffOneTarget, _ = big.NewInt(0).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+
+// DifficultyToTarget converts a (bitcoin style) difficulty to a target
+func DifficultyToTarget(diff float64) *big.Int {
+	if diff <= 0 {
+		return big.NewInt(0).Sub(two256, big.NewInt(1))
+	}
+	t, _ := big.NewFloat(0).Quo(big.NewFloat(0).SetInt(diffOneTarget), big.NewFloat(diff)).Int(nil)
+	return clipBig(t, big.NewInt(0), big.NewInt(0).Sub(two256, big.NewInt(1)))
+}
+
+// TargetToDifficulty is the inverse of DifficultyToTarget
+func TargetToDifficulty(target *big.Int) float64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := big.NewFloat(0).Quo(big.NewFloat(0).SetInt(diffOneTarget), big.NewFloat(0).SetInt(target)).Float64()
+	return d
+}
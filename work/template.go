@@ -0,0 +1,125 @@
+package work
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/rpc"
+)
+
+type BlockTemplate struct {
+	Height            int64
+	Version           int32
+	PreviousBlock     *chainhash.Hash
+	Bits              uint32
+	Target            *big.Int
+	CurTime           int64
+	MinTime           int64
+	CoinbaseValue     uint64
+	Transactions      []*btcwire.MsgTx
+	TxHashes          []*chainhash.Hash
+	TxFees            []int64
+	TxWeights         []int64
+	TxSigOps          []int64
+	TxDepends         [][]int
+	MerkleBranch      []*chainhash.Hash
+	WitnessRoot       *chainhash.Hash
+	WitnessCommitment []byte
+	Rules             []string
+	LongPollID        string
+	FetchedAt         time.Time
+}
+
+func TemplateFromRPC(r *rpc.BlockTemplate) (*BlockTemplate, error) {
+	bt := &BlockTemplate{
+		Height:        r.Height,
+		Version:       r.Version,
+		CurTime:       r.CurTime,
+		MinTime:       r.MinTime,
+		CoinbaseValue: uint64(r.CoinbaseValue),
+		Rules:         r.Rules,
+		LongPollID:    r.LongPollID,
+		FetchedAt:     clock.Now(),
+	}
+
+	var err error
+	bt.PreviousBlock, err = chainhash.NewHashFromStr(r.PreviousBlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	bits, err := strconv.ParseUint(r.Bits, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bits in block template: %s", err.Error())
+	}
+	bt.Bits = uint32(bits)
+
+	var ok bool
+	bt.Target, ok = big.NewInt(0).SetString(r.Target, 16)
+	if !ok {
+		return nil, fmt.Errorf("Invalid target in block template: %s", r.Target)
+	}
+
+	bt.Transactions = make([]*btcwire.MsgTx, len(r.Transactions))
+	bt.TxHashes = make([]*chainhash.Hash, len(r.Transactions))
+	bt.TxFees = make([]int64, len(r.Transactions))
+	bt.TxWeights = make([]int64, len(r.Transactions))
+	bt.TxSigOps = make([]int64, len(r.Transactions))
+	bt.TxDepends = make([][]int, len(r.Transactions))
+	for i, t := range r.Transactions {
+		b, err := hex.DecodeString(t.Data)
+		if err != nil {
+			return nil, err
+		}
+		tx := btcwire.NewMsgTx(1)
+		err = tx.Deserialize(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode template transaction %s: %s", t.TxID, err.Error())
+		}
+		bt.Transactions[i] = tx
+		h := tx.TxHash()
+		bt.TxHashes[i] = &h
+		bt.TxFees[i] = t.Fee
+		bt.TxWeights[i] = t.Weight
+		if bt.TxWeights[i] == 0 {
+			// Older daemons don't report weight
+			bt.TxWeights[i] = blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+		}
+		bt.TxSigOps[i] = t.SigOps
+		// Dependencies are 1-based indexes into the transaction list
+		bt.TxDepends[i] = make([]int, 0, len(t.Depends))
+		for _, d := range t.Depends {
+			bt.TxDepends[i] = append(bt.TxDepends[i], d-1)
+		}
+	}
+	bt.MerkleBranch = CalcMerkleBranch(bt.TxHashes)
+
+	if bt.HasRule("segwit") {
+		bt.WitnessRoot = CalcWitnessMerkleRoot(bt.Transactions)
+		bt.WitnessCommitment = WitnessCommitmentScript(bt.WitnessRoot)
+		if r.DefaultWitnessCommitment != "" && r.DefaultWitnessCommitment != hex.EncodeToString(bt.WitnessCommitment) {
+			return nil, fmt.Errorf("Witness commitment does not match the daemon's")
+		}
+	}
+
+	return bt, nil
+}
+
+// HasRule returns true if the daemon reported the (possibly mandatory) rule
+func (bt *BlockTemplate) HasRule(rule string) bool {
+	for _, r := range bt.Rules {
+		if r == rule || r == "!"+rule {
+			return true
+		}
+	}
+	return false
+}
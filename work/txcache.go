@@ -0,0 +1,117 @@
+package work
+
+import (
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+
+	"github.com/gertjaap/p2pool-go/clock"
+)
+
+type txCacheEntry struct {
+	tx       *btcwire.MsgTx
+	lastSeen time.Time
+}
+
+// TxCache keeps transactions we've recently seen in templates (or got from
+// peers), so transactions referenced by shares can be resolved without asking
+// the daemon, which may have dropped them from its mempool already
+type TxCache struct {
+	Expiry time.Duration
+
+	txs       map[chainhash.Hash]*txCacheEntry
+	lock      sync.RWMutex
+	lastPrune time.Time
+}
+
+func NewTxCache() *TxCache {
+	return &TxCache{
+		Expiry:    time.Hour,
+		txs:       map[chainhash.Hash]*txCacheEntry{},
+		lastPrune: clock.Now(),
+	}
+}
+
+func (c *TxCache) Add(txs ...*btcwire.MsgTx) {
+	now := clock.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, tx := range txs {
+		h := tx.TxHash()
+		e, ok := c.txs[h]
+		if ok {
+			e.lastSeen = now
+			continue
+		}
+		c.txs[h] = &txCacheEntry{tx: tx, lastSeen: now}
+	}
+	if now.Sub(c.lastPrune) > c.Expiry/10 {
+		c.prune(now)
+	}
+}
+
+// Touch marks transactions as recently used so they're not expired
+func (c *TxCache) Touch(hashes []*chainhash.Hash) {
+	now := clock.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, h := range hashes {
+		if e, ok := c.txs[*h]; ok {
+			e.lastSeen = now
+		}
+	}
+}
+
+func (c *TxCache) Get(h *chainhash.Hash) *btcwire.MsgTx {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	e, ok := c.txs[*h]
+	if !ok {
+		return nil
+	}
+	return e.tx
+}
+
+// GetAll looks up all transactions, returning the ones found in order and the
+// hashes of the ones we don't have
+func (c *TxCache) GetAll(hashes []*chainhash.Hash) ([]*btcwire.MsgTx, []*chainhash.Hash) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	found := make([]*btcwire.MsgTx, 0, len(hashes))
+	missing := make([]*chainhash.Hash, 0)
+	for _, h := range hashes {
+		e, ok := c.txs[*h]
+		if !ok {
+			missing = append(missing, h)
+			continue
+		}
+		found = append(found, e.tx)
+	}
+	return found, missing
+}
+
+// Clear drops all cached transactions and returns how many there were
+func (c *TxCache) Clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.txs)
+	c.txs = map[chainhash.Hash]*txCacheEntry{}
+	return n
+}
+
+func (c *TxCache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.txs)
+}
+
+func (c *TxCache) prune(now time.Time) {
+	for h, e := range c.txs {
+		if now.Sub(e.lastSeen) > c.Expiry {
+			delete(c.txs, h)
+		}
+	}
+	c.lastPrune = now
+}
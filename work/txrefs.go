@@ -0,0 +1,91 @@
+package work
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// BuildTxRefs returns the new transaction hashes and transaction hash refs
+// for a share on top of previous that includes txHashes. Transactions already
+// introduced by one of the last TxRefLookbehind shares are referred to, the
+// rest is new.
+func (sc *ShareChain) BuildTxRefs(previous *chainhash.Hash, txHashes []*chainhash.Hash) ([]*chainhash.Hash, []wire.TransactionHashRef) {
+	known := map[chainhash.Hash]wire.TransactionHashRef{}
+	s := sc.GetShare(previous)
+	for i := 0; i < sc.Network.TxRefLookbehind && s != nil; i++ {
+		full, err := s.Full(sc.Network)
+		if err != nil {
+			// Its transactions are included as new instead
+			sc.logger().Warnf("Could not decode share %s: %s", s.Share.Hash.String(), err.Error())
+			break
+		}
+		for j, h := range full.ShareInfo.NewTransactionHashes {
+			if _, ok := known[*h]; !ok {
+				known[*h] = wire.TransactionHashRef{ShareCount: uint64(i + 1), TxCount: uint64(j)}
+			}
+		}
+		s = s.Previous()
+	}
+
+	newHashes := make([]*chainhash.Hash, 0)
+	refs := make([]wire.TransactionHashRef, len(txHashes))
+	for i, h := range txHashes {
+		ref, ok := known[*h]
+		if !ok {
+			ref = wire.TransactionHashRef{ShareCount: 0, TxCount: uint64(len(newHashes))}
+			newHashes = append(newHashes, h)
+		}
+		refs[i] = ref
+	}
+	return newHashes, refs
+}
+
+// GetShareTxHashes resolves the transaction hash refs of a share into the
+// hashes of the transactions in the block it commits to, except the gentx
+func (sc *ShareChain) GetShareTxHashes(s *wire.Share) ([]*chainhash.Hash, error) {
+	s, err := s.Decoded(sc.Network)
+	if err != nil {
+		return nil, err
+	}
+	ancestors := []*ChainShare{}
+	next := sc.GetShare(s.ShareInfo.ShareData.PreviousShareHash)
+
+	hashes := make([]*chainhash.Hash, 0, len(s.ShareInfo.TransactionHashRefs))
+	for _, ref := range s.ShareInfo.TransactionHashRefs {
+		list := s.ShareInfo.NewTransactionHashes
+		if ref.ShareCount > 0 {
+			for uint64(len(ancestors)) < ref.ShareCount {
+				if next == nil {
+					return nil, fmt.Errorf("Share %s refers to a transaction in a share we don't have", s.Hash.String())
+				}
+				ancestors = append(ancestors, next)
+				next = next.Previous()
+			}
+			ancestor, err := ancestors[ref.ShareCount-1].Full(sc.Network)
+			if err != nil {
+				return nil, err
+			}
+			list = ancestor.ShareInfo.NewTransactionHashes
+		}
+		if ref.TxCount >= uint64(len(list)) {
+			return nil, fmt.Errorf("Share %s has an out of range transaction ref", s.Hash.String())
+		}
+		hashes = append(hashes, list[ref.TxCount])
+	}
+	return hashes, nil
+}
+
+// GetShareTransactions resolves all transactions in the block a share commits
+// to from the cache. The hashes of transactions that aren't cached are
+// returned separately.
+func (sc *ShareChain) GetShareTransactions(s *wire.Share, cache *TxCache) ([]*btcwire.MsgTx, []*chainhash.Hash, error) {
+	hashes, err := sc.GetShareTxHashes(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	txs, missing := cache.GetAll(hashes)
+	return txs, missing, nil
+}
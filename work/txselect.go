@@ -0,0 +1,195 @@
+package work
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	btcwire "github.com/btcsuite/btcd/wire"
+)
+
+const (
+	MaxBlockWeight     = 4000000
+	MaxBlockSigOpsCost = 80000
+
+	// Room kept free for the block header, transaction count and the
+	// generation transaction, which can be large with many payouts
+	genTxWeightReserve = 80*4 + 9*4 + 200000
+	genTxSigOpsReserve = 400
+)
+
+// CheckMaxBlockWeight makes sure a maximum block weight leaves room for
+// transactions next to the generation transaction and is within consensus
+func CheckMaxBlockWeight(maxWeight int64) error {
+	if maxWeight <= genTxWeightReserve {
+		return fmt.Errorf("Must be above %d, the weight kept for the generation transaction", genTxWeightReserve)
+	}
+	if maxWeight > MaxBlockWeight {
+		return fmt.Errorf("Must be at most %d", MaxBlockWeight)
+	}
+	return nil
+}
+
+// SelectTransactions reduces the template's transactions to the most
+// profitable set that fits in maxWeight and the sigop limit, keeping space for
+// the generation transaction. Transactions are picked together with the
+// transactions they depend on, by the fee rate of that package, so a child
+// paying for its parent gets both in. The coinbase value and merkle data are
+// updated to match. Packages paying less than minFeeRate (in satoshis per
+// virtual byte) are left out altogether. At most maxCount transactions are
+// picked, if it is positive. It returns how many transactions were left
+// out and the fees they paid.
+func (bt *BlockTemplate) SelectTransactions(maxWeight int64, minFeeRate float64, maxCount int) (int, int64) {
+	if CheckMaxBlockWeight(maxWeight) != nil {
+		maxWeight = MaxBlockWeight
+	}
+	weightBudget := maxWeight - genTxWeightReserve
+	sigOpsBudget := int64(MaxBlockSigOpsCost - genTxSigOpsReserve)
+
+	// The daemon lists parents before children, so the ancestors of a
+	// transaction are known once we get to it. Transactions depending on
+	// one not in the template can't be picked.
+	n := len(bt.Transactions)
+	ancestors := make([][]int, n)
+	descendants := make([][]int, n)
+	invalid := make([]bool, n)
+	for i := 0; i < n; i++ {
+		seen := map[int]bool{}
+		for _, d := range bt.TxDepends[i] {
+			if d < 0 || d >= i || invalid[d] {
+				invalid[i] = true
+				break
+			}
+			if !seen[d] {
+				seen[d] = true
+				ancestors[i] = append(ancestors[i], d)
+			}
+			for _, a := range ancestors[d] {
+				if !seen[a] {
+					seen[a] = true
+					ancestors[i] = append(ancestors[i], a)
+				}
+			}
+		}
+		if invalid[i] {
+			ancestors[i] = nil
+			continue
+		}
+		for _, a := range ancestors[i] {
+			descendants[a] = append(descendants[a], i)
+		}
+	}
+
+	selected := make([]bool, n)
+	pkgFee := make([]int64, n)
+	pkgWeight := make([]int64, n)
+	pkgSigOps := make([]int64, n)
+	pkgCount := make([]int, n)
+	update := func(i int) {
+		pkgFee[i], pkgWeight[i], pkgSigOps[i], pkgCount[i] = bt.TxFees[i], bt.TxWeights[i], bt.TxSigOps[i], 1
+		for _, a := range ancestors[i] {
+			if !selected[a] {
+				pkgFee[i] += bt.TxFees[a]
+				pkgWeight[i] += bt.TxWeights[a]
+				pkgSigOps[i] += bt.TxSigOps[a]
+				pkgCount[i]++
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		update(i)
+	}
+
+	weight := int64(0)
+	sigOps := int64(0)
+	count := 0
+	for {
+		best := -1
+		for i := 0; i < n; i++ {
+			if selected[i] || invalid[i] {
+				continue
+			}
+			if maxCount > 0 && count+pkgCount[i] > maxCount {
+				continue
+			}
+			if weight+pkgWeight[i] > weightBudget || sigOps+pkgSigOps[i] > sigOpsBudget {
+				continue
+			}
+			if float64(pkgFee[i]*4) < minFeeRate*float64(pkgWeight[i]) {
+				continue
+			}
+			// Compare fee/weight without dividing
+			if best == -1 || pkgFee[i]*pkgWeight[best] > pkgFee[best]*pkgWeight[i] {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		weight += pkgWeight[best]
+		sigOps += pkgSigOps[best]
+		count += pkgCount[best]
+		changed := append([]int{best}, ancestors[best]...)
+		for _, i := range changed {
+			selected[i] = true
+		}
+		for _, i := range changed {
+			for _, d := range descendants[i] {
+				if !selected[d] {
+					update(d)
+				}
+			}
+		}
+	}
+
+	dropped := 0
+	droppedFees := int64(0)
+	for i := range selected {
+		if !selected[i] {
+			dropped++
+			droppedFees += bt.TxFees[i]
+		}
+	}
+	if dropped == 0 {
+		return 0, 0
+	}
+
+	// Keep the daemon's order, which has parents before children
+	newIndex := make([]int, len(selected))
+	txs := make([]*btcwire.MsgTx, 0, len(selected)-dropped)
+	hashes := make([]*chainhash.Hash, 0, len(selected)-dropped)
+	fees := make([]int64, 0, len(selected)-dropped)
+	weights := make([]int64, 0, len(selected)-dropped)
+	sigops := make([]int64, 0, len(selected)-dropped)
+	depends := make([][]int, 0, len(selected)-dropped)
+	for i := range selected {
+		newIndex[i] = len(txs)
+		if !selected[i] {
+			continue
+		}
+		deps := make([]int, len(bt.TxDepends[i]))
+		for j, d := range bt.TxDepends[i] {
+			deps[j] = newIndex[d]
+		}
+		txs = append(txs, bt.Transactions[i])
+		hashes = append(hashes, bt.TxHashes[i])
+		fees = append(fees, bt.TxFees[i])
+		weights = append(weights, bt.TxWeights[i])
+		sigops = append(sigops, bt.TxSigOps[i])
+		depends = append(depends, deps)
+	}
+
+	bt.Transactions = txs
+	bt.TxHashes = hashes
+	bt.TxFees = fees
+	bt.TxWeights = weights
+	bt.TxSigOps = sigops
+	bt.TxDepends = depends
+	bt.CoinbaseValue -= uint64(droppedFees)
+	bt.MerkleBranch = CalcMerkleBranch(bt.TxHashes)
+	if bt.WitnessRoot != nil {
+		bt.WitnessRoot = CalcWitnessMerkleRoot(bt.Transactions)
+		bt.WitnessCommitment = WitnessCommitmentScript(bt.WitnessRoot)
+	}
+	return dropped, droppedFees
+}
@@ -0,0 +1,53 @@
+package work
+
+import (
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+// ChainReport is the outcome of checking stored shares with VerifyShares
+type ChainReport struct {
+	Shares int `json:"shares"`
+	// Invalid are the hashes of shares without enough proof of work
+	Invalid    []string `json:"invalid"`
+	Duplicates int      `json:"duplicates"`
+	// Tails are shares whose previous share isn't stored, a chain without
+	// gaps has one
+	Tails int `json:"tails"`
+	// Tips are shares no stored share builds on, more than one means forks
+	Tips int `json:"tips"`
+}
+
+// OK tells whether the shares form a valid chain without gaps
+func (r ChainReport) OK() bool {
+	return len(r.Invalid) == 0 && r.Tails <= 1
+}
+
+// VerifyShares checks the proof of work of shares and how they link up
+func VerifyShares(shares []wire.Share) ChainReport {
+	r := ChainReport{Shares: len(shares), Invalid: make([]string, 0)}
+	known := map[string]bool{}
+	for _, s := range shares {
+		h := s.Hash.String()
+		if known[h] {
+			r.Duplicates++
+		}
+		known[h] = true
+		if !s.IsValid() {
+			r.Invalid = append(r.Invalid, h)
+		}
+	}
+	builtOn := map[string]bool{}
+	for _, s := range shares {
+		prev := s.ShareInfo.ShareData.PreviousShareHash.String()
+		builtOn[prev] = true
+		if !known[prev] {
+			r.Tails++
+		}
+	}
+	for h := range known {
+		if !builtOn[h] {
+			r.Tips++
+		}
+	}
+	return r
+}
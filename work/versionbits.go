@@ -0,0 +1,61 @@
+package work
+
+import (
+	"strconv"
+)
+
+const (
+	versionBitsTopMask = 0xe0000000
+	versionBitsTop     = 0x20000000
+)
+
+// VersionBits configures which BIP9 deployments we signal for in our block
+// headers. By default the version the daemon suggests is used as is.
+type VersionBits struct {
+	// Signal are deployments, by name or bit number, to signal for when the
+	// daemon lists them as available
+	Signal []string
+	// NoSignal are deployments not to signal for, unless the daemon says
+	// the bit is required
+	NoSignal []string
+}
+
+// Apply adjusts a template's version. Only deployments the template lists
+// as available are touched, and required bits are always kept.
+func (vb VersionBits) Apply(version int32, available map[string]int, required uint32) int32 {
+	if len(vb.Signal) == 0 && len(vb.NoSignal) == 0 {
+		return version
+	}
+	v := uint32(version)
+	if v&versionBitsTopMask != versionBitsTop {
+		// Not a version bits version, leave it alone
+		return version
+	}
+	for _, d := range vb.Signal {
+		if bit, ok := deploymentBit(d, available); ok {
+			v |= 1 << uint(bit)
+		}
+	}
+	for _, d := range vb.NoSignal {
+		if bit, ok := deploymentBit(d, available); ok {
+			v &^= 1 << uint(bit)
+		}
+	}
+	return int32(v | required)
+}
+
+func deploymentBit(deployment string, available map[string]int) (int, bool) {
+	if bit, ok := available[deployment]; ok {
+		return bit, true
+	}
+	bit, err := strconv.Atoi(deployment)
+	if err != nil || bit < 0 || bit > 28 {
+		return 0, false
+	}
+	for _, b := range available {
+		if b == bit {
+			return bit, true
+		}
+	}
+	return 0, false
+}
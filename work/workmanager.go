@@ -0,0 +1,714 @@
+package work
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/gertjaap/p2pool-go/clock"
+	"github.com/gertjaap/p2pool-go/events"
+	"github.com/gertjaap/p2pool-go/logging"
+	p2pnet "github.com/gertjaap/p2pool-go/net"
+	"github.com/gertjaap/p2pool-go/rpc"
+	"github.com/gertjaap/p2pool-go/util"
+	"github.com/gertjaap/p2pool-go/wire"
+)
+
+var uint128Mask = big.NewInt(0).Sub(big.NewInt(0).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// Job is a unit of work handed out to a miner. It contains everything needed
+// to turn a solution into a share and, if it's good enough, into a block.
+type Job struct {
+	Template       *BlockTemplate
+	Share          wire.Share
+	CoinbasePrefix []byte
+	CoinbaseSuffix []byte
+	ShareTarget    *big.Int
+	BlockTarget    *big.Int
+	CreatedAt      time.Time
+	// Solo jobs pay the whole block to the miner and don't produce shares
+	Solo bool
+	// ID identifies jobs handed out to stratum gateways to the node that
+	// made them
+	ID string
+
+	// coinbaseState is the hash state after CoinbasePrefix, if known
+	coinbaseState *util.Sha256Digest
+}
+
+type SubmitResult struct {
+	POWHash *chainhash.Hash
+	IsShare bool
+	IsBlock bool
+	// DOA is set for shares built on a sharechain tip or block that was
+	// already replaced
+	DOA   bool
+	Share *wire.Share
+}
+
+type WorkManager struct {
+	Network        p2pnet.Network
+	ShareChain     *ShareChain
+	Daemons        *DaemonPool
+	Submitter      *BlockSubmitter
+	TxCache        *TxCache
+	Donation       uint16
+	FeePercent     float64
+	FeeAddress     string
+	CoinbaseTag    string
+	MaxBlockWeight int64
+	// MinFeeRate is the lowest fee rate, in satoshis per virtual byte, a
+	// transaction must pay to be included in our blocks
+	MinFeeRate   float64
+	PollInterval time.Duration
+	SoloTimeout  time.Duration
+	// ProposeTemplates has the daemon validate the block built from every
+	// new template, to catch block construction bugs early
+	ProposeTemplates bool
+	VersionBits      VersionBits
+	// AddressRate returns the hashrate of our miners mining to a payout
+	// address. It is used to raise the share difficulty of miners that
+	// would earn less than dust per block, see dustShareTarget.
+	AddressRate        func(pubKeyHash []byte, pubKeyHashVersion uint8) float64
+	LocalSharesChannel chan wire.Share
+	NewWorkChannel     chan bool
+	// Log gets the records about work, the chain's logger if nil
+	Log *logging.SubsystemLogger
+
+	template     *BlockTemplate
+	templateLock sync.RWMutex
+	lastTip      *chainhash.Hash
+	lastSolo     bool
+	lastPaused   bool
+	pendingClean bool
+	pendingLock  sync.Mutex
+	// watchers are signaled with NewWorkChannel, see WatchWork
+	watchers map[chan bool]struct{}
+	// heartbeat is when Run last went through its loop, in unix nanoseconds
+	heartbeat int64
+
+	feePubKeyHash        []byte
+	feePubKeyHashVersion uint8
+	stale                *staleTracker
+	genTx                genTxCache
+}
+
+func NewWorkManager(n p2pnet.Network, sc *ShareChain, daemons *DaemonPool, submitter *BlockSubmitter) *WorkManager {
+	return &WorkManager{
+		Network:            n,
+		ShareChain:         sc,
+		Daemons:            daemons,
+		Submitter:          submitter,
+		TxCache:            NewTxCache(),
+		PollInterval:       time.Second * 5,
+		SoloTimeout:        time.Minute * 10,
+		MaxBlockWeight:     MaxBlockWeight,
+		LocalSharesChannel: make(chan wire.Share, 10),
+		NewWorkChannel:     make(chan bool, 1),
+		stale:              newStaleTracker(),
+	}
+}
+
+func (wm *WorkManager) logger() *logging.SubsystemLogger {
+	return wm.Log.Or(log)
+}
+
+// SetDonation sets the percentage of our shares' payout weight that is
+// advertised as going to the donation output
+func (wm *WorkManager) SetDonation(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Donation percentage %f out of range", percent)
+	}
+	wm.Donation = uint16(math.Round(percent * 65535 / 100))
+	return nil
+}
+
+// DonationPercent returns the donation advertised in our shares in percent
+func (wm *WorkManager) DonationPercent() float64 {
+	return float64(wm.Donation) * 100 / 65535
+}
+
+// SetFee configures the node fee: the given percentage of the shares mined
+// by this node's miners pay out to the operator's address. The fee can't be a
+// separate gentx output, since every peer recomputes the gentx of our shares
+// from the sharechain and would reject them.
+func (wm *WorkManager) SetFee(percent float64, address string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Fee percentage %f out of range", percent)
+	}
+	if percent == 0 {
+		wm.FeePercent, wm.FeeAddress, wm.feePubKeyHash = 0, "", nil
+		return nil
+	}
+	pkh, version, err := AddressToPubKeyHash(address, wm.Network)
+	if err != nil {
+		return fmt.Errorf("Invalid fee address: %s", err.Error())
+	}
+	wm.FeePercent = percent
+	wm.FeeAddress = address
+	wm.feePubKeyHash = pkh
+	wm.feePubKeyHashVersion = version
+	return nil
+}
+
+// Run polls the daemon for new templates and watches the sharechain tip,
+// signaling NewWorkChannel whenever miners need new jobs, until ctx is done
+func (wm *WorkManager) Run(ctx context.Context) {
+	go wm.Daemons.Run(ctx)
+	go wm.longPoll(ctx)
+	go wm.WatchBlockSolutions()
+	lastPoll := time.Time{}
+	for ctx.Err() == nil {
+		if clock.Since(lastPoll) >= wm.PollInterval {
+			lastPoll = clock.Now()
+			err := wm.UpdateTemplate()
+			if err != nil {
+				wm.logger().Warnf("Could not get block template: %s", err.Error())
+			}
+		}
+
+		wm.checkTip()
+		wm.checkPaused()
+		atomic.StoreInt64(&wm.heartbeat, clock.Now().UnixNano())
+		clock.SleepContext(ctx, time.Second)
+	}
+}
+
+// Heartbeat returns when the work loop last ran, to tell whether it's stuck
+func (wm *WorkManager) Heartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&wm.heartbeat))
+}
+
+// checkTip signals new work when the sharechain tip changed or we switched
+// between solo and pooled mining
+func (wm *WorkManager) checkTip() {
+	tip := wm.ShareChain.GetTipHash()
+	if tip != nil && (wm.lastTip == nil || !tip.IsEqual(wm.lastTip)) {
+		wm.lastTip = tip
+		wm.signalNewWork(false)
+	}
+	solo := wm.IsSolo()
+	if solo != wm.lastSolo {
+		wm.lastSolo = solo
+		if solo && wm.ShareChain.Loading() {
+			wm.logger().Infof("Mining solo until the sharechain is loaded")
+		} else if solo {
+			wm.logger().Warnf("No recent shares on the sharechain, falling back to solo mining")
+		} else {
+			wm.logger().Infof("Sharechain is synced, back to pooled mining")
+			events.PublishOn(wm.Network.Name, events.ShareChainSynced, nil)
+		}
+		wm.signalNewWork(false)
+	}
+}
+
+// checkPaused signals new work when we stop or resume handing out jobs
+// because of the daemons' state
+func (wm *WorkManager) checkPaused() {
+	paused, reason := wm.Paused()
+	if paused == wm.lastPaused {
+		return
+	}
+	wm.lastPaused = paused
+	if paused {
+		wm.logger().Warnf("Not handing out work: %s", reason)
+		events.PublishOn(wm.Network.Name, events.DaemonUnavailable, events.Daemon{Reason: reason})
+	} else {
+		wm.logger().Infof("Daemon is available again, resuming work")
+		events.PublishOn(wm.Network.Name, events.DaemonAvailable, events.Daemon{})
+	}
+	wm.signalNewWork(true)
+}
+
+// Paused tells whether we can't hand out work because no daemon is usable,
+// and why
+func (wm *WorkManager) Paused() (bool, string) {
+	if wm.Daemons == nil || wm.Daemons.Usable() {
+		return false, ""
+	}
+	if wm.Daemons.Syncing() {
+		return true, "the coin daemon is syncing"
+	}
+	return true, "the coin daemon is unreachable"
+}
+
+// longPoll waits for the daemon to tell us about new templates, so we learn
+// about new blocks without waiting for the next poll
+func (wm *WorkManager) longPoll(ctx context.Context) {
+	for ctx.Err() == nil {
+		bt := wm.CurrentTemplate()
+		d := wm.Daemons.Active()
+		if bt == nil || bt.LongPollID == "" || !d.Adapter.LongPoll() {
+			clock.SleepContext(ctx, time.Second)
+			continue
+		}
+		r, err := d.GetBlockTemplateLongPoll(ctx, bt.LongPollID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Failing over is left to the regular polls and health
+			// checks, long polls time out without anything being wrong
+			wm.logger().Debugf("Long poll to %s failed: %s", d.URL, err.Error())
+			clock.SleepContext(ctx, time.Second*5)
+			continue
+		}
+		err = wm.SetTemplate(r)
+		if err != nil {
+			wm.logger().Warnf("Invalid block template from long poll: %s", err.Error())
+		}
+	}
+}
+
+// NotifyBlock is called when we hear about a new block from somewhere other
+// than the daemon, like a peer. If it's new to us we refresh the template
+// right away instead of waiting for the next poll.
+func (wm *WorkManager) NotifyBlock(hash *chainhash.Hash) {
+	bt := wm.CurrentTemplate()
+	if bt != nil && bt.PreviousBlock.IsEqual(hash) {
+		return
+	}
+	wm.logger().Debugf("Heard about block %s, refreshing template", hash.String())
+	err := wm.UpdateTemplate()
+	if err != nil {
+		wm.logger().Warnf("Could not get block template: %s", err.Error())
+	}
+}
+
+// RefreshTemplate fetches a new block template right away and sends miners
+// new jobs, even if the template didn't change
+func (wm *WorkManager) RefreshTemplate() error {
+	err := wm.UpdateTemplate()
+	if err != nil {
+		return err
+	}
+	wm.signalNewWork(false)
+	return nil
+}
+
+func (wm *WorkManager) signalNewWork(clean bool) {
+	wm.pendingLock.Lock()
+	wm.pendingClean = wm.pendingClean || clean
+	wm.pendingLock.Unlock()
+	select {
+	case wm.NewWorkChannel <- true:
+	default:
+	}
+	wm.pendingLock.Lock()
+	defer wm.pendingLock.Unlock()
+	for w := range wm.watchers {
+		select {
+		case w <- clean:
+		default:
+			// Not taken yet, fold this signal into the waiting one
+			select {
+			case waiting := <-w:
+				w <- waiting || clean
+			default:
+				w <- clean
+			}
+		}
+	}
+}
+
+// NewWork returns the channel new work is signaled on
+func (wm *WorkManager) NewWork() <-chan bool {
+	return wm.NewWorkChannel
+}
+
+// WatchWork returns a channel that is signaled along with NewWorkChannel,
+// for others than the stratum server that follow the work. It receives
+// whether the work invalidates all previous jobs. The returned function
+// stops the signals.
+func (wm *WorkManager) WatchWork() (<-chan bool, func()) {
+	w := make(chan bool, 1)
+	wm.pendingLock.Lock()
+	if wm.watchers == nil {
+		wm.watchers = map[chan bool]struct{}{}
+	}
+	wm.watchers[w] = struct{}{}
+	wm.pendingLock.Unlock()
+	return w, func() {
+		wm.pendingLock.Lock()
+		delete(wm.watchers, w)
+		wm.pendingLock.Unlock()
+	}
+}
+
+// TakeClean returns whether the work signaled on NewWorkChannel invalidates
+// all previous jobs, and resets the flag
+func (wm *WorkManager) TakeClean() bool {
+	wm.pendingLock.Lock()
+	defer wm.pendingLock.Unlock()
+	clean := wm.pendingClean
+	wm.pendingClean = false
+	return clean
+}
+
+func (wm *WorkManager) UpdateTemplate() error {
+	d := wm.Daemons.Active()
+	r, err := d.GetBlockTemplate()
+	if err != nil {
+		wm.Daemons.Failed(d, err)
+		if next := wm.Daemons.Active(); next != d {
+			r, err = next.GetBlockTemplate()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return wm.SetTemplate(r)
+}
+
+// SetTemplate makes a template from the daemon, or a synthetic one, the
+// current work
+func (wm *WorkManager) SetTemplate(r *rpc.BlockTemplate) error {
+	bt, err := TemplateFromRPC(r)
+	if err != nil {
+		return err
+	}
+	bt.Version = wm.VersionBits.Apply(bt.Version, r.VBAvailable, r.VBRequired)
+	// Shares introduce at most all transactions of their block
+	dropped, droppedFees := bt.SelectTransactions(wm.MaxBlockWeight, wm.MinFeeRate, wm.Network.MaxNewTransactions)
+	if dropped > 0 {
+		wm.logger().Debugf("Dropped %d transactions (%d in fees) from template to stay within weight %d, fee rate %.1f and the transaction limit", dropped, droppedFees, wm.MaxBlockWeight, wm.MinFeeRate)
+	}
+	wm.TxCache.Add(bt.Transactions...)
+
+	wm.templateLock.Lock()
+	newBlock := wm.template == nil || !wm.template.PreviousBlock.IsEqual(bt.PreviousBlock)
+	changed := newBlock || len(wm.template.TxHashes) != len(bt.TxHashes)
+	wm.template = bt
+	wm.templateLock.Unlock()
+
+	if newBlock {
+		wm.logger().Infof("New block at height %d, sending clean jobs", bt.Height)
+	}
+	if changed {
+		wm.logger().Debugf("New block template at height %d with %d transactions", bt.Height, len(bt.Transactions))
+		wm.signalNewWork(newBlock)
+		if wm.ProposeTemplates {
+			go wm.proposeTemplate()
+		}
+	}
+	return nil
+}
+
+// proposeTemplate has the daemon validate the block we would produce from
+// the current template, so problems with how we build blocks show up before
+// we find one
+func (wm *WorkManager) proposeTemplate() {
+	j, err := wm.GetJob(make([]byte, 20), 0)
+	if err != nil {
+		wm.logger().Warnf("Could not create job to propose: %s", err.Error())
+		return
+	}
+	b, err := JobBlock(j, 0, uint32(j.Share.ShareInfo.Timestamp), 0)
+	if err != nil {
+		wm.logger().Warnf("Could not assemble block to propose: %s", err.Error())
+		return
+	}
+	reason, err := wm.Submitter.Propose(b)
+	if err != nil {
+		wm.logger().Warnf("Could not propose block template: %s", err.Error())
+		return
+	}
+	if reason != "" {
+		wm.logger().Errorf("Daemon rejected our block at height %d as proposal: %s", j.Template.Height, reason)
+		return
+	}
+	wm.logger().Debugf("Daemon accepted our block at height %d as proposal", j.Template.Height)
+}
+
+// IsStale returns true if the job was built on a block that is no longer the
+// tip of the coin's chain
+func (wm *WorkManager) IsStale(j *Job) bool {
+	bt := wm.CurrentTemplate()
+	return bt != nil && !bt.PreviousBlock.IsEqual(j.Template.PreviousBlock)
+}
+
+func (wm *WorkManager) CurrentTemplate() *BlockTemplate {
+	wm.templateLock.RLock()
+	defer wm.templateLock.RUnlock()
+	return wm.template
+}
+
+// IsSolo returns true if we have no usable sharechain, either because it's
+// still loading, we haven't got any shares yet or the last share is too old.
+// A zero SoloTimeout disables the fallback, except while loading.
+func (wm *WorkManager) IsSolo() bool {
+	if wm.ShareChain.Loading() {
+		return true
+	}
+	if wm.SoloTimeout <= 0 {
+		return false
+	}
+	tip := wm.ShareChain.GetShare(wm.ShareChain.GetTipHash())
+	if tip == nil {
+		return true
+	}
+	return clock.Since(time.Unix(int64(tip.Share.ShareInfo.Timestamp), 0)) > wm.SoloTimeout
+}
+
+// POWHash returns the proof of work hash of a solution for the job
+func (j *Job) POWHash(n p2pnet.Network, extranonce uint64, timestamp uint32, nonce uint32) (*chainhash.Hash, error) {
+	return j.powHash(n, j.genTxHash(extranonce), timestamp, nonce)
+}
+
+func (j *Job) powHash(n p2pnet.Network, gentxHash *chainhash.Hash, timestamp uint32, nonce uint32) (*chainhash.Hash, error) {
+	merkleRoot, err := wire.CalcMerkleLink(gentxHash, j.Template.MerkleBranch, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := btcwire.NewBlockHeader(j.Share.MinHeader.Version, j.Share.MinHeader.PreviousBlock, merkleRoot, j.Share.MinHeader.Bits, nonce)
+	hdr.Timestamp = time.Unix(int64(timestamp), 0)
+	var buf bytes.Buffer
+	err = hdr.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHash(n.POWHash(buf.Bytes()))
+}
+
+// dustShareTarget returns the share target for a miner whose expected payout
+// per block is below the dust threshold, nil for other miners. Like the
+// Python p2pool, instead of paying such a miner a dust output every block we
+// have it find harder shares, so it is paid more but less often. The target
+// is the one at which a share is worth the dust threshold.
+func (wm *WorkManager) dustShareTarget(pubKeyHash []byte, pubKeyHashVersion uint8, prevHash *chainhash.Hash, bt *BlockTemplate) *big.Int {
+	n := wm.Network
+	if wm.AddressRate == nil || n.DustThreshold == 0 || bt.CoinbaseValue == 0 || n.SharePeriod == 0 {
+		return nil
+	}
+	lookbehind := 3600 / n.SharePeriod
+	if wm.ShareChain.GetHeight(prevHash, lookbehind+1) <= lookbehind {
+		return nil
+	}
+	poolRate, _ := big.NewFloat(0).SetInt(wm.ShareChain.GetPoolAttemptsPerSecond(prevHash, lookbehind)).Float64()
+	if poolRate <= 0 {
+		return nil
+	}
+	expected := wm.AddressRate(pubKeyHash, pubKeyHashVersion) / poolRate * float64(bt.CoinbaseValue) * (1 - wm.DonationPercent()/100)
+	if expected >= float64(n.DustThreshold) {
+		return nil
+	}
+	attempts := TargetToAverageAttempts(bt.Target)
+	attempts.Mul(attempts, big.NewInt(int64(n.Spread)))
+	attempts.Mul(attempts, big.NewInt(0).SetUint64(n.DustThreshold))
+	attempts.Div(attempts, big.NewInt(0).SetUint64(bt.CoinbaseValue))
+	if attempts.Sign() == 0 {
+		return nil
+	}
+	return AverageAttemptsToTarget(attempts)
+}
+
+// GetJob builds a job paying to the given pubkey hash on top of the current
+// sharechain tip and block template
+func (wm *WorkManager) GetJob(pubKeyHash []byte, pubKeyHashVersion uint8) (*Job, error) {
+	bt := wm.CurrentTemplate()
+	if bt == nil {
+		return nil, fmt.Errorf("No block template available yet")
+	}
+	if paused, reason := wm.Paused(); paused {
+		return nil, fmt.Errorf("No work while %s", reason)
+	}
+
+	if wm.feePubKeyHash != nil && rand.Float64()*100 < wm.FeePercent {
+		pubKeyHash, pubKeyHashVersion = wm.feePubKeyHash, wm.feePubKeyHashVersion
+	}
+
+	finderScript, err := PubKeyHashToScript(pubKeyHash, pubKeyHashVersion, wm.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	segwit := wm.Network.ShareVersion >= wire.SegwitShareVersion
+	prevHash := wm.ShareChain.GetTipHash()
+	if prevHash == nil {
+		// First share of a new chain
+		prevHash = &chainhash.Hash{}
+	}
+	prev := wm.ShareChain.GetShare(prevHash)
+
+	coinbase := CoinbaseScript(bt.Height, []byte(wm.CoinbaseTag))
+	// Low heights without a tag make a coinbase too short for the network
+	for len(coinbase) < wm.Network.MinCoinbaseSize {
+		coinbase = append(coinbase, txscript.OP_0)
+	}
+
+	si := wire.ShareInfo{
+		ShareData: wire.ShareData{
+			PreviousShareHash: prevHash,
+			CoinBase:          string(coinbase),
+			Nonce:             rand.Uint32(),
+			PubKeyHash:        pubKeyHash,
+			PubKeyHashVersion: pubKeyHashVersion,
+			Subsidy:           bt.CoinbaseValue,
+			Donation:          wm.Donation,
+			StaleInfo:         wm.staleInfo(prevHash),
+			DesiredVersion:    wm.Network.ShareVersion,
+		},
+		Timestamp: int32(wm.ShareChain.Clock.Now().Unix()),
+		AbsHeight: 1,
+		AbsWork:   big.NewInt(0),
+	}
+	si.NewTransactionHashes, si.TransactionHashRefs = wm.ShareChain.BuildTxRefs(prevHash, bt.TxHashes)
+	witnessCommitment := bt.WitnessCommitment
+	if segwit {
+		// Segwit shares always commit to witness data, even if the coin
+		// network doesn't ask for it yet
+		witnessRoot := bt.WitnessRoot
+		if witnessRoot == nil {
+			witnessRoot = CalcWitnessMerkleRoot(bt.Transactions)
+			witnessCommitment = WitnessCommitmentScript(witnessRoot)
+		}
+		si.SegwitData = wire.SegwitData{TXIDMerkleLink: bt.MerkleBranch, WTXIDMerkleRoot: witnessRoot}
+	} else if bt.WitnessRoot != nil {
+		return nil, fmt.Errorf("Segwit is active on the coin network, but share version %d can't commit to witness data", wm.Network.ShareVersion)
+	}
+
+	desiredTarget := wm.dustShareTarget(pubKeyHash, pubKeyHashVersion, prevHash, bt)
+	maxTarget, shareTarget := wm.ShareChain.GetNextShareTargets(prevHash, desiredTarget, wm.Network)
+	si.MaxBits = int32(blockchain.BigToCompact(maxTarget))
+	si.Bits = int32(blockchain.BigToCompact(shareTarget))
+
+	if prev != nil {
+		ps := prev.Share.ShareInfo
+		si.Timestamp = ClampTimestamp(si.Timestamp, prev.Share, wm.Network)
+		si.AbsHeight = ps.AbsHeight + 1
+		si.AbsWork = big.NewInt(0).Add(ps.AbsWork, TargetToAverageAttempts(shareTarget))
+		si.AbsWork.And(si.AbsWork, uint128Mask)
+		far := wm.ShareChain.GetNthParent(prevHash, 99)
+		if far != nil {
+			si.FarShareHash = far.Share.Hash
+		}
+	} else {
+		si.AbsWork = TargetToAverageAttempts(shareTarget)
+	}
+
+	refHash, err := wire.GetRefHash(wm.Network, si, []*chainhash.Hash{}, wm.Network.ShareVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	solo := wm.IsSolo()
+	parts := wm.genTx.get(bt, prevHash, genTxKey{string(finderScript), string(coinbase), solo}, func() []byte {
+		var payouts []Payout
+		if solo {
+			payouts = []Payout{{Script: finderScript, Amount: bt.CoinbaseValue}}
+		} else {
+			payouts = wm.ShareChain.GetPayouts(prevHash, bt.CoinbaseValue, finderScript, bt.Target, wm.Network)
+		}
+		return SerializeGenTx(BuildGenTx(coinbase, payouts, &chainhash.Hash{}, witnessCommitment))
+	})
+	gentxBytes, coinbaseState := parts.withRef(refHash)
+
+	j := &Job{
+		Template:    bt,
+		ShareTarget: shareTarget,
+		BlockTarget: bt.Target,
+		CreatedAt:   clock.Now(),
+		Solo:        solo,
+
+		coinbaseState: coinbaseState,
+	}
+	j.CoinbasePrefix, j.CoinbaseSuffix = SplitGenTx(gentxBytes)
+	j.Share = wire.Share{
+		Type: wm.Network.ShareVersion,
+		MinHeader: wire.SmallBlockHeader{
+			Version:       bt.Version,
+			PreviousBlock: bt.PreviousBlock,
+			Bits:          bt.Bits,
+		},
+		ShareInfo:     si,
+		RefMerkleLink: []*chainhash.Hash{},
+		HashLink:      parts.link,
+		MerkleLink:    bt.MerkleBranch,
+	}
+
+	return j, nil
+}
+
+// Submit checks a solution for a job. The extranonce is the last txout nonce,
+// made up of the extranonces of the stratum connection and the miner.
+func (wm *WorkManager) Submit(j *Job, extranonce uint64, timestamp uint32, nonce uint32) (*SubmitResult, error) {
+	gentxHash := j.genTxHash(extranonce)
+	powHash, err := j.powHash(wm.Network, gentxHash, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SubmitResult{POWHash: powHash}
+	bnHash := blockchain.HashToBig(res.POWHash)
+	res.IsBlock = bnHash.Cmp(j.BlockTarget) <= 0
+	res.IsShare = !j.Solo && bnHash.Cmp(j.ShareTarget) <= 0
+
+	if res.IsBlock {
+		b, err := JobBlock(j, extranonce, timestamp, nonce)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			err := wm.Submitter.SubmitBlock(b)
+			if err != nil {
+				wm.logger().Errorf("Block submission failed: %s", err.Error())
+			}
+		}()
+	}
+
+	if res.IsShare {
+		s := j.Share
+		s.MinHeader.Timestamp = timestamp
+		s.MinHeader.Nonce = nonce
+		s.LastTxOutNonce = extranonce
+		err = s.CalcHashes(wm.Network)
+		if err != nil {
+			return nil, err
+		}
+		if !s.GenTXHash.IsEqual(gentxHash) {
+			return nil, fmt.Errorf("Hash link of local share does not match generation transaction")
+		}
+		s.TraceID = logging.NewTraceID()
+		tlog := wm.logger().Trace(s.TraceID)
+		tip := wm.ShareChain.GetTipHash()
+		if tip == nil {
+			tip = &chainhash.Hash{}
+		}
+		res.DOA = wm.IsStale(j) || !s.ShareInfo.ShareData.PreviousShareHash.IsEqual(tip)
+		if res.DOA {
+			tlog.Infof("Found share %s (dead on arrival)", s.Hash.String())
+		} else {
+			tlog.Infof("Found share %s", s.Hash.String())
+		}
+		wm.stale.record(&s, res.DOA)
+		ev := shareEvent(&s, wm.Network)
+		ev.DOA = res.DOA
+		events.PublishOn(wm.Network.Name, events.LocalShare, ev)
+		wm.ShareChain.AddShares([]wire.Share{s})
+		// Our own shares are worth not losing to a crash, they're written
+		// right away rather than with the next batch
+		err = wm.ShareChain.Flush()
+		if err != nil {
+			tlog.Errorf("Could not save sharechain: %s", err.Error())
+		}
+		res.Share = &s
+		select {
+		case wm.LocalSharesChannel <- s:
+		default:
+			tlog.Warnf("Local share channel full, share %s not broadcast", s.Hash.String())
+		}
+	}
+
+	return res, nil
+}